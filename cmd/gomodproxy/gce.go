@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const gceTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+// gceTransport authorizes requests with the access token of the default
+// service account, as provided by the GCE/GKE metadata server.
+type gceTransport struct {
+	sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// gceClient returns an HTTP client authorized to access Google Cloud APIs on
+// behalf of the service account the proxy runs as.
+func gceClient() *http.Client {
+	return &http.Client{Transport: &gceTransport{}}
+}
+
+func (t *gceTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	token, err := t.accessToken()
+	if err != nil {
+		return nil, err
+	}
+	r = r.Clone(r.Context())
+	r.Header.Set("Authorization", "Bearer "+token)
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func (t *gceTransport) accessToken() (string, error) {
+	t.Lock()
+	defer t.Unlock()
+	// tokens are refreshed a bit earlier to account for slow requests
+	if t.token != "" && time.Now().Add(time.Minute).Before(t.expires) {
+		return t.token, nil
+	}
+	req, err := http.NewRequest(http.MethodGet, gceTokenURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata token: %s", res.Status)
+	}
+	token := struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	t.token = token.AccessToken
+	t.expires = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	return t.token, nil
+}
@@ -2,21 +2,31 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 	"unicode"
 
 	"github.com/sixt/gomodproxy/pkg/api"
+	"github.com/sixt/gomodproxy/pkg/store"
+	"github.com/sixt/gomodproxy/pkg/vcs"
 
 	"expvar"
 	_ "net/http/pprof"
@@ -42,6 +52,10 @@ func prometheusExpose(w io.Writer, name string, v interface{}) {
 		}
 		fmt.Fprintf(w, "%s %f\n", name, f)
 	} else if m, ok := v.(map[string]interface{}); ok {
+		if buckets, ok := m["buckets"].(map[string]interface{}); ok && len(m) == 3 {
+			prometheusHistogram(w, name, buckets, m["count"], m["sum"])
+			return
+		}
 		for k, v := range m {
 			// for composite maps we construct metric names by joining the parent map
 			// name and the key name.
@@ -54,6 +68,26 @@ func prometheusExpose(w io.Writer, name string, v interface{}) {
 	}
 }
 
+// prometheusHistogram writes a histogram exposed by expvar as a JSON object
+// with cumulative bucket counts keyed by their upper bounds.
+func prometheusHistogram(w io.Writer, name string, buckets map[string]interface{}, count, sum interface{}) {
+	bounds := []string{}
+	for le := range buckets {
+		bounds = append(bounds, le)
+	}
+	sort.Slice(bounds, func(i, j int) bool {
+		a, _ := strconv.ParseFloat(bounds[i], 64)
+		b, _ := strconv.ParseFloat(bounds[j], 64)
+		return a < b
+	})
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	for _, le := range bounds {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %v\n", name, le, buckets[le])
+	}
+	fmt.Fprintf(w, "%s_sum %v\n", name, sum)
+	fmt.Fprintf(w, "%s_count %v\n", name, count)
+}
+
 func prometheusHandler(w http.ResponseWriter, r *http.Request) {
 	expvar.Do(func(kv expvar.KeyValue) {
 		var v interface{}
@@ -64,7 +98,13 @@ func prometheusHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-func prettyLog(v ...interface{}) {
+// prettyLogger returns a logger printing human-readable lines to w.
+func prettyLogger(w io.Writer) func(...interface{}) {
+	l := log.New(w, "", log.LstdFlags)
+	return func(v ...interface{}) { l.Println(prettyLine(v...)) }
+}
+
+func prettyLine(v ...interface{}) string {
 	s := ""
 	msg := ""
 	if len(v)%2 != 0 {
@@ -75,10 +115,21 @@ func prettyLog(v ...interface{}) {
 	for i := 0; i < len(v); i = i + 2 {
 		s = s + fmt.Sprintf("%v=%v ", v[i], v[i+1])
 	}
-	log.Println(s)
+	return s
 }
 
-func jsonLog(v ...interface{}) {
+// jsonLogger returns a logger printing JSON objects to w, one per line.
+func jsonLogger(w io.Writer) func(...interface{}) {
+	enc := json.NewEncoder(w)
+	mu := sync.Mutex{}
+	return func(v ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		enc.Encode(jsonEntry(v...))
+	}
+}
+
+func jsonEntry(v ...interface{}) map[string]interface{} {
 	entry := map[string]interface{}{}
 	if len(v)%2 != 0 {
 		entry["msg"] = v[0]
@@ -87,7 +138,7 @@ func jsonLog(v ...interface{}) {
 	for i := 0; i < len(v); i = i + 2 {
 		entry[fmt.Sprintf("%v", v[i])] = v[i+1]
 	}
-	json.NewEncoder(os.Stdout).Encode(entry)
+	return entry
 }
 
 type listFlag []string
@@ -95,71 +146,521 @@ type listFlag []string
 func (f *listFlag) String() string     { return strings.Join(*f, " ") }
 func (f *listFlag) Set(s string) error { *f = append(*f, s); return nil }
 
+// vcsConfig holds VCS settings that can be given in the command line as well
+// as in the config file.
+type vcsConfig struct {
+	gitPaths  listFlag
+	vcsPaths  listFlag
+	anonPaths listFlag
+	mirrors   listFlag
+	cliPaths  listFlag
+	hgPaths   listFlag
+	svnPaths  listFlag
+	pins      listFlag
+	tags      listFlag
+	sshURLs   listFlag
+	workers   int
+}
+
+func (c *vcsConfig) register(fs *flag.FlagSet) {
+	fs.Var(&c.gitPaths, "git", "list of git settings (prefix:auth)")
+	fs.Var(&c.vcsPaths, "vcs", "list of custom VCS handlers")
+	fs.Var(&c.anonPaths, "gitanon", "list of git prefixes fetched via anonymous git:// protocol (insecure)")
+	fs.Var(&c.mirrors, "mirror", "list of git prefixes fetched from local bare repositories (prefix:dir)")
+	fs.Var(&c.cliPaths, "gitcli", "list of git settings served by the system git command (prefix:auth)")
+	fs.Var(&c.hgPaths, "hg", "list of Mercurial settings (prefix:auth)")
+	fs.Var(&c.svnPaths, "svn", "list of Subversion settings (prefix:auth)")
+	fs.Var(&c.pins, "pin", "list of git modules pinned to a commit (module@hash)")
+	fs.Var(&c.tags, "tagpattern", "list of git prefixes with custom release tags (prefix=regexp capturing the version)")
+	fs.Var(&c.sshURLs, "sshurl", "list of git prefixes fetched over SSH from custom URLs (prefix=template with {repo}, {host} and {path})")
+	fs.IntVar(&c.workers, "workers", c.workers, "number of parallel VCS workers")
+}
+
+// options returns API options for the git and custom VCS settings. Modules
+// with a prefix given in several settings are fetched from the local mirror
+// first, then via go-git, git command, anonymous git, hg, svn and custom VCS.
+func (c vcsConfig) options(gitOptions []vcs.GitOption) ([]api.Option, error) {
+	options := []api.Option{}
+	for _, mirror := range c.mirrors {
+		kv := strings.SplitN(mirror, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("bad mirror syntax: %s", mirror)
+		}
+		mirrorOptions := append(append([]vcs.GitOption{}, gitOptions...), vcs.Mirror(kv[0], kv[1]))
+		options = append(options, api.Git(kv[0], "", mirrorOptions...))
+	}
+
+	for _, path := range c.gitPaths {
+		kv := strings.SplitN(path, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("bad git path: %s", path)
+		}
+		options = append(options, api.Git(kv[0], kv[1], gitOptions...))
+	}
+
+	for _, path := range c.cliPaths {
+		kv := strings.SplitN(path, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("bad gitcli path: %s", path)
+		}
+		options = append(options, api.GitCLI(kv[0], kv[1]))
+	}
+
+	anonOptions := append(append([]vcs.GitOption{}, gitOptions...), vcs.InsecureGitProtocol())
+	for _, prefix := range c.anonPaths {
+		options = append(options, api.Git(prefix, "", anonOptions...))
+	}
+
+	for _, path := range c.hgPaths {
+		kv := strings.SplitN(path, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("bad hg path: %s", path)
+		}
+		options = append(options, api.Hg(kv[0], kv[1]))
+	}
+
+	for _, path := range c.svnPaths {
+		kv := strings.SplitN(path, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("bad svn path: %s", path)
+		}
+		options = append(options, api.SVN(kv[0], kv[1]))
+	}
+
+	for _, path := range c.vcsPaths {
+		kv := strings.SplitN(path, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("bad VCS syntax: %s", path)
+		}
+		options = append(options, api.CustomVCS(kv[0], kv[1]))
+	}
+	for _, pin := range c.pins {
+		kv := strings.SplitN(pin, "@", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("bad pin syntax: %s", pin)
+		}
+		options = append(options, api.Pin(kv[0], kv[1]))
+	}
+	for _, tag := range c.tags {
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("bad tag pattern syntax: %s", tag)
+		}
+		re, err := regexp.Compile(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("bad tag pattern: %w", err)
+		} else if re.NumSubexp() < 1 {
+			return nil, fmt.Errorf("tag pattern captures no version: %s", kv[1])
+		}
+		options = append(options, api.TagPattern(kv[0], re))
+	}
+	for _, url := range c.sshURLs {
+		kv := strings.SplitN(url, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, fmt.Errorf("bad ssh url syntax: %s", url)
+		}
+		options = append(options, api.SSHURL(kv[0], kv[1]))
+	}
+	return append(options, api.VCSWorkers(c.workers)), nil
+}
+
+// load reads VCS settings from the config file and merges them with the
+// current ones. Config file contains -git, -gitanon, -gitcli, -mirror, -hg,
+// -svn, -vcs, -pin, -tagpattern, -sshurl and -workers flags separated by
+// spaces or newlines, lines starting with "#" are ignored.
+func (c vcsConfig) load(path string) (vcsConfig, error) {
+	if path == "" {
+		return c, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return c, err
+	}
+	args := []string{}
+	for _, line := range strings.Split(string(b), "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), "#") {
+			args = append(args, strings.Fields(line)...)
+		}
+	}
+	c.gitPaths = append(listFlag{}, c.gitPaths...)
+	c.vcsPaths = append(listFlag{}, c.vcsPaths...)
+	c.anonPaths = append(listFlag{}, c.anonPaths...)
+	c.mirrors = append(listFlag{}, c.mirrors...)
+	c.cliPaths = append(listFlag{}, c.cliPaths...)
+	c.hgPaths = append(listFlag{}, c.hgPaths...)
+	c.svnPaths = append(listFlag{}, c.svnPaths...)
+	c.pins = append(listFlag{}, c.pins...)
+	c.tags = append(listFlag{}, c.tags...)
+	c.sshURLs = append(listFlag{}, c.sshURLs...)
+	fs := flag.NewFlagSet(path, flag.ContinueOnError)
+	c.register(fs)
+	return c, fs.Parse(args)
+}
+
 func main() {
-	gitPaths := listFlag{}
-	vcsPaths := listFlag{}
+	// "gomodproxy selftest [flags]" fetches a module with the given flags and
+	// exits instead of serving requests.
+	selftestMode := len(os.Args) > 1 && os.Args[1] == "selftest"
+	if selftestMode {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+
+	vcsFlags := vcsConfig{workers: 1}
 
 	addr := flag.String("addr", ":0", "http server address")
 	verbose := flag.Bool("v", false, "verbose logging")
 	prometheus := flag.String("prometheus", "", "prometheus address")
 	debug := flag.Bool("debug", false, "enable debug HTTP API (pprof/expvar)")
 	json := flag.Bool("json", false, "json structured logging")
+	accessLog := flag.String("accesslog", "", "file to write per-request access logs to instead of the main log")
+	auditLog := flag.String("auditlog", "", "file to write the audit log of private module downloads to")
+	logDedup := flag.Duration("logdedup", 0, "log repeated identical errors once per the given time")
 	dir := flag.String("dir", filepath.Join(os.Getenv("HOME"), ".gomodproxy/cache"), "modules cache directory")
 	gitdir := flag.String("gitdir", filepath.Join(os.Getenv("HOME"), ".gomodproxy/git"), "git cache directory")
 	memLimit := flag.Int64("mem", 256, "in-memory cache size in MB")
-	workers := flag.Int("workers", 1, "number of parallel VCS workers")
-	flag.Var(&gitPaths, "git", "list of git settings")
-	flag.Var(&vcsPaths, "vcs", "list of custom VCS handlers")
+	memItems := flag.Int("memitems", 0, "maximum number of modules in the in-memory cache (default: no limit)")
+	memShards := flag.Int("memshards", 1, "number of independently locked shards of the in-memory cache")
+	microItems := flag.Int("microcache", 0, "number of last served modules kept in a tiny in-process cache in front of all caches (default: disabled)")
+	microLimit := flag.Int64("microcachesize", 16, "-microcache size in MB")
+	cacheBypass := flag.Bool("cachebypass", false, "let clients fetch a module again and replace the cached one with the X-Gomodproxy-No-Cache: 1 header")
+	gitLimit := flag.Int64("gitlimit", 0, "git cache directory size limit in MB (default: unlimited)")
+	softDelete := flag.Duration("softdelete", 0, "keep deleted cache entries for the given time so they can be restored")
+	gcsBucket := flag.String("gcs", "", "Google Cloud Storage bucket used as a shared modules cache")
+	gcsPrefix := flag.String("gcsprefix", "", "object name prefix in the -gcs bucket")
+	gcsEndpoint := flag.String("gcsendpoint", "", "Cloud Storage API endpoint, e.g. of an emulator (no authorization is used)")
+	goLayout := flag.Bool("golayout", false, "keep -dir in the download cache layout of the go tool, usable as GOPROXY=file://... (no -dedup and -softdelete)")
+	dedup := flag.Bool("dedup", false, "store identical module version contents only once in the cache directory (not shared by other proxies)")
+	legacyTags := flag.Bool("legacytags", false, "accept git release tags without the \"v\" prefix")
+	majorDir := flag.Bool("majorsubdir", false, "serve major version modules from the vN subdirectory without go.mod if the root go.mod declares another module path")
+	caseTags := flag.Bool("casetags", false, "accept git release tags with uppercase letters, e.g. \"V1.0.0\"")
+	knownHosts := flag.String("knownhosts", "", "known_hosts file to verify SSH host keys against (default: ~/.ssh/known_hosts)")
+	acceptNew := flag.Bool("acceptnewhostkeys", false, "trust SSH hosts missing in the known_hosts file and remember their keys")
+	ignoreHostKeys := flag.Bool("insecureignorehostkeys", false, "accept any SSH host key without verifying it (insecure, for testing only)")
+	shallow := flag.Int("shallowdepth", 0, "resolve git pseudo-versions from the given number of the latest commits of every branch first (default: full history)")
+	noPseudo := flag.Bool("nopseudo", false, "list no versions for git repositories without release tags instead of the default branch tip pseudo-version")
+	manifest := flag.String("manifest", "", "file with declared git module versions and their commits, reloaded on SIGHUP")
+	metaConns := flag.Int("metaconns", 16, "idle connections kept open to every vanity import host")
+	metaIdle := flag.Duration("metaidle", 90*time.Second, "time to keep idle connections to vanity import hosts open")
+	caCert := flag.String("cacert", "", "PEM file with extra CA certificates trusted for vanity import and git hosts")
+	metaTimeout := flag.Duration("metatimeout", 30*time.Second, "time limit of go-import meta tag lookups on vanity import hosts (0 means no limit)")
+	config := flag.String("config", "", "config file with git/vcs/workers flags, reloaded on SIGHUP")
+	maxBody := flag.Int64("maxbody", 1<<20, "maximum request body size in bytes")
+	listTimeout := flag.Duration("partiallists", 0, "answer version lists taking longer than the given time with the versions found so far")
+	maxDeadline := flag.Duration("maxdeadline", 0, "max request deadline clients can set with X-Gomodproxy-Deadline header")
+	adminToken := flag.String("admin", "", "enable admin HTTP API (/admin/) protected by the given token")
+	maxAge := flag.Duration("maxage", 365*24*time.Hour, "time clients and CDNs may cache release versions for")
+	latestPre := flag.Bool("latestprerelease", false, "let @latest resolve to pre-release versions newer than the latest release")
+	indexFile := flag.String("index", "", "file to keep the log of cached module versions served at /index in (\"-\" keeps it in memory), requires -admin")
+	indexMax := flag.Int("indexmax", 1000000, "number of the latest cached module versions kept in the -index log")
+	prefetch := flag.Int("prefetch", 0, "number of release versions next to a missed one to fetch into the cache in the background")
+	rampPeriod := flag.Duration("workerramp", 0, "time to raise the number of VCS workers from -workerrampstart to -workers over after the start")
+	rampStart := flag.Int("workerrampstart", 1, "number of VCS workers right after the start with -workerramp")
+	summary := flag.Duration("summary", 0, "interval to log a summary of cache hits, bytes served and fetched, and hot modules at")
+	summaryTop := flag.Int("summarytop", 10, "number of hot modules listed in the -summary log")
+	recheck := flag.Float64("recheck", 0, "fraction of cache hits to re-resolve in the background to detect moved tags, e.g. 0.01")
+	pseudoMaxAge := flag.Duration("pseudomaxage", 0, "time to reuse the pseudo-version resolved for @latest of modules without releases")
+	zipWorkers := flag.Int("zipworkers", 1, "number of parallel workers reading files when building git module archives")
+	goproxyIgnore := flag.Bool("goproxyignore", false, "exclude files listed in .goproxyignore from module archives (changes checksums)")
+	maxFileSize := flag.Int64("maxfilesize", 0, "max size in bytes of files in git module archives (default: unlimited)")
+	skipLarge := flag.Bool("skiplarge", false, "leave files above -maxfilesize out of module archives instead of failing (changes checksums)")
+	snapshot := flag.String("snapshot", "", "serve git modules as of the given RFC3339 time, e.g. 2019-01-01T00:00:00Z")
+	verifySum := flag.String("verifysum", "", "go.sum file to verify fetched modules against")
+	goVersion := flag.String("goversion", "", "go directive added to synthesized go.mod files, e.g. 1.16 (changes go.mod checksums)")
+	requireMod := flag.Bool("requiregomod", false, "refuse modules without go.mod instead of synthesizing one")
+	goImport := flag.String("goimport", "", "public URL of the proxy to answer ?go-get=1 requests for -git and -vcs modules with, e.g. https://goproxy.example.com")
+	notFound := flag.String("notfound", "", "message returned with 404 for requests that are not proxy API requests")
+	landing := flag.Bool("landing", false, "answer / with a page listing the module prefixes served from the configured repositories")
+	landingMsg := flag.String("landingmessage", "", "message shown on the -landing page")
+	requireSum := flag.Bool("requiresum", false, "refuse modules missing in the -verifysum file")
+	insecure := listFlag{}
+	flag.Var(&insecure, "insecure", "list of glob patterns of git module prefixes fetched over plain HTTP, like GOINSECURE")
+	allowedHosts := listFlag{}
+	flag.Var(&allowedHosts, "allowhost", "list of VCS hosts the proxy may contact (default: any public host)")
+	ignore := listFlag{}
+	flag.Var(&ignore, "ignore", "list of glob patterns excluded from module archives (changes checksums)")
+	digests := listFlag{}
+	flag.Var(&digests, "digest", "list of extra digests of module archives kept in the cache directory (sha512)")
+	pseudoMaxAges := listFlag{}
+	flag.Var(&pseudoMaxAges, "modulepseudomaxage", "list of -pseudomaxage overrides for module prefixes (prefix=duration)")
+	selftestModule := flag.String("module", "github.com/pkg/errors", "module fetched by selftest")
+	selftestVersion := flag.String("version", "v0.8.1", "module version fetched by selftest")
+	vcsFlags.register(flag.CommandLine)
 
 	flag.Parse()
 
-	ln, err := net.Listen("tcp", *addr)
-	if err != nil {
-		log.Fatal("net.Listen:", err)
-	}
-	defer ln.Close()
-
-	fmt.Println("Listening on", ln.Addr())
-
 	options := []api.Option{}
+	newLogger := prettyLogger
+	if *json {
+		newLogger = jsonLogger
+	}
 	logger := func(...interface{}) {}
 	if *verbose || *json {
 		if *json {
-			logger = jsonLog
+			logger = newLogger(os.Stdout)
 		} else {
-			logger = prettyLog
+			logger = newLogger(os.Stderr)
 		}
 	}
-	options = append(options, api.Log(logger))
+	if *accessLog != "" {
+		f, err := os.OpenFile(*accessLog, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		options = append(options, api.AccessLog(newLogger(f)))
+	}
+	if *auditLog != "" {
+		f, err := os.OpenFile(*auditLog, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		options = append(options, api.AuditLog(newLogger(f)))
+	}
+	logOptions := []api.LogOption{}
+	if *logDedup > 0 {
+		logOptions = append(logOptions, api.DedupErrors(*logDedup))
+	}
+	options = append(options, api.Log(logger, logOptions...))
 
-	for _, path := range gitPaths {
-		kv := strings.SplitN(path, ":", 2)
-		if len(kv) != 2 {
-			log.Fatal("bad git path:", path)
+	options = append(options, api.MetaLookups(vcs.MetaMaxIdleConns(*metaConns), vcs.MetaIdleTimeout(*metaIdle), vcs.MetaTimeout(*metaTimeout)))
+
+	gitOptions := []vcs.GitOption{}
+	if *legacyTags {
+		gitOptions = append(gitOptions, vcs.LegacyTags())
+	}
+	if *majorDir {
+		gitOptions = append(gitOptions, vcs.MajorSubdirectory())
+	}
+	if *caseTags {
+		gitOptions = append(gitOptions, vcs.CaseInsensitiveTags())
+	}
+	if *noPseudo {
+		gitOptions = append(gitOptions, vcs.NoPseudoVersions())
+	}
+	if *acceptNew {
+		gitOptions = append(gitOptions, vcs.AcceptNewHostKeys())
+	}
+	if *shallow > 0 {
+		gitOptions = append(gitOptions, vcs.ShallowPseudoVersions(*shallow))
+	}
+	if *zipWorkers > 1 {
+		gitOptions = append(gitOptions, vcs.ZipWorkers(*zipWorkers))
+	}
+	if *maxFileSize > 0 {
+		gitOptions = append(gitOptions, vcs.MaxFileSize(*maxFileSize))
+	}
+	if *skipLarge {
+		gitOptions = append(gitOptions, vcs.SkipLargeFiles())
+	}
+	if *goproxyIgnore || len(ignore) > 0 {
+		gitOptions = append(gitOptions, vcs.Ignore(ignore...))
+	}
+	load := func() ([]api.Option, error) {
+		c, err := vcsFlags.load(*config)
+		if err != nil {
+			return nil, err
+		}
+		options, err := c.options(gitOptions)
+		if err == nil && *manifest != "" {
+			options = append(options, api.Manifest(*manifest))
 		}
-		options = append(options, api.Git(kv[0], kv[1]))
+		return options, err
+	}
+	vcsOpts, err := load()
+	if err != nil {
+		log.Fatal(err)
+	}
+	options = append(options, vcsOpts...)
+	options = append(options, api.Reload(load))
+	if *adminToken != "" {
+		options = append(options, api.Admin(*adminToken))
 	}
 
-	for _, path := range vcsPaths {
-		kv := strings.SplitN(path, ":", 2)
+	options = append(options, api.MaxBodySize(*maxBody))
+	if *listTimeout > 0 {
+		options = append(options, api.PartialLists(*listTimeout))
+	}
+	if *maxDeadline > 0 {
+		options = append(options, api.Deadlines(*maxDeadline))
+	}
+	if *snapshot != "" {
+		t, err := time.Parse(time.RFC3339, *snapshot)
+		if err != nil {
+			log.Fatal("bad snapshot time: ", err)
+		}
+		options = append(options, api.Snapshot(t))
+	}
+	if *verifySum != "" {
+		options = append(options, api.VerifySum(*verifySum))
+		if *requireSum {
+			options = append(options, api.RequireSum())
+		}
+	}
+	if len(allowedHosts) > 0 {
+		options = append(options, api.AllowedHosts(allowedHosts...))
+	}
+	if *caCert != "" {
+		b, err := ioutil.ReadFile(*caCert)
+		if err != nil {
+			log.Fatal(err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(b) {
+			log.Fatal("no certificates found in ", *caCert)
+		}
+		options = append(options, api.TLSConfig(&tls.Config{RootCAs: pool}))
+	}
+	for _, patterns := range insecure {
+		options = append(options, api.Insecure(strings.Split(patterns, ",")...))
+	}
+	if *knownHosts != "" {
+		options = append(options, api.KnownHosts(*knownHosts))
+	}
+	if *ignoreHostKeys {
+		if *knownHosts != "" || *acceptNew {
+			log.Fatal("-insecureignorehostkeys can not be combined with -knownhosts or -acceptnewhostkeys")
+		}
+		options = append(options, api.InsecureIgnoreHostKey())
+	}
+	options = append(options, api.CacheMaxAge(*maxAge))
+	if *goVersion != "" {
+		options = append(options, api.SyntheticGoVersion(*goVersion))
+	}
+	if *requireMod {
+		options = append(options, api.RequireGoMod())
+	}
+	if *goImport != "" {
+		options = append(options, api.GoImport(*goImport))
+	}
+	if *notFound != "" {
+		options = append(options, api.NotFoundMessage(*notFound))
+	}
+	if *landing {
+		options = append(options, api.Landing(*landingMsg))
+	}
+	if *latestPre {
+		options = append(options, api.LatestPrerelease())
+	}
+	if *prefetch > 0 {
+		options = append(options, api.PrefetchSiblings(*prefetch))
+	}
+	if *recheck > 0 {
+		options = append(options, api.RecheckCached(*recheck))
+	}
+	if *rampPeriod > 0 {
+		options = append(options, api.WorkerRamp(*rampStart, *rampPeriod))
+	}
+	if *summary > 0 {
+		options = append(options, api.Summary(*summary, *summaryTop))
+	}
+	if *microItems > 0 {
+		options = append(options, api.MicroCache(*microItems, *microLimit*1024*1024))
+	}
+	if *cacheBypass {
+		options = append(options, api.CacheBypass())
+	}
+	if *indexFile == "-" {
+		options = append(options, api.Index("", *indexMax))
+	} else if *indexFile != "" {
+		options = append(options, api.Index(*indexFile, *indexMax))
+	}
+	if *pseudoMaxAge > 0 {
+		options = append(options, api.PseudoVersionMaxAge(*pseudoMaxAge))
+	}
+	for _, s := range pseudoMaxAges {
+		kv := strings.SplitN(s, "=", 2)
 		if len(kv) != 2 {
-			log.Fatal("bad VCS syntax:", path)
+			log.Fatal("bad module pseudo-version max age syntax: ", s)
 		}
-		options = append(options, api.CustomVCS(kv[0], kv[1]))
+		d, err := time.ParseDuration(kv[1])
+		if err != nil {
+			log.Fatal("bad module pseudo-version max age: ", err)
+		}
+		options = append(options, api.ModulePseudoVersionMaxAge(kv[0], d))
+	}
+
+	diskOptions := []store.DiskOption{}
+	memOptions := []store.MemoryOption{}
+	if *dedup {
+		diskOptions = append(diskOptions, store.Dedup())
+	}
+	for _, name := range digests {
+		switch name {
+		case store.SHA512.Name:
+			diskOptions = append(diskOptions, store.ExtraDigests(store.SHA512))
+			options = append(options, api.Digests(store.SHA512))
+		default:
+			log.Fatal("unknown digest: ", name)
+		}
+	}
+	if *memItems > 0 {
+		memOptions = append(memOptions, store.MemoryMaxItems(*memItems))
+	}
+	if *memShards > 1 {
+		memOptions = append(memOptions, store.MemoryShards(*memShards))
+	}
+	if *softDelete > 0 {
+		diskOptions = append(diskOptions, store.SoftDelete(*softDelete))
+		memOptions = append(memOptions, store.MemorySoftDelete(*softDelete))
 	}
 
 	options = append(options,
-		api.VCSWorkers(*workers),
 		api.GitDir(*gitdir),
-		api.Memory(logger, *memLimit*1024*1024),
-		api.CacheDir(*dir),
+		api.GitDirLimit(*gitLimit*1024*1024),
+		api.Memory(logger, *memLimit*1024*1024, memOptions...),
 	)
+	if *goLayout {
+		goLayoutOptions := []store.GoLayoutOption{}
+		if *goVersion != "" {
+			goLayoutOptions = append(goLayoutOptions, store.GoLayoutGoVersion(*goVersion))
+		}
+		options = append(options, api.Store(store.GoLayout(*dir, goLayoutOptions...)))
+	} else {
+		options = append(options, api.CacheDir(*dir, diskOptions...))
+	}
+	if *gcsBucket != "" {
+		client, gcsOptions := gceClient(), []store.GCSOption{}
+		if *gcsEndpoint != "" {
+			client, gcsOptions = http.DefaultClient, append(gcsOptions, store.GCSEndpoint(*gcsEndpoint))
+		}
+		options = append(options, api.Store(store.GCS(*gcsBucket, *gcsPrefix, client, gcsOptions...)))
+	}
+
+	handler := api.New(options...)
+	if selftestMode {
+		if !selftest(os.Stdout, handler, *selftestModule, *selftestVersion) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatal("net.Listen:", err)
+	}
+	defer ln.Close()
+
+	fmt.Println("Listening on", ln.Addr())
 
 	sigc := make(chan os.Signal, 1)
 	signal.Notify(sigc, os.Interrupt)
 
+	hupc := make(chan os.Signal, 1)
+	signal.Notify(hupc, syscall.SIGHUP)
+	go func() {
+		for range hupc {
+			if err := handler.(interface{ Reload() error }).Reload(); err != nil {
+				log.Println("reload:", err)
+			}
+		}
+	}()
+
 	mux := http.NewServeMux()
-	mux.Handle("/", api.New(options...))
+	mux.Handle("/", handler)
 	if *prometheus != "" {
 		if *prometheus == *addr {
 			mux.HandleFunc("/metrics", prometheusHandler)
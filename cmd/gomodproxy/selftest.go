@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/sixt/gomodproxy/pkg/store"
+)
+
+// selftest fetches the given module version through the proxy handler, the
+// same way the go tool does, and prints a report of every step to w. It
+// returns false if any of the steps has failed.
+func selftest(w io.Writer, h http.Handler, module, version string) bool {
+	get := func(path string) ([]byte, error) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/"+module+"/@v/"+path, nil))
+		if rec.Code != http.StatusOK {
+			return nil, fmt.Errorf("%s: %d %s", path, rec.Code, bytes.TrimSpace(rec.Body.Bytes()))
+		}
+		return rec.Body.Bytes(), nil
+	}
+
+	var zip []byte
+	steps := []struct {
+		name string
+		run  func() error
+	}{
+		{"resolve", func() error {
+			b, err := get(version + ".info")
+			if err != nil {
+				return err
+			}
+			info := struct{ Version string }{}
+			if err := json.Unmarshal(b, &info); err != nil {
+				return err
+			}
+			version = info.Version
+			return nil
+		}},
+		{"fetch", func() (err error) {
+			zip, err = get(version + ".zip")
+			return err
+		}},
+		{"store", func() error {
+			b, err := get(version + ".zip")
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(b, zip) {
+				return fmt.Errorf("cached archive differs from the fetched one")
+			}
+			return nil
+		}},
+		{"checksum", func() error {
+			hash, err := store.HashZip(zip)
+			if err == nil {
+				fmt.Fprintf(w, "%s %s %s\n", module, version, hash)
+			}
+			return err
+		}},
+	}
+
+	for _, step := range steps {
+		start := time.Now()
+		err := step.run()
+		if err != nil {
+			fmt.Fprintf(w, "FAIL %-8s %v: %v\n", step.name, time.Since(start), err)
+			return false
+		}
+		fmt.Fprintf(w, "PASS %-8s %v\n", step.name, time.Since(start))
+	}
+	return true
+}
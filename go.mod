@@ -2,4 +2,8 @@ module github.com/sixt/gomodproxy
 
 go 1.13
 
-require gopkg.in/src-d/go-git.v4 v4.13.1
+require (
+	golang.org/x/crypto v0.0.0-20191011191535-87dc89f01550
+	golang.org/x/mod v0.3.0
+	gopkg.in/src-d/go-git.v4 v4.13.1
+)
@@ -0,0 +1,405 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sixt/gomodproxy/pkg/store"
+	"github.com/sixt/gomodproxy/pkg/vcs"
+)
+
+type admin struct {
+	token string
+}
+
+// Admin enables administrative API endpoints under the /admin/ and /debug/
+// paths. Requests must provide the token as a bearer token in the
+// Authorization header. The endpoints are not served at all without a token,
+// so an empty token leaves them disabled.
+func Admin(token string) Option {
+	return func(api *api) {
+		if token != "" {
+			api.admin = &admin{token: token}
+		}
+	}
+}
+
+// Reload configures a function that returns a fresh set of options when API
+// configuration is reloaded. Only VCS settings (git and custom VCS prefixes,
+// pinned modules, manifest) and the number of VCS workers are replaced on
+// reload, other options are ignored.
+func Reload(load func() ([]Option, error)) Option {
+	return func(api *api) {
+		api.reload = load
+	}
+}
+
+// Reload re-reads API configuration using the function given in the Reload
+// option and atomically replaces VCS settings. Requests that are already in
+// progress keep using the previous settings. The VCS workers are kept as they
+// are unless their number changes, so that fetches in progress and a worker
+// ramp keep counting against the limit.
+func (api *api) Reload() error {
+	if api.reload == nil {
+		return errors.New("reload is not configured")
+	}
+	options, err := api.reload()
+	if err != nil {
+		return err
+	}
+	api.RLock()
+	next := reloaded(api, options)
+	api.RUnlock()
+	api.Lock()
+	api.vcsPaths, api.manifest = next.vcsPaths, next.manifest
+	api.pins, api.tagPatterns, api.sshURLs = next.pins, next.tagPatterns, next.sshURLs
+	if cap(next.semc) != cap(api.semc) {
+		api.semc = next.semc
+	}
+	api.Unlock()
+	api.log("api.Reload", "vcspaths", len(next.vcsPaths), "workers", cap(next.semc))
+	return nil
+}
+
+// reloaded returns an API instance with the given options applied on top of
+// the settings that can not be reloaded.
+func reloaded(base *api, options []Option) *api {
+	api := &api{log: base.log, gitdir: base.gitdir, hosts: base.hosts, snapshot: base.snapshot, insecure: base.insecure, metaClient: base.metaClient,
+		knownHosts: base.knownHosts, ignoreKeys: base.ignoreKeys, semc: base.semc}
+	for _, opt := range options {
+		opt(api)
+	}
+	return api
+}
+
+// authorized tells if the request carries the admin token.
+func (a *admin) authorized(r *http.Request) bool {
+	auth := []byte(r.Header.Get("Authorization"))
+	return subtle.ConstantTimeCompare(auth, []byte("Bearer "+a.token)) == 1
+}
+
+func (api *api) serveAdmin(w http.ResponseWriter, r *http.Request) {
+	if !api.admin.authorized(r) {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	switch r.URL.Path {
+	case "/admin/reload":
+		if r.Method != http.MethodPost {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		if err := api.Reload(); err != nil {
+			api.log("api.reload", "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	case "/admin/restore":
+		if r.Method != http.MethodPost {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		api.restore(w, r)
+	case "/admin/mirror":
+		if r.Method != http.MethodPost {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		api.mirror(w, r)
+	case "/admin/purge":
+		if r.Method != http.MethodPost {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		api.purge(w, r)
+	case "/debug/auth":
+		api.serveAuth(w, r)
+	case "/debug/fetch":
+		api.serveFetch(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// restore brings back the module version given in the query into all stores
+// that keep deleted snapshots for a grace period.
+func (api *api) restore(w http.ResponseWriter, r *http.Request) {
+	module, version := r.URL.Query().Get("module"), r.URL.Query().Get("version")
+	if module == "" || version == "" {
+		http.Error(w, "module and version are required", http.StatusBadRequest)
+		return
+	}
+	restored := false
+	for _, s := range api.stores {
+		if restorer, ok := s.(store.Restorer); ok {
+			if err := restorer.Restore(r.Context(), module, vcs.Version(version)); err == nil {
+				restored = true
+			}
+		}
+	}
+	api.log("api.restore", "module", module, "version", version, "restored", restored)
+	if !restored {
+		http.NotFound(w, r)
+	}
+}
+
+// purge deletes all cached versions of the modules matching the glob pattern
+// given in the query from all stores, e.g. "github.com/compromised-org/*".
+// Like in GOPRIVATE, a pattern matching a path prefix matches all modules
+// below it. Cached versions are found in the stores that can enumerate their
+// contents. Like for DELETE requests, errors are only reported once every
+// version has been deleted from every store.
+func (api *api) purge(w http.ResponseWriter, r *http.Request) {
+	pattern := r.URL.Query().Get("pattern")
+	if pattern == "" {
+		http.Error(w, "pattern is required", http.StatusBadRequest)
+		return
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		http.Error(w, "bad pattern: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx := r.Context()
+	matched := map[store.Entry]bool{}
+	for _, s := range api.stores {
+		inspector, ok := s.(store.Inspector)
+		if !ok {
+			continue
+		}
+		entries, err := inspector.Entries(ctx)
+		if err != nil {
+			api.log("api.purge", "pattern", pattern, "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, e := range entries {
+			if matchPrefix(pattern, e.Module) {
+				matched[store.Entry{Module: e.Module, Version: e.Version}] = true
+			}
+		}
+	}
+
+	res := struct {
+		Pattern string
+		Purged  int
+	}{Pattern: pattern}
+	errs := []string{}
+	for e := range matched {
+		api.forget(ctx, e.Module, e.Version)
+		deleted := false
+		for _, s := range api.stores {
+			err := s.Del(ctx, e.Module, e.Version)
+			if err == nil {
+				deleted = true
+			} else if !errors.Is(err, os.ErrNotExist) {
+				api.log("api.purge", "module", e.Module, "version", e.Version, "error", err)
+				errs = append(errs, err.Error())
+			}
+		}
+		if deleted {
+			res.Purged++
+		}
+	}
+	api.log("api.purge", "pattern", pattern, "purged", res.Purged)
+	if len(errs) > 0 {
+		http.Error(w, strings.Join(errs, "; "), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// matchPrefix reports whether the glob pattern matches the module path or
+// any of its path prefixes.
+func matchPrefix(pattern, module string) bool {
+	for p := module; p != "." && p != "/" && p != ""; p = path.Dir(p) {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+type mirrored struct {
+	Version vcs.Version
+	Error   string `json:",omitempty"`
+}
+
+// mirror fetches all versions of the module given in the query into the
+// caches, optionally narrowed down with the same "prefix" and "match"
+// parameters as the version list, and reports the result for every version.
+// Fetches from the VCS are limited by the number of VCS workers as usual.
+func (api *api) mirror(w http.ResponseWriter, r *http.Request) {
+	module := r.URL.Query().Get("module")
+	if module == "" {
+		http.Error(w, "module is required", http.StatusBadRequest)
+		return
+	}
+	match, err := versionFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := api.hosts.Check(strings.SplitN(module, "/", 2)[0]); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	ctx := r.Context()
+	list, err := api.vcs(ctx, module).List(ctx)
+	if err != nil {
+		api.log("api.mirror", "module", module, "error", err)
+		http.Error(w, err.Error(), httpStatus(ctx, err))
+		return
+	}
+
+	res := struct {
+		Module   string
+		Versions []mirrored
+		Failed   int
+	}{Module: module, Versions: []mirrored{}}
+	for _, v := range list {
+		if match(v) {
+			res.Versions = append(res.Versions, mirrored{Version: v})
+		}
+	}
+	wg := sync.WaitGroup{}
+	for i := range res.Versions {
+		wg.Add(1)
+		go func(m *mirrored) {
+			defer wg.Done()
+			if _, _, err := api.module(ctx, module, m.Version); err != nil {
+				m.Error = err.Error()
+			}
+		}(&res.Versions[i])
+	}
+	wg.Wait()
+	for _, m := range res.Versions {
+		if m.Error != "" {
+			res.Failed++
+		}
+	}
+	api.log("api.mirror", "module", module, "versions", len(res.Versions), "failed", res.Failed)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// serveAuth reports which VCS settings match the module given in the query:
+// the configured prefix, the repository and the kind of credentials used to
+// fetch it. Credentials themselves are never reported.
+func (api *api) serveAuth(w http.ResponseWriter, r *http.Request) {
+	module := r.URL.Query().Get("module")
+	if module == "" {
+		http.Error(w, "module is required", http.StatusBadRequest)
+		return
+	}
+	res := struct {
+		Module string
+		Prefix string `json:",omitempty"`
+		vcs.Remote
+		Error string `json:",omitempty"`
+	}{Module: module, Remote: vcs.Remote{VCS: "gomod", Auth: "none"}}
+	if path, ok := api.match(module); ok {
+		res.Prefix = path.prefix
+		res.Remote = vcs.Remote{}
+		if d, ok := path.vcs(module).(vcs.Describer); ok {
+			remote, err := d.Describe(r.Context())
+			if err != nil {
+				res.Error = err.Error()
+			}
+			res.Remote = remote
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+type fetchPhase struct {
+	Name    string
+	Seconds float64
+}
+
+// serveFetch downloads the module version given in the query from the VCS,
+// bypassing the caches, and reports the time spent in every phase of the
+// fetch. CPU time is the time used by the whole process meanwhile.
+func (api *api) serveFetch(w http.ResponseWriter, r *http.Request) {
+	module, version := r.URL.Query().Get("module"), r.URL.Query().Get("version")
+	if module == "" || version == "" {
+		http.Error(w, "module and version are required", http.StatusBadRequest)
+		return
+	}
+	if err := api.hosts.Check(strings.SplitN(module, "/", 2)[0]); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	res := struct {
+		Module     string
+		Version    string
+		Phases     []fetchPhase
+		Seconds    float64
+		CPUSeconds float64
+		Size       int               `json:",omitempty"`
+		Sum        string            `json:",omitempty"`
+		Digests    map[string]string `json:",omitempty"`
+		Error      string            `json:",omitempty"`
+	}{Module: module, Version: version, Phases: []fetchPhase{}}
+
+	trace := &vcs.Trace{}
+	ctx := vcs.WithTrace(r.Context(), trace)
+	start, cpu := time.Now(), cpuTime()
+	sums, size, errmsg := api.tracedFetch(ctx, module, vcs.Version(version))
+	res.Sum, res.Size, res.Error = sums["h1"], size, errmsg
+	if len(api.digests) > 0 {
+		res.Digests = sums
+	}
+	res.Seconds = time.Since(start).Seconds()
+	res.CPUSeconds = (cpuTime() - cpu).Seconds()
+	for _, phase := range trace.Phases {
+		res.Phases = append(res.Phases, fetchPhase{Name: phase.Name, Seconds: phase.Duration.Seconds()})
+	}
+	api.log("api.debugFetch", "module", module, "version", version, "phases", res.Phases, "error", res.Error)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// tracedFetch downloads and hashes the module the same way as fetch does,
+// but without touching the stores. The "h1:" hash is returned as "h1" along
+// with the configured digests.
+func (api *api) tracedFetch(ctx context.Context, module string, version vcs.Version) (sums map[string]string, size int, errmsg string) {
+	// wait for semaphore, the fetch counts against the VCS workers limit
+	api.RLock()
+	semc := api.semc
+	api.RUnlock()
+	select {
+	case semc <- struct{}{}:
+	case <-ctx.Done():
+		return nil, 0, ctx.Err().Error()
+	}
+	defer func() { <-semc }()
+
+	v := api.vcs(ctx, module)
+	if _, err := v.Timestamp(ctx, version); err != nil {
+		return nil, 0, err.Error()
+	}
+	zr, err := v.Zip(ctx, version)
+	if err != nil {
+		return nil, 0, err.Error()
+	}
+	defer zr.Close()
+	b, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return nil, 0, err.Error()
+	}
+	defer vcs.Span(ctx, "hash")()
+	if sums, err = store.Digests(b, api.digests...); err != nil {
+		return nil, len(b), err.Error()
+	}
+	return sums, len(b), ""
+}
@@ -2,16 +2,25 @@ package api
 
 import (
 	"archive/zip"
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"expvar"
 	"fmt"
 	"io"
+	"math"
+	"math/rand"
 	"net/http"
-	"path/filepath"
+	"os"
+	"path"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"unicode"
 
@@ -22,13 +31,91 @@ import (
 type logger = func(v ...interface{})
 
 type api struct {
-	log      logger
-	gitdir   string
+	log         logger
+	accessLog   logger
+	audit       logger
+	gitdir      string
+	gitLimit    int64
+	prunec      chan struct{}
+	stores      []store.Store
+	admin       *admin
+	reload      func() ([]Option, error)
+	maxDeadline time.Duration
+	maxAge      time.Duration
+	routes      []route
+	pins        map[string]string
+	tagPatterns map[string]*regexp.Regexp
+	sshURLs     map[string]string
+	insecure    []string
+	tlsConfig   *tls.Config
+	knownHosts  []string
+	ignoreKeys  bool
+	manifest    *manifest
+	index       *index
+	hosts       *vcs.HostPolicy
+	sums        *sums
+	snapshot    time.Time
+	metaOptions []vcs.MetaOption
+	metaClient  *http.Client
+	requireMod  bool
+	goVersion   string
+	notFound    string
+	landing     *landing
+	bypass      bool
+	goImport    string
+	listTimeout time.Duration
+	maxBody     int64
+	digests     []store.Digest
+
+	// Branch tips resolved by @latest, and the cached snapshots of branches
+	// and other named revisions, are reused until they expire.
+	pseudoMaxAge     time.Duration
+	pseudoMaxAges    map[string]time.Duration
+	latestPrerelease bool
+	tipsMu           sync.Mutex
+	tips             map[string]tip
+	revs             map[string]time.Time
+
+	// Cached versions are re-resolved in the background with the given rate.
+	recheckRate float64
+	checks      sync.WaitGroup
+
+	// Release versions next to a missed one are fetched in the background.
+	prefetch   int
+	prefetches sync.WaitGroup
+
+	// VCS workers are added gradually after the start, if enabled.
+	ramp *ramp
+
+	// Cache effectiveness is logged periodically, if enabled.
+	summary *summary
+
+	// The last served snapshots are kept in front of the stores, if enabled.
+	micro store.Store
+
+	// Writes to the slower stores run in the background, at most cap(putc) at
+	// a time.
+	putc chan struct{}
+	puts sync.WaitGroup
+
+	// VCS settings can be reloaded at runtime and are guarded by the mutex.
+	sync.RWMutex
 	vcsPaths []vcsPath
-	stores   []store.Store
 	semc     chan struct{}
 }
 
+type route struct {
+	id       string
+	regexp   *regexp.Regexp
+	handler  func(w http.ResponseWriter, r *http.Request, module, version string)
+	duration *histogram
+}
+
+type tip struct {
+	version vcs.Version
+	expires time.Time
+}
+
 type vcsPath struct {
 	prefix string
 	vcs    func(module string) vcs.VCS
@@ -37,11 +124,110 @@ type vcsPath struct {
 // Option configures an API handler.
 type Option func(*api)
 
+// defaultMaxBody is the default limit of request bodies. The proxy API takes
+// no bodies at all, only the admin API might.
+const defaultMaxBody = 1 << 20
+
+// defaultMaxAge is how long clients and CDNs may cache immutable responses.
+const defaultMaxAge = 365 * 24 * time.Hour
+
+// recheckTimeout limits the time spent on re-resolving a cached version.
+const recheckTimeout = time.Minute
+
+// prefetchTimeout limits the time spent on prefetching the versions next to a
+// missed one.
+const prefetchTimeout = 5 * time.Minute
+
+// maxPuts is the number of snapshots that can be written to the slower stores
+// at the same time. Fetches wait for their turn when the limit is reached.
+const maxPuts = 16
+
+const (
+	deadlineHeader = "X-Gomodproxy-Deadline"
+	partialHeader  = "X-Gomodproxy-Partial"
+	moduleHeader   = "X-Gomodproxy-Module"
+	repoHeader     = "X-Gomodproxy-Repo"
+	vcsHeader      = "X-Gomodproxy-VCS"
+	noCacheHeader  = "X-Gomodproxy-No-Cache"
+)
+
+// originWriter adds diagnostic headers describing the requested module and
+// the VCS it has been resolved to right before the response is written. VCS
+// headers are only present if the VCS has been contacted for the request.
+type originWriter struct {
+	http.ResponseWriter
+	module string
+	origin vcs.Origin
+	code   int
+	done   bool
+}
+
+func (w *originWriter) header() {
+	if w.done {
+		return
+	}
+	w.done = true
+	h := w.Header()
+	h.Set(moduleHeader, w.module)
+	if w.origin.VCS != "" {
+		h.Set(vcsHeader, w.origin.VCS)
+	}
+	if w.origin.Repo != "" && w.origin.Repo != w.module {
+		h.Set(repoHeader, w.origin.Repo)
+	}
+}
+
+func (w *originWriter) WriteHeader(code int) {
+	w.header()
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *originWriter) Write(b []byte) (int, error) {
+	w.header()
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *originWriter) Flush() {
+	w.header()
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Version list lines are sent to the client once listBufferSize bytes are
+// buffered, or every listFlushInterval while versions are being discovered.
+const (
+	listBufferSize    = 32 * 1024
+	listFlushInterval = 100 * time.Millisecond
+)
+
+// flushWriter sends every write to the client right away, so that long
+// responses are streamed in chunks instead of being buffered as a whole.
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (fw flushWriter) Write(b []byte) (int, error) {
+	n, err := fw.w.Write(b)
+	if f, ok := fw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return n, err
+}
+
 var (
 	apiList = regexp.MustCompile(`^/(?P<module>.*)/@v/list$`)
 	apiInfo = regexp.MustCompile(`^/(?P<module>.*)/@v/(?P<version>.*).info$`)
 	apiMod  = regexp.MustCompile(`^/(?P<module>.*)/@v/(?P<version>.*).mod$`)
 	apiZip  = regexp.MustCompile(`^/(?P<module>.*)/@v/(?P<version>.*).zip$`)
+
+	apiLatest = regexp.MustCompile(`^/(?P<module>.*)/@latest$`)
 )
 
 var (
@@ -50,37 +236,259 @@ var (
 	httpRequests         = expvar.NewMap("http_requests_total")
 	httpErrors           = expvar.NewMap("http_errors_total")
 	httpRequestDurations = expvar.NewMap("http_request_duration_seconds")
+	retagged             = expvar.NewMap("retagged_total")
+	zipServedBytes       = expvar.NewMap("zip_served_bytes_total")
+	vcsFetchedBytes      = expvar.NewMap("vcs_fetched_bytes_total")
+)
+
+var (
+	errRetagged = errors.New("tag points to a different commit than the cached module")
+	errNoGoMod  = errors.New("module has no go.mod file")
 )
 
 // New returns a configured http.Handler which implements GOPROXY API.
 func New(options ...Option) http.Handler {
-	api := &api{log: func(...interface{}) {}, semc: make(chan struct{}, 1)}
+	api := &api{log: func(...interface{}) {}, semc: make(chan struct{}, 1), putc: make(chan struct{}, maxPuts), prunec: make(chan struct{}, 1), maxAge: defaultMaxAge, maxBody: defaultMaxBody}
 	for _, opt := range options {
 		opt(api)
 	}
+	if api.accessLog == nil {
+		api.accessLog = api.log
+	}
+	api.metaClient = vcs.NewMetaClient(api.tlsConfig, api.metaOptions...)
+	api.routes = []route{
+		{id: "list", regexp: apiList, handler: api.list},
+		{id: "info", regexp: apiInfo, handler: api.info},
+		{id: "api", regexp: apiMod, handler: api.mod},
+		{id: "zip", regexp: apiZip, handler: api.zip},
+		{id: "latest", regexp: apiLatest, handler: api.latest},
+	}
+	for i := range api.routes {
+		api.routes[i].duration = requestDuration(api.routes[i].id)
+	}
+	if api.ramp != nil {
+		api.ramp.hold(api.semc)
+	}
+	if api.summary != nil {
+		api.summary.delta()
+		go api.summary.run(api.log)
+	}
 	return api
 }
 
+// requestDuration returns a histogram in the request durations map for the
+// given route, reusing the existing one if any.
+func requestDuration(id string) *histogram {
+	if v, ok := httpRequestDurations.Get(id).(*histogram); ok {
+		return v
+	}
+	v := newHistogram(durationBuckets)
+	httpRequestDurations.Set(id, v)
+	return v
+}
+
 // Log configures API to use a specific logger function, such as log.Println,
 // testing.T.Log or any other custom logger.
-func Log(log logger) Option { return func(api *api) { api.log = log } }
+func Log(log logger, options ...LogOption) Option {
+	for _, opt := range options {
+		log = opt(log)
+	}
+	return func(api *api) { api.log = log }
+}
+
+// AccessLog configures API to log a summary line of every request with a
+// separate logger, e.g. to keep access logs apart from diagnostic ones. By
+// default requests are logged with the main logger.
+func AccessLog(log logger) Option { return func(api *api) { api.accessLog = log } }
 
 // GitDir configures API to use a specific directory for bare git repos.
 func GitDir(dir string) Option { return func(api *api) { api.gitdir = dir } }
 
+// GitDirLimit makes API remove the least recently used bare git repos after
+// fetching a module when the git directory grows above the limit in bytes.
+func GitDirLimit(limit int64) Option { return func(api *api) { api.gitLimit = limit } }
+
 // Git configures API to use a specific git client when trying to download a
 // repository with the given prefix. Auth string can be a path to the SSK key,
-// or a colon-separated username:password string.
-func Git(prefix string, auth string) Option {
-	a := vcs.Key(auth)
-	if creds := strings.SplitN(auth, ":", 2); len(creds) == 2 {
-		a = vcs.Password(creds[0], creds[1])
+// optionally followed by a colon and the passphrase of the key, or a
+// colon-separated username:password string. Git options, if any, are passed
+// to the git client as is.
+func Git(prefix string, auth string, options ...vcs.GitOption) Option {
+	a := gitAuth(auth)
+	return func(api *api) {
+		api.vcsPaths = append(api.vcsPaths, vcsPath{
+			prefix: prefix,
+			vcs: func(module string) vcs.VCS {
+				api.RLock()
+				manifest := api.manifest
+				hash, pinned := api.pins[module]
+				api.RUnlock()
+				if manifest != nil && manifest.err != nil {
+					// not wrapped, so that a missing manifest is not reported as a missing module
+					return failedVCS{fmt.Errorf("manifest: %v", manifest.err)}
+				}
+				opts := append([]vcs.GitOption{vcs.Hosts(api.hosts), vcs.MetaClient(api.metaClient)}, options...)
+				if !api.snapshot.IsZero() {
+					opts = append(opts, vcs.Snapshot(api.snapshot))
+				}
+				if pinned {
+					opts = append(opts, vcs.Pin(hash))
+				}
+				if re := api.tagPattern(module); re != nil {
+					opts = append(opts, vcs.TagPattern(re))
+				}
+				if url := api.sshURL(module); url != "" {
+					opts = append(opts, vcs.SSHURL(url))
+				}
+				if api.isInsecure(module) {
+					opts = append(opts, vcs.InsecureHTTP())
+				}
+				if len(api.knownHosts) > 0 {
+					opts = append(opts, vcs.KnownHosts(api.knownHosts...))
+				}
+				if api.ignoreKeys {
+					opts = append(opts, vcs.InsecureIgnoreHostKey())
+				}
+				if versions, ok := manifest.versions(module); ok {
+					opts = append(opts, vcs.Manifest(versions))
+				}
+				return vcs.NewGit(api.log, api.gitdir, module, a, opts...)
+			},
+		})
+	}
+}
+
+// gitAuth parses the auth string of Git and the other VCS clients.
+// "id_rsa:passphrase" is told apart from "username:password" by the key file:
+// usernames never contain slashes, and a relative key path without one, e.g.
+// "id_rsa", names an existing file.
+func gitAuth(auth string) vcs.Auth {
+	creds := strings.SplitN(auth, ":", 2)
+	if len(creds) != 2 {
+		return vcs.Key(auth)
+	} else if strings.Contains(creds[0], "/") || isFile(creds[0]) {
+		return vcs.KeyWithPassphrase(creds[0], creds[1])
+	}
+	return vcs.Password(creds[0], creds[1])
+}
+
+// isFile tells if the path names an existing regular file.
+func isFile(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.Mode().IsRegular()
+}
+
+// Pin configures API to serve the commit with the given full hash for every
+// requested version of the git module. This is a manual emergency override,
+// e.g. to freeze a module at a known-good commit during an incident. Content
+// served for pinned versions does not match their tags, so clients that
+// already have those versions in go.sum will get checksum mismatches.
+func Pin(module string, hash string) Option {
+	return func(api *api) {
+		if api.pins == nil {
+			api.pins = map[string]string{}
+		}
+		api.pins[module] = hash
+	}
+}
+
+// TagPattern configures API to serve release tags of the git modules with the
+// given prefix that match the regular expression, e.g. "release-1.2.3" with
+// `^release-(\d+\.\d+\.\d+)$`, as the "vX.Y.Z" versions captured by its first
+// subexpression. If several prefixes match, the longest one is used.
+func TagPattern(prefix string, re *regexp.Regexp) Option {
+	return func(api *api) {
+		if api.tagPatterns == nil {
+			api.tagPatterns = map[string]*regexp.Regexp{}
+		}
+		api.tagPatterns[prefix] = re
+	}
+}
+
+// tagPattern returns the tag pattern of the module, or nil if it has none.
+func (api *api) tagPattern(module string) *regexp.Regexp {
+	api.RLock()
+	defer api.RUnlock()
+	var re *regexp.Regexp
+	n := -1
+	for prefix, r := range api.tagPatterns {
+		if strings.HasPrefix(module, prefix) && len(prefix) > n {
+			re, n = r, len(prefix)
+		}
+	}
+	return re
+}
+
+// SSHURL configures API to fetch the git modules with the given prefix over
+// SSH from the URL built by the template, e.g. "ssh://git@host:29418/{path}"
+// for a Gerrit server, see vcs.SSHURL. If several prefixes match, the longest
+// one is used.
+func SSHURL(prefix string, template string) Option {
+	return func(api *api) {
+		if api.sshURLs == nil {
+			api.sshURLs = map[string]string{}
+		}
+		api.sshURLs[prefix] = template
+	}
+}
+
+// sshURL returns the SSH URL template of the module, if any.
+func (api *api) sshURL(module string) string {
+	api.RLock()
+	defer api.RUnlock()
+	url, n := "", -1
+	for prefix, template := range api.sshURLs {
+		if strings.HasPrefix(module, prefix) && len(prefix) > n {
+			url, n = template, len(prefix)
+		}
+	}
+	return url
+}
+
+// GitCLI configures API to fetch modules with the given path prefix using the
+// system "git" command instead of go-git, e.g. for huge repositories. The auth
+// string is the same as for Git, but the passphrase of a key is not used, so
+// an encrypted key must be loaded into ssh-agent. Repositories are kept in the
+// GitDir, if any. Insecure and TLSConfig do not apply, the git command uses its own
+// configuration and the system CA certificates.
+func GitCLI(prefix string, auth string) Option {
+	a := gitAuth(auth)
+	return func(api *api) {
+		api.vcsPaths = append(api.vcsPaths, vcsPath{
+			prefix: prefix,
+			vcs: func(module string) vcs.VCS {
+				return vcs.NewGitCLI(api.log, api.gitdir, module, a, api.hosts)
+			},
+		})
+	}
+}
+
+// Hg configures API to fetch modules with the given path prefix from
+// Mercurial repositories using the "hg" command. The auth string is either a
+// path to the SSH key or "username:password" for HTTPS access, like for
+// GitCLI.
+func Hg(prefix string, auth string) Option {
+	a := gitAuth(auth)
+	return func(api *api) {
+		api.vcsPaths = append(api.vcsPaths, vcsPath{
+			prefix: prefix,
+			vcs: func(module string) vcs.VCS {
+				return vcs.NewHg(api.log, api.gitdir, module, a, api.hosts)
+			},
+		})
 	}
+}
+
+// SVN configures API to fetch modules with the given path prefix from
+// Subversion repositories using the "svn" command. The auth string is either
+// a path to the SSH key or "username:password", like for GitCLI.
+func SVN(prefix string, auth string) Option {
+	a := gitAuth(auth)
 	return func(api *api) {
 		api.vcsPaths = append(api.vcsPaths, vcsPath{
 			prefix: prefix,
 			vcs: func(module string) vcs.VCS {
-				return vcs.NewGit(api.log, api.gitdir, module, a)
+				return vcs.NewSVN(api.log, module, a, api.hosts)
 			},
 		})
 	}
@@ -98,19 +506,94 @@ func CustomVCS(prefix string, cmd string) Option {
 }
 
 // Memory configures API to use in-memory cache for downloaded modules.
-func Memory(log logger, limit int64) Option {
+func Memory(log logger, limit int64, options ...store.MemoryOption) Option {
 	return func(api *api) {
-		api.stores = append(api.stores, store.Memory(log, limit))
+		api.stores = append(api.stores, store.Memory(log, limit, options...))
 	}
 }
 
 // CacheDir configures API to use a local disk storage for downloaded modules.
-func CacheDir(dir string) Option {
+func CacheDir(dir string, options ...store.DiskOption) Option {
 	return func(api *api) {
-		api.stores = append(api.stores, store.Disk(dir))
+		api.stores = append(api.stores, store.Disk(dir, options...))
 	}
 }
 
+// Digests configures API to report the given digests of module archives next
+// to their "h1:" hash in the /debug/fetch response. To keep them in the disk
+// cache as well, pass the store.ExtraDigests option to CacheDir.
+func Digests(digests ...store.Digest) Option {
+	return func(api *api) { api.digests = append(api.digests, digests...) }
+}
+
+// Store configures API to use a custom cache store for downloaded modules,
+// such as GCS. Stores are queried in the order they are configured.
+func Store(s store.Store) Option {
+	return func(api *api) {
+		api.stores = append(api.stores, s)
+	}
+}
+
+// CacheMaxAge configures how long clients and CDNs may cache the responses
+// for release versions, which never change. Lists, @latest and pseudo-versions
+// are never cached.
+func CacheMaxAge(d time.Duration) Option { return func(api *api) { api.maxAge = d } }
+
+// LatestPrerelease makes @latest resolve to the highest version of the module
+// even if it is a pre-release, e.g. during a release-candidate phase. By
+// default pre-releases are only considered if there are no releases.
+func LatestPrerelease() Option { return func(api *api) { api.latestPrerelease = true } }
+
+// RequireGoMod makes API refuse to serve the modules fetched from the VCS that
+// have no go.mod file in the module root, instead of synthesizing one, so that
+// pre-modules code can not be depended upon by accident. Such modules are
+// answered with 410. Modules that are already cached are still served.
+func RequireGoMod() Option { return func(api *api) { api.requireMod = true } }
+
+// SyntheticGoVersion makes API add a "go" directive with the given Go version,
+// e.g. "1.16", to the go.mod files synthesized for modules that have none.
+// By default only the "module" directive is written, like the go tool and
+// proxy.golang.org do. Note that go.mod checksums of such modules then differ
+// from the ones recorded in the public checksum database.
+func SyntheticGoVersion(version string) Option { return func(api *api) { api.goVersion = version } }
+
+// NotFoundMessage configures API to answer the requests that are not module
+// proxy requests with the given message, e.g. to tell which modules the proxy
+// serves. The status is still 404. Clients accepting "application/json" get
+// it as the "Error" field of a JSON object.
+func NotFoundMessage(msg string) Option { return func(api *api) { api.notFound = msg } }
+
+// RecheckCached makes API re-resolve the given fraction of release versions
+// served from the caches, in the background, and report those whose tags
+// have been moved to a different commit since they were cached. Such modules
+// are counted in the "retagged_total" metric. Only the commit hash is
+// compared, so the check does not download the module. Modules cached without
+// the hash, e.g. by the stores that do not keep it, are not checked.
+func RecheckCached(rate float64) Option { return func(api *api) { api.recheckRate = rate } }
+
+// PrefetchSiblings makes API fetch up to n release versions closest to the
+// requested one into the caches in the background after a cache miss for a
+// release version, so that the go.mod lookups of the following version
+// selection hit the cache. Prefetching only uses idle VCS workers and stops as
+// soon as all of them are busy, but it still adds to the VCS load.
+func PrefetchSiblings(n int) Option { return func(api *api) { api.prefetch = n } }
+
+// PartialLists makes API answer list requests that take longer than the given
+// timeout with the versions discovered so far, rather than waiting for all of
+// them or failing, e.g. for repositories with a huge number of tags. Such
+// responses are logged and carry the "X-Gomodproxy-Partial: true" trailer, or
+// header if no version was discovered in time. A partial list can be
+// misleading, since it may miss the latest versions. Only VCS clients that
+// stream versions, such as git, return partial lists.
+func PartialLists(timeout time.Duration) Option {
+	return func(api *api) { api.listTimeout = timeout }
+}
+
+// MaxBodySize limits the size of request bodies, e.g. of the admin API, to the
+// given number of bytes. Larger requests are rejected with 413. GET and HEAD
+// requests must have no body regardless of the limit.
+func MaxBodySize(n int64) Option { return func(api *api) { api.maxBody = n } }
+
 // VCSWorkers configures API to use at most n parallel workers when fetching
 // from the VCS. The reason to restrict number of workers is to limit their
 // memory usage.
@@ -120,92 +603,442 @@ func VCSWorkers(n int) Option {
 	}
 }
 
-func decodeBangs(s string) string {
-	buf := []rune{}
-	bang := false
-	for _, r := range []rune(s) {
-		if bang {
-			bang = false
-			buf = append(buf, unicode.ToUpper(r))
-			continue
+// Deadlines allows clients to limit the time spent on a single request with
+// the X-Gomodproxy-Deadline header, which contains the number of seconds.
+// Requests that can not be completed within the deadline fail with 504 status.
+// Client deadlines are capped by the given max duration.
+func Deadlines(max time.Duration) Option {
+	return func(api *api) {
+		api.maxDeadline = max
+	}
+}
+
+// MetaLookups configures the HTTP client of the go-import meta tag lookups of
+// the git clients of Git, e.g. the number of connections kept open to every
+// vanity import host.
+func MetaLookups(options ...vcs.MetaOption) Option {
+	return func(api *api) {
+		api.metaOptions = append(api.metaOptions, options...)
+	}
+}
+
+// AllowedHosts configures API to contact only the given VCS hosts, including
+// the hosts probed for go-import meta tags. Requests for modules on other
+// hosts are rejected with 403. A host may be a "*.example.com" pattern.
+// Loopback and link-local addresses are always rejected unless listed
+// explicitly, even if no allowed hosts are configured.
+func AllowedHosts(hosts ...string) Option {
+	return func(api *api) {
+		api.hosts = vcs.AllowHosts(hosts...)
+	}
+}
+
+// TLSConfig configures the TLS connections to the VCS hosts, both for
+// go-import meta tag lookups and for git fetches over HTTPS, e.g. to trust the
+// private CA of an internal module host. The configuration of git fetches is
+// process-wide. It only applies to the git clients of Git, the hg, svn and git
+// command line clients use the system configuration.
+func TLSConfig(c *tls.Config) Option {
+	return func(api *api) {
+		api.tlsConfig = c
+		vcs.ConfigureTLS(c)
+	}
+}
+
+// Insecure configures API to fetch the git modules matching any of the glob
+// patterns, or whose path prefixes do, over plain HTTP instead of HTTPS, like
+// GOINSECURE does for the go tool, e.g. "git.example.com" or "*.corp.example".
+// Go-import meta tags of such modules are looked up over HTTP as well. It only
+// applies to the git clients of Git, the GitCLI, Hg and SVN clients always
+// use the URLs they resolve.
+func Insecure(patterns ...string) Option {
+	return func(api *api) {
+		api.insecure = append(api.insecure, patterns...)
+	}
+}
+
+// isInsecure tells if the module is fetched over plain HTTP.
+func (api *api) isInsecure(module string) bool {
+	for _, pattern := range api.insecure {
+		if matchPrefix(pattern, module) {
+			return true
 		}
-		if r == '!' {
-			bang = true
-			continue
+	}
+	return false
+}
+
+// KnownHosts configures API to verify the SSH host keys of git remotes
+// against the given known_hosts files instead of ~/.ssh/known_hosts.
+// Connections to unknown hosts, or to hosts whose key differs from the known
+// one, fail with an error naming the host and the key fingerprints.
+func KnownHosts(files ...string) Option {
+	return func(api *api) {
+		api.knownHosts = append(api.knownHosts, files...)
+	}
+}
+
+// InsecureIgnoreHostKey configures API to accept any SSH host key of git
+// remotes without verifying it. It is meant for test environments only.
+func InsecureIgnoreHostKey() Option {
+	return func(api *api) {
+		api.ignoreKeys = true
+	}
+}
+
+// Snapshot configures API to serve git modules as if it was the given time, so
+// that historical builds can be reproduced: versions tagged later are not
+// listed and branch tips resolve to the last commit made before that time.
+// Modules that are already cached are still served.
+func Snapshot(t time.Time) Option {
+	return func(api *api) {
+		api.snapshot = t
+	}
+}
+
+// PseudoVersionMaxAge configures API to reuse the pseudo-version resolved for
+// the branch tip of a module without release tags for the given duration
+// before asking the VCS for the branch HEAD again. Cached contents of branches
+// and other named revisions, e.g. "master.zip", expire after the same time if
+// it is set, and are cached for good otherwise. Tagged versions are resolved
+// as usual, and their contents, like those of pseudo-versions, stay cached
+// regardless of the age.
+func PseudoVersionMaxAge(d time.Duration) Option {
+	return func(api *api) {
+		api.pseudoMaxAge = d
+	}
+}
+
+// ModulePseudoVersionMaxAge overrides PseudoVersionMaxAge for the modules with
+// the given prefix, e.g. to re-resolve the branch tips of fast-moving internal
+// modules more often than those of the third-party ones. If several prefixes
+// match, the longest one is used.
+func ModulePseudoVersionMaxAge(prefix string, d time.Duration) Option {
+	return func(api *api) {
+		if api.pseudoMaxAges == nil {
+			api.pseudoMaxAges = map[string]time.Duration{}
+		}
+		api.pseudoMaxAges[prefix] = d
+	}
+}
+
+// httpStatus returns HTTP response status code for the error that happened
+// when handling a request.
+func httpStatus(ctx context.Context, err error) int {
+	if ctx.Err() == context.DeadlineExceeded || errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	}
+	if errors.Is(err, errNoGoMod) {
+		return http.StatusGone
+	}
+	switch vcs.Classify(err) {
+	case vcs.NotFound:
+		return http.StatusGone
+	case vcs.Unauthorized:
+		return http.StatusUnauthorized
+	case vcs.Unavailable:
+		return http.StatusServiceUnavailable
+	case vcs.Forbidden:
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// query returns true if the version is one of the version queries understood
+// by the go tool, such as "none", "latest", "upgrade", "patch" or comparisons
+// like "<v1.2.0", rather than a version that can be fetched. The go tool never
+// asks the proxy to resolve them via @v/ requests, so such requests are
+// answered with 410 letting the client handle them. Only comparisons are
+// resolved by .info requests, for other tools.
+func query(version string) bool {
+	switch version {
+	case "", "none", "latest", "upgrade", "patch":
+		return true
+	}
+	return strings.HasPrefix(version, "<") || strings.HasPrefix(version, ">")
+}
+
+// checkPath returns an error if the decoded request path contains characters
+// that never occur in module paths and versions, such as a query or a fragment
+// that came percent-encoded, or control characters, or if it has empty, "." or
+// ".." elements. Those must never reach cache keys or VCS URLs.
+func checkPath(p string) error {
+	for _, r := range p {
+		if r == '?' || r == '#' || r == '\\' || r > unicode.MaxASCII || unicode.IsControl(r) || unicode.IsSpace(r) {
+			return fmt.Errorf("bad character %q in path %q", r, p)
+		}
+	}
+	elems := strings.Split(p, "/")
+	for i, elem := range elems {
+		if (elem == "" && i > 0 && i < len(elems)-1) || elem == "." || elem == ".." {
+			return fmt.Errorf("bad path %q", p)
 		}
-		buf = append(buf, r)
 	}
-	return string(buf)
+	return nil
 }
 
 func (api *api) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	now := time.Now()
-	defer func() { api.log("api.ServeHTTP", "method", r.Method, "url", r.URL, "time", time.Since(now)) }()
-
-	for _, route := range []struct {
-		id      string
-		regexp  *regexp.Regexp
-		handler func(w http.ResponseWriter, r *http.Request, module, version string)
-	}{
-		{"list", apiList, api.list},
-		{"info", apiInfo, api.info},
-		{"api", apiMod, api.mod},
-		{"zip", apiZip, api.zip},
-	} {
+	defer func() { api.accessLog("api.ServeHTTP", "method", r.Method, "url", r.URL, "time", time.Since(now)) }()
+
+	if (r.Method == http.MethodGet || r.Method == http.MethodHead) && r.ContentLength != 0 {
+		http.Error(w, "unexpected request body", http.StatusBadRequest)
+		return
+	}
+	if r.ContentLength > api.maxBody {
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, api.maxBody)
+
+	if api.admin != nil && (strings.HasPrefix(r.URL.Path, "/admin/") || strings.HasPrefix(r.URL.Path, "/debug/")) {
+		api.serveAdmin(w, r)
+		return
+	}
+	if api.index != nil && api.admin != nil && r.URL.Path == "/index" {
+		if !api.admin.authorized(r) {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		api.serveIndex(w, r)
+		return
+	}
+	if api.landing != nil && r.URL.Path == "/" {
+		api.serveLanding(w, r)
+		return
+	}
+
+	if api.maxDeadline > 0 {
+		if s := r.Header.Get(deadlineHeader); s != "" {
+			sec, err := strconv.ParseFloat(s, 64)
+			if err != nil || math.IsNaN(sec) || math.IsInf(sec, 0) || sec <= 0 {
+				http.Error(w, "bad "+deadlineHeader+" header", http.StatusBadRequest)
+				return
+			}
+			// compared in seconds, as huge values overflow the duration
+			d := api.maxDeadline
+			if sec < d.Seconds() {
+				d = time.Duration(sec * float64(time.Second))
+			}
+			ctx, cancel := context.WithTimeout(r.Context(), d)
+			defer cancel()
+			r = r.WithContext(ctx)
+		}
+	}
+
+	r = api.withBypass(r)
+
+	if err := checkPath(r.URL.Path); err != nil {
+		httpRequests.Add("bad_request", 1)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if api.goImport != "" && r.URL.Query().Get("go-get") == "1" {
+		httpRequests.Add("go_import", 1)
+		api.serveGoImport(w, r)
+		return
+	}
+	for _, route := range api.routes {
 		if m := route.regexp.FindStringSubmatch(r.URL.Path); m != nil {
 			module, version := m[1], ""
 			if len(m) > 2 {
 				version = m[2]
 			}
-			module = decodeBangs(module)
+			if _, _, ok := comparison(version); len(m) > 2 && query(version) && !(ok && route.id == "info") {
+				http.Error(w, "not a module version: "+version, http.StatusGone)
+				return
+			}
+			module = vcs.DecodeBangs(module)
 			if r.Method == http.MethodDelete && version != "" {
 				api.delete(w, r, module, version)
 				return
 			}
 			httpRequests.Add(route.id, 1)
-			defer func() {
-				v := &expvar.Float{}
-				v.Set(time.Since(now).Seconds())
-				httpRequestDurations.Set(route.id, v)
-			}()
-			route.handler(w, r, module, version)
+			if err := api.hosts.Check(strings.SplitN(module, "/", 2)[0]); err != nil {
+				api.log("api.ServeHTTP", "module", module, "error", err)
+				httpErrors.Add(module, 1)
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+			ow := &originWriter{ResponseWriter: w, module: module}
+			s := served{}
+			ctx := withServed(vcs.WithOrigin(r.Context(), &ow.origin), &s)
+			route.handler(ow, r.WithContext(ctx), module, version)
+			route.duration.Observe(time.Since(now).Seconds())
+			if api.audit != nil {
+				api.auditServe(r, module, s, ow.code)
+			}
 			return
 		}
 	}
 
 	httpRequests.Add("not_found", 1)
-	http.NotFound(w, r)
+	api.notFoundError(w, r)
+}
+
+// notFoundError answers the request with 404 and the configured message, if
+// any.
+func (api *api) notFoundError(w http.ResponseWriter, r *http.Request) {
+	if api.notFound == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(struct{ Error string }{api.notFound})
+		return
+	}
+	http.Error(w, api.notFound, http.StatusNotFound)
 }
 
 func (api *api) vcs(ctx context.Context, module string) vcs.VCS {
-	for _, path := range api.vcsPaths {
-		if strings.HasPrefix(module, path.prefix) {
-			return path.vcs(module)
-		}
+	if path, ok := api.match(module); ok {
+		return path.vcs(module)
 	}
 	return vcs.NewGoMod(api.log, module)
 }
 
+// match returns the first configured VCS path matching the module. If more
+// VCS clients are configured for the same prefix, the path fails over from
+// one to the next in the order they were configured.
+func (api *api) match(module string) (vcsPath, bool) {
+	api.RLock()
+	vcsPaths := api.vcsPaths
+	api.RUnlock()
+	for i, path := range vcsPaths {
+		if !strings.HasPrefix(module, path.prefix) {
+			continue
+		}
+		backends := []func(string) vcs.VCS{path.vcs}
+		for _, other := range vcsPaths[i+1:] {
+			if other.prefix == path.prefix {
+				backends = append(backends, other.vcs)
+			}
+		}
+		if len(backends) > 1 {
+			path.vcs = func(module string) vcs.VCS {
+				clients := []vcs.VCS{}
+				for _, backend := range backends {
+					clients = append(clients, backend(module))
+				}
+				return vcs.Failover(api.log, module, clients...)
+			}
+		}
+		return path, true
+	}
+	return vcsPath{}, false
+}
+
 func (api *api) module(ctx context.Context, module string, version vcs.Version) ([]byte, time.Time, error) {
-	for _, store := range api.stores {
-		if snapshot, err := store.Get(ctx, module, version); err == nil {
-			cacheHits.Add(module, 1)
-			return snapshot.Data, snapshot.Timestamp, nil
+	// Fast path: most requests are cache hits and must not pay for anything
+	// beyond the store lookup.
+	hit := func(snapshot store.Snapshot) ([]byte, time.Time, error) {
+		cacheHits.Add(module, 1)
+		setServed(ctx, version, "cache")
+		if api.recheckRate > 0 && rand.Float64() < api.recheckRate {
+			api.recheck(module, version, snapshot.Hash)
 		}
+		return snapshot.Data, snapshot.Timestamp, nil
 	}
+	// Named revisions, e.g. "master", move like the branch tips do, so they
+	// expire when a max age is set.
+	named := !version.IsValid() && api.tipMaxAge(module) > 0
+	if bypassed(ctx) {
+		cacheBypasses.Add(module, 1)
+		api.log("api.module", "module", module, "version", version, "bypass", true)
+	} else if named && !api.revFresh(module, version) {
+		api.log("api.module", "module", module, "version", version, "expired", true)
+	} else {
+		if api.micro != nil {
+			if snapshot, err := api.micro.Get(ctx, module, version); err == nil {
+				microHits.Add(module, 1)
+				return hit(snapshot)
+			}
+		}
+		for _, store := range api.stores {
+			if snapshot, err := store.Get(ctx, module, version); err == nil {
+				api.remember(ctx, snapshot)
+				return hit(snapshot)
+			}
+		}
+	}
+	b, t, err := api.fetch(ctx, module, version)
+	if err == nil && named {
+		api.revFetched(module, version)
+	}
+	if err == nil && api.prefetch > 0 && version.IsRelease() {
+		api.prefetchSiblings(module, version)
+	}
+	return b, t, err
+}
+
+// revFresh tells if the cached snapshot of the named revision of the module
+// has been fetched less than tipMaxAge ago.
+func (api *api) revFresh(module string, version vcs.Version) bool {
+	api.tipsMu.Lock()
+	defer api.tipsMu.Unlock()
+	expires, ok := api.revs[module+"@"+string(version)]
+	return ok && time.Now().Before(expires)
+}
+
+// revFetched records that the named revision of the module has just been
+// fetched, so that its snapshot is served from the cache until tipMaxAge.
+func (api *api) revFetched(module string, version vcs.Version) {
+	maxAge := api.tipMaxAge(module)
+	api.tipsMu.Lock()
+	defer api.tipsMu.Unlock()
+	if api.revs == nil {
+		api.revs = map[string]time.Time{}
+	}
+	now := time.Now()
+	for key, expires := range api.revs {
+		if now.After(expires) {
+			delete(api.revs, key)
+		}
+	}
+	api.revs[module+"@"+string(version)] = now.Add(maxAge)
+}
+
+// fetch downloads the module from the VCS and puts it into the stores.
+func (api *api) fetch(ctx context.Context, module string, version vcs.Version) ([]byte, time.Time, error) {
 	cacheMisses.Add(module, 1)
 
 	// wait for semaphore
-	api.semc <- struct{}{}
-	defer func() { <-api.semc }()
+	api.RLock()
+	semc := api.semc
+	api.RUnlock()
+	select {
+	case semc <- struct{}{}:
+	case <-ctx.Done():
+		return nil, time.Time{}, ctx.Err()
+	}
+	defer func() { <-semc }()
+
+	b, timestamp, err := api.download(ctx, module, version)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	setServed(ctx, version, "vcs")
+	return b, timestamp, nil
+}
 
-	timestamp, err := api.vcs(ctx, module).Timestamp(ctx, version)
+// download fetches the module from the VCS and puts it into the stores. The
+// caller must hold a VCS worker.
+func (api *api) download(ctx context.Context, module string, version vcs.Version) ([]byte, time.Time, error) {
+	// the commit is kept with the snapshot to tell moved tags later
+	origin := vcs.Origin{}
+	// the same client serves both, so that failovers take the archive from
+	// the source that has returned the timestamp
+	v := api.vcs(ctx, module)
+	timestamp, err := v.Timestamp(vcs.WithOrigin(ctx, &origin), version)
 	if err != nil {
 		return nil, time.Time{}, err
 	}
 
 	b := &bytes.Buffer{}
-	zr, err := api.vcs(ctx, module).Zip(ctx, version)
+	zr, err := v.Zip(ctx, version)
 	if err != nil {
 		return nil, time.Time{}, err
 	}
@@ -214,90 +1047,615 @@ func (api *api) module(ctx context.Context, module string, version vcs.Version)
 	if _, err := io.Copy(b, zr); err != nil {
 		return nil, time.Time{}, err
 	}
+	vcsFetchedBytes.Add(module, int64(b.Len()))
+	if err := checkZip(b.Bytes()); err != nil {
+		return nil, time.Time{}, err
+	}
+	if err := api.verify(module, version, b.Bytes()); err != nil {
+		return nil, time.Time{}, err
+	}
+	if api.requireMod && goMod(b.Bytes(), module, version) == nil {
+		return nil, time.Time{}, fmt.Errorf("%s@%s: %w", module, version, errNoGoMod)
+	}
 
-	for i := len(api.stores) - 1; i >= 0; i-- {
-		err := api.stores[i].Put(ctx, store.Snapshot{
-			Module:    module,
-			Version:   version,
-			Timestamp: timestamp,
-			Data:      b.Bytes(),
-		})
-		if err != nil {
+	// The first store, normally the in-memory one, is written right away so
+	// that the following requests hit it. The slower stores are written in the
+	// background to not delay the response.
+	snapshot := store.Snapshot{Module: module, Version: version, Timestamp: timestamp, Data: b.Bytes(), Hash: origin.Hash}
+	if bypassed(ctx) {
+		api.replace(ctx, module, version)
+	}
+	api.remember(ctx, snapshot)
+	if len(api.stores) > 0 {
+		if err := api.stores[0].Put(ctx, snapshot); err != nil {
 			api.log("api.module.Put", "module", module, "version", version, "error", err)
 		}
 	}
+	if len(api.stores) > 1 {
+		select {
+		case api.putc <- struct{}{}:
+			api.puts.Add(1)
+			go api.put(api.stores[1:], snapshot)
+		case <-ctx.Done():
+			api.log("api.module.Put", "module", module, "version", version, "error", ctx.Err())
+		}
+	}
+
+	if api.index != nil {
+		if err := api.index.add(module, version); err != nil {
+			api.log("api.index", "module", module, "version", version, "error", err)
+		}
+	}
 
+	api.pruneGitDir()
 	return b.Bytes(), timestamp, nil
 }
 
+// prefetchSiblings downloads the release versions closest to the given one
+// that are not cached yet in the background, one at a time, as long as there
+// are idle VCS workers.
+func (api *api) prefetchSiblings(module string, version vcs.Version) {
+	api.RLock()
+	semc := api.semc
+	api.RUnlock()
+	acquire := func() bool {
+		select {
+		case semc <- struct{}{}:
+			return true
+		default:
+			return false
+		}
+	}
+	api.prefetches.Add(1)
+	go func() {
+		defer api.prefetches.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), prefetchTimeout)
+		defer cancel()
+		if !acquire() {
+			return
+		}
+		list, err := api.vcs(ctx, module).List(ctx)
+		<-semc
+		if err != nil {
+			api.log("api.prefetch", "module", module, "error", err)
+			return
+		}
+		for _, v := range siblings(list, version, api.prefetch) {
+			if api.cached(ctx, module, v) {
+				continue
+			}
+			if ctx.Err() != nil || !acquire() {
+				return
+			}
+			_, _, err := api.download(ctx, module, v)
+			<-semc
+			if err != nil {
+				api.log("api.prefetch", "module", module, "version", v, "error", err)
+				continue
+			}
+			api.log("api.prefetch", "module", module, "version", v)
+		}
+	}()
+}
+
+// siblings returns up to n release versions from the list, other than the
+// given one, ordered by how close they are to it.
+func siblings(list []vcs.Version, version vcs.Version, n int) []vcs.Version {
+	releases := []vcs.Version{version}
+	for _, v := range list {
+		if v.IsRelease() && v != version {
+			releases = append(releases, v)
+		}
+	}
+	sort.Slice(releases, func(i, j int) bool { return releases[i].Compare(releases[j]) < 0 })
+	i := sort.Search(len(releases), func(i int) bool { return releases[i].Compare(version) >= 0 })
+	result := []vcs.Version{}
+	for lo, hi := i-1, i+1; len(result) < n && (lo >= 0 || hi < len(releases)); {
+		if lo >= 0 {
+			result = append(result, releases[lo])
+			lo--
+		}
+		if hi < len(releases) && len(result) < n {
+			result = append(result, releases[hi])
+			hi++
+		}
+	}
+	return result
+}
+
+// cached returns true if any of the stores has the module version.
+func (api *api) cached(ctx context.Context, module string, version vcs.Version) bool {
+	for _, store := range api.stores {
+		if _, err := store.Get(ctx, module, version); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// recheck resolves the release version of a cached module again in the
+// background and reports if its commit differs from the cached one, which means
+// the tag has been moved to another commit. Checks are skipped while all VCS
+// workers are busy, and for modules cached without the commit hash.
+func (api *api) recheck(module string, version vcs.Version, cached string) {
+	if version.Hash() != "" || cached == "" {
+		return
+	}
+	api.RLock()
+	semc := api.semc
+	api.RUnlock()
+	select {
+	case semc <- struct{}{}:
+	default:
+		return
+	}
+	api.checks.Add(1)
+	go func() {
+		defer func() {
+			<-semc
+			api.checks.Done()
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), recheckTimeout)
+		defer cancel()
+		origin := vcs.Origin{}
+		if _, err := api.vcs(ctx, module).Timestamp(vcs.WithOrigin(ctx, &origin), version); err != nil {
+			api.log("api.recheck", "module", module, "version", version, "error", err)
+		} else if origin.Hash != "" && origin.Hash != cached {
+			retagged.Add(module, 1)
+			api.log("api.recheck", "module", module, "version", version, "cached", cached, "current", origin.Hash, "error", errRetagged)
+		}
+	}()
+}
+
+// pruneGitDir trims the git directory to its size limit in the background,
+// unless it is being trimmed already.
+func (api *api) pruneGitDir() {
+	if api.gitLimit <= 0 || api.gitdir == "" {
+		return
+	}
+	select {
+	case api.prunec <- struct{}{}:
+	default:
+		return
+	}
+	go func() {
+		defer func() { <-api.prunec }()
+		removed, err := vcs.PruneGitDir(api.gitdir, api.gitLimit)
+		if err != nil {
+			api.log("api.pruneGitDir", "dir", api.gitdir, "error", err)
+		}
+		for _, dir := range removed {
+			api.log("api.pruneGitDir", "removed", dir)
+		}
+	}()
+}
+
+// put writes the snapshot to the stores concurrently and logs all their
+// errors at once.
+func (api *api) put(stores []store.Store, snapshot store.Snapshot) {
+	defer func() {
+		<-api.putc
+		api.puts.Done()
+	}()
+	errc := make(chan error, len(stores))
+	for _, s := range stores {
+		go func(s store.Store) { errc <- s.Put(context.Background(), snapshot) }(s)
+	}
+	errs := []string{}
+	for range stores {
+		if err := <-errc; err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		err := errors.New(strings.Join(errs, "; "))
+		api.log("api.module.Put", "module", snapshot.Module, "version", snapshot.Version, "error", err)
+	}
+}
+
 func (api *api) list(w http.ResponseWriter, r *http.Request, module, version string) {
 	api.log("api.list", "module", module)
-	list, err := api.vcs(r.Context(), module).List(r.Context())
+	match, err := versionFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	v := api.vcs(r.Context(), module)
+	if s, ok := v.(vcs.Streamer); ok {
+		var timeout <-chan time.Time
+		if api.listTimeout > 0 {
+			timer := time.NewTimer(api.listTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		// the versions are no longer read once the timeout elapses
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		// the remote may be slow to send even the first version
+		type stream struct {
+			versions <-chan vcs.Version
+			err      error
+		}
+		started := make(chan stream, 1)
+		go func() {
+			versions, err := s.ListStream(ctx)
+			started <- stream{versions, err}
+		}()
+		var versions <-chan vcs.Version
+		select {
+		case st := <-started:
+			if st.err != nil {
+				api.log("api.list", "module", module, "error", st.err)
+				httpErrors.Add(module, 1)
+				http.Error(w, st.err.Error(), httpStatus(r.Context(), st.err))
+				return
+			}
+			versions = st.versions
+		case <-timeout:
+			api.log("api.list", "module", module, "partial", true, "versions", 0, "timeout", api.listTimeout)
+			api.cacheControl(w, module, "")
+			// nothing is sent yet, so the mark is a header rather than a trailer
+			w.Header().Set(partialHeader, "true")
+			return
+		}
+		api.cacheControl(w, module, "")
+		bw := bufio.NewWriterSize(flushWriter{w}, listBufferSize)
+		defer bw.Flush()
+		// versions discovered slowly still reach the client in time
+		ticker := time.NewTicker(listFlushInterval)
+		defer ticker.Stop()
+		for n := 0; ; {
+			select {
+			case v, ok := <-versions:
+				if !ok {
+					return
+				}
+				n++
+				if match(v) {
+					fmt.Fprintln(bw, string(v))
+				}
+			case <-ticker.C:
+				bw.Flush()
+			case <-timeout:
+				api.log("api.list", "module", module, "partial", true, "versions", n, "timeout", api.listTimeout)
+				bw.Flush()
+				w.Header().Set(http.TrailerPrefix+partialHeader, "true")
+				return
+			}
+		}
+	}
+
+	list, err := v.List(r.Context())
 	if err != nil {
 		api.log("api.list", "module", module, "error", err)
 		httpErrors.Add(module, 1)
-		http.Error(w, err.Error(), http.StatusNotFound)
+		http.Error(w, err.Error(), httpStatus(r.Context(), err))
 		return
 	}
 
+	api.cacheControl(w, module, "")
+	bw := bufio.NewWriterSize(flushWriter{w}, listBufferSize)
+	defer bw.Flush()
 	for _, v := range list {
-		fmt.Fprintln(w, string(v))
+		if match(v) {
+			fmt.Fprintln(bw, string(v))
+		}
 	}
 }
 
-func (api *api) info(w http.ResponseWriter, r *http.Request, module, version string) {
-	api.log("api.info", "module", module, "version", version)
-	_, t, err := api.module(r.Context(), module, vcs.Version(version))
+// versionFilter returns a function that tells if a version should be listed
+// according to the optional "prefix" and "match" (glob pattern) query
+// parameters. The go command sends neither, they are meant for other tools.
+func versionFilter(r *http.Request) (func(vcs.Version) bool, error) {
+	prefix, pattern := r.URL.Query().Get("prefix"), r.URL.Query().Get("match")
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("bad match pattern: %w", err)
+	}
+	return func(v vcs.Version) bool {
+		if !strings.HasPrefix(string(v), prefix) {
+			return false
+		}
+		ok, _ := path.Match(pattern, string(v))
+		return pattern == "" || ok
+	}, nil
+}
 
+func (api *api) info(w http.ResponseWriter, r *http.Request, module, query string) {
+	api.log("api.info", "module", module, "version", query)
+	version := vcs.Version(query)
+	var t time.Time
+	var err error
+	if op, target, ok := comparison(query); ok {
+		version, err = api.resolveComparison(r.Context(), module, op, target)
+	} else if !version.IsValid() {
+		version, err = api.resolve(r.Context(), module, query)
+	}
+	if err == nil {
+		_, t, err = api.module(r.Context(), module, version)
+	}
 	if err != nil {
-		api.log("api.info", "module", module, "version", version, "error", err)
+		api.log("api.info", "module", module, "version", query, "error", err)
 		httpErrors.Add(module, 1)
-		http.Error(w, err.Error(), http.StatusNotFound)
+		http.Error(w, err.Error(), httpStatus(r.Context(), err))
 		return
 	}
 
+	// the query is passed, so that resolved comparisons are not cached
+	api.cacheControl(w, module, query)
 	json.NewEncoder(w).Encode(struct {
 		Version string
 		Time    time.Time
-	}{version, t})
+	}{string(version), t})
 }
 
 func (api *api) mod(w http.ResponseWriter, r *http.Request, module, version string) {
 	api.log("api.mod", "module", module, "version", version)
 	b, _, err := api.module(r.Context(), module, vcs.Version(version))
-	if err == nil {
-		if zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b))); err == nil {
-			for _, f := range zr.File {
-				if f.Name == filepath.Join(module+"@"+string(version), "go.mod") {
-					if r, err := f.Open(); err == nil {
-						defer r.Close()
-						io.Copy(w, r)
-						return
-					}
-				}
-			}
+	if err != nil {
+		api.log("api.mod", "module", module, "version", version, "error", err)
+		httpErrors.Add(module, 1)
+		http.Error(w, err.Error(), httpStatus(r.Context(), err))
+		return
+	}
+	api.cacheControl(w, module, version)
+
+	// go.mod is copied verbatim, since any change to it (e.g. dropping the
+	// toolchain directive) would break its checksum.
+	if f := goMod(b, module, vcs.Version(version)); f != nil {
+		if r, err := f.Open(); err == nil {
+			defer r.Close()
+			io.Copy(w, r)
+			return
+		}
+	}
+	fmt.Fprintf(w, "module %s\n", module)
+	if api.goVersion != "" {
+		fmt.Fprintf(w, "\ngo %s\n", api.goVersion)
+	}
+}
+
+// goMod returns the go.mod file in the root of the module archive, or nil if
+// there is none.
+func goMod(b []byte, module string, version vcs.Version) *zip.File {
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		return nil
+	}
+	for _, f := range zr.File {
+		if f.Name == path.Join(module+"@"+string(version), "go.mod") {
+			return f
 		}
 	}
-	w.Write([]byte(fmt.Sprintf("module %s\n", module)))
+	return nil
 }
 
 func (api *api) zip(w http.ResponseWriter, r *http.Request, module, version string) {
 	api.log("api.zip", "module", module, "version", version)
-	b, _, err := api.module(r.Context(), module, vcs.Version(version))
+	ctx := r.Context()
+	b, _, err := api.module(ctx, module, vcs.Version(version))
+	if err == nil && checkZip(b) != nil {
+		// Cached archive is corrupted, e.g. a partially written file, so drop it
+		// and download the module again.
+		api.log("api.zip", "module", module, "version", version, "error", checkZip(b))
+		api.forget(ctx, module, vcs.Version(version))
+		for _, store := range api.stores {
+			store.Del(ctx, module, vcs.Version(version))
+		}
+		b, _, err = api.fetch(ctx, module, vcs.Version(version))
+	}
 	if err != nil {
 		api.log("api.zip", "module", module, "version", version, "error", err)
 		httpErrors.Add(module, 1)
-		http.Error(w, err.Error(), http.StatusNotFound)
+		http.Error(w, err.Error(), httpStatus(ctx, err))
+		return
+	}
+	// The whole archive is in memory and known to be valid, so the response is
+	// written at once with the exact length. If the client disconnects midway
+	// it sees a short body rather than a complete-looking truncated archive.
+	api.cacheControl(w, module, version)
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	n, err := w.Write(b)
+	zipServedBytes.Add(module, int64(n))
+	if err != nil {
+		api.log("api.zip", "module", module, "version", version, "error", err)
+	}
+}
+
+// cacheControl sets Cache-Control header of a successful response. Release
+// versions are immutable and can be cached for long, unlike lists, branch
+// names and pseudo-versions, or modules pinned to a commit.
+func (api *api) cacheControl(w http.ResponseWriter, module, version string) {
+	v := vcs.Version(version)
+	api.RLock()
+	_, pinned := api.pins[module]
+	api.RUnlock()
+	if pinned || !strings.HasPrefix(version, "v") || v.Hash() != "" {
+		w.Header().Set("Cache-Control", "no-cache")
+		return
+	}
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d, immutable", int64(api.maxAge.Seconds())))
+}
+
+// checkZip returns an error if the data is not a complete ZIP archive.
+func checkZip(b []byte) error {
+	if _, err := zip.NewReader(bytes.NewReader(b), int64(len(b))); err != nil {
+		return fmt.Errorf("bad module archive: %w", err)
+	}
+	return nil
+}
+
+func (api *api) latest(w http.ResponseWriter, r *http.Request, module, _ string) {
+	api.log("api.latest", "module", module)
+	ctx := r.Context()
+	version, err := api.resolveLatest(ctx, module)
+	var t time.Time
+	if err == nil {
+		_, t, err = api.module(ctx, module, version)
+	}
+	if err != nil {
+		api.log("api.latest", "module", module, "error", err)
+		httpErrors.Add(module, 1)
+		http.Error(w, err.Error(), httpStatus(ctx, err))
 		return
 	}
-	io.Copy(w, bytes.NewReader(b))
+
+	api.cacheControl(w, module, "")
+	json.NewEncoder(w).Encode(struct {
+		Version string
+		Time    time.Time
+	}{string(version), t})
+}
+
+// resolveLatest returns the highest release version of the module, or the
+// highest pre-release if there are no releases, or the pseudo-version of its
+// branch tip if there are no tags at all.
+func (api *api) resolveLatest(ctx context.Context, module string) (vcs.Version, error) {
+	api.tipsMu.Lock()
+	cached, ok := api.tips[module]
+	api.tipsMu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.version, nil
+	}
+
+	list, err := api.vcs(ctx, module).List(ctx)
+	if err != nil {
+		return "", err
+	}
+	if len(list) == 0 {
+		// reported as not found, so that the go tool falls back to the next proxy
+		return "", fmt.Errorf("no versions found: %w", os.ErrNotExist)
+	}
+	// Like the go command, prefer releases over pre-releases unless told
+	// otherwise.
+	latest, stable := vcs.Version(""), vcs.Version("")
+	for _, v := range list {
+		if latest == "" || v.Compare(latest) > 0 {
+			latest = v
+		}
+		if v.IsRelease() && (stable == "" || v.Compare(stable) > 0) {
+			stable = v
+		}
+	}
+	if stable != "" && !api.latestPrerelease {
+		latest = stable
+	}
+
+	if maxAge := api.tipMaxAge(module); latest.Hash() != "" && maxAge > 0 {
+		if cached.version != "" && cached.version != latest {
+			api.log("api.latest", "module", module, "old", cached.version, "new", latest)
+		}
+		api.tipsMu.Lock()
+		if api.tips == nil {
+			api.tips = map[string]tip{}
+		}
+		api.tips[module] = tip{version: latest, expires: time.Now().Add(maxAge)}
+		api.tipsMu.Unlock()
+	}
+	return latest, nil
+}
+
+// comparison splits a version comparison query, such as ">=v1.2.0", into the
+// operator and the version.
+func comparison(query string) (op string, version vcs.Version, ok bool) {
+	for _, op := range []string{"<=", ">=", "<", ">"} {
+		if strings.HasPrefix(query, op) {
+			version = vcs.Version(strings.TrimPrefix(query, op))
+			return op, version, version.IsValid()
+		}
+	}
+	return "", "", false
+}
+
+// resolve returns the module version of the branch, tag or commit hash, if
+// the VCS client can tell it, so that the go tool gets the canonical version
+// it expects, e.g. a pseudo-version for "@master". Resolving fetches the
+// repository and takes a VCS worker.
+func (api *api) resolve(ctx context.Context, module string, rev string) (vcs.Version, error) {
+	resolver, ok := api.vcs(ctx, module).(vcs.Resolver)
+	if !ok {
+		return vcs.Version(rev), nil
+	}
+	api.RLock()
+	semc := api.semc
+	api.RUnlock()
+	select {
+	case semc <- struct{}{}:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+	defer func() { <-semc }()
+	return resolver.Resolve(ctx, rev)
 }
 
+// resolveComparison returns the module version closest to the target one that
+// satisfies the comparison, like the go tool does: the lowest one for ">" and
+// ">=", the highest one for "<" and "<=". Releases are preferred over
+// pre-releases.
+func (api *api) resolveComparison(ctx context.Context, module string, op string, target vcs.Version) (vcs.Version, error) {
+	list, err := api.vcs(ctx, module).List(ctx)
+	if err != nil {
+		return "", err
+	}
+	closest := func(releases bool) vcs.Version {
+		best := vcs.Version("")
+		for _, v := range list {
+			if !v.IsValid() || releases && !v.IsRelease() {
+				continue
+			}
+			c := v.Compare(target)
+			switch op {
+			case ">=", ">":
+				if (c > 0 || c == 0 && op == ">=") && (best == "" || v.Compare(best) < 0) {
+					best = v
+				}
+			case "<=", "<":
+				if (c < 0 || c == 0 && op == "<=") && (best == "" || v.Compare(best) > 0) {
+					best = v
+				}
+			}
+		}
+		return best
+	}
+	if v := closest(true); v != "" {
+		return v, nil
+	}
+	if v := closest(false); v != "" {
+		return v, nil
+	}
+	// reported as not found, so that the go tool falls back to the next proxy
+	return "", fmt.Errorf("no version matching %s%s: %w", op, target, os.ErrNotExist)
+}
+
+// tipMaxAge returns how long the pseudo-version resolved for the branch tip of
+// the module may be reused.
+func (api *api) tipMaxAge(module string) time.Duration {
+	maxAge, n := api.pseudoMaxAge, -1
+	for prefix, d := range api.pseudoMaxAges {
+		if strings.HasPrefix(module, prefix) && len(prefix) > n {
+			maxAge, n = d, len(prefix)
+		}
+	}
+	return maxAge
+}
+
+// delete drops the module version from all the stores. A failing or missing
+// store does not keep the snapshot in the others, errors are only reported
+// once every store has been tried.
 func (api *api) delete(w http.ResponseWriter, r *http.Request, module, version string) {
+	api.forget(r.Context(), module, vcs.Version(version))
+	deleted, errs := false, []string{}
 	for _, store := range api.stores {
-		if err := store.Del(r.Context(), module, vcs.Version(version)); err != nil {
-			http.Error(w, err.Error(), http.StatusNotFound)
-			return
+		err := store.Del(r.Context(), module, vcs.Version(version))
+		if err == nil {
+			deleted = true
+		} else if !errors.Is(err, os.ErrNotExist) {
+			api.log("api.delete", "module", module, "version", version, "error", err)
+			errs = append(errs, err.Error())
 		}
 	}
+	if len(errs) > 0 {
+		http.Error(w, strings.Join(errs, "; "), http.StatusInternalServerError)
+	} else if !deleted {
+		http.Error(w, module+"@"+version+": not cached", http.StatusNotFound)
+	}
 }
@@ -1,15 +1,118 @@
 package api
 
 import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/sixt/gomodproxy/pkg/store"
+	"github.com/sixt/gomodproxy/pkg/vcs"
+	"golang.org/x/mod/modfile"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
 )
 
+// fakeVCS is a VCS client that serves modules from memory.
+type fakeVCS struct {
+	versions []vcs.Version
+	files    map[string]string
+	time     time.Time
+	hash     string // commit recorded in the origin, if set
+	delay    time.Duration
+	err      error
+	truncate int   // if set, zip stream is cut after the given number of bytes
+	readErr  error // error returned after the truncated zip stream
+}
+
+func (f *fakeVCS) List(ctx context.Context) ([]vcs.Version, error) { return f.versions, f.err }
+
+func (f *fakeVCS) Timestamp(ctx context.Context, version vcs.Version) (time.Time, error) {
+	if err := f.wait(ctx); err != nil {
+		return time.Time{}, err
+	}
+	if f.hash != "" {
+		vcs.RecordCommit(ctx, f.hash)
+	}
+	return f.time, f.err
+}
+
+func (f *fakeVCS) Zip(ctx context.Context, version vcs.Version) (io.ReadCloser, error) {
+	defer vcs.Span(ctx, "zip")()
+	if err := f.wait(ctx); err != nil {
+		return nil, err
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+	b := f.zip(version)
+	if f.truncate > 0 {
+		return ioutil.NopCloser(io.MultiReader(bytes.NewReader(b[:f.truncate]), errReader{f.readErr})), nil
+	}
+	return ioutil.NopCloser(bytes.NewReader(b)), nil
+}
+
+// errReader is a reader that fails with the given error, or returns EOF.
+type errReader struct{ err error }
+
+func (r errReader) Read(b []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	return 0, io.EOF
+}
+
+// wait simulates a slow fetch from the VCS.
+func (f *fakeVCS) wait(ctx context.Context) error {
+	select {
+	case <-time.After(f.delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (f *fakeVCS) zip(version vcs.Version) []byte {
+	b := &bytes.Buffer{}
+	zw := zip.NewWriter(b)
+	for name, content := range f.files {
+		w, _ := zw.Create("example.com/foo@" + string(version) + "/" + name)
+		w.Write([]byte(content))
+	}
+	zw.Close()
+	return b.Bytes()
+}
+
+// withVCS configures API to use the given VCS client for the module prefix.
+func withVCS(prefix string, v vcs.VCS) Option {
+	return func(api *api) {
+		api.vcsPaths = append(api.vcsPaths, vcsPath{
+			prefix: prefix,
+			vcs:    func(module string) vcs.VCS { return v },
+		})
+	}
+}
+
 const testGoSource = `
 package main
 
@@ -75,3 +178,2036 @@ func TestBuildWithProxy(t *testing.T) {
 		t.Fatal(string(out), err)
 	}
 }
+
+func TestZipContentLength(t *testing.T) {
+	fake := &fakeVCS{files: map[string]string{"go.mod": "module example.com/foo\n", "foo.go": "package foo\n"}}
+	api := New(Log(t.Log), withVCS("example.com/", fake), Memory(t.Log, -1))
+
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/example.com/foo/@v/v1.0.0.zip", nil))
+	if w.Code != http.StatusOK {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	if n := w.Header().Get("Content-Length"); n != strconv.Itoa(w.Body.Len()) || n == "0" {
+		t.Fatal(n, w.Body.Len())
+	}
+}
+
+func TestModVerbatim(t *testing.T) {
+	gomod := "module example.com/foo\n\ngo 1.21\n\ntoolchain go1.21.5\n\nrequire (\n\tgithub.com/pkg/errors v0.9.1 // indirect\n\tgolang.org/x/net v0.17.0\n)\n"
+	fake := &fakeVCS{files: map[string]string{"go.mod": gomod, "foo.go": "package foo\n"}}
+	api := New(Log(t.Log), withVCS("example.com/", fake), Memory(t.Log, -1))
+
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/example.com/foo/@v/v1.0.0.mod", nil))
+	if w.Code != http.StatusOK || w.Body.String() != gomod {
+		t.Fatal(w.Code, w.Body.String())
+	}
+}
+
+func TestRequireGoMod(t *testing.T) {
+	fake := &fakeVCS{files: map[string]string{"foo.go": "package foo\n"}}
+	for _, test := range []struct {
+		Options []Option
+		Status  int
+		Body    string
+	}{
+		{Status: http.StatusOK, Body: "module example.com/foo\n"},
+		{Options: []Option{RequireGoMod()}, Status: http.StatusGone, Body: "module has no go.mod file\n"},
+	} {
+		mem := store.Memory(t.Log, -1)
+		options := append([]Option{Log(t.Log), withVCS("example.com/", fake), func(api *api) { api.stores = append(api.stores, mem) }}, test.Options...)
+		api := New(options...)
+		for _, ext := range []string{".mod", ".zip"} {
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, httptest.NewRequest("GET", "/example.com/foo/@v/v1.0.0"+ext, nil))
+			if w.Code != test.Status {
+				t.Fatal(ext, w.Code, w.Body.String())
+			}
+			if ext == ".mod" && !strings.HasSuffix(w.Body.String(), test.Body) {
+				t.Fatal(w.Body.String())
+			}
+		}
+		_, err := mem.Get(context.Background(), "example.com/foo", "v1.0.0")
+		if cached := err == nil; cached != (test.Status == http.StatusOK) {
+			t.Fatal(cached)
+		}
+	}
+}
+
+func TestSyntheticGoVersion(t *testing.T) {
+	fake := &fakeVCS{files: map[string]string{"foo.go": "package foo\n"}}
+	for _, test := range []struct {
+		Options []Option
+		Go      string
+	}{
+		{},
+		{Options: []Option{SyntheticGoVersion("1.16")}, Go: "1.16"},
+	} {
+		api := New(append([]Option{Log(t.Log), withVCS("example.com/", fake)}, test.Options...)...)
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("GET", "/example.com/foo/@v/v1.0.0.mod", nil))
+		if w.Code != http.StatusOK {
+			t.Fatal(w.Code, w.Body.String())
+		}
+		f, err := modfile.Parse("go.mod", w.Body.Bytes(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Module.Mod.Path != "example.com/foo" {
+			t.Fatal(f.Module.Mod.Path)
+		}
+		if test.Go == "" && f.Go != nil {
+			t.Fatal(f.Go.Version)
+		} else if test.Go != "" && (f.Go == nil || f.Go.Version != test.Go) {
+			t.Fatal(w.Body.String())
+		}
+	}
+}
+
+func TestZipPartial(t *testing.T) {
+	files := map[string]string{"go.mod": "module example.com/foo\n", "foo.go": "package foo\n"}
+	for _, test := range []struct {
+		Name string
+		VCS  *fakeVCS
+	}{
+		{Name: "error", VCS: &fakeVCS{files: files, truncate: 64, readErr: errors.New("connection reset")}},
+		{Name: "eof", VCS: &fakeVCS{files: files, truncate: 64}},
+	} {
+		mem := store.Memory(t.Log, -1)
+		api := New(Log(t.Log), withVCS("example.com/", test.VCS), func(api *api) { api.stores = append(api.stores, mem) })
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("GET", "/example.com/foo/@v/v1.0.0.zip", nil))
+		if w.Code == http.StatusOK {
+			t.Fatal(test.Name, w.Code, w.Body.Len())
+		}
+		if _, err := mem.Get(context.Background(), "example.com/foo", "v1.0.0"); err == nil {
+			t.Fatal(test.Name, "truncated archive should not be cached")
+		}
+	}
+}
+
+func TestZipCorruptedCache(t *testing.T) {
+	fake := &fakeVCS{files: map[string]string{"go.mod": "module example.com/foo\n"}}
+	mem := store.Memory(t.Log, -1)
+	mem.Put(context.Background(), store.Snapshot{Module: "example.com/foo", Version: "v1.0.0", Data: fake.zip("v1.0.0")[:64]})
+	api := New(Log(t.Log), withVCS("example.com/", fake), func(api *api) { api.stores = append(api.stores, mem) })
+
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/example.com/foo/@v/v1.0.0.zip", nil))
+	if w.Code != http.StatusOK {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	if !bytes.Equal(w.Body.Bytes(), fake.zip("v1.0.0")) {
+		t.Fatal("archive should be downloaded again")
+	}
+}
+
+func TestLatest(t *testing.T) {
+	fake := &fakeVCS{
+		versions: []vcs.Version{"v1.0.0", "v1.10.0", "v1.9.0", "v0.0.0-20180921100000-aaaaaaaaaaaa"},
+		files:    map[string]string{"go.mod": "module example.com/foo\n"},
+	}
+	api := New(Log(t.Log), withVCS("example.com/", fake))
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/example.com/foo/@latest", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"Version":"v1.10.0"`) {
+		t.Fatal(w.Code, w.Body.String())
+	}
+}
+
+func TestLatestPrerelease(t *testing.T) {
+	for _, test := range []struct {
+		Name     string
+		Versions []vcs.Version
+		Default  vcs.Version
+		Pre      vcs.Version
+	}{
+		{Name: "stable", Versions: []vcs.Version{"v1.0.0", "v1.1.0"}, Default: "v1.1.0", Pre: "v1.1.0"},
+		{Name: "mixed", Versions: []vcs.Version{"v1.0.0", "v1.1.0-rc.2", "v1.1.0-rc.1"}, Default: "v1.0.0", Pre: "v1.1.0-rc.2"},
+		{Name: "prerelease", Versions: []vcs.Version{"v1.0.0-beta", "v1.0.0-rc.1"}, Default: "v1.0.0-rc.1", Pre: "v1.0.0-rc.1"},
+		{Name: "numeric", Versions: []vcs.Version{"v1.0.0-alpha.10", "v1.0.0-alpha.9", "v1.0.0-alpha"}, Default: "v1.0.0-alpha.10", Pre: "v1.0.0-alpha.10"},
+	} {
+		fake := &fakeVCS{versions: test.Versions, files: map[string]string{"go.mod": "module example.com/foo\n"}}
+		for _, options := range [][]Option{{}, {LatestPrerelease()}} {
+			want := test.Default
+			if len(options) > 0 {
+				want = test.Pre
+			}
+			api := New(append(options, Log(t.Log), withVCS("example.com/", fake))...)
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, httptest.NewRequest("GET", "/example.com/foo/@latest", nil))
+			if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"Version":"`+string(want)+`"`) {
+				t.Fatal(test.Name, len(options), w.Code, w.Body.String())
+			}
+		}
+	}
+}
+
+// resolvingVCS is a fake VCS client that resolves the given revisions.
+type resolvingVCS struct {
+	*fakeVCS
+	revs map[string]vcs.Version
+}
+
+func (r resolvingVCS) Resolve(ctx context.Context, rev string) (vcs.Version, error) {
+	if v, ok := r.revs[rev]; ok {
+		return v, nil
+	}
+	return "", fmt.Errorf("%s: %w", rev, os.ErrNotExist)
+}
+
+func TestInfoResolve(t *testing.T) {
+	fake := &fakeVCS{files: map[string]string{"go.mod": "module example.com/foo\n"}}
+	pseudo := vcs.Version("v1.2.4-0.20180921100000-aaaaaaaaaaaa")
+	v := resolvingVCS{fakeVCS: fake, revs: map[string]vcs.Version{"master": pseudo, "aaaaaaa": pseudo}}
+	api := New(Log(t.Log), withVCS("example.com/", v))
+	for _, test := range []struct {
+		Path string
+		Code int
+		Want string
+	}{
+		{"/example.com/foo/@v/master.info", http.StatusOK, `"Version":"` + string(pseudo) + `"`},
+		{"/example.com/foo/@v/aaaaaaa.info", http.StatusOK, `"Version":"` + string(pseudo) + `"`},
+		{"/example.com/foo/@v/v1.0.0.info", http.StatusOK, `"Version":"v1.0.0"`},
+		{"/example.com/foo/@v/nosuchbranch.info", http.StatusGone, ""},
+	} {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("GET", test.Path, nil))
+		if w.Code != test.Code || !strings.Contains(w.Body.String(), test.Want) {
+			t.Fatal(test.Path, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestIncompatible(t *testing.T) {
+	fake := &fakeVCS{versions: []vcs.Version{"v1.0.0", "v2.0.0+incompatible"}, files: map[string]string{"foo.go": "package foo\n"}}
+	api := New(Log(t.Log), withVCS("example.com/", fake))
+	for _, test := range []struct {
+		Path string
+		Want string
+	}{
+		{"/example.com/foo/@v/list", "v1.0.0\nv2.0.0+incompatible\n"},
+		{"/example.com/foo/@v/v2.0.0+incompatible.info", `"Version":"v2.0.0+incompatible"`},
+		{"/example.com/foo/@v/v2.0.0+incompatible.mod", "module example.com/foo\n"},
+		{"/example.com/foo/@latest", `"Version":"v2.0.0+incompatible"`},
+	} {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("GET", test.Path, nil))
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), test.Want) {
+			t.Fatal(test.Path, w.Code, w.Body.String())
+		}
+	}
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/example.com/foo/@v/v2.0.0+incompatible.zip", nil))
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if w.Code != http.StatusOK || err != nil || len(zr.File) != 1 || zr.File[0].Name != "example.com/foo@v2.0.0+incompatible/foo.go" {
+		t.Fatal(w.Code, err)
+	}
+}
+
+func TestLatestPseudoVersionMaxAge(t *testing.T) {
+	fake := &fakeVCS{
+		versions: []vcs.Version{"v0.0.0-20180921100000-aaaaaaaaaaaa"},
+		files:    map[string]string{"go.mod": "module example.com/foo\n"},
+	}
+	maxAge := 100 * time.Millisecond
+	api := New(Log(t.Log), withVCS("example.com/", fake), PseudoVersionMaxAge(maxAge))
+	latest := func() string {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("GET", "/example.com/foo/@latest", nil))
+		if w.Code != http.StatusOK {
+			t.Fatal(w.Code, w.Body.String())
+		}
+		return w.Body.String()
+	}
+
+	if s := latest(); !strings.Contains(s, "aaaaaaaaaaaa") {
+		t.Fatal(s)
+	}
+	// Branch tip moves, but the resolved pseudo-version is still reused
+	fake.versions = []vcs.Version{"v0.0.0-20180922100000-bbbbbbbbbbbb"}
+	if s := latest(); !strings.Contains(s, "aaaaaaaaaaaa") {
+		t.Fatal(s)
+	}
+	// Once it expires the new tip is resolved
+	time.Sleep(maxAge)
+	if s := latest(); !strings.Contains(s, "bbbbbbbbbbbb") {
+		t.Fatal(s)
+	}
+}
+
+func TestModulePseudoVersionMaxAge(t *testing.T) {
+	fake := &fakeVCS{
+		versions: []vcs.Version{"v0.0.0-20180921100000-aaaaaaaaaaaa"},
+		files:    map[string]string{"go.mod": "module example.com/foo\n"},
+	}
+	maxAge := 100 * time.Millisecond
+	api := New(Log(t.Log), withVCS("example.com/", fake),
+		PseudoVersionMaxAge(time.Hour),
+		ModulePseudoVersionMaxAge("example.com/internal/", maxAge),
+		ModulePseudoVersionMaxAge("example.com/internal/frozen/", 0))
+	latest := func(module string) string {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("GET", "/"+module+"/@latest", nil))
+		if w.Code != http.StatusOK {
+			t.Fatal(w.Code, w.Body.String())
+		}
+		return w.Body.String()
+	}
+
+	modules := []string{"example.com/external/foo", "example.com/internal/foo", "example.com/internal/frozen/foo"}
+	for _, module := range modules {
+		if s := latest(module); !strings.Contains(s, "aaaaaaaaaaaa") {
+			t.Fatal(module, s)
+		}
+	}
+	// Branch tip moves, only the module with the disabled override sees it
+	fake.versions = []vcs.Version{"v0.0.0-20180922100000-bbbbbbbbbbbb"}
+	for module, hash := range map[string]string{modules[0]: "aaaaaaaaaaaa", modules[1]: "aaaaaaaaaaaa", modules[2]: "bbbbbbbbbbbb"} {
+		if s := latest(module); !strings.Contains(s, hash) {
+			t.Fatal(module, s)
+		}
+	}
+	// Once the short override expires, only its modules see the new tip
+	time.Sleep(maxAge)
+	for module, hash := range map[string]string{modules[0]: "aaaaaaaaaaaa", modules[1]: "bbbbbbbbbbbb"} {
+		if s := latest(module); !strings.Contains(s, hash) {
+			t.Fatal(module, s)
+		}
+	}
+}
+
+func TestNamedRevisionMaxAge(t *testing.T) {
+	fake := &fakeVCS{files: map[string]string{"go.mod": "module example.com/foo\n", "foo.go": "package foo // 1\n"}}
+	maxAge := 100 * time.Millisecond
+	mem := store.Memory(t.Log, -1)
+	api := New(Log(t.Log), withVCS("example.com/", fake), PseudoVersionMaxAge(time.Hour),
+		ModulePseudoVersionMaxAge("example.com/internal/", maxAge), ModulePseudoVersionMaxAge("example.com/tip/", 0),
+		func(api *api) { api.stores = append(api.stores, mem) })
+	zip := func(module, version string) string {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("GET", "/"+module+"/@v/"+version+".zip", nil))
+		if w.Code != http.StatusOK {
+			t.Fatal(w.Code, w.Body.String())
+		}
+		return w.Body.String()
+	}
+
+	modules := []string{"example.com/external/foo", "example.com/internal/foo", "example.com/tip/foo"}
+	for _, module := range modules {
+		for _, version := range []string{"master", "v1.0.0"} {
+			if s := zip(module, version); !strings.Contains(s, "// 1") {
+				t.Fatal(module, version, s)
+			}
+		}
+	}
+	// Branch moves, but the cached branches and tagged versions are served
+	fake.files["foo.go"] = "package foo // 2\n"
+	for _, module := range modules {
+		if s := zip(module, "master"); !strings.Contains(s, "// 1") {
+			t.Fatal(module, s)
+		}
+		if s := zip(module, "v1.0.0"); !strings.Contains(s, "// 1") {
+			t.Fatal(module, s)
+		}
+	}
+	// Once the short max age is over, the branch is fetched again, branches of
+	// modules without a max age stay cached for good
+	time.Sleep(maxAge)
+	for module, want := range map[string]string{modules[0]: "// 1", modules[1]: "// 2", modules[2]: "// 1"} {
+		if s := zip(module, "master"); !strings.Contains(s, want) {
+			t.Fatal(module, s)
+		}
+	}
+}
+
+func TestAllowedHosts(t *testing.T) {
+	fake := &fakeVCS{versions: []vcs.Version{"v1.0.0"}}
+	for _, test := range []struct {
+		Options []Option
+		Module  string
+		Status  int
+	}{
+		{Module: "169.254.169.254/latest/meta-data", Status: http.StatusForbidden},
+		{Module: "127.0.0.1:8080/foo", Status: http.StatusForbidden},
+		{Module: "[::1]/foo", Status: http.StatusForbidden},
+		{Module: "localhost/foo", Status: http.StatusForbidden},
+		{Module: "example.com/foo", Status: http.StatusOK},
+		{Options: []Option{AllowedHosts("github.com")}, Module: "example.com/foo", Status: http.StatusForbidden},
+		{Options: []Option{AllowedHosts("*.example.com")}, Module: "git.example.com/foo", Status: http.StatusOK},
+		{Options: []Option{AllowedHosts("*.example.com")}, Module: "169.254.169.254/foo", Status: http.StatusForbidden},
+		{Options: []Option{AllowedHosts("127.0.0.1:8080")}, Module: "127.0.0.1:8080/foo", Status: http.StatusOK},
+	} {
+		api := New(append([]Option{Log(t.Log), withVCS("", fake)}, test.Options...)...)
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("GET", "/"+test.Module+"/@v/list", nil))
+		if w.Code != test.Status {
+			t.Fatal(test.Module, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestOriginHeaders(t *testing.T) {
+	var host string
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("go-get") != "1" {
+			http.NotFound(w, r)
+			return
+		}
+		// Vanity import path points to a repository with a different path
+		fmt.Fprintf(w, `<html><head><meta name="go-import" content="%s/vanity git https://%s/repos/vanity"></head></html>`, host, host)
+	}))
+	defer ts.Close()
+	host = strings.TrimPrefix(ts.URL, "https://")
+
+	api := New(Log(t.Log), Git(host+"/", ""), AllowedHosts("127.0.0.1"), TLSConfig(&tls.Config{InsecureSkipVerify: true}))
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/"+host+"/vanity/@v/list", nil))
+	if h := w.Header().Get("X-Gomodproxy-Module"); h != host+"/vanity" {
+		t.Fatal(h)
+	}
+	if h := w.Header().Get("X-Gomodproxy-Repo"); h != host+"/repos/vanity" {
+		t.Fatal(h)
+	}
+	if h := w.Header().Get("X-Gomodproxy-VCS"); h != "git" {
+		t.Fatal(h)
+	}
+}
+
+func TestInsecure(t *testing.T) {
+	var host string
+	gitRequests := int32(0)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("go-get") == "1" {
+			fmt.Fprintf(w, `<html><head><meta name="go-import" content="%s/foo git http://%s/repos/foo"></head></html>`, host, host)
+			return
+		}
+		if r.URL.Path == "/repos/foo.git/info/refs" {
+			atomic.AddInt32(&gitRequests, 1)
+		}
+		http.NotFound(w, r)
+	}))
+	defer ts.Close()
+	host = strings.TrimPrefix(ts.URL, "http://")
+
+	for _, insecure := range []bool{false, true} {
+		options := []Option{Log(t.Log), Git(host+"/", ""), AllowedHosts("127.0.0.1")}
+		if insecure {
+			options = append(options, Insecure("example.com", "127.0.0.1:*"))
+		}
+		w := httptest.NewRecorder()
+		New(options...).ServeHTTP(w, httptest.NewRequest("GET", "/"+host+"/foo/@v/list", nil))
+		if w.Code == http.StatusOK {
+			t.Fatal(w.Code, w.Body.String())
+		}
+		// only insecure modules are fetched over plain HTTP
+		if n := atomic.LoadInt32(&gitRequests); (n > 0) != insecure {
+			t.Fatal(insecure, n, w.Body.String())
+		}
+	}
+
+	// the patterns are kept when the git settings are reloaded
+	atomic.StoreInt32(&gitRequests, 0)
+	h := New(Log(t.Log), Git(host+"/", ""), AllowedHosts("127.0.0.1"), Insecure("127.0.0.1:*"),
+		Reload(func() ([]Option, error) { return []Option{Git(host+"/", "")}, nil }))
+	if err := h.(*api).Reload(); err != nil {
+		t.Fatal(err)
+	}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/"+host+"/foo/@v/list", nil))
+	if n := atomic.LoadInt32(&gitRequests); n == 0 {
+		t.Fatal("reloaded git settings should keep fetching insecure modules over plain HTTP")
+	}
+}
+
+func TestGitAuth(t *testing.T) {
+	f, err := ioutil.TempFile(".", "id_rsa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	key := filepath.Base(f.Name())
+
+	for auth, want := range map[string]vcs.Auth{
+		key + ":secret":           vcs.KeyWithPassphrase(key, "secret"),
+		"":                        vcs.NoAuth(),
+		"/path/to/id_rsa":         vcs.Key("/path/to/id_rsa"),
+		"/path/to/id_rsa:secret":  vcs.KeyWithPassphrase("/path/to/id_rsa", "secret"),
+		"./id_rsa:sec:ret":        vcs.KeyWithPassphrase("./id_rsa", "sec:ret"),
+		"username:password":       vcs.Password("username", "password"),
+		"username:pass/word:more": vcs.Password("username", "pass/word:more"),
+	} {
+		if a := gitAuth(auth); a != want {
+			t.Fatal(auth, a, want)
+		}
+	}
+
+	// the command line clients parse it the same way
+	for _, option := range []Option{GitCLI("github.com/", "/path/to/id_rsa:secret"), Hg("github.com/", "/path/to/id_rsa:secret"), SVN("github.com/", "/path/to/id_rsa:secret")} {
+		h := New(option).(*api)
+		if remote, err := h.vcsPaths[0].vcs("github.com/foo/bar").(vcs.Describer).Describe(context.Background()); err != nil || remote.Auth != "key" {
+			t.Fatal(remote, err)
+		}
+	}
+}
+
+func TestVerifySum(t *testing.T) {
+	fake := &fakeVCS{files: map[string]string{"go.mod": "module example.com/foo\n"}}
+	good, err := store.HashZip(fake.zip("v1.0.0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ioutil.TempFile(os.TempDir(), "gomodproxy_gosum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprintf(f, "example.com/foo v1.0.0 %s\n", good)
+	fmt.Fprintf(f, "example.com/foo v1.0.0/go.mod h1:ignored=\n")
+	fmt.Fprintf(f, "example.com/foo v1.1.0 h1:47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=\n")
+	f.Close()
+
+	mismatches := func() int64 {
+		if v, ok := hashMismatches.Get("example.com/foo").(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	before := mismatches()
+
+	for _, test := range []struct {
+		Version string
+		Require bool
+		Status  int
+	}{
+		{Version: "v1.0.0", Status: http.StatusOK},
+		{Version: "v1.1.0", Status: http.StatusInternalServerError},
+		{Version: "v1.2.0", Status: http.StatusOK},
+		{Version: "v1.2.0", Require: true, Status: http.StatusInternalServerError},
+	} {
+		mem := store.Memory(t.Log, -1)
+		options := []Option{Log(t.Log), withVCS("example.com/", fake), VerifySum(f.Name()), func(api *api) { api.stores = append(api.stores, mem) }}
+		if test.Require {
+			options = append(options, RequireSum())
+		}
+		api := New(options...)
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("GET", "/example.com/foo/@v/"+test.Version+".zip", nil))
+		if w.Code != test.Status {
+			t.Fatal(test.Version, w.Code, w.Body.String())
+		}
+		if _, err := mem.Get(context.Background(), "example.com/foo", vcs.Version(test.Version)); (err == nil) != (test.Status == http.StatusOK) {
+			t.Fatal(test.Version, "only verified modules should be cached", err)
+		}
+	}
+	if n := mismatches(); n != before+1 {
+		t.Fatal(n, before)
+	}
+
+	// Unreadable go.sum makes all fetches fail
+	api := New(Log(t.Log), withVCS("example.com/", fake), VerifySum(f.Name()+".missing"))
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/example.com/foo/@v/v1.0.0.zip", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Fatal(w.Code)
+	}
+}
+
+// streamVCS is a VCS client that streams n versions and fails to list them
+// all at once. If resume channel is set, it stops after the first pause
+// versions, closes paused channel and waits until resume channel is closed.
+type streamVCS struct {
+	fakeVCS
+	n      int
+	pause  int
+	paused chan struct{}
+	resume chan struct{}
+	stuck  bool // if set, ListStream blocks until the context is done
+}
+
+func (s *streamVCS) List(ctx context.Context) ([]vcs.Version, error) {
+	return nil, errors.New("slice API should not be used")
+}
+
+func (s *streamVCS) ListStream(ctx context.Context) (<-chan vcs.Version, error) {
+	if s.stuck {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	c := make(chan vcs.Version)
+	go func() {
+		defer close(c)
+		for i := 0; i < s.n; i++ {
+			if i == s.pause && s.resume != nil {
+				close(s.paused)
+				<-s.resume
+			}
+			select {
+			case c <- vcs.Version(fmt.Sprintf("v1.0.%d", i)):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return c, nil
+}
+
+func TestListStream(t *testing.T) {
+	stream := &streamVCS{n: 50000}
+	api := New(Log(t.Log), withVCS("example.com/", stream))
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/example.com/foo/@v/list", nil))
+	if w.Code != http.StatusOK {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	lines := strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n")
+	if len(lines) != stream.n || lines[0] != "v1.0.0" || lines[stream.n-1] != fmt.Sprintf("v1.0.%d", stream.n-1) {
+		t.Fatal(len(lines))
+	}
+}
+
+func TestPartialLists(t *testing.T) {
+	stream := &streamVCS{n: 100, pause: 10, paused: make(chan struct{}), resume: make(chan struct{})}
+	defer close(stream.resume)
+	api := New(Log(t.Log), withVCS("example.com/", stream), PartialLists(100*time.Millisecond))
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/example.com/foo/@v/list", nil))
+	lines := strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n")
+	if w.Code != http.StatusOK || len(lines) != 10 || lines[9] != "v1.0.9" {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	if partial := w.Result().Trailer.Get(partialHeader); partial != "true" {
+		t.Fatal(w.Result().Trailer)
+	}
+
+	// complete lists are not marked
+	stream = &streamVCS{n: 100}
+	api = New(Log(t.Log), withVCS("example.com/", stream), PartialLists(time.Minute))
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/example.com/foo/@v/list", nil))
+	if lines := strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n"); len(lines) != 100 {
+		t.Fatal(len(lines))
+	}
+	if partial := w.Result().Trailer.Get(partialHeader); partial != "" {
+		t.Fatal(w.Result().Trailer)
+	}
+
+	// remotes that send nothing at all are answered with the header
+	stream = &streamVCS{stuck: true}
+	api = New(Log(t.Log), withVCS("example.com/", stream), PartialLists(100*time.Millisecond))
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/example.com/foo/@v/list", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "" || w.Header().Get(partialHeader) != "true" {
+		t.Fatal(w.Code, w.Header(), w.Body.String())
+	}
+}
+
+// flushRecorder is a response recorder that reports flushes and remembers the
+// largest write.
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushed  chan struct{}
+	maxWrite int
+}
+
+func (w *flushRecorder) Write(b []byte) (int, error) {
+	if len(b) > w.maxWrite {
+		w.maxWrite = len(b)
+	}
+	return w.ResponseRecorder.Write(b)
+}
+
+func (w *flushRecorder) Flush() {
+	w.ResponseRecorder.Flush()
+	select {
+	case w.flushed <- struct{}{}:
+	default:
+	}
+}
+
+func TestListProgressive(t *testing.T) {
+	stream := &streamVCS{n: 200000, pause: 1000, paused: make(chan struct{}), resume: make(chan struct{})}
+	api := New(Log(t.Log), withVCS("example.com/", stream))
+	w := &flushRecorder{ResponseRecorder: httptest.NewRecorder(), flushed: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		api.ServeHTTP(w, httptest.NewRequest("GET", "/example.com/foo/@v/list", nil))
+	}()
+
+	// Versions discovered so far are sent while the listing is stalled
+	<-stream.paused
+	select {
+	case <-w.flushed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no versions sent before the listing is complete")
+	}
+	if lines := strings.Count(w.Body.String(), "\n"); lines != stream.pause {
+		t.Fatal(lines)
+	}
+	close(stream.resume)
+	<-done
+
+	// The rest is sent in chunks rather than as a whole
+	if lines := strings.Count(w.Body.String(), "\n"); lines != stream.n {
+		t.Fatal(lines)
+	}
+	if w.maxWrite > listBufferSize || w.Body.Len() < 10*listBufferSize {
+		t.Fatal(w.maxWrite, w.Body.Len())
+	}
+}
+
+func TestDebugAuth(t *testing.T) {
+	logs := &bytes.Buffer{}
+	logger := func(v ...interface{}) { fmt.Fprintln(logs, v...) }
+	api := New(Log(logger), Admin("secret"),
+		Git("github.com/mycompany/", "deploy:s3cr3tpassw0rd"),
+		Git("bitbucket.org/mycompany/", "/keys/s3cr3t_id_rsa"),
+		CustomVCS("example.com/", "TOKEN=s3cr3ttoken fetch.sh"))
+
+	auth := func(module string) (int, string) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/debug/auth?module="+module, nil)
+		r.Header.Set("Authorization", "Bearer secret")
+		api.ServeHTTP(w, r)
+		return w.Code, w.Body.String()
+	}
+
+	for _, test := range []struct {
+		Module string
+		Want   []string
+	}{
+		{Module: "github.com/mycompany/repo/sub", Want: []string{`"Prefix":"github.com/mycompany/"`, `"Auth":"password"`, `"Repo":"github.com/mycompany/repo"`, `"URL":"https://github.com/mycompany/repo.git"`}},
+		{Module: "bitbucket.org/mycompany/repo", Want: []string{`"Auth":"key"`, `"URL":"ssh://bitbucket.org/mycompany/repo.git"`}},
+		{Module: "example.com/foo", Want: []string{`"VCS":"cmd"`, `"Auth":"none"`}},
+		{Module: "github.com/other/repo", Want: []string{`"VCS":"gomod"`, `"Auth":"none"`}},
+	} {
+		code, body := auth(test.Module)
+		if code != http.StatusOK {
+			t.Fatal(test.Module, code, body)
+		}
+		for _, want := range test.Want {
+			if !strings.Contains(body, want) {
+				t.Fatal(test.Module, body, want)
+			}
+		}
+		if strings.Contains(body, "s3cr3t") {
+			t.Fatal(test.Module, "secret leaked:", body)
+		}
+	}
+	if strings.Contains(logs.String(), "s3cr3t") {
+		t.Fatal("secret leaked to logs:", logs.String())
+	}
+
+	// The endpoint is guarded by the admin token
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/debug/auth?module=github.com/mycompany/repo", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatal(w.Code)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	fake := &fakeVCS{files: map[string]string{"go.mod": "module example.com/foo\n"}}
+	grace := 100 * time.Millisecond
+	mem := store.Memory(t.Log, -1, store.MemorySoftDelete(grace))
+	api := New(Log(t.Log), withVCS("example.com/", fake), Admin("secret"), func(api *api) { api.stores = append(api.stores, mem) })
+	do := func(method, url string) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, url, nil)
+		r.Header.Set("Authorization", "Bearer secret")
+		api.ServeHTTP(w, r)
+		return w.Code
+	}
+	cached := func() bool {
+		_, err := mem.Get(context.Background(), "example.com/foo", "v1.0.0")
+		return err == nil
+	}
+
+	if code := do("GET", "/example.com/foo/@v/v1.0.0.zip"); code != http.StatusOK || !cached() {
+		t.Fatal(code)
+	}
+	if code := do("DELETE", "/example.com/foo/@v/v1.0.0.zip"); code != http.StatusOK || cached() {
+		t.Fatal(code)
+	}
+	if code := do("POST", "/admin/restore?module=example.com/foo&version=v1.0.0"); code != http.StatusOK || !cached() {
+		t.Fatal(code)
+	}
+	if code := do("DELETE", "/example.com/foo/@v/v1.0.0.zip"); code != http.StatusOK {
+		t.Fatal(code)
+	}
+	time.Sleep(grace)
+	if code := do("POST", "/admin/restore?module=example.com/foo&version=v1.0.0"); code != http.StatusNotFound || cached() {
+		t.Fatal(code)
+	}
+}
+
+// failingStore is a store that can not delete snapshots.
+type failingStore struct{ store.Store }
+
+func (s failingStore) Del(ctx context.Context, module string, version vcs.Version) error {
+	return errors.New("read-only store")
+}
+
+func TestDeleteAllStores(t *testing.T) {
+	ctx := context.Background()
+	empty, mem := store.Memory(t.Log, -1), store.Memory(t.Log, -1)
+	failing := failingStore{store.Memory(t.Log, -1)}
+	do := func(stores ...store.Store) *httptest.ResponseRecorder {
+		mem.Put(ctx, store.Snapshot{Module: "example.com/foo", Version: "v1.0.0", Data: []byte("foo")})
+		api := New(Log(t.Log), withVCS("example.com/", noVCS{t}), func(api *api) { api.stores = stores })
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("DELETE", "/example.com/foo/@v/v1.0.0.zip", nil))
+		return w
+	}
+	cached := func() bool {
+		_, err := mem.Get(ctx, "example.com/foo", "v1.0.0")
+		return err == nil
+	}
+
+	// a store missing the snapshot does not keep it in the next one
+	if w := do(empty, mem); w.Code != http.StatusOK || cached() {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	// failures are reported after the snapshot is deleted from other stores
+	if w := do(failing, empty, mem); w.Code != http.StatusInternalServerError || cached() || !strings.Contains(w.Body.String(), "read-only store") {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	if w := do(empty); w.Code != http.StatusNotFound {
+		t.Fatal(w.Code, w.Body.String())
+	}
+}
+
+func TestPurge(t *testing.T) {
+	ctx := context.Background()
+	mem := store.Memory(t.Log, -1)
+	stores := func(stores ...store.Store) Option {
+		return func(api *api) { api.stores = append(api.stores, stores...) }
+	}
+	api := New(Log(t.Log), withVCS("github.com/", noVCS{t}), Admin("s3cr3t"), stores(mem))
+	for _, key := range []string{
+		"github.com/bad/foo@v1.0.0",
+		"github.com/bad/foo@v1.1.0",
+		"github.com/bad/bar/v2@v2.0.0",
+		"github.com/good/foo@v1.0.0",
+		"github.com/badger/foo@v1.0.0",
+	} {
+		kv := strings.SplitN(key, "@", 2)
+		mem.Put(ctx, store.Snapshot{Module: kv[0], Version: vcs.Version(kv[1]), Data: []byte(key)})
+	}
+	purge := func(pattern, token string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/admin/purge?pattern="+url.QueryEscape(pattern), nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		api.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := purge("github.com/bad/*", ""); w.Code != http.StatusUnauthorized {
+		t.Fatal(w.Code)
+	}
+	if w := purge("github.com/[bad", "s3cr3t"); w.Code != http.StatusBadRequest {
+		t.Fatal(w.Code)
+	}
+	w := purge("github.com/bad/*", "s3cr3t")
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != `{"Pattern":"github.com/bad/*","Purged":3}` {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	entries, err := mem.(store.Inspector).Entries(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	left := []string{}
+	for _, e := range entries {
+		left = append(left, e.Module+"@"+string(e.Version))
+	}
+	sort.Strings(left)
+	if strings.Join(left, " ") != "github.com/badger/foo@v1.0.0 github.com/good/foo@v1.0.0" {
+		t.Fatal(left)
+	}
+
+	// failures are reported after the versions are deleted from other stores
+	failing := failingStore{store.Memory(t.Log, -1)}
+	api = New(Log(t.Log), withVCS("github.com/", noVCS{t}), Admin("s3cr3t"), stores(failing, mem))
+	if w := purge("github.com/good", "s3cr3t"); w.Code != http.StatusInternalServerError || !strings.Contains(w.Body.String(), "read-only store") {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	if _, err := mem.Get(ctx, "github.com/good/foo", "v1.0.0"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal(err)
+	}
+}
+
+func TestVersionQueries(t *testing.T) {
+	fake := &fakeVCS{files: map[string]string{"go.mod": "module example.com/foo\n"}, err: errors.New("VCS should not be used")}
+	api := New(Log(t.Log), withVCS("example.com/", fake))
+	for _, version := range []string{"none", "latest", "upgrade", "patch", "", "<v1.2.0", ">=v1.0.0"} {
+		for _, ext := range []string{"info", "mod", "zip"} {
+			if ext == "info" && strings.ContainsAny(version, "<>") {
+				continue // resolved by the API, see TestComparisonQueries
+			}
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/example.com/foo/@v/v1.0.0.info", nil)
+			r.URL.Path = "/example.com/foo/@v/" + version + "." + ext
+			api.ServeHTTP(w, r)
+			if w.Code != http.StatusGone {
+				t.Fatal(version, ext, w.Code)
+			}
+		}
+	}
+}
+
+func TestComparisonQueries(t *testing.T) {
+	fake := &fakeVCS{
+		versions: []vcs.Version{"v1.0.0", "v1.1.0", "v1.2.0-rc.1", "v1.2.0", "v1.3.0", "v2.0.0-rc.1"},
+		files:    map[string]string{"go.mod": "module example.com/foo\n"},
+	}
+	api := New(Log(t.Log), withVCS("example.com/", fake))
+	for _, test := range []struct {
+		Query   string
+		Version string
+	}{
+		{Query: ">=v1.2.0", Version: "v1.2.0"},
+		{Query: ">v1.2.0", Version: "v1.3.0"},
+		{Query: "<v1.2.0", Version: "v1.1.0"},
+		{Query: "<=v1.2.0", Version: "v1.2.0"},
+		{Query: ">=v1.1.5", Version: "v1.2.0"},
+		{Query: "<=v1.0.0", Version: "v1.0.0"},
+		// pre-releases are only used if no release matches
+		{Query: ">v1.3.0", Version: "v2.0.0-rc.1"},
+		{Query: "<v1.0.0"},
+		{Query: ">v2.0.0"},
+		{Query: ">=master"},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/example.com/foo/@v/v1.0.0.info", nil)
+		r.URL.Path = "/example.com/foo/@v/" + test.Query + ".info"
+		api.ServeHTTP(w, r)
+		if test.Version == "" {
+			if w.Code != http.StatusGone {
+				t.Fatal(test.Query, w.Code, w.Body.String())
+			}
+			continue
+		}
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"Version":"`+test.Version+`"`) {
+			t.Fatal(test.Query, w.Code, w.Body.String())
+		}
+		if cc := w.Header().Get("Cache-Control"); cc != "no-cache" {
+			t.Fatal(test.Query, cc)
+		}
+	}
+}
+
+func TestNotFoundMessage(t *testing.T) {
+	fake := &fakeVCS{versions: []vcs.Version{"v1.0.0"}}
+	for _, test := range []struct {
+		Options []Option
+		Accept  string
+		Type    string
+		Body    string
+	}{
+		{Type: "text/plain; charset=utf-8", Body: "404 page not found\n"},
+		{Options: []Option{NotFoundMessage("only example.com modules")}, Type: "text/plain; charset=utf-8", Body: "only example.com modules\n"},
+		{Options: []Option{NotFoundMessage("only example.com modules")}, Accept: "application/json", Type: "application/json", Body: `{"Error":"only example.com modules"}` + "\n"},
+	} {
+		api := New(append([]Option{Log(t.Log), withVCS("example.com/", fake)}, test.Options...)...)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/example.com/foo/@v/", nil)
+		r.Header.Set("Accept", test.Accept)
+		api.ServeHTTP(w, r)
+		if w.Code != http.StatusNotFound || w.Header().Get("Content-Type") != test.Type || w.Body.String() != test.Body {
+			t.Fatal(w.Code, w.Header().Get("Content-Type"), w.Body.String())
+		}
+	}
+}
+
+func TestLanding(t *testing.T) {
+	fake := &fakeVCS{versions: []vcs.Version{"v1.0.0"}, files: map[string]string{"go.mod": "module example.com/foo\n"}}
+	get := func(api http.Handler, path, accept string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("Accept", accept)
+		api.ServeHTTP(w, r)
+		return w
+	}
+
+	// Disabled by default
+	if w := get(New(Log(t.Log), withVCS("example.com/", fake)), "/", ""); w.Code != http.StatusNotFound {
+		t.Fatal(w.Code)
+	}
+
+	api := New(Log(t.Log), withVCS("example.com/", fake), Git("github.com/mycompany/", "user:s3cr3t"), Landing("Ask #platform for access"))
+	w := get(api, "/", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Ask #platform for access") ||
+		!strings.Contains(w.Body.String(), "  github.com/mycompany/\n") || strings.Contains(w.Body.String(), "s3cr3t") {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	w = get(api, "/", "application/json")
+	want := `{"Message":"Ask #platform for access","Prefixes":["example.com/","github.com/mycompany/"]}` + "\n"
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" || w.Body.String() != want {
+		t.Fatal(w.Code, w.Body.String())
+	}
+
+	// Module routes are not affected
+	if w := get(api, "/example.com/foo/@v/list", ""); w.Code != http.StatusOK || w.Body.String() != "v1.0.0\n" {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	if w := get(api, "/example.com/foo/@v/", ""); w.Code != http.StatusNotFound {
+		t.Fatal(w.Code)
+	}
+}
+
+func TestGoImport(t *testing.T) {
+	fake := &fakeVCS{versions: []vcs.Version{"v1.0.0"}}
+	api := New(Log(t.Log), GoImport("https://goproxy.example.com/"), withVCS("example.com/", fake), Git("github.com/mycompany/", ""))
+	for _, test := range []struct {
+		Path   string
+		Status int
+		Meta   string
+	}{
+		{"/example.com/foo/bar?go-get=1", http.StatusOK, `<meta name="go-import" content="example.com/foo/bar mod https://goproxy.example.com">`},
+		{"/github.com/mycompany/repo/sub/pkg?go-get=1", http.StatusOK, `<meta name="go-import" content="github.com/mycompany/repo mod https://goproxy.example.com">`},
+		{"/github.com/other/repo?go-get=1", http.StatusNotFound, ""},
+		{"/example.com/foo/bar", http.StatusNotFound, ""},
+	} {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("GET", test.Path, nil))
+		if w.Code != test.Status || !strings.Contains(w.Body.String(), test.Meta) {
+			t.Fatal(test.Path, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestRequestBody(t *testing.T) {
+	fake := &fakeVCS{files: map[string]string{"go.mod": "module example.com/foo\n"}}
+	api := New(Log(t.Log), withVCS("example.com/", fake), Admin("secret"), MaxBodySize(16))
+	for _, test := range []struct {
+		Method string
+		Path   string
+		Body   string
+		Status int
+	}{
+		{"GET", "/example.com/foo/@v/v1.0.0.info", "", http.StatusOK},
+		{"GET", "/example.com/foo/@v/v1.0.0.info", "x", http.StatusBadRequest},
+		{"HEAD", "/example.com/foo/@v/v1.0.0.info", "x", http.StatusBadRequest},
+		{"POST", "/admin/reload", strings.Repeat("x", 17), http.StatusRequestEntityTooLarge},
+		{"DELETE", "/example.com/foo/@v/v1.0.0.info", strings.Repeat("x", 1<<20), http.StatusRequestEntityTooLarge},
+	} {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest(test.Method, test.Path, strings.NewReader(test.Body)))
+		if w.Code != test.Status {
+			t.Fatal(test.Method, test.Path, len(test.Body), w.Code, w.Body.String())
+		}
+	}
+
+	// bodies of unknown length are cut at the limit
+	r := httptest.NewRequest("POST", "/admin/reload", nil)
+	r.Body, r.ContentLength = ioutil.NopCloser(strings.NewReader(strings.Repeat("x", 17))), -1
+	api.ServeHTTP(httptest.NewRecorder(), r)
+	if b, err := ioutil.ReadAll(r.Body); err == nil || len(b) > 16 {
+		t.Fatal(len(b), err)
+	}
+}
+
+func TestAdminDisabled(t *testing.T) {
+	fake := &fakeVCS{files: map[string]string{"go.mod": "module example.com/foo\n"}}
+	reload := Reload(func() ([]Option, error) { return nil, nil })
+	for _, options := range [][]Option{{reload}, {reload, Admin("")}} {
+		api := New(append([]Option{Log(t.Log), withVCS("example.com/", fake)}, options...)...)
+		for _, test := range []struct{ Method, Path string }{
+			{"POST", "/admin/reload"},
+			{"POST", "/admin/restore?module=example.com/foo&version=v1.0.0"},
+			{"POST", "/admin/mirror?module=example.com/foo"},
+			{"POST", "/admin/purge?pattern=example.com/*"},
+			{"GET", "/debug/auth?module=example.com/foo"},
+			{"GET", "/debug/fetch?module=example.com/foo&version=v1.0.0"},
+		} {
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, httptest.NewRequest(test.Method, test.Path, nil))
+			if w.Code != http.StatusNotFound {
+				t.Fatal(test.Method, test.Path, w.Code)
+			}
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	v1 := &fakeVCS{versions: []vcs.Version{"v1.0.0"}}
+	v2 := &fakeVCS{versions: []vcs.Version{"v2.0.0"}}
+	current := v1
+	api := New(Log(t.Log), withVCS("example.com/", v1), Admin("secret"),
+		Reload(func() ([]Option, error) {
+			return []Option{withVCS("example.com/", current), VCSWorkers(4)}, nil
+		}))
+
+	list := func() string {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("GET", "/example.com/foo/@v/list", nil))
+		return w.Body.String()
+	}
+	reload := func(token string) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/admin/reload", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		api.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if s := list(); s != "v1.0.0\n" {
+		t.Fatal(s)
+	}
+	current = v2
+	if code := reload("wrong"); code != http.StatusUnauthorized {
+		t.Fatal(code)
+	}
+	if s := list(); s != "v1.0.0\n" {
+		t.Fatal(s)
+	}
+	if code := reload("secret"); code != http.StatusOK {
+		t.Fatal(code)
+	}
+	if s := list(); s != "v2.0.0\n" {
+		t.Fatal(s)
+	}
+}
+
+func TestReloadKeepsSettings(t *testing.T) {
+	base := New(Log(t.Log), Insecure("git.example.com"), KnownHosts("/etc/gomodproxy/known_hosts"), InsecureIgnoreHostKey()).(*api)
+	next := reloaded(base, []Option{Git("git.example.com/", "")})
+	if !reflect.DeepEqual(next.insecure, base.insecure) || !reflect.DeepEqual(next.knownHosts, base.knownHosts) || !next.ignoreKeys || next.metaClient != base.metaClient {
+		t.Fatal(next.insecure, next.knownHosts, next.ignoreKeys)
+	}
+}
+
+func TestReloadPinsAndWorkers(t *testing.T) {
+	fake := &fakeVCS{files: map[string]string{"go.mod": "module example.com/foo\n"}}
+	options := []Option{withVCS("example.com/", fake), VCSWorkers(4)}
+	h := New(Log(t.Log), withVCS("example.com/", fake), VCSWorkers(4), Reload(func() ([]Option, error) { return options, nil }))
+	cacheControl := func() string {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/example.com/foo/@v/v1.0.0.info", nil))
+		return w.Header().Get("Cache-Control")
+	}
+	if s := cacheControl(); !strings.Contains(s, "immutable") {
+		t.Fatal(s)
+	}
+
+	// workers are kept while their number stays the same
+	semc := h.(*api).semc
+	options = append(options, Pin("example.com/foo", strings.Repeat("a", 40)))
+	if err := h.(*api).Reload(); err != nil {
+		t.Fatal(err)
+	} else if h.(*api).semc != semc {
+		t.Fatal("workers replaced")
+	}
+	if s := cacheControl(); s != "no-cache" {
+		t.Fatal(s)
+	}
+	options = append(options, VCSWorkers(8))
+	if err := h.(*api).Reload(); err != nil {
+		t.Fatal(err)
+	} else if cap(h.(*api).semc) != 8 {
+		t.Fatal(cap(h.(*api).semc))
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	fake := &fakeVCS{files: map[string]string{"go.mod": "module example.com/foo\n"}, delay: time.Second}
+	api := New(Log(t.Log), withVCS("example.com/", fake), Deadlines(time.Minute))
+	for _, path := range []string{"info", "mod", "zip"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/example.com/foo/@v/v1.0.0."+path, nil)
+		r.Header.Set("X-Gomodproxy-Deadline", "0.05")
+		start := time.Now()
+		api.ServeHTTP(w, r)
+		if w.Code != http.StatusGatewayTimeout {
+			t.Fatal(path, w.Code, w.Body.String())
+		} else if time.Since(start) >= fake.delay {
+			t.Fatal(path, time.Since(start))
+		}
+	}
+}
+
+func TestDeadlineCap(t *testing.T) {
+	fake := &fakeVCS{files: map[string]string{"go.mod": "module example.com/foo\n"}, delay: time.Second}
+	api := New(Log(t.Log), withVCS("example.com/", fake), Deadlines(50*time.Millisecond))
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/example.com/foo/@v/v1.0.0.zip", nil)
+	r.Header.Set("X-Gomodproxy-Deadline", "3600")
+	api.ServeHTTP(w, r)
+	if w.Code != http.StatusGatewayTimeout {
+		t.Fatal(w.Code, w.Body.String())
+	}
+
+	// values too large for a duration are capped as well, others are rejected
+	fake.delay = 0
+	api = New(Log(t.Log), withVCS("example.com/", fake), Deadlines(time.Minute))
+	for _, test := range []struct {
+		Deadline string
+		Status   int
+	}{
+		{"1e10", http.StatusOK},
+		{"1e300", http.StatusOK},
+		{"NaN", http.StatusBadRequest},
+		{"Inf", http.StatusBadRequest},
+		{"-1", http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/example.com/foo/@v/v1.0.0.info", nil)
+		r.Header.Set("X-Gomodproxy-Deadline", test.Deadline)
+		api.ServeHTTP(w, r)
+		if w.Code != test.Status {
+			t.Fatal(test.Deadline, w.Code, w.Body.String())
+		}
+	}
+}
+
+// noVCS is a VCS client that fails the test if it is ever contacted.
+type noVCS struct{ t *testing.T }
+
+func (v noVCS) List(ctx context.Context) ([]vcs.Version, error) {
+	v.t.Error("unexpected List")
+	return nil, errors.New("unexpected")
+}
+
+func (v noVCS) Timestamp(ctx context.Context, version vcs.Version) (time.Time, error) {
+	v.t.Error("unexpected Timestamp", version)
+	return time.Time{}, errors.New("unexpected")
+}
+
+func (v noVCS) Zip(ctx context.Context, version vcs.Version) (io.ReadCloser, error) {
+	v.t.Error("unexpected Zip", version)
+	return nil, errors.New("unexpected")
+}
+
+func TestBadPaths(t *testing.T) {
+	api := New(Log(t.Log), withVCS("", noVCS{t}))
+	for _, path := range []string{
+		"/example.com/foo%3Fx=1/@v/list",
+		"/example.com/foo%23frag/@v/v1.0.0.info",
+		"/example.com/foo/@v/v1.0.0%3F.mod",
+		"/example.com/foo/@v/v1.0.0%23x.zip",
+		"/example.com/foo%00/@v/v1.0.0.zip",
+		"/example.com/foo/@v/v1.0.0%0A.info",
+		"/example.com/fo%20o/@latest",
+		"/example.com/f%C3%B6o/@latest",
+		"/example.com/../etc/@v/list",
+		"/example.com//foo/@v/list",
+		"/example.com/foo/@v/../../x.info",
+	} {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Fatal(path, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestErrorStatus(t *testing.T) {
+	for _, test := range []struct {
+		Err    error
+		Status int
+	}{
+		{Err: transport.ErrRepositoryNotFound, Status: http.StatusGone},
+		{Err: transport.ErrAuthenticationRequired, Status: http.StatusUnauthorized},
+		{Err: fmt.Errorf("dial: %w", &net.DNSError{Err: "no such host"}), Status: http.StatusServiceUnavailable},
+		{Err: errors.New("unexpected"), Status: http.StatusInternalServerError},
+	} {
+		fake := &fakeVCS{err: test.Err}
+		api := New(Log(t.Log), withVCS("example.com/", fake))
+		for _, path := range []string{"list", "v1.0.0.info", "v1.0.0.mod", "v1.0.0.zip"} {
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, httptest.NewRequest("GET", "/example.com/foo/@v/"+path, nil))
+			if w.Code != test.Status {
+				t.Fatal(test.Err, path, w.Code, test.Status)
+			}
+		}
+	}
+}
+
+func BenchmarkCacheHit(b *testing.B) {
+	fake := &fakeVCS{files: map[string]string{"go.mod": "module example.com/foo\n"}}
+	api := New(withVCS("example.com/", fake), Memory(func(...interface{}) {}, -1))
+	r := httptest.NewRequest("GET", "/example.com/foo/@v/v1.0.0.info", nil)
+	api.ServeHTTP(httptest.NewRecorder(), r)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		api.ServeHTTP(httptest.NewRecorder(), r)
+	}
+}
+
+func TestDedupErrors(t *testing.T) {
+	var mu sync.Mutex
+	lines := []string{}
+	log := func(v ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		lines = append(lines, fmt.Sprint(v...))
+	}
+	errorLines := func() (n int, summary string) {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, line := range lines {
+			if strings.Contains(line, "repeated") {
+				summary = line
+			} else if strings.Contains(line, "error") {
+				n++
+			}
+		}
+		return n, summary
+	}
+
+	fake := &fakeVCS{err: transport.ErrRepositoryNotFound}
+	api := New(Log(log, DedupErrors(100*time.Millisecond)), withVCS("example.com/", fake))
+	for i := 0; i < 5; i++ {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("GET", "/example.com/foo/@v/v1.0.0.info", nil))
+		if w.Code != http.StatusGone {
+			t.Fatal(w.Code, w.Body.String())
+		}
+	}
+	if n, _ := errorLines(); n != 1 {
+		t.Fatal(n, lines)
+	}
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		if _, summary := errorLines(); summary != "" {
+			if !strings.Contains(summary, "repeated4") {
+				t.Fatal(summary)
+			}
+			return
+		}
+	}
+	t.Fatal("no summary logged", lines)
+}
+
+// slowStore is a store that blocks writes until it is released.
+type slowStore struct {
+	store.Store
+	release chan struct{}
+}
+
+func (s *slowStore) Put(ctx context.Context, snapshot store.Snapshot) error {
+	<-s.release
+	return s.Store.Put(ctx, snapshot)
+}
+
+func TestSlowStore(t *testing.T) {
+	fake := &fakeVCS{files: map[string]string{"go.mod": "module example.com/foo\n"}}
+	slow := &slowStore{Store: store.Memory(t.Log, -1), release: make(chan struct{})}
+	api := New(Log(t.Log), withVCS("example.com/", fake), Memory(t.Log, -1), Store(slow)).(*api)
+
+	done := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("GET", "/example.com/foo/@v/v1.0.0.zip", nil))
+		done <- w.Code
+	}()
+	select {
+	case code := <-done:
+		if code != http.StatusOK {
+			t.Fatal(code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("response is blocked by a slow store")
+	}
+	if _, err := api.stores[0].Get(context.Background(), "example.com/foo", "v1.0.0"); err != nil {
+		t.Fatal("fast store should be written first", err)
+	}
+
+	close(slow.release)
+	api.puts.Wait()
+	if _, err := slow.Get(context.Background(), "example.com/foo", "v1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// countingStore is a store that counts the reads of its snapshots.
+type countingStore struct {
+	store.Store
+	gets int32
+}
+
+func (s *countingStore) Get(ctx context.Context, module string, version vcs.Version) (store.Snapshot, error) {
+	atomic.AddInt32(&s.gets, 1)
+	return s.Store.Get(ctx, module, version)
+}
+
+func TestMicroCache(t *testing.T) {
+	fake := &fakeVCS{files: map[string]string{"go.mod": "module example.com/foo\n"}}
+	disk := &countingStore{Store: store.Memory(t.Log, -1)}
+	if err := disk.Put(context.Background(), store.Snapshot{Module: "example.com/foo", Version: "v1.0.0", Data: fake.zip("v1.0.0")}); err != nil {
+		t.Fatal(err)
+	}
+	api := New(Log(t.Log), withVCS("example.com/", fake), Store(disk), MicroCache(2, 1<<20))
+	do := func(method string) int {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest(method, "/example.com/foo/@v/v1.0.0.zip", nil))
+		return w.Code
+	}
+
+	// Repeated requests are served from the micro-cache
+	for i := 0; i < 3; i++ {
+		if code := do("GET"); code != http.StatusOK {
+			t.Fatal(code)
+		}
+	}
+	if n := atomic.LoadInt32(&disk.gets); n != 1 {
+		t.Fatal(n)
+	}
+
+	// Deleted snapshots are dropped from the micro-cache as well
+	if code := do("DELETE"); code != http.StatusOK {
+		t.Fatal(code)
+	}
+	if code := do("GET"); code != http.StatusOK {
+		t.Fatal(code)
+	}
+	if n := atomic.LoadInt32(&disk.gets); n != 2 {
+		t.Fatal(n)
+	}
+}
+
+func TestCacheBypass(t *testing.T) {
+	fake := &fakeVCS{files: map[string]string{"go.mod": "module example.com/foo\n"}}
+	for _, bypass := range []bool{false, true} {
+		mem := store.Memory(t.Log, -1)
+		if err := mem.Put(context.Background(), store.Snapshot{Module: "example.com/foo", Version: "v1.0.0", Data: fake.zip("v1.0.0")}); err != nil {
+			t.Fatal(err)
+		}
+		options := []Option{Log(t.Log), withVCS("example.com/", fake), Store(mem), MicroCache(2, 1<<20)}
+		if bypass {
+			options = append(options, CacheBypass())
+		}
+		api := New(options...)
+		mod := func(noCache bool) string {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/example.com/foo/@v/v1.0.0.mod", nil)
+			if noCache {
+				r.Header.Set("X-Gomodproxy-No-Cache", "1")
+			}
+			api.ServeHTTP(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatal(w.Code, w.Body.String())
+			}
+			return w.Body.String()
+		}
+		if s := mod(false); s != "module example.com/foo\n" {
+			t.Fatal(s)
+		}
+
+		// The header fetches the module again and updates the cache, if enabled
+		fake.files = map[string]string{"go.mod": "module example.com/foo\n\ngo 1.13\n"}
+		want := "module example.com/foo\n"
+		if bypass {
+			want = "module example.com/foo\n\ngo 1.13\n"
+		}
+		if s := mod(true); s != want {
+			t.Fatal(bypass, s)
+		}
+		if s := mod(false); s != want {
+			t.Fatal(bypass, s)
+		}
+		if snapshot, err := mem.Get(context.Background(), "example.com/foo", "v1.0.0"); err != nil || bytes.Equal(snapshot.Data, fake.zip("v1.0.0")) != bypass {
+			t.Fatal(bypass, err)
+		}
+		fake.files = map[string]string{"go.mod": "module example.com/foo\n"}
+	}
+}
+
+func TestCacheControl(t *testing.T) {
+	fake := &fakeVCS{
+		versions: []vcs.Version{"v1.0.0"},
+		files:    map[string]string{"go.mod": "module example.com/foo\n"},
+	}
+	api := New(Log(t.Log), withVCS("example.com/", fake), Memory(t.Log, -1), CacheMaxAge(time.Hour), Pin("example.com/pinned", "0123456789abcdef0123456789abcdef01234567"))
+	immutable := "public, max-age=3600, immutable"
+	for _, test := range []struct {
+		Path  string
+		Cache string
+	}{
+		{"/example.com/foo/@v/v1.0.0.info", immutable},
+		{"/example.com/foo/@v/v1.0.0.mod", immutable},
+		{"/example.com/foo/@v/v1.0.0.zip", immutable},
+		{"/example.com/foo/@v/v1.1.0-rc.1.zip", immutable},
+		{"/example.com/foo/@v/v0.0.0-20180921100000-aaaaaaaaaaaa.info", "no-cache"},
+		{"/example.com/foo/@v/v0.0.0-20180921100000-aaaaaaaaaaaa.zip", "no-cache"},
+		{"/example.com/foo/@v/master.info", "no-cache"},
+		{"/example.com/foo/@v/list", "no-cache"},
+		{"/example.com/foo/@latest", "no-cache"},
+		{"/example.com/pinned/@v/v1.0.0.zip", "no-cache"},
+	} {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("GET", test.Path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatal(test.Path, w.Code, w.Body.String())
+		}
+		if cache := w.Header().Get("Cache-Control"); cache != test.Cache {
+			t.Fatal(test.Path, cache)
+		}
+	}
+
+	// Errors are not cached
+	fake.err = errors.New("boom")
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/example.com/foo/@v/v2.0.0.info", nil))
+	if w.Code == http.StatusOK || w.Header().Get("Cache-Control") != "" {
+		t.Fatal(w.Code, w.Header())
+	}
+}
+
+func TestManifest(t *testing.T) {
+	f, err := ioutil.TempFile("", "gomodproxy_manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# released versions\n" +
+		"example.com/foo v1.0.0 0123456789abcdef0123456789abcdef01234567\n" +
+		"example.com/foo v1.1.0 89abcdef0123456789abcdef0123456789abcdef\n" +
+		"example.com/bar v0.1.0 0123456789abcdef0123456789abcdef01234567\n")
+	f.Close()
+
+	api := New(Log(t.Log), Git("example.com/", ""), Manifest(f.Name()))
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/example.com/foo/@v/list", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "v1.0.0\nv1.1.0\n" {
+		t.Fatal(w.Code, w.Body.String())
+	}
+
+	// Broken manifest fails all git requests
+	api = New(Log(t.Log), Git("example.com/", ""), Manifest(f.Name()+".missing"))
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/example.com/foo/@v/list", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Fatal(w.Code, w.Body.String())
+	}
+}
+
+func TestDebugFetch(t *testing.T) {
+	fake := &fakeVCS{files: map[string]string{"go.mod": "module example.com/foo\n"}}
+	mem := store.Memory(t.Log, -1)
+	size := store.Digest{Name: "size", Sum: func(b []byte) (string, error) { return strconv.Itoa(len(b)), nil }}
+	busy := func(api *api) { api.semc <- struct{}{} }
+	api := New(Log(t.Log), Admin("secret"), withVCS("example.com/", fake), Digests(size), func(api *api) { api.stores = append(api.stores, mem) })
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/debug/fetch?module=example.com/foo&version=v1.0.0", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	api.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	res := struct {
+		Phases []struct {
+			Name    string
+			Seconds float64
+		}
+		Seconds float64
+		Sum     string
+		Digests map[string]string
+		Error   string
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err, w.Body.String())
+	}
+	sum, _ := store.HashZip(fake.zip("v1.0.0"))
+	if res.Error != "" || res.Sum != sum || res.Seconds <= 0 {
+		t.Fatal(w.Body.String())
+	}
+	if res.Digests["h1"] != sum || res.Digests["size"] != strconv.Itoa(len(fake.zip("v1.0.0"))) {
+		t.Fatal(w.Body.String())
+	}
+	if len(res.Phases) != 2 || res.Phases[0].Name != "zip" || res.Phases[1].Name != "hash" {
+		t.Fatal(w.Body.String())
+	}
+	// The caches are bypassed
+	if _, err := mem.Get(context.Background(), "example.com/foo", "v1.0.0"); err == nil {
+		t.Fatal("debug fetch should not be cached")
+	}
+
+	// Clients without the admin token can not force fetches
+	api = New(Log(t.Log), Admin("secret"), withVCS("example.com/", fake))
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/debug/fetch?module=example.com/foo&version=v1.0.0", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatal(w.Code, w.Body.String())
+	}
+
+	// Debug fetches wait for a free VCS worker like the others
+	api = New(Log(t.Log), Admin("secret"), withVCS("example.com/", fake), VCSWorkers(1), busy)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/debug/fetch?module=example.com/foo&version=v1.0.0", nil).WithContext(ctx)
+	r.Header.Set("Authorization", "Bearer secret")
+	api.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), context.DeadlineExceeded.Error()) {
+		t.Fatal(w.Code, w.Body.String())
+	}
+}
+
+func TestListFilter(t *testing.T) {
+	fake := &fakeVCS{versions: []vcs.Version{"v1.0.0", "v1.1.0", "v1.10.0", "v2.0.0", "v2.1.0-rc.1"}}
+	api := New(Log(t.Log), withVCS("example.com/", fake))
+	for _, test := range []struct {
+		Query string
+		Code  int
+		Body  string
+	}{
+		{Query: "", Code: http.StatusOK, Body: "v1.0.0\nv1.1.0\nv1.10.0\nv2.0.0\nv2.1.0-rc.1\n"},
+		{Query: "?prefix=v1.1", Code: http.StatusOK, Body: "v1.1.0\nv1.10.0\n"},
+		{Query: "?match=v2.*", Code: http.StatusOK, Body: "v2.0.0\nv2.1.0-rc.1\n"},
+		{Query: "?match=v*.0.0", Code: http.StatusOK, Body: "v1.0.0\nv2.0.0\n"},
+		{Query: "?prefix=v2&match=*-rc.*", Code: http.StatusOK, Body: "v2.1.0-rc.1\n"},
+		{Query: "?prefix=v3", Code: http.StatusOK, Body: ""},
+		{Query: "?match=[", Code: http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("GET", "/example.com/foo/@v/list"+test.Query, nil))
+		if w.Code != test.Code || (test.Code == http.StatusOK && w.Body.String() != test.Body) {
+			t.Fatal(test.Query, w.Code, w.Body.String())
+		}
+	}
+}
+
+// failingVCS is a fake VCS that fails to fetch the given versions.
+type failingVCS struct {
+	*fakeVCS
+	failed map[vcs.Version]bool
+}
+
+func (f failingVCS) Timestamp(ctx context.Context, version vcs.Version) (time.Time, error) {
+	if f.failed[version] {
+		return time.Time{}, errors.New("broken tag")
+	}
+	return f.fakeVCS.Timestamp(ctx, version)
+}
+
+func TestMirror(t *testing.T) {
+	fake := failingVCS{
+		fakeVCS: &fakeVCS{
+			versions: []vcs.Version{"v1.0.0", "v1.1.0", "v1.2.0", "v2.0.0"},
+			files:    map[string]string{"go.mod": "module example.com/foo\n"},
+		},
+		failed: map[vcs.Version]bool{"v1.1.0": true},
+	}
+	mem := store.Memory(t.Log, -1)
+	api := New(Log(t.Log), Admin("secret"), withVCS("example.com/", fake), func(api *api) { api.stores = append(api.stores, mem) })
+
+	mirror := func(query string) (int, string) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/admin/mirror?module=example.com/foo"+query, nil)
+		r.Header.Set("Authorization", "Bearer secret")
+		api.ServeHTTP(w, r)
+		return w.Code, w.Body.String()
+	}
+
+	// Only the versions matching the filter are mirrored
+	if code, body := mirror("&prefix=v2."); code != http.StatusOK || !strings.Contains(body, `"Failed":0`) {
+		t.Fatal(code, body)
+	}
+	if _, err := mem.Get(context.Background(), "example.com/foo", "v1.0.0"); err == nil {
+		t.Fatal("v1.0.0 should not be mirrored yet")
+	}
+
+	code, body := mirror("")
+	if code != http.StatusOK || !strings.Contains(body, `"Failed":1`) || !strings.Contains(body, `{"Version":"v1.1.0","Error":"broken tag"}`) {
+		t.Fatal(code, body)
+	}
+	for _, v := range []vcs.Version{"v1.0.0", "v1.2.0", "v2.0.0"} {
+		if _, err := mem.Get(context.Background(), "example.com/foo", v); err != nil {
+			t.Fatal(v, err)
+		}
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	var mu sync.Mutex
+	access, logs := &bytes.Buffer{}, &bytes.Buffer{}
+	logger := func(b *bytes.Buffer) func(...interface{}) {
+		return func(v ...interface{}) {
+			mu.Lock()
+			defer mu.Unlock()
+			fmt.Fprintln(b, v...)
+		}
+	}
+	fake := &fakeVCS{files: map[string]string{"go.mod": "module example.com/foo\n"}}
+	api := New(Log(logger(logs)), AccessLog(logger(access)), withVCS("example.com/", fake))
+
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/example.com/foo/@v/v1.0.0.info", nil))
+	if w.Code != http.StatusOK {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !strings.Contains(access.String(), "api.ServeHTTP method GET url /example.com/foo/@v/v1.0.0.info") || strings.Contains(access.String(), "api.info") {
+		t.Fatal("access log:", access.String())
+	}
+	if !strings.Contains(logs.String(), "api.info module example.com/foo") || strings.Contains(logs.String(), "api.ServeHTTP method") {
+		t.Fatal("main log:", logs.String())
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	var mu sync.Mutex
+	audit := []string{}
+	auditLog := func(v ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		audit = append(audit, fmt.Sprintln(v...))
+	}
+	fake := &fakeVCS{files: map[string]string{"go.mod": "module example.com/foo\n"}}
+	api := New(Log(t.Log), AuditLog(auditLog), withVCS("example.com/", fake), Memory(t.Log, -1))
+
+	for _, test := range []struct {
+		URL    string
+		User   string
+		Source string
+	}{
+		{URL: "/example.com/foo/@v/v1.0.0.zip", Source: "vcs"},
+		{URL: "/example.com/foo/@v/v1.0.0.mod", User: "alice", Source: "cache"},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", test.URL, nil)
+		if test.User != "" {
+			r.SetBasicAuth(test.User, "secret")
+		}
+		api.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatal(w.Code, w.Body.String())
+		}
+		mu.Lock()
+		entry := audit[len(audit)-1]
+		mu.Unlock()
+		want := "api.audit principal 192.0.2.1 module example.com/foo version v1.0.0 source " + test.Source + " timestamp "
+		if !strings.HasPrefix(entry, want) || strings.Contains(entry, "secret") {
+			t.Fatal(entry)
+		}
+		if claimed := strings.Contains(entry, " claimeduser alice\n"); claimed != (test.User != "") {
+			t.Fatal(entry)
+		}
+	}
+
+	// failed requests and lists are not audited
+	fake.err = errors.New("failed")
+	for _, url := range []string{"/example.com/foo/@v/list", "/example.com/foo/@v/v2.0.0.info"} {
+		api.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", url, nil))
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(audit) != 2 {
+		t.Fatal(audit)
+	}
+}
+
+func TestPrefetchSiblings(t *testing.T) {
+	fake := &fakeVCS{
+		versions: []vcs.Version{"v0.9.0", "v1.0.0", "v1.1.0", "v1.2.0", "v1.3.0", "v1.4.0-rc.1"},
+		files:    map[string]string{"go.mod": "module example.com/foo\n"},
+	}
+	mem := store.Memory(t.Log, -1)
+	api := New(Log(t.Log), withVCS("example.com/", fake), PrefetchSiblings(2), func(api *api) { api.stores = append(api.stores, mem) }).(*api)
+
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/example.com/foo/@v/v1.2.0.mod", nil))
+	if w.Code != http.StatusOK {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	api.prefetches.Wait()
+	for v, want := range map[vcs.Version]bool{"v1.0.0": false, "v1.1.0": true, "v1.2.0": true, "v1.3.0": true, "v1.4.0-rc.1": false} {
+		if _, err := mem.Get(context.Background(), "example.com/foo", v); (err == nil) != want {
+			t.Fatal(v, err)
+		}
+	}
+
+	// sibling .mod requests are cache hits and prefetch nothing more
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/example.com/foo/@v/v1.3.0.mod", nil))
+	api.prefetches.Wait()
+	if w.Code != http.StatusOK || w.Body.String() != "module example.com/foo\n" {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	if _, err := mem.Get(context.Background(), "example.com/foo", "v1.0.0"); err == nil {
+		t.Fatal("prefetched after a cache hit")
+	}
+
+	for _, test := range []struct {
+		Version  vcs.Version
+		N        int
+		Siblings []vcs.Version
+	}{
+		{"v1.2.0", 3, []vcs.Version{"v1.1.0", "v1.3.0", "v1.0.0"}},
+		{"v0.9.0", 2, []vcs.Version{"v1.0.0", "v1.1.0"}},
+		{"v1.3.0", 10, []vcs.Version{"v1.2.0", "v1.1.0", "v1.0.0", "v0.9.0"}},
+		{"v1.2.5", 2, []vcs.Version{"v1.2.0", "v1.3.0"}},
+	} {
+		if s := siblings(fake.versions, test.Version, test.N); !reflect.DeepEqual(s, test.Siblings) {
+			t.Fatal(test.Version, s)
+		}
+	}
+}
+
+func TestRecheckCached(t *testing.T) {
+	tagged := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	fake := &fakeVCS{time: tagged, hash: strings.Repeat("a", 40), files: map[string]string{"go.mod": "module example.com/retag\n"}}
+	api := New(Log(t.Log), withVCS("example.com/", fake), Memory(t.Log, -1), RecheckCached(1)).(*api)
+	get := func() {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("GET", "/example.com/retag/@v/v1.0.0.info", nil))
+		if w.Code != http.StatusOK {
+			t.Fatal(w.Code, w.Body.String())
+		}
+		api.checks.Wait()
+	}
+	count := func() int64 {
+		if v, ok := retagged.Get("example.com/retag").(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+
+	// Unchanged tag is not reported
+	get()
+	get()
+	if n := count(); n != 0 {
+		t.Fatal(n)
+	}
+
+	// Tag moved to another commit is reported, even if the commit time is the
+	// same, while the cached module is still served
+	fake.hash = strings.Repeat("b", 40)
+	get()
+	if n := count(); n != 1 {
+		t.Fatal(n)
+	}
+}
+
+func TestIndex(t *testing.T) {
+	fake := &fakeVCS{
+		versions: []vcs.Version{"v1.0.0", "v1.1.0", "v1.2.0"},
+		files:    map[string]string{"go.mod": "module example.com/foo\n"},
+	}
+	f, err := ioutil.TempFile(os.TempDir(), "gomodproxy_index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	file := f.Name()
+	mem := store.Memory(t.Log, -1)
+	cache := func(api *api) { api.stores = append(api.stores, mem) }
+	api := New(Log(t.Log), Index(file, 2), Admin("secret"), withVCS("example.com/", fake), cache)
+
+	index := func(query string) []indexEntry {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/index"+query, nil)
+		r.Header.Set("Authorization", "Bearer secret")
+		api.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatal(w.Code, w.Body.String())
+		}
+		entries := []indexEntry{}
+		dec := json.NewDecoder(w.Body)
+		for dec.More() {
+			e := indexEntry{}
+			if err := dec.Decode(&e); err != nil {
+				t.Fatal(err)
+			}
+			entries = append(entries, e)
+		}
+		return entries
+	}
+
+	if entries := index(""); len(entries) != 0 {
+		t.Fatal(entries)
+	}
+	// The index is only served with the admin token
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/index", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatal(w.Code)
+	}
+	for _, v := range []string{"v1.0.0", "v1.1.0", "v1.0.0"} {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("GET", "/example.com/foo/@v/"+v+".zip", nil))
+		if w.Code != http.StatusOK {
+			t.Fatal(v, w.Code, w.Body.String())
+		}
+	}
+
+	// Cache hits are not added to the index
+	entries := index("")
+	if len(entries) != 2 || entries[0].Path != "example.com/foo" || entries[0].Version != "v1.0.0" || entries[1].Version != "v1.1.0" {
+		t.Fatal(entries)
+	}
+
+	// The last timestamp is the cursor of the next page
+	page := index("?limit=1")
+	if len(page) != 1 || page[0].Version != "v1.0.0" {
+		t.Fatal(page)
+	}
+	since := page[0].Timestamp.Add(time.Nanosecond).Format(time.RFC3339Nano)
+	if page := index("?limit=1&since=" + since); len(page) != 1 || page[0].Version != "v1.1.0" {
+		t.Fatal(page)
+	}
+
+	// The log survives restarts
+	api = New(Log(t.Log), Index(file, 2), Admin("secret"), withVCS("example.com/", fake), cache)
+	if reloaded := index(""); len(reloaded) != 2 || !reloaded[1].Timestamp.Equal(entries[1].Timestamp) {
+		t.Fatal(reloaded)
+	}
+
+	// and holds only the latest entries
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/example.com/foo/@v/v1.2.0.zip", nil))
+	if w.Code != http.StatusOK {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	api = New(Log(t.Log), Index(file, 2), Admin("secret"))
+	if latest := index(""); len(latest) != 2 || latest[0].Version != "v1.1.0" || latest[1].Version != "v1.2.0" {
+		t.Fatal(latest)
+	}
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/index?since=yesterday", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	api.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Fatal(w.Code)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	primary := &fakeVCS{err: fmt.Errorf("mirror: %w", os.ErrNotExist)}
+	secondary := &fakeVCS{versions: []vcs.Version{"v1.0.0"}, files: map[string]string{"go.mod": "module example.com/foo\n"}}
+	api := New(Log(t.Log), withVCS("example.com/", primary), withVCS("example.com/", secondary))
+	for _, test := range []struct {
+		Path   string
+		Status int
+		Body   string
+	}{
+		{"/example.com/foo/@v/list", http.StatusOK, "v1.0.0\n"},
+		{"/example.com/foo/@v/v1.0.0.info", http.StatusOK, `"Version":"v1.0.0"`},
+		{"/example.com/foo/@v/v1.0.0.mod", http.StatusOK, "module example.com/foo\n"},
+		{"/example.com/foo/@v/v1.0.0.zip", http.StatusOK, ""},
+	} {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("GET", test.Path, nil))
+		if w.Code != test.Status || !strings.Contains(w.Body.String(), test.Body) {
+			t.Fatal(test.Path, w.Code, w.Body.String())
+		}
+	}
+
+	// the error of the last backend is reported when all of them fail
+	secondary.err = errors.New("github is down")
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/example.com/bar/@v/list", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Fatal(w.Code, w.Body.String())
+	}
+}
+
+// flakyVCS fails the given number of timestamp requests before it recovers.
+type flakyVCS struct {
+	*fakeVCS
+	fails int32
+}
+
+func (f *flakyVCS) Timestamp(ctx context.Context, version vcs.Version) (time.Time, error) {
+	if atomic.AddInt32(&f.fails, -1) >= 0 {
+		return time.Time{}, errors.New("mirror is down")
+	}
+	return f.fakeVCS.Timestamp(ctx, version)
+}
+
+func TestFailoverSameSource(t *testing.T) {
+	primary := &flakyVCS{fakeVCS: &fakeVCS{files: map[string]string{"foo.go": "package foo // primary\n"}}, fails: 1}
+	secondary := &fakeVCS{files: map[string]string{"foo.go": "package foo // secondary\n"}}
+	api := New(Log(t.Log), withVCS("example.com/", primary), withVCS("example.com/", secondary))
+	// the primary recovers after the timestamp, the archive still comes from
+	// the secondary that has returned it
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/example.com/foo/@v/v1.0.0.zip", nil))
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), secondary.zip("v1.0.0")) {
+		t.Fatal(w.Code, w.Body.String())
+	}
+}
+
+func TestSummary(t *testing.T) {
+	var mu sync.Mutex
+	summaries := []string{}
+	log := func(v ...interface{}) {
+		if v[0] == "api.summary" {
+			mu.Lock()
+			defer mu.Unlock()
+			summaries = append(summaries, fmt.Sprintln(v...))
+		}
+	}
+	fake := &fakeVCS{files: map[string]string{"go.mod": "module example.com/foo\n"}}
+	api := New(Log(log), withVCS("example.com/", fake), Memory(t.Log, -1), Summary(200*time.Millisecond, 1))
+	for _, path := range []string{"/example.com/foo/@v/v1.0.0.zip", "/example.com/foo/@v/v1.0.0.zip", "/example.com/bar/@v/v1.0.0.info"} {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatal(path, w.Code, w.Body.String())
+		}
+	}
+	size := int64(len(fake.zip("v1.0.0")))
+	want := fmt.Sprintf("api.summary interval 200ms hits 1 misses 2 hitrate 0.333 served_bytes %d fetched_bytes %d top example.com/foo:2\n", 2*size, 2*size)
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		mu.Lock()
+		n := len(summaries)
+		mu.Unlock()
+		if n > 0 {
+			break
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(summaries) == 0 || summaries[0] != want {
+		t.Fatal(summaries, want)
+	}
+}
+
+func TestWorkerRamp(t *testing.T) {
+	var mu sync.Mutex
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	ticks := make(chan time.Time)
+	fakeClock := func(api *api) {
+		api.ramp.now = func() time.Time {
+			mu.Lock()
+			defer mu.Unlock()
+			return now
+		}
+		api.ramp.after = func(time.Duration) <-chan time.Time { return ticks }
+	}
+	api := New(Log(t.Log), VCSWorkers(5), WorkerRamp(1, 10*time.Second), fakeClock).(*api)
+
+	for _, test := range []struct {
+		Elapsed time.Duration
+		Limit   int
+	}{
+		{0, 1},
+		{5 * time.Second, 3},
+		{9 * time.Second, 4},
+		{10 * time.Second, 5},
+	} {
+		mu.Lock()
+		now = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC).Add(test.Elapsed)
+		mu.Unlock()
+		if test.Elapsed > 0 {
+			ticks <- now
+		}
+		// the effective limit is the number of free worker slots
+		for start := time.Now(); cap(api.semc)-len(api.semc) != test.Limit; time.Sleep(time.Millisecond) {
+			if time.Since(start) > 5*time.Second {
+				t.Fatal(test.Elapsed, cap(api.semc)-len(api.semc), test.Limit)
+			}
+		}
+		if limit := api.ramp.limit(5); limit != test.Limit {
+			t.Fatal(test.Elapsed, limit, test.Limit)
+		}
+	}
+}
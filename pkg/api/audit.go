@@ -0,0 +1,62 @@
+package api
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/sixt/gomodproxy/pkg/vcs"
+)
+
+// AuditLog configures API to record every successful response serving a
+// private module, i.e. one matching a -git or a custom VCS prefix, to the
+// given logger. Entries carry the principal (the client IP), the module, the
+// version, where it was served from ("cache" or "vcs") and the time. The basic
+// auth username is added as "claimeduser" if the request has one, e.g. set by
+// an authenticating proxy in front, since the proxy does not verify it. Public
+// modules are never audited.
+func AuditLog(log logger) Option { return func(api *api) { api.audit = log } }
+
+// served records the module version a request has been answered with.
+type served struct {
+	version vcs.Version
+	source  string
+}
+
+type servedKey struct{}
+
+func withServed(ctx context.Context, s *served) context.Context {
+	return context.WithValue(ctx, servedKey{}, s)
+}
+
+func setServed(ctx context.Context, version vcs.Version, source string) {
+	if s, ok := ctx.Value(servedKey{}).(*served); ok {
+		s.version, s.source = version, source
+	}
+}
+
+// principal returns the address of the client that has sent the request.
+func principal(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// auditServe writes the audit entry for a request that has served a private
+// module version.
+func (api *api) auditServe(r *http.Request, module string, s served, code int) {
+	if s.source == "" || code >= http.StatusBadRequest {
+		return
+	}
+	if _, private := api.match(module); !private {
+		return
+	}
+	entry := []interface{}{"api.audit", "principal", principal(r), "module", module, "version", s.version,
+		"source", s.source, "timestamp", time.Now().UTC().Format(time.RFC3339Nano)}
+	if user, _, ok := r.BasicAuth(); ok && user != "" {
+		entry = append(entry, "claimeduser", user)
+	}
+	api.audit(entry...)
+}
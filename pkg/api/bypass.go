@@ -0,0 +1,47 @@
+package api
+
+import (
+	"context"
+	"expvar"
+	"net/http"
+
+	"github.com/sixt/gomodproxy/pkg/vcs"
+)
+
+// cacheBypasses counts the requests that skipped the cache because of the
+// X-Gomodproxy-No-Cache header.
+var cacheBypasses = expvar.NewMap("cache_bypasses_total")
+
+// CacheBypass allows clients to skip the cache for a single request with the
+// "X-Gomodproxy-No-Cache: 1" header, e.g. to refresh a module while debugging.
+// The module is fetched from the VCS and replaces the cached snapshot in all
+// the stores. Without this option the header is ignored, so that clients can
+// not force expensive fetches.
+func CacheBypass() Option {
+	return func(api *api) { api.bypass = true }
+}
+
+type bypassKey struct{}
+
+// withBypass marks the request context to skip the cache, if the request asks
+// for it and the API allows it.
+func (api *api) withBypass(r *http.Request) *http.Request {
+	if !api.bypass || r.Header.Get(noCacheHeader) != "1" {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), bypassKey{}, true))
+}
+
+func bypassed(ctx context.Context) bool {
+	b, _ := ctx.Value(bypassKey{}).(bool)
+	return b
+}
+
+// replace drops the cached snapshot of the module version from the micro-cache
+// and all the stores, so that the freshly fetched one is written in its place.
+func (api *api) replace(ctx context.Context, module string, version vcs.Version) {
+	api.forget(ctx, module, version)
+	for _, store := range api.stores {
+		store.Del(ctx, module, version)
+	}
+}
@@ -0,0 +1,42 @@
+package api
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+
+	"github.com/sixt/gomodproxy/pkg/vcs"
+)
+
+// GoImport makes API answer "?go-get=1" requests for the modules matching the
+// -git and custom VCS prefixes with a go-import meta tag of the "mod" kind
+// pointing at the proxy with the given base URL, e.g.
+// "https://goproxy.example.com". Clients resolving those import paths on
+// their own, e.g. because of GOPRIVATE, then download the modules from the
+// proxy instead of contacting the VCS.
+func GoImport(proxyURL string) Option {
+	return func(api *api) { api.goImport = strings.TrimSuffix(proxyURL, "/") }
+}
+
+func (api *api) serveGoImport(w http.ResponseWriter, r *http.Request) {
+	importPath := strings.Trim(r.URL.Path, "/")
+	path, ok := api.match(importPath)
+	if !ok || importPath == "" {
+		api.notFoundError(w, r)
+		return
+	}
+	// The repository root is the module root in most cases. VCS clients that
+	// can not tell it without fetching the repository get the import path.
+	root := importPath
+	if d, ok := path.vcs(importPath).(vcs.Describer); ok {
+		if remote, err := d.Describe(r.Context()); err == nil && remote.Repo != "" {
+			root = remote.Repo
+		} else if err != nil {
+			api.log("api.goImport", "module", importPath, "error", err)
+		}
+	}
+	content := html.EscapeString(root + " mod " + api.goImport)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, "<!DOCTYPE html>\n<html>\n<head>\n<meta name=\"go-import\" content=\"%s\">\n</head>\n<body>\ngo get %s\n</body>\n</html>\n", content, html.EscapeString(importPath))
+}
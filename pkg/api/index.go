@@ -0,0 +1,198 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sixt/gomodproxy/pkg/vcs"
+)
+
+// indexLimit is the default and the maximum number of index entries returned
+// at once.
+const indexLimit = 2000
+
+type indexEntry struct {
+	Path      string
+	Version   vcs.Version
+	Timestamp time.Time
+}
+
+// index is an append-only log of the module versions the proxy has cached,
+// optionally persisted to a file as newline-delimited JSON. Only the last max
+// entries are kept.
+type index struct {
+	sync.Mutex
+	entries []indexEntry
+	max     int
+	path    string
+	f       *os.File
+	err     error
+}
+
+// Index enables "GET /index?since=<RFC3339 time>&limit=<n>" endpoint that
+// lists the module versions cached by the proxy since the given time, like
+// index.golang.org does. The endpoint is served only with the Admin token,
+// since the log reveals the private modules the proxy has fetched. The log is
+// kept in the given file, or only in memory if the path is empty, and holds at
+// most max entries, older ones are dropped. If the file can not be opened, the
+// index is disabled and the endpoint fails.
+func Index(path string, max int) Option {
+	return func(api *api) {
+		api.index = &index{max: max, path: path}
+		if path != "" {
+			api.index.entries, api.index.f, api.index.err = openIndex(path)
+			if api.index.err == nil && len(api.index.entries) > max {
+				api.index.err = api.index.compact()
+			}
+		}
+	}
+}
+
+func openIndex(path string) ([]indexEntry, *os.File, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	entries := []indexEntry{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		e := indexEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			f.Close()
+			return nil, nil, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		entries = append(entries, e)
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return entries, f, nil
+}
+
+// add appends the module version to the log.
+func (x *index) add(module string, version vcs.Version) error {
+	x.Lock()
+	defer x.Unlock()
+	if x.err != nil {
+		return x.err
+	}
+	e := indexEntry{Path: module, Version: version, Timestamp: time.Now().UTC()}
+	if n := len(x.entries); n > 0 && !e.Timestamp.After(x.entries[n-1].Timestamp) {
+		// keep timestamps increasing for the "since" cursor to work
+		e.Timestamp = x.entries[n-1].Timestamp.Add(time.Nanosecond)
+	}
+	if x.f != nil {
+		b, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if _, err := x.f.Write(append(b, '\n')); err != nil {
+			return err
+		}
+	}
+	x.entries = append(x.entries, e)
+	if len(x.entries) > x.max+x.max/4 {
+		// drop the oldest entries in batches, so that the file is not
+		// rewritten on every addition
+		return x.compact()
+	}
+	return nil
+}
+
+// compact drops all but the last max entries and rewrites the file, if any,
+// with the remaining ones. The lock must be held or the index not yet used.
+func (x *index) compact() error {
+	if n := len(x.entries); n > x.max {
+		x.entries = append([]indexEntry{}, x.entries[n-x.max:]...)
+	}
+	if x.f == nil {
+		return nil
+	}
+	tmp := x.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, e := range x.entries {
+		if err := enc.Encode(e); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, x.path); err != nil {
+		return err
+	}
+	f, err = os.OpenFile(x.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		x.f.Close()
+		x.f, x.err = nil, err
+		return err
+	}
+	x.f.Close()
+	x.f = f
+	return nil
+}
+
+// since returns at most limit entries added at or after the given time.
+func (x *index) since(t time.Time, limit int) ([]indexEntry, error) {
+	x.Lock()
+	defer x.Unlock()
+	if x.err != nil {
+		return nil, x.err
+	}
+	i := sort.Search(len(x.entries), func(i int) bool { return !x.entries[i].Timestamp.Before(t) })
+	entries := x.entries[i:]
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return append([]indexEntry{}, entries...), nil
+}
+
+func (api *api) serveIndex(w http.ResponseWriter, r *http.Request) {
+	since, limit := time.Time{}, indexLimit
+	if s := r.URL.Query().Get("since"); s != "" {
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			http.Error(w, "bad since time: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		since = t
+	}
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			http.Error(w, "bad limit: "+s, http.StatusBadRequest)
+			return
+		}
+		if n < limit {
+			limit = n
+		}
+	}
+	entries, err := api.index.since(since, limit)
+	if err != nil {
+		http.Error(w, "index: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	for _, e := range entries {
+		enc.Encode(e)
+	}
+}
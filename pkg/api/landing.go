@@ -0,0 +1,60 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Landing configures API to answer requests for the root path with a short
+// page about the proxy for people opening it in a browser: the given message,
+// if any, and the module prefixes fetched with the configured VCS clients.
+// Credentials and repository URLs are never shown. Clients accepting
+// "application/json" get the same as a JSON object.
+func Landing(msg string) Option {
+	return func(api *api) { api.landing = &landing{message: msg} }
+}
+
+type landing struct {
+	message string
+}
+
+func (api *api) serveLanding(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	res := struct {
+		Message  string `json:",omitempty"`
+		Prefixes []string
+	}{Message: api.landing.message, Prefixes: []string{}}
+	seen := map[string]bool{}
+	api.RLock()
+	for _, path := range api.vcsPaths {
+		if !seen[path.prefix] {
+			seen[path.prefix] = true
+			res.Prefixes = append(res.Prefixes, path.prefix)
+		}
+	}
+	api.RUnlock()
+
+	w.Header().Set("Cache-Control", "no-cache")
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "gomodproxy - Go module proxy")
+	if res.Message != "" {
+		fmt.Fprintf(w, "\n%s\n", res.Message)
+	}
+	fmt.Fprintln(w, "\nUse it with GOPROXY set to the URL of this page.")
+	if len(res.Prefixes) > 0 {
+		fmt.Fprintln(w, "\nModules fetched from the configured repositories:")
+		for _, prefix := range res.Prefixes {
+			fmt.Fprintf(w, "  %s\n", prefix)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package api
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sixt/gomodproxy/pkg/vcs"
+)
+
+// LogOption wraps the API logger to change what is logged.
+type LogOption func(logger) logger
+
+// DedupErrors collapses log entries with the same message, module and error
+// kind into the first one, e.g. while a VCS host is down. The number of
+// entries dropped is logged once the window is over.
+func DedupErrors(window time.Duration) LogOption {
+	return func(log logger) logger {
+		d := &dedupLog{log: log, window: window, seen: map[dedupKey]int{}}
+		return d.print
+	}
+}
+
+type dedupKey struct {
+	msg    interface{}
+	module interface{}
+	kind   vcs.ErrorKind
+}
+
+type dedupLog struct {
+	log    logger
+	window time.Duration
+	sync.Mutex
+	seen map[dedupKey]int
+}
+
+func (d *dedupLog) print(v ...interface{}) {
+	key, ok := dedupKey{}, false
+	if len(v)%2 != 0 {
+		key.msg = v[0]
+		for i := 1; i+1 < len(v); i = i + 2 {
+			switch v[i] {
+			case "module":
+				key.module = v[i+1]
+			case "error":
+				if err, isErr := v[i+1].(error); isErr {
+					key.kind, ok = vcs.Classify(err), true
+				}
+			}
+		}
+	}
+	if !ok {
+		d.log(v...)
+		return
+	}
+
+	d.Lock()
+	n, dup := d.seen[key]
+	d.seen[key] = n + 1
+	d.Unlock()
+	if dup {
+		return
+	}
+	d.log(v...)
+	time.AfterFunc(d.window, func() {
+		d.Lock()
+		n := d.seen[key] - 1
+		delete(d.seen, key)
+		d.Unlock()
+		if n > 0 {
+			d.log(key.msg, "module", key.module, "error", key.kind, "repeated", n, "window", d.window)
+		}
+	})
+}
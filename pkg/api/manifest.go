@@ -0,0 +1,76 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sixt/gomodproxy/pkg/vcs"
+)
+
+type manifest struct {
+	modules map[string]map[vcs.Version]string
+	err     error
+}
+
+// Manifest configures API to serve git modules listed in the given file only
+// at the declared versions, each from the declared commit, instead of using
+// the repository tags. Every line of the file contains a module path, a
+// version and a full commit hash, lines starting with "#" are ignored. If the
+// file can not be read, all git fetches fail.
+func Manifest(path string) Option {
+	return func(api *api) {
+		api.manifest = &manifest{}
+		api.manifest.modules, api.manifest.err = readManifest(path)
+	}
+}
+
+func readManifest(path string) (map[string]map[vcs.Version]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	modules := map[string]map[vcs.Version]string{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		} else if len(fields) != 3 || len(fields[2]) != 40 {
+			return nil, fmt.Errorf("%s:%d: malformed manifest line", path, n)
+		}
+		if modules[fields[0]] == nil {
+			modules[fields[0]] = map[vcs.Version]string{}
+		}
+		modules[fields[0]][vcs.Version(fields[1])] = fields[2]
+	}
+	return modules, scanner.Err()
+}
+
+// versions returns the declared versions of the module, if any.
+func (m *manifest) versions(module string) (map[vcs.Version]string, bool) {
+	if m == nil {
+		return nil, false
+	}
+	versions, ok := m.modules[module]
+	return versions, ok
+}
+
+// failedVCS is a VCS client that fails every request, e.g. when its
+// configuration can not be loaded.
+type failedVCS struct{ err error }
+
+func (f failedVCS) List(ctx context.Context) ([]vcs.Version, error) { return nil, f.err }
+
+func (f failedVCS) Timestamp(ctx context.Context, version vcs.Version) (time.Time, error) {
+	return time.Time{}, f.err
+}
+
+func (f failedVCS) Zip(ctx context.Context, version vcs.Version) (io.ReadCloser, error) {
+	return nil, f.err
+}
@@ -0,0 +1,60 @@
+package api
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"sync"
+)
+
+// durationBuckets are upper bounds of the request duration histogram buckets
+// in seconds, from cache hits to cold VCS fetches.
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// histogram is an expvar.Var that counts observed values in cumulative
+// buckets, the same way Prometheus histograms do.
+type histogram struct {
+	sync.Mutex
+	bounds []float64
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+// Observe adds a single value to the histogram.
+func (h *histogram) Observe(v float64) {
+	h.Lock()
+	defer h.Unlock()
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum = h.sum + v
+}
+
+// String returns a JSON object with cumulative bucket counts keyed by their
+// upper bounds, the total count and the sum of observed values.
+func (h *histogram) String() string {
+	h.Lock()
+	defer h.Unlock()
+	buckets := map[string]uint64{}
+	n := uint64(0)
+	for i, bound := range h.bounds {
+		n = n + h.counts[i]
+		buckets[strconv.FormatFloat(bound, 'g', -1, 64)] = n
+	}
+	buckets[strconv.FormatFloat(math.Inf(1), 'g', -1, 64)] = h.count
+	b, _ := json.Marshal(struct {
+		Buckets map[string]uint64 `json:"buckets"`
+		Count   uint64            `json:"count"`
+		Sum     float64           `json:"sum"`
+	}{buckets, h.count, h.sum})
+	return string(b)
+}
@@ -0,0 +1,30 @@
+package api
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram([]float64{0.1, 1, 10})
+	for _, v := range []float64{0.05, 0.5, 0.7, 5, 50} {
+		h.Observe(v)
+	}
+	m := struct {
+		Buckets map[string]uint64
+		Count   uint64
+		Sum     float64
+	}{}
+	if err := json.Unmarshal([]byte(h.String()), &m); err != nil {
+		t.Fatal(err)
+	}
+	// buckets should be cumulative
+	for le, n := range map[string]uint64{"0.1": 1, "1": 3, "10": 4, "+Inf": 5} {
+		if m.Buckets[le] != n {
+			t.Fatal(le, m.Buckets)
+		}
+	}
+	if m.Count != 5 || m.Sum != 56.25 {
+		t.Fatal(m)
+	}
+}
@@ -0,0 +1,40 @@
+package api
+
+import (
+	"context"
+	"expvar"
+
+	"github.com/sixt/gomodproxy/pkg/store"
+	"github.com/sixt/gomodproxy/pkg/vcs"
+)
+
+// microHits counts the cache hits served by the micro-cache, which are also
+// counted in cache_hits_total.
+var microHits = expvar.NewMap("micro_cache_hits_total")
+
+// MicroCache configures API to keep the last n served snapshots, of at most
+// limit bytes in total, in a tiny in-process LRU cache in front of all the
+// configured stores. It absorbs bursts of identical requests, e.g. from many
+// CI jobs building the same project at once, when only a slow disk or remote
+// store is configured.
+func MicroCache(n int, limit int64) Option {
+	return func(api *api) {
+		log := func(v ...interface{}) { api.log(v...) }
+		api.micro = store.Memory(log, limit, store.MemoryMaxItems(n))
+	}
+}
+
+// remember puts the served snapshot into the micro-cache, if enabled.
+func (api *api) remember(ctx context.Context, snapshot store.Snapshot) {
+	if api.micro != nil {
+		api.micro.Put(ctx, snapshot)
+	}
+}
+
+// forget drops the module version from the micro-cache, if enabled, so that
+// deleted snapshots are not served from it.
+func (api *api) forget(ctx context.Context, module string, version vcs.Version) {
+	if api.micro != nil {
+		api.micro.Del(ctx, module, version)
+	}
+}
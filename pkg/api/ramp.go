@@ -0,0 +1,63 @@
+package api
+
+import "time"
+
+// ramp raises the number of VCS workers from the initial value to the full
+// one over the warm-up period, so that a cold proxy is not overwhelmed by
+// the first burst of cache misses.
+type ramp struct {
+	start  int
+	period time.Duration
+	began  time.Time
+	now    func() time.Time
+	after  func(d time.Duration) <-chan time.Time
+}
+
+// WorkerRamp configures API to start with n VCS workers and to raise their
+// number linearly to the VCSWorkers limit over the given period after the
+// start. Reloading the config with a different number of workers makes all of
+// them available at once.
+func WorkerRamp(n int, period time.Duration) Option {
+	return func(api *api) {
+		api.ramp = &ramp{start: n, period: period, now: time.Now, after: time.After}
+	}
+}
+
+// limit returns the number of workers allowed at the moment.
+func (r *ramp) limit(full int) int {
+	start := r.start
+	if start < 1 {
+		start = 1
+	}
+	elapsed := r.now().Sub(r.began)
+	if start >= full || elapsed >= r.period {
+		return full
+	} else if elapsed < 0 {
+		return start
+	}
+	return start + int(int64(full-start)*int64(elapsed)/int64(r.period))
+}
+
+// hold takes the worker slots above the current limit from the semaphore and
+// gives them back one by one as the limit grows.
+func (r *ramp) hold(semc chan struct{}) {
+	r.began = r.now()
+	full := cap(semc)
+	held := full - r.limit(full)
+	if held <= 0 {
+		return
+	}
+	for i := 0; i < held; i++ {
+		semc <- struct{}{}
+	}
+	step := r.period / time.Duration(held)
+	go func() {
+		for held > 0 {
+			<-r.after(step)
+			for held > full-r.limit(full) {
+				<-semc
+				held--
+			}
+		}
+	}()
+}
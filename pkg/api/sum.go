@@ -0,0 +1,103 @@
+package api
+
+import (
+	"bufio"
+	"errors"
+	"expvar"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/sixt/gomodproxy/pkg/store"
+	"github.com/sixt/gomodproxy/pkg/vcs"
+)
+
+var (
+	errHashMismatch = errors.New("module hash does not match go.sum")
+	errNoSum        = errors.New("module is missing in go.sum")
+)
+
+var hashMismatches = expvar.NewMap("hash_mismatch_total")
+
+type sums struct {
+	hashes  map[string]string
+	err     error
+	require bool
+}
+
+// VerifySum configures API to check the "h1:" hashes of the modules fetched
+// from the VCS against the given go.sum file before caching and serving them.
+// Modules that are missing in go.sum are served as is, unless RequireSum
+// option is given. If go.sum can not be read, all fetches fail.
+func VerifySum(path string) Option {
+	return func(api *api) {
+		if api.sums == nil {
+			api.sums = &sums{}
+		}
+		api.sums.hashes, api.sums.err = readSums(path)
+	}
+}
+
+// RequireSum makes API refuse to serve the modules that are missing in the
+// go.sum file given with VerifySum option.
+func RequireSum() Option {
+	return func(api *api) {
+		if api.sums == nil {
+			api.sums = &sums{}
+		}
+		api.sums.require = true
+	}
+}
+
+// readSums parses go.sum file into a map of module archive hashes keyed by
+// "module@version". Hashes of go.mod files are skipped.
+func readSums(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	hashes := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		} else if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: malformed go.sum line", path, n)
+		}
+		if strings.HasSuffix(fields[1], "/go.mod") {
+			continue
+		}
+		hashes[fields[0]+"@"+fields[1]] = fields[2]
+	}
+	return hashes, scanner.Err()
+}
+
+// verify checks the module archive against the go.sum hashes, if configured.
+func (api *api) verify(module string, version vcs.Version, data []byte) error {
+	if api.sums == nil {
+		return nil
+	}
+	if api.sums.err != nil {
+		// not wrapped, so that a missing go.sum is not reported as a missing module
+		return fmt.Errorf("go.sum: %v", api.sums.err)
+	}
+	want, ok := api.sums.hashes[module+"@"+string(version)]
+	if !ok {
+		if api.sums.require {
+			return fmt.Errorf("%s@%s: %w", module, version, errNoSum)
+		}
+		return nil
+	}
+	got, err := store.HashZip(data)
+	if err != nil {
+		return err
+	}
+	if got != want {
+		hashMismatches.Add(module, 1)
+		api.log("api.verify", "module", module, "version", version, "want", want, "got", got)
+		return fmt.Errorf("%s@%s: %w", module, version, errHashMismatch)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package api
+
+import (
+	"expvar"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// summary periodically logs how effective the caches have been.
+type summary struct {
+	interval time.Duration
+	top      int
+	// last holds the counter values at the previous report, by metric and
+	// module.
+	last map[*expvar.Map]map[string]int64
+}
+
+// Summary configures API to log a summary of the cache effectiveness every
+// interval: the number of cache hits and misses, the hit rate, the bytes of
+// module archives served to the clients and fetched from the VCS, and the top
+// modules by the number of requests. Every summary covers only the last
+// interval, while the underlying metrics keep counting since the start.
+func Summary(interval time.Duration, top int) Option {
+	return func(api *api) { api.summary = &summary{interval: interval, top: top} }
+}
+
+// run logs the summaries, counting from the last call to delta.
+func (s *summary) run(log logger) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.report(log)
+	}
+}
+
+func (s *summary) report(log logger) {
+	d := s.delta()
+	hits, misses := total(d[cacheHits]), total(d[cacheMisses])
+	rate := 0.0
+	if hits+misses > 0 {
+		rate = float64(hits) / float64(hits+misses)
+	}
+	requests := map[string]int64{}
+	for _, m := range []*expvar.Map{cacheHits, cacheMisses} {
+		for module, n := range d[m] {
+			requests[module] += n
+		}
+	}
+	modules := []string{}
+	for module := range requests {
+		modules = append(modules, module)
+	}
+	sort.Slice(modules, func(i, j int) bool {
+		if requests[modules[i]] != requests[modules[j]] {
+			return requests[modules[i]] > requests[modules[j]]
+		}
+		return modules[i] < modules[j]
+	})
+	if len(modules) > s.top {
+		modules = modules[:s.top]
+	}
+	hot := []string{}
+	for _, module := range modules {
+		hot = append(hot, fmt.Sprintf("%s:%d", module, requests[module]))
+	}
+	log("api.summary", "interval", s.interval, "hits", hits, "misses", misses,
+		"hitrate", fmt.Sprintf("%.3f", rate), "served_bytes", total(d[zipServedBytes]),
+		"fetched_bytes", total(d[vcsFetchedBytes]), "top", strings.Join(hot, ","))
+}
+
+// delta returns the increase of the counters since the previous call.
+func (s *summary) delta() map[*expvar.Map]map[string]int64 {
+	d := map[*expvar.Map]map[string]int64{}
+	current := map[*expvar.Map]map[string]int64{}
+	for _, m := range []*expvar.Map{cacheHits, cacheMisses, zipServedBytes, vcsFetchedBytes} {
+		current[m], d[m] = map[string]int64{}, map[string]int64{}
+		m.Do(func(kv expvar.KeyValue) {
+			if v, ok := kv.Value.(*expvar.Int); ok {
+				current[m][kv.Key] = v.Value()
+				if n := v.Value() - s.last[m][kv.Key]; n > 0 {
+					d[m][kv.Key] = n
+				}
+			}
+		})
+	}
+	s.last = current
+	return d
+}
+
+func total(m map[string]int64) (n int64) {
+	for _, v := range m {
+		n = n + v
+	}
+	return n
+}
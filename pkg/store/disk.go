@@ -1,23 +1,115 @@
 package store
 
 import (
+	"archive/zip"
+	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/sixt/gomodproxy/pkg/vcs"
 )
 
-type disk string
+const (
+	blobsDir = ".blobs"
+	trashDir = ".trash"
+)
+
+// storeErrors counts failed store operations by store and operation name, e.g.
+// "disk.put", so that cache backend failures can be alerted on.
+var storeErrors = expvar.NewMap("store_errors_total")
+
+// skippedWrites counts snapshots that were not written to the disk, because an
+// identical archive was already there, e.g. written by another proxy instance
+// sharing the cache directory.
+var skippedWrites = expvar.NewInt("store_skipped_writes_total")
+
+// countError increments the error counter of the operation if err is not nil.
+func countError(op string, err error) error {
+	if err != nil {
+		storeErrors.Add(op, 1)
+	}
+	return err
+}
+
+type disk struct {
+	sync.Mutex
+	dir     string
+	dedup   bool
+	grace   time.Duration
+	digests []Digest
+}
+
+// DiskOption configures a disk store.
+type DiskOption func(*disk)
+
+// Dedup makes the disk store keep identical module contents only once, e.g.
+// of pseudo-versions of commits that did not change the module. Archives are
+// kept without their "module@version/" prefix, every module version becomes a
+// small pointer file referring to such an archive by its "h1:" hash, and the
+// archive of the version is rebuilt from it when read. Archives are removed
+// when no pointers refer to them. The references are counted by the store
+// itself, so a deduplicated directory must not be shared by several processes.
+func Dedup() DiskOption { return func(d *disk) { d.dedup = true } }
+
+// SoftDelete makes the disk store move deleted snapshots into the ".trash"
+// subdirectory and keep them there for the given grace period, so that they
+// can be restored.
+func SoftDelete(grace time.Duration) DiskOption { return func(d *disk) { d.grace = grace } }
+
+// ExtraDigests makes the disk store compute the given digests of every archive
+// it writes and keep them, together with the "h1:" hash, as a JSON object in
+// the ".digests" file next to the archive.
+func ExtraDigests(digests ...Digest) DiskOption {
+	return func(d *disk) { d.digests = append(d.digests, digests...) }
+}
 
 // Disk returns a local disk cache that stores files within a given directory.
-func Disk(dir string) Store { return disk(dir) }
+func Disk(dir string, options ...DiskOption) Store {
+	d := &disk{dir: dir}
+	for _, opt := range options {
+		opt(d)
+	}
+	return d
+}
+
+func (d *disk) Put(ctx context.Context, snapshot Snapshot) error {
+	return countError("disk.put", d.put(snapshot))
+}
+
+func (d *disk) Get(ctx context.Context, module string, version vcs.Version) (Snapshot, error) {
+	s, err := d.get(module, version)
+	// missing files are regular cache misses rather than failures
+	if err != nil && !os.IsNotExist(err) {
+		countError("disk.get", err)
+	}
+	return s, err
+}
 
-func (d disk) Put(ctx context.Context, snapshot Snapshot) error {
-	dir := string(d)
-	timeFile := filepath.Join(dir, snapshot.Key()+".time")
-	zipFile := filepath.Join(dir, snapshot.Key()+".zip")
+func (d *disk) Del(ctx context.Context, module string, version vcs.Version) error {
+	err := d.del(module, version)
+	if err != nil && !os.IsNotExist(err) {
+		countError("disk.del", err)
+	}
+	return err
+}
+
+func (d *disk) put(snapshot Snapshot) error {
+	timeFile := filepath.Join(d.dir, snapshot.Key()+".time")
+
+	d.Lock()
+	defer d.Unlock()
 
 	if err := os.MkdirAll(filepath.Dir(timeFile), 0755); err != nil {
 		return err
@@ -27,35 +119,417 @@ func (d disk) Put(ctx context.Context, snapshot Snapshot) error {
 	if err != nil {
 		return err
 	}
-	if err := ioutil.WriteFile(timeFile, t, 0644); err != nil {
+	if _, err := writeFile(timeFile, t); err != nil {
+		return err
+	}
+	hashFile := filepath.Join(d.dir, snapshot.Key()+".hash")
+	if snapshot.Hash == "" {
+		if err := os.Remove(hashFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else if _, err := writeFile(hashFile, []byte(snapshot.Hash)); err != nil {
 		return err
 	}
-	return ioutil.WriteFile(zipFile, snapshot.Data, 0644)
+	deduped := false
+	if d.dedup {
+		// the digests are of the archive that is served, i.e. rebuilt
+		if snapshot.Data, deduped, err = d.putBlob(snapshot); err != nil {
+			return err
+		}
+	}
+	if len(d.digests) > 0 {
+		sums, err := Digests(snapshot.Data, d.digests...)
+		if err != nil {
+			return err
+		}
+		b, err := json.Marshal(sums)
+		if err != nil {
+			return err
+		}
+		if _, err := writeFile(filepath.Join(d.dir, snapshot.Key()+".digests"), b); err != nil {
+			return err
+		}
+	}
+	if deduped {
+		return nil
+	}
+	written, err := writeFile(filepath.Join(d.dir, snapshot.Key()+".zip"), snapshot.Data)
+	if err == nil && !written {
+		skippedWrites.Add(1)
+	}
+	return err
 }
 
-func (d disk) Get(ctx context.Context, module string, version vcs.Version) (Snapshot, error) {
-	dir := string(d)
+// writeFile atomically replaces the file with the given data, unless it already
+// has exactly the same contents, and reports whether the file was written.
+// Readers never see partially written files, even if several processes write
+// the same file at once.
+func writeFile(name string, data []byte) (bool, error) {
+	if fi, err := os.Stat(name); err == nil && fi.Size() == int64(len(data)) {
+		if old, err := ioutil.ReadFile(name); err == nil && bytes.Equal(old, data) {
+			return false, nil
+		}
+	}
+	f, err := ioutil.TempFile(filepath.Dir(name), "."+filepath.Base(name)+".tmp")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return false, err
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return false, err
+	}
+	if err := f.Close(); err != nil {
+		return false, err
+	}
+	return true, os.Rename(f.Name(), name)
+}
+
+func (d *disk) get(module string, version vcs.Version) (Snapshot, error) {
 	s := Snapshot{Module: module, Version: version}
-	t, err := ioutil.ReadFile(filepath.Join(dir, s.Key()+".time"))
+	t, err := ioutil.ReadFile(filepath.Join(d.dir, s.Key()+".time"))
 	if err != nil {
 		return Snapshot{}, err
 	}
 	if err := s.Timestamp.UnmarshalText(t); err != nil {
 		return Snapshot{}, err
 	}
-	s.Data, err = ioutil.ReadFile(filepath.Join(dir, s.Key()+".zip"))
+	if hash, err := ioutil.ReadFile(filepath.Join(d.dir, s.Key()+".hash")); err == nil {
+		s.Hash = string(hash)
+	}
+	if d.dedup {
+		// Snapshots written before deduplication was enabled have no pointer
+		// file, so fall back to reading the archive directly.
+		if sum, err := ioutil.ReadFile(filepath.Join(d.dir, s.Key()+".sum")); err == nil {
+			blob, err := ioutil.ReadFile(d.blobFile(string(sum), ".zip"))
+			if err != nil {
+				return Snapshot{}, err
+			}
+			s.Data, err = renameZip(blob, "", zipPrefix(module, version))
+			return s, err
+		}
+	}
+	s.Data, err = ioutil.ReadFile(filepath.Join(d.dir, s.Key()+".zip"))
 	return s, err
 }
 
-func (d disk) Del(ctx context.Context, module string, version vcs.Version) error {
-	dir := string(d)
-	s := Snapshot{Module: module, Version: version}
-	err := os.Remove(filepath.Join(dir, s.Key()+".time"))
+func (d *disk) del(module string, version vcs.Version) error {
+	key := Snapshot{Module: module, Version: version}.Key()
+	d.Lock()
+	defer d.Unlock()
+	if d.grace > 0 {
+		d.purge()
+		return d.trash(key)
+	}
+	return d.remove(filepath.Join(d.dir, key))
+}
+
+// Restore brings back a snapshot deleted within the grace period.
+func (d *disk) Restore(ctx context.Context, module string, version vcs.Version) error {
+	key := Snapshot{Module: module, Version: version}.Key()
+	d.Lock()
+	defer d.Unlock()
+	d.purge()
+	trashed := filepath.Join(d.dir, trashDir, key)
+	if _, err := os.Stat(trashed + ".deleted"); err != nil {
+		return err
+	}
+	base := filepath.Join(d.dir, key)
+	if _, err := os.Stat(base + ".time"); err == nil {
+		// snapshot has been fetched again since it was deleted
+		if err := d.remove(trashed); err != nil {
+			return err
+		}
+	} else if err := move(trashed, base); err != nil {
+		return err
+	}
+	return os.Remove(trashed + ".deleted")
+}
+
+// Entries returns the snapshots kept on the disk, except the deleted ones
+// kept for a grace period. With deduplication the size is the one of the
+// shared archive without the version prefix.
+func (d *disk) Entries(ctx context.Context) ([]Entry, error) {
+	d.Lock()
+	defer d.Unlock()
+	entries := []Entry{}
+	err := filepath.Walk(d.dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() && (fi.Name() == blobsDir || fi.Name() == trashDir) {
+			return filepath.SkipDir
+		}
+		if fi.IsDir() || !strings.HasSuffix(path, ".time") {
+			return nil
+		}
+		rel, err := filepath.Rel(d.dir, strings.TrimSuffix(path, ".time"))
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		i := strings.LastIndex(key, "@")
+		if i < 0 {
+			return nil
+		}
+		e := Entry{Module: vcs.DecodeBangs(key[:i]), Version: vcs.Version(vcs.DecodeBangs(key[i+1:]))}
+		zip := strings.TrimSuffix(path, ".time") + ".zip"
+		if sum, err := ioutil.ReadFile(strings.TrimSuffix(path, ".time") + ".sum"); err == nil {
+			zip = d.blobFile(string(sum), ".zip")
+		}
+		if zfi, err := os.Stat(zip); err == nil {
+			e.Size = zfi.Size()
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+	return entries, err
+}
+
+// Reset deletes all snapshots from the disk. Deleted snapshots are kept for
+// the grace period, if configured.
+func (d *disk) Reset(ctx context.Context) error {
+	entries, err := d.Entries(ctx)
 	if err != nil {
 		return err
 	}
-	err = os.Remove(filepath.Join(dir, s.Key()+".zip"))
+	for _, e := range entries {
+		if err := d.Del(ctx, e.Module, e.Version); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// remove deletes the snapshot files with the given path prefix. The caller
+// must hold the lock.
+func (d *disk) remove(base string) error {
+	if err := os.Remove(base + ".time"); err != nil {
+		return err
+	}
+	for _, ext := range []string{".digests", ".hash"} {
+		if err := os.Remove(base + ext); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if d.dedup {
+		if sum, err := ioutil.ReadFile(base + ".sum"); err == nil {
+			if err := os.Remove(base + ".sum"); err != nil {
+				return err
+			}
+			return d.unref(string(sum))
+		}
+	}
+	return os.Remove(base + ".zip")
+}
+
+// trash moves the snapshot files into the trash directory and records the
+// time of deletion. The caller must hold the lock.
+func (d *disk) trash(key string) error {
+	base := filepath.Join(d.dir, key)
+	if _, err := os.Stat(base + ".time"); err != nil {
+		return err
+	}
+	trashed := filepath.Join(d.dir, trashDir, key)
+	if err := move(base, trashed); err != nil {
+		return err
+	}
+	t, err := time.Now().MarshalText()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(trashed+".deleted", t, 0644)
+}
+
+// purge removes the trashed snapshots deleted earlier than the grace period
+// ago. The caller must hold the lock.
+func (d *disk) purge() {
+	filepath.Walk(filepath.Join(d.dir, trashDir), func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() || !strings.HasSuffix(path, ".deleted") {
+			return nil
+		}
+		var t time.Time
+		if b, err := ioutil.ReadFile(path); err != nil || t.UnmarshalText(b) != nil || time.Since(t) <= d.grace {
+			return nil
+		}
+		if err := d.remove(strings.TrimSuffix(path, ".deleted")); err != nil && !os.IsNotExist(err) {
+			countError("disk.purge", err)
+			return nil
+		}
+		os.Remove(path)
+		return nil
+	})
+}
+
+// move renames the snapshot files from one path prefix to another.
+func move(from, to string) error {
+	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		return err
+	}
+	for _, ext := range []string{".time", ".zip", ".sum", ".digests", ".hash"} {
+		if err := os.Rename(from+ext, to+ext); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *disk) Close() error { return nil }
+
+// putBlob stores the archive without the version prefix once per hash of its
+// contents and points the snapshot to it. It returns the archive rebuilt from
+// the stored one, which is served from now on, and false if the archive is not
+// a module archive and has to be stored as is. The caller must hold the lock.
+func (d *disk) putBlob(snapshot Snapshot) ([]byte, bool, error) {
+	sumFile := filepath.Join(d.dir, snapshot.Key()+".sum")
+	blob, err := renameZip(snapshot.Data, zipPrefix(snapshot.Module, snapshot.Version), "")
+	if err == errNoPrefix {
+		if old, err := ioutil.ReadFile(sumFile); err == nil {
+			if err := d.unref(string(old)); err != nil {
+				return nil, false, err
+			}
+			if err := os.Remove(sumFile); err != nil {
+				return nil, false, err
+			}
+		}
+		return snapshot.Data, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	sum, err := HashZip(blob)
+	if err != nil {
+		return nil, false, err
+	}
+
+	old, err := ioutil.ReadFile(sumFile)
+	if err != nil || string(old) != sum {
+		if err == nil {
+			if err := d.unref(string(old)); err != nil {
+				return nil, false, err
+			}
+		}
+		refs, err := d.refs(sum)
+		if err != nil {
+			return nil, false, err
+		}
+		if refs == 0 {
+			if err := os.MkdirAll(filepath.Join(d.dir, blobsDir), 0755); err != nil {
+				return nil, false, err
+			}
+			if _, err := writeFile(d.blobFile(sum, ".zip"), blob); err != nil {
+				return nil, false, err
+			}
+		}
+		if err := d.setRefs(sum, refs+1); err != nil {
+			return nil, false, err
+		}
+		if _, err := writeFile(sumFile, []byte(sum)); err != nil {
+			return nil, false, err
+		}
+		// the archive stored before deduplication was enabled is not read anymore
+		if err := os.Remove(filepath.Join(d.dir, snapshot.Key()+".zip")); err != nil && !os.IsNotExist(err) {
+			return nil, false, err
+		}
+	} else {
+		skippedWrites.Add(1)
+	}
+	// an identical module may have been stored with different file headers
+	if blob, err = ioutil.ReadFile(d.blobFile(sum, ".zip")); err != nil {
+		return nil, false, err
+	}
+	data, err := renameZip(blob, "", zipPrefix(snapshot.Module, snapshot.Version))
+	return data, true, err
+}
+
+// errNoPrefix is reported for archives with files outside of the module
+// version directory.
+var errNoPrefix = errors.New("not a module archive")
+
+// zipPrefix returns the directory of the module version in its archive.
+func zipPrefix(module string, version vcs.Version) string {
+	return module + "@" + string(version) + "/"
+}
+
+// renameZip returns a copy of the archive with the prefix of the file names
+// replaced. File headers and contents are kept, so renaming the files back
+// gives the same archive if it has been written by archive/zip.
+func renameZip(data []byte, from, to string) ([]byte, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	b := &bytes.Buffer{}
+	zw := zip.NewWriter(b)
+	for _, f := range zr.File {
+		if !strings.HasPrefix(f.Name, from) {
+			return nil, errNoPrefix
+		}
+		fh := f.FileHeader
+		fh.Name = to + strings.TrimPrefix(f.Name, from)
+		// the raw timestamps and extra fields are written as they are
+		fh.Modified = time.Time{}
+		w, err := zw.CreateHeader(&fh)
+		if err != nil {
+			return nil, err
+		}
+		r, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.Copy(w, r)
+		r.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (d *disk) unref(sum string) error {
+	refs, err := d.refs(sum)
+	if err != nil {
+		return err
+	}
+	if refs > 1 {
+		return d.setRefs(sum, refs-1)
+	}
+	if err := os.Remove(d.blobFile(sum, ".refs")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Remove(d.blobFile(sum, ".zip"))
+}
+
+func (d *disk) refs(sum string) (int, error) {
+	b, err := ioutil.ReadFile(d.blobFile(sum, ".refs"))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(b)))
+}
+
+func (d *disk) setRefs(sum string, n int) error {
+	_, err := writeFile(d.blobFile(sum, ".refs"), []byte(strconv.Itoa(n)))
 	return err
 }
 
-func (d disk) Close() error { return nil }
+// blobFile returns a path of the content-addressed blob file for the given
+// "h1:" hash. Base64 is not safe for file names, so the hash is hex-encoded.
+func (d *disk) blobFile(sum string, ext string) string {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(sum, "h1:"))
+	if err != nil {
+		b = []byte(sum)
+	}
+	return filepath.Join(d.dir, blobsDir, hex.EncodeToString(b)+ext)
+}
@@ -0,0 +1,444 @@
+package store
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sixt/gomodproxy/pkg/vcs"
+)
+
+func testZip(t *testing.T, files ...string) []byte {
+	b := &bytes.Buffer{}
+	zw := zip.NewWriter(b)
+	for i := 0; i+1 < len(files); i = i + 2 {
+		w, err := zw.Create(files[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(files[i+1]))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func testDir(t *testing.T) string {
+	dir, err := ioutil.TempDir(os.TempDir(), "gomodproxy_store_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func blobs(t *testing.T, dir string) []string {
+	names, err := filepath.Glob(filepath.Join(dir, blobsDir, "*.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func TestDiskStore(t *testing.T) {
+	ctx := context.Background()
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+
+	d := Disk(dir)
+	data := testZip(t, "foo@v1.0.0/foo.go", "package foo")
+	hash := strings.Repeat("a", 40)
+	if err := d.Put(ctx, Snapshot{Module: "foo", Version: "v1.0.0", Data: data, Hash: hash}); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := d.Get(ctx, "foo", "v1.0.0"); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(res.Data, data) || res.Hash != hash {
+		t.Fatal(res)
+	}
+	if err := d.Del(ctx, "foo", "v1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := d.Get(ctx, "foo", "v1.0.0"); err == nil {
+		t.Fatal(res)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "foo@v1.0.0.hash")); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+}
+
+func TestDiskStoreDedup(t *testing.T) {
+	ctx := context.Background()
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+
+	d := Disk(dir, Dedup())
+	// module archives of versions with the same contents differ by the prefix
+	archives := map[string][]byte{
+		"v0.0.0-20180101000000-aaaaaaaaaaaa": testZip(t, "foo@v0.0.0-20180101000000-aaaaaaaaaaaa/foo.go", "package foo"),
+		"v0.0.0-20180102000000-aaaaaaaaaaaa": testZip(t, "foo@v0.0.0-20180102000000-aaaaaaaaaaaa/foo.go", "package foo"),
+		"v1.0.0":                             testZip(t, "foo@v1.0.0/foo.go", "package foo // changed"),
+	}
+	for version, data := range archives {
+		if err := d.Put(ctx, Snapshot{Module: "foo", Version: vcs.Version(version), Data: data}); err != nil {
+			t.Fatal(version, err)
+		}
+	}
+
+	// identical contents should be stored only once
+	if n := len(blobs(t, dir)); n != 2 {
+		t.Fatal(n)
+	}
+
+	// pointers should resolve to the archive of the right version
+	for version, data := range archives {
+		if res, err := d.Get(ctx, "foo", vcs.Version(version)); err != nil {
+			t.Fatal(version, err)
+		} else if !bytes.Equal(res.Data, data) {
+			t.Fatal(version, res)
+		}
+	}
+
+	// archives that are not module archives are stored as they are
+	notModule := testZip(t, "foo/foo.go", "package foo")
+	if err := d.Put(ctx, Snapshot{Module: "bar", Version: "v1.0.0", Data: notModule}); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := d.Get(ctx, "bar", "v1.0.0"); err != nil || !bytes.Equal(res.Data, notModule) {
+		t.Fatal(res, err)
+	}
+	if err := d.Del(ctx, "bar", "v1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+
+	// shared archive should remain until the last reference is removed
+	if err := d.Del(ctx, "foo", "v0.0.0-20180101000000-aaaaaaaaaaaa"); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(blobs(t, dir)); n != 2 {
+		t.Fatal(n)
+	}
+	if _, err := d.Get(ctx, "foo", "v0.0.0-20180102000000-aaaaaaaaaaaa"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Del(ctx, "foo", "v0.0.0-20180102000000-aaaaaaaaaaaa"); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(blobs(t, dir)); n != 1 {
+		t.Fatal(n)
+	}
+	if err := d.Del(ctx, "foo", "v1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(blobs(t, dir)); n != 0 {
+		t.Fatal(n)
+	}
+
+	// archives stored before deduplication was enabled are replaced
+	if err := Disk(dir).Put(ctx, Snapshot{Module: "foo", Version: "v1.0.0", Data: archives["v1.0.0"]}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put(ctx, Snapshot{Module: "foo", Version: "v1.0.0", Data: archives["v1.0.0"]}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "foo@v1.0.0.zip")); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	if res, err := d.Get(ctx, "foo", "v1.0.0"); err != nil || !bytes.Equal(res.Data, archives["v1.0.0"]) {
+		t.Fatal(res, err)
+	}
+}
+
+func TestDiskStoreMixedCase(t *testing.T) {
+	ctx := context.Background()
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+
+	if key := (Snapshot{Module: "github.com/Sirupsen/logrus", Version: "v1.0.0-RC1"}).Key(); key != "github.com/!sirupsen/logrus@v1.0.0-!r!c1" {
+		t.Fatal(key)
+	}
+
+	d := Disk(dir)
+	upper := testZip(t, "github.com/Sirupsen/logrus@v1.0.0/logrus.go", "package logrus // upper")
+	lower := testZip(t, "github.com/sirupsen/logrus@v1.0.0/logrus.go", "package logrus // lower")
+	if err := d.Put(ctx, Snapshot{Module: "github.com/Sirupsen/logrus", Version: "v1.0.0", Data: upper}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put(ctx, Snapshot{Module: "github.com/sirupsen/logrus", Version: "v1.0.0", Data: lower}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "github.com/!sirupsen/logrus@v1.0.0.zip")); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := d.Get(ctx, "github.com/Sirupsen/logrus", "v1.0.0"); err != nil || !bytes.Equal(res.Data, upper) {
+		t.Fatal(res, err)
+	}
+	if res, err := d.Get(ctx, "github.com/sirupsen/logrus", "v1.0.0"); err != nil || !bytes.Equal(res.Data, lower) {
+		t.Fatal(res, err)
+	}
+}
+
+func TestDiskStoreErrors(t *testing.T) {
+	ctx := context.Background()
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+
+	// A regular file in place of the cache directory makes all writes fail
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	count := func(op string) int64 {
+		if v, ok := storeErrors.Get(op).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	puts, gets := count("disk.put"), count("disk.get")
+
+	d := Disk(file)
+	if err := d.Put(ctx, Snapshot{Module: "foo", Version: "v1.0.0", Data: testZip(t)}); err == nil {
+		t.Fatal("put should fail")
+	}
+	if n := count("disk.put"); n != puts+1 {
+		t.Fatal(n, puts)
+	}
+
+	// Cache misses are not errors
+	if _, err := Disk(dir).Get(ctx, "foo", "v1.0.0"); err == nil {
+		t.Fatal("get should fail")
+	}
+	if n := count("disk.get"); n != gets {
+		t.Fatal(n, gets)
+	}
+}
+
+func TestDiskStoreIdenticalWrites(t *testing.T) {
+	ctx := context.Background()
+	for _, options := range [][]DiskOption{nil, {Dedup()}} {
+		dir := testDir(t)
+		defer os.RemoveAll(dir)
+
+		// Two instances sharing the directory put the same snapshot at once
+		snapshot := Snapshot{Module: "foo", Version: "v1.0.0", Data: testZip(t, "foo@v1.0.0/foo.go", "package foo")}
+		skipped := skippedWrites.Value()
+		wg := sync.WaitGroup{}
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := Disk(dir, options...).Put(ctx, snapshot); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+		d := Disk(dir, options...)
+		if err := d.Put(ctx, snapshot); err != nil {
+			t.Fatal(err)
+		}
+		// At least the last put finds the identical archive
+		if n := skippedWrites.Value() - skipped; n < 1 || n > 2 {
+			t.Fatal(n)
+		}
+
+		// Concurrent puts of one instance result in a single write
+		skipped = skippedWrites.Value()
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := d.Put(ctx, Snapshot{Module: "bar", Version: "v1.0.0", Data: snapshot.Data}); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+		if n := skippedWrites.Value() - skipped; n != 1 {
+			t.Fatal(n)
+		}
+
+		// Different contents are still written
+		skipped = skippedWrites.Value()
+		data := testZip(t, "foo@v1.0.0/foo.go", "package foo // changed")
+		if err := d.Put(ctx, Snapshot{Module: "foo", Version: "v1.0.0", Data: data}); err != nil {
+			t.Fatal(err)
+		}
+		if n := skippedWrites.Value() - skipped; n != 0 {
+			t.Fatal(n)
+		}
+		if res, err := d.Get(ctx, "foo", "v1.0.0"); err != nil || !bytes.Equal(res.Data, data) {
+			t.Fatal(res, err)
+		}
+
+		// No temporary files are left behind
+		filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+			if err == nil && strings.Contains(fi.Name(), ".tmp") {
+				t.Error(path)
+			}
+			return nil
+		})
+	}
+}
+
+func TestDiskStoreDigests(t *testing.T) {
+	ctx := context.Background()
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+
+	size := Digest{Name: "size", Sum: func(data []byte) (string, error) { return strconv.Itoa(len(data)), nil }}
+	d := Disk(dir, ExtraDigests(SHA512, size), SoftDelete(time.Hour))
+	data := testZip(t, "foo@v1.0.0/foo.go", "package foo")
+	if err := d.Put(ctx, Snapshot{Module: "foo", Version: "v1.0.0", Data: data}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "foo@v1.0.0.digests"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sums := map[string]string{}
+	if err := json.Unmarshal(b, &sums); err != nil {
+		t.Fatal(err)
+	}
+	h1, _ := HashZip(data)
+	sha := sha512.Sum512(data)
+	if len(sums) != 3 || sums["h1"] != h1 || sums["sha512"] != hex.EncodeToString(sha[:]) || sums["size"] != strconv.Itoa(len(data)) {
+		t.Fatal(sums)
+	}
+
+	// digests follow the snapshot into the trash and back
+	if err := d.Del(ctx, "foo", "v1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "foo@v1.0.0.digests")); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	if err := d.(Restorer).Restore(ctx, "foo", "v1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	if restored, err := ioutil.ReadFile(filepath.Join(dir, "foo@v1.0.0.digests")); err != nil || !bytes.Equal(restored, b) {
+		t.Fatal(string(restored), err)
+	}
+
+	// failing digests fail the write
+	broken := Digest{Name: "broken", Sum: func(data []byte) (string, error) { return "", errors.New("broken") }}
+	if err := Disk(dir, ExtraDigests(broken)).Put(ctx, Snapshot{Module: "bar", Version: "v1.0.0", Data: data}); err == nil {
+		t.Fatal("digest error ignored")
+	}
+}
+
+func TestDiskStoreSoftDelete(t *testing.T) {
+	ctx := context.Background()
+	for _, dedup := range []bool{false, true} {
+		dir := testDir(t)
+		defer os.RemoveAll(dir)
+
+		grace := 100 * time.Millisecond
+		options := []DiskOption{SoftDelete(grace)}
+		if dedup {
+			options = append(options, Dedup())
+		}
+		d := Disk(dir, options...)
+		data := testZip(t, "foo@v1.0.0/foo.go", "package foo")
+		d.Put(ctx, Snapshot{Module: "foo", Version: "v1.0.0", Data: data})
+		d.Put(ctx, Snapshot{Module: "foo", Version: "v1.1.0", Data: testZip(t, "foo@v1.1.0/foo.go", "package foo")})
+
+		// Deleted snapshot can be restored within the grace period
+		if err := d.Del(ctx, "foo", "v1.0.0"); err != nil {
+			t.Fatal(dedup, err)
+		}
+		if _, err := d.Get(ctx, "foo", "v1.0.0"); err == nil {
+			t.Fatal(dedup, "deleted snapshot should not be served")
+		}
+		if err := d.(Restorer).Restore(ctx, "foo", "v1.0.0"); err != nil {
+			t.Fatal(dedup, err)
+		}
+		if res, err := d.Get(ctx, "foo", "v1.0.0"); err != nil {
+			t.Fatal(dedup, err)
+		} else if !bytes.Equal(res.Data, data) {
+			t.Fatal(dedup, res)
+		}
+
+		// Once the grace period is over, the snapshot is gone
+		if err := d.Del(ctx, "foo", "v1.0.0"); err != nil {
+			t.Fatal(dedup, err)
+		}
+		time.Sleep(grace)
+		if err := d.(Restorer).Restore(ctx, "foo", "v1.0.0"); err == nil {
+			t.Fatal(dedup, "expired snapshot should not be restored")
+		}
+		if names, _ := filepath.Glob(filepath.Join(dir, trashDir, "foo@v1.0.0.*")); len(names) != 0 {
+			t.Fatal(dedup, names)
+		}
+		if dedup {
+			if n := len(blobs(t, dir)); n != 1 {
+				t.Fatal(n)
+			}
+		}
+		if _, err := d.Get(ctx, "foo", "v1.1.0"); err != nil {
+			t.Fatal(dedup, err)
+		}
+	}
+}
+
+func TestDiskStoreEntries(t *testing.T) {
+	ctx := context.Background()
+	for _, dedup := range []bool{false, true} {
+		dir := testDir(t)
+		defer os.RemoveAll(dir)
+
+		options := []DiskOption{SoftDelete(time.Hour)}
+		if dedup {
+			options = append(options, Dedup())
+		}
+		d := Disk(dir, options...)
+		data := testZip(t, "github.com/Sirupsen/logrus@v1.0.0/logrus.go", "package logrus")
+		d.Put(ctx, Snapshot{Module: "github.com/Sirupsen/logrus", Version: "v1.0.0", Data: data})
+		d.Put(ctx, Snapshot{Module: "foo", Version: "v1.0.0", Data: testZip(t, "foo@v1.0.0/foo.go", "package foo")})
+		d.Put(ctx, Snapshot{Module: "foo", Version: "v1.1.0", Data: testZip(t, "foo@v1.1.0/foo.go", "package foo")})
+		d.Del(ctx, "foo", "v1.0.0")
+
+		entries, err := d.(Inspector).Entries(ctx)
+		if err != nil {
+			t.Fatal(dedup, err)
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Module < entries[j].Module })
+		want := []Entry{
+			{Module: "foo", Version: "v1.1.0", Size: entries[0].Size},
+			{Module: "github.com/Sirupsen/logrus", Version: "v1.0.0", Size: int64(len(data))},
+		}
+		if dedup {
+			// shared archives are kept without the version prefix
+			want[1].Size = entries[1].Size
+		}
+		if !reflect.DeepEqual(entries, want) || entries[0].Size == 0 || entries[1].Size == 0 || entries[1].Size > int64(len(data)) {
+			t.Fatal(dedup, entries)
+		}
+
+		// Reset deletes the snapshots, which can still be restored
+		if err := d.(Inspector).Reset(ctx); err != nil {
+			t.Fatal(dedup, err)
+		}
+		if entries, _ := d.(Inspector).Entries(ctx); len(entries) != 0 {
+			t.Fatal(dedup, entries)
+		}
+		if err := d.(Restorer).Restore(ctx, "github.com/Sirupsen/logrus", "v1.0.0"); err != nil {
+			t.Fatal(dedup, err)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/sixt/gomodproxy/pkg/vcs"
+)
+
+const gcsEndpoint = "https://storage.googleapis.com"
+
+type gcs struct {
+	bucket   string
+	prefix   string
+	endpoint string
+	client   *http.Client
+}
+
+// GCSOption configures a Google Cloud Storage store.
+type GCSOption func(*gcs)
+
+// GCSEndpoint makes the store use a different storage API endpoint, e.g. an
+// emulator.
+func GCSEndpoint(endpoint string) GCSOption { return func(g *gcs) { g.endpoint = endpoint } }
+
+// GCS returns a Google Cloud Storage cache that keeps snapshots as objects
+// with the given name prefix in the bucket, using the same layout as the disk
+// store. The client is expected to authorize the requests, e.g. with an
+// OAuth2 transport.
+func GCS(bucket, prefix string, client *http.Client, options ...GCSOption) Store {
+	g := &gcs{bucket: bucket, prefix: prefix, endpoint: gcsEndpoint, client: client}
+	for _, opt := range options {
+		opt(g)
+	}
+	return g
+}
+
+func (g *gcs) Put(ctx context.Context, snapshot Snapshot) error {
+	t, err := snapshot.Timestamp.MarshalText()
+	if err != nil {
+		return err
+	}
+	// Time object is written last, so that a snapshot is never visible without
+	// its archive.
+	err = g.upload(ctx, snapshot.Key()+".zip", snapshot.Data)
+	if err == nil {
+		err = g.upload(ctx, snapshot.Key()+".time", t)
+	}
+	return countError("gcs.put", err)
+}
+
+func (g *gcs) Get(ctx context.Context, module string, version vcs.Version) (Snapshot, error) {
+	s, err := g.get(ctx, module, version)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		countError("gcs.get", err)
+	}
+	return s, err
+}
+
+func (g *gcs) Del(ctx context.Context, module string, version vcs.Version) error {
+	key := Snapshot{Module: module, Version: version}.Key()
+	err := g.delete(ctx, key+".time")
+	if zipErr := g.delete(ctx, key+".zip"); err == nil {
+		err = zipErr
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		countError("gcs.del", err)
+	}
+	return err
+}
+
+func (g *gcs) Close() error { return nil }
+
+func (g *gcs) get(ctx context.Context, module string, version vcs.Version) (Snapshot, error) {
+	s := Snapshot{Module: module, Version: version}
+	t, err := g.download(ctx, s.Key()+".time")
+	if err != nil {
+		return Snapshot{}, err
+	}
+	if err := s.Timestamp.UnmarshalText(t); err != nil {
+		return Snapshot{}, err
+	}
+	if s.Data, err = g.download(ctx, s.Key()+".zip"); err != nil {
+		return Snapshot{}, err
+	}
+	return s, nil
+}
+
+func (g *gcs) object(name string) string {
+	return g.endpoint + "/storage/v1/b/" + url.PathEscape(g.bucket) + "/o/" + url.PathEscape(g.prefix+name)
+}
+
+func (g *gcs) upload(ctx context.Context, name string, data []byte) error {
+	u := g.endpoint + "/upload/storage/v1/b/" + url.PathEscape(g.bucket) + "/o?uploadType=media&name=" + url.QueryEscape(g.prefix+name)
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	_, err = g.do(ctx, req, name)
+	return err
+}
+
+func (g *gcs) download(ctx context.Context, name string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, g.object(name)+"?alt=media", nil)
+	if err != nil {
+		return nil, err
+	}
+	return g.do(ctx, req, name)
+}
+
+func (g *gcs) delete(ctx context.Context, name string) error {
+	req, err := http.NewRequest(http.MethodDelete, g.object(name), nil)
+	if err != nil {
+		return err
+	}
+	_, err = g.do(ctx, req, name)
+	return err
+}
+
+// do sends the request and returns the response body. Missing objects are
+// reported as os.ErrNotExist, like in the disk store.
+func (g *gcs) do(ctx context.Context, req *http.Request, name string) ([]byte, error) {
+	res, err := g.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("gcs: %s: %w", name, os.ErrNotExist)
+	} else if res.StatusCode >= 300 {
+		if len(b) > 256 {
+			b = b[:256]
+		}
+		return nil, fmt.Errorf("gcs: %s: %s: %s", name, res.Status, bytes.TrimSpace(b))
+	}
+	return b, nil
+}
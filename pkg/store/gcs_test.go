@@ -0,0 +1,108 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeGCS implements the subset of the Cloud Storage JSON API used by the
+// store, keeping objects in memory.
+type fakeGCS struct {
+	sync.Mutex
+	objects map[string][]byte
+}
+
+func (f *fakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	const upload, object = "/upload/storage/v1/b/bucket/o", "/storage/v1/b/bucket/o/"
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == upload && r.URL.Query().Get("uploadType") == "media":
+		b, _ := ioutil.ReadAll(r.Body)
+		f.objects[r.URL.Query().Get("name")] = b
+		w.Write([]byte("{}"))
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, object) && r.URL.Query().Get("alt") == "media":
+		b, ok := f.objects[strings.TrimPrefix(r.URL.Path, object)]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(b)
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, object):
+		name := strings.TrimPrefix(r.URL.Path, object)
+		if _, ok := f.objects[name]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+		delete(f.objects, name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+	}
+}
+
+func TestGCSStore(t *testing.T) {
+	ctx := context.Background()
+	fake := &fakeGCS{objects: map[string][]byte{}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	s := GCS("bucket", "cache/", srv.Client(), GCSEndpoint(srv.URL))
+	defer s.Close()
+
+	if _, err := s.Get(ctx, "example.com/foo", "v1.0.0"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal(err)
+	}
+
+	data := testZip(t, "example.com/foo@v1.0.0/foo.go", "package foo")
+	now := time.Now().UTC().Truncate(time.Second)
+	if err := s.Put(ctx, Snapshot{Module: "example.com/foo", Version: "v1.0.0", Timestamp: now, Data: data}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"cache/example.com/foo@v1.0.0.zip", "cache/example.com/foo@v1.0.0.time"} {
+		if _, ok := fake.objects[name]; !ok {
+			t.Fatal("missing object", name, fake.objects)
+		}
+	}
+
+	res, err := s.Get(ctx, "example.com/foo", "v1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(res.Data) != string(data) || !res.Timestamp.Equal(now) {
+		t.Fatal(res)
+	}
+
+	if err := s.Del(ctx, "example.com/foo", "v1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(ctx, "example.com/foo", "v1.0.0"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal(err)
+	}
+	if err := s.Del(ctx, "example.com/foo", "v1.0.0"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal(err)
+	}
+}
+
+func TestGCSStoreErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "access denied", http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	s := GCS("bucket", "", srv.Client(), GCSEndpoint(srv.URL))
+	if err := s.Put(context.Background(), Snapshot{Module: "foo", Version: "v1.0.0"}); err == nil || !strings.Contains(err.Error(), "access denied") {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(context.Background(), "foo", "v1.0.0"); err == nil || errors.Is(err, os.ErrNotExist) {
+		t.Fatal(err)
+	}
+}
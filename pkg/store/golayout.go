@@ -0,0 +1,211 @@
+package store
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sixt/gomodproxy/pkg/vcs"
+	"golang.org/x/mod/semver"
+)
+
+type goLayout struct {
+	sync.Mutex
+	dir       string
+	goVersion string
+}
+
+// goInfo is the contents of the .info file of a module version.
+type goInfo struct {
+	Version string
+	Time    time.Time
+}
+
+// GoLayout returns a local disk cache that keeps snapshots in the layout of
+// the module download cache of the go tool, i.e. $GOMODCACHE/cache/download:
+// every version has the ".zip", ".info", ".mod" and ".ziphash" files in the
+// "<module>/@v/" directory, next to the "list" of cached versions. Such a
+// directory can be used with GOPROXY=file:///path/to/dir, or served by any
+// static file server. Only canonical semantic versions are kept, the go tool
+// rejects other ones, such as branch names, in the list and the .info files.
+func GoLayout(dir string, options ...GoLayoutOption) Store {
+	g := &goLayout{dir: dir}
+	for _, opt := range options {
+		opt(g)
+	}
+	return g
+}
+
+// GoLayoutOption configures a store in the go tool download cache layout.
+type GoLayoutOption func(*goLayout)
+
+// GoLayoutGoVersion adds a "go" directive with the given Go version to the
+// .mod files synthesized for modules without go.mod, like the API does with
+// the same option.
+func GoLayoutGoVersion(version string) GoLayoutOption {
+	return func(g *goLayout) { g.goVersion = version }
+}
+
+func (g *goLayout) Put(ctx context.Context, snapshot Snapshot) error {
+	return countError("golayout.put", g.put(snapshot))
+}
+
+func (g *goLayout) Get(ctx context.Context, module string, version vcs.Version) (Snapshot, error) {
+	s, err := g.get(module, version)
+	if err != nil && !os.IsNotExist(err) {
+		countError("golayout.get", err)
+	}
+	return s, err
+}
+
+func (g *goLayout) Del(ctx context.Context, module string, version vcs.Version) error {
+	err := g.del(module, version)
+	if err != nil && !os.IsNotExist(err) {
+		countError("golayout.del", err)
+	}
+	return err
+}
+
+func (g *goLayout) Close() error { return nil }
+
+// base returns the path of the version files without the extension.
+func (g *goLayout) base(module string, version vcs.Version) string {
+	return filepath.Join(g.dir, vcs.EncodeBangs(module), "@v", vcs.EncodeBangs(string(version)))
+}
+
+func (g *goLayout) put(snapshot Snapshot) error {
+	if !canonical(snapshot.Version) {
+		return nil
+	}
+	base := g.base(snapshot.Module, snapshot.Version)
+	sum, err := HashZip(snapshot.Data)
+	if err != nil {
+		return err
+	}
+	info, err := json.Marshal(goInfo{Version: string(snapshot.Version), Time: snapshot.Timestamp.UTC()})
+	if err != nil {
+		return err
+	}
+
+	g.Lock()
+	defer g.Unlock()
+	if err := os.MkdirAll(filepath.Dir(base), 0755); err != nil {
+		return err
+	}
+	// The .info file is written last, so that a version is never visible
+	// without its archive.
+	for _, f := range []struct {
+		ext  string
+		data []byte
+	}{
+		{".zip", snapshot.Data},
+		{".ziphash", []byte(sum)},
+		{".mod", goMod(snapshot, g.goVersion)},
+		{".info", info},
+	} {
+		if _, err := writeFile(base+f.ext, f.data); err != nil {
+			return err
+		}
+	}
+	return g.updateList(snapshot.Module, snapshot.Version, true)
+}
+
+func (g *goLayout) get(module string, version vcs.Version) (Snapshot, error) {
+	base := g.base(module, version)
+	b, err := ioutil.ReadFile(base + ".info")
+	if err != nil {
+		return Snapshot{}, err
+	}
+	info := goInfo{}
+	if err := json.Unmarshal(b, &info); err != nil {
+		return Snapshot{}, err
+	}
+	data, err := ioutil.ReadFile(base + ".zip")
+	if err != nil {
+		return Snapshot{}, err
+	}
+	return Snapshot{Module: module, Version: version, Timestamp: info.Time, Data: data}, nil
+}
+
+func (g *goLayout) del(module string, version vcs.Version) error {
+	base := g.base(module, version)
+	g.Lock()
+	defer g.Unlock()
+	if err := os.Remove(base + ".info"); err != nil {
+		return err
+	}
+	for _, ext := range []string{".zip", ".ziphash", ".mod"} {
+		if err := os.Remove(base + ext); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return g.updateList(module, version, false)
+}
+
+// updateList adds the version to or removes it from the sorted list of the
+// module versions. The caller must hold the lock.
+func (g *goLayout) updateList(module string, version vcs.Version, add bool) error {
+	name := filepath.Join(g.dir, vcs.EncodeBangs(module), "@v", "list")
+	b, err := ioutil.ReadFile(name)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	versions := []vcs.Version{}
+	for _, line := range strings.Split(string(b), "\n") {
+		if v := vcs.Version(strings.TrimSpace(line)); v != "" && v != version {
+			versions = append(versions, v)
+		}
+	}
+	if add {
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Compare(versions[j]) < 0 })
+	list := &bytes.Buffer{}
+	for _, v := range versions {
+		list.WriteString(string(v) + "\n")
+	}
+	_, err = writeFile(name, list.Bytes())
+	return err
+}
+
+// canonical tells if the version is a canonical semantic version, optionally
+// with the "+incompatible" build metadata.
+func canonical(version vcs.Version) bool {
+	v := strings.TrimSuffix(string(version), "+incompatible")
+	return v != "" && semver.Canonical(v) == v
+}
+
+// goMod returns the go.mod file of the module snapshot, or the minimal one
+// the go tool synthesizes for modules without go.mod, with the go directive
+// of the given Go version, if any.
+func goMod(snapshot Snapshot, goVersion string) []byte {
+	zr, err := zip.NewReader(bytes.NewReader(snapshot.Data), int64(len(snapshot.Data)))
+	if err == nil {
+		name := path.Join(snapshot.Module+"@"+string(snapshot.Version), "go.mod")
+		for _, f := range zr.File {
+			if f.Name != name {
+				continue
+			}
+			if r, err := f.Open(); err == nil {
+				defer r.Close()
+				if b, err := ioutil.ReadAll(r); err == nil {
+					return b
+				}
+			}
+		}
+	}
+	mod := "module " + snapshot.Module + "\n"
+	if goVersion != "" {
+		mod += "\ngo " + goVersion + "\n"
+	}
+	return []byte(mod)
+}
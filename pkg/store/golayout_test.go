@@ -0,0 +1,150 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestGoLayoutStore(t *testing.T) {
+	ctx := context.Background()
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+
+	g := GoLayout(dir)
+	when := time.Date(2018, 9, 21, 10, 0, 0, 0, time.UTC)
+	data := testZip(t, "github.com/Foo/bar@v1.0.0/go.mod", "module github.com/Foo/bar\n", "github.com/Foo/bar@v1.0.0/bar.go", "package bar\n")
+	legacy := testZip(t, "github.com/Foo/bar@v0.9.0/bar.go", "package bar\n")
+	for _, s := range []Snapshot{
+		{Module: "github.com/Foo/bar", Version: "v1.0.0", Timestamp: when, Data: data},
+		{Module: "github.com/Foo/bar", Version: "v0.9.0", Timestamp: when, Data: legacy},
+		{Module: "github.com/Foo/bar", Version: "v1.0.0-RC1", Timestamp: when, Data: data},
+		// not canonical, so not kept
+		{Module: "github.com/Foo/bar", Version: "master", Timestamp: when, Data: data},
+		{Module: "github.com/Foo/bar", Version: "v1.0", Timestamp: when, Data: data},
+	} {
+		if err := g.Put(ctx, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	read := func(name string) string {
+		b, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	sum, _ := HashZip(data)
+	for name, content := range map[string]string{
+		"github.com/!foo/bar/@v/v1.0.0.zip":     string(data),
+		"github.com/!foo/bar/@v/v1.0.0.ziphash": sum,
+		"github.com/!foo/bar/@v/v1.0.0.mod":     "module github.com/Foo/bar\n",
+		"github.com/!foo/bar/@v/v0.9.0.mod":     "module github.com/Foo/bar\n",
+		"github.com/!foo/bar/@v/list":           "v0.9.0\nv1.0.0-RC1\nv1.0.0\n",
+	} {
+		if s := read(name); s != content {
+			t.Fatal(name, s)
+		}
+	}
+	info := struct {
+		Version string
+		Time    time.Time
+	}{}
+	if err := json.Unmarshal([]byte(read("github.com/!foo/bar/@v/v1.0.0-!r!c1.info")), &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != "v1.0.0-RC1" || !info.Time.Equal(when) {
+		t.Fatal(info)
+	}
+
+	if res, err := g.Get(ctx, "github.com/Foo/bar", "v1.0.0"); err != nil || !bytes.Equal(res.Data, data) || !res.Timestamp.Equal(when) {
+		t.Fatal(res, err)
+	}
+	if _, err := g.Get(ctx, "github.com/Foo/bar", "master"); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	if err := g.Del(ctx, "github.com/Foo/bar", "v1.0.0-RC1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.Get(ctx, "github.com/Foo/bar", "v1.0.0-RC1"); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	if s := read("github.com/!foo/bar/@v/list"); s != "v0.9.0\nv1.0.0\n" {
+		t.Fatal(s)
+	}
+}
+
+func TestGoLayoutGoVersion(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+
+	g := GoLayout(dir, GoLayoutGoVersion("1.16"))
+	data := testZip(t, "example.com/foo@v1.0.0/foo.go", "package foo\n")
+	if err := g.Put(context.Background(), Snapshot{Module: "example.com/foo", Version: "v1.0.0", Timestamp: time.Now(), Data: data}); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "example.com/foo/@v/v1.0.0.mod")); err != nil || string(b) != "module example.com/foo\n\ngo 1.16\n" {
+		t.Fatal(string(b), err)
+	}
+}
+
+func TestGoLayoutGoProxy(t *testing.T) {
+	gobin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go is required to download modules from the store")
+	}
+	ctx := context.Background()
+	dir, modcache, work := testDir(t), testDir(t), testDir(t)
+	defer os.RemoveAll(dir)
+	defer os.RemoveAll(modcache)
+	defer os.RemoveAll(work)
+
+	data := testZip(t, "example.com/foo@v1.0.0/go.mod", "module example.com/foo\n", "example.com/foo@v1.0.0/foo.go", "package foo\n")
+	if err := GoLayout(dir).Put(ctx, Snapshot{Module: "example.com/foo", Version: "v1.0.0", Timestamp: time.Now(), Data: data}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The go tool downloads the module using the store directory as a proxy
+	cmd := exec.Command(gobin, "mod", "download", "-json", "example.com/foo@latest")
+	cmd.Dir = work
+	cmd.Env = append(os.Environ(), "GOPROXY=file://"+filepath.ToSlash(dir), "GOMODCACHE="+modcache,
+		"GOFLAGS=-modcacherw", "GOSUMDB=off", "GONOSUMDB=", "GOTOOLCHAIN=local", "GO111MODULE=on")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatal(err, string(out))
+	}
+	res := struct {
+		Version  string
+		Sum      string
+		GoModSum string
+	}{}
+	if err := json.Unmarshal(out, &res); err != nil {
+		t.Fatal(err, string(out))
+	}
+	sum, _ := HashZip(data)
+	if res.Version != "v1.0.0" || res.Sum != sum {
+		t.Fatal(res, sum)
+	}
+
+	// Files written by the go tool into its own download cache are the same
+	for _, name := range []string{"v1.0.0.zip", "v1.0.0.ziphash", "v1.0.0.mod", "list"} {
+		ours, err := ioutil.ReadFile(filepath.Join(dir, "example.com/foo/@v", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		theirs, err := ioutil.ReadFile(filepath.Join(modcache, "cache/download/example.com/foo/@v", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(ours, theirs) {
+			t.Fatal(name, string(ours), string(theirs))
+		}
+	}
+}
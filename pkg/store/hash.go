@@ -0,0 +1,75 @@
+package store
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// HashZip returns a "h1:" hash of the ZIP archive contents, the same one the
+// Go tool puts into go.sum files.
+func HashZip(data []byte) (string, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", err
+	}
+	files := map[string]*zip.File{}
+	names := []string{}
+	for _, f := range zr.File {
+		files[f.Name] = f
+		names = append(names, f.Name)
+	}
+	sort.Strings(names)
+	h := sha256.New()
+	for _, name := range names {
+		r, err := files[name].Open()
+		if err != nil {
+			return "", err
+		}
+		hf := sha256.New()
+		_, err = io.Copy(hf, r)
+		r.Close()
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%x  %s\n", hf.Sum(nil), name)
+	}
+	return "h1:" + base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// Digest is an additional hash of module archives, e.g. for internal
+// verification tools. It never replaces the "h1:" hash the go tool relies on.
+type Digest struct {
+	Name string
+	Sum  func(data []byte) (string, error)
+}
+
+// SHA512 is the hex-encoded SHA-512 digest of the whole ZIP archive.
+var SHA512 = Digest{Name: "sha512", Sum: func(data []byte) (string, error) {
+	sum := sha512.Sum512(data)
+	return hex.EncodeToString(sum[:]), nil
+}}
+
+// Digests returns the "h1:" hash and the given digests of the ZIP archive by
+// their names, the former as "h1".
+func Digests(data []byte, digests ...Digest) (map[string]string, error) {
+	h1, err := HashZip(data)
+	if err != nil {
+		return nil, err
+	}
+	sums := map[string]string{"h1": h1}
+	for _, d := range digests {
+		sum, err := d.Sum(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s digest: %w", d.Name, err)
+		}
+		sums[d.Name] = sum
+	}
+	return sums, nil
+}
@@ -2,29 +2,144 @@ package store
 
 import (
 	"context"
-	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
 	"sync"
+	"time"
 
 	"github.com/sixt/gomodproxy/pkg/vcs"
 )
 
+// errNotFound is reported for snapshots missing in the memory store, like
+// os.ErrNotExist is for the disk store.
+var errNotFound = fmt.Errorf("not found: %w", os.ErrNotExist)
+
 type memory struct {
 	sync.Mutex
-	log   logger
-	limit int64
-	size  int64
-	head  *lruItem
-	tail  *lruItem
+	log    logger
+	limit  int64
+	size   int64
+	items  int
+	count  int
+	grace  time.Duration
+	shards int
+	head   *lruItem
+	tail   *lruItem
+	index  map[string]*lruItem
 }
 
 type lruItem struct {
 	Snapshot
-	prev *lruItem
-	next *lruItem
+	deleted time.Time
+	prev    *lruItem
+	next    *lruItem
+}
+
+// MemoryOption configures an in-memory store.
+type MemoryOption func(*memory)
+
+// MemorySoftDelete makes the in-memory store keep deleted snapshots for the
+// given grace period, so that they can be restored. Deleted snapshots still
+// take their space in the cache and may be evicted earlier.
+func MemorySoftDelete(grace time.Duration) MemoryOption {
+	return func(m *memory) { m.grace = grace }
+}
+
+// MemoryMaxItems makes the in-memory store keep at most n snapshots, evicting
+// the least recently used ones even if the size limit is not reached. This
+// bounds the overhead of many tiny modules. Zero means no limit.
+func MemoryMaxItems(n int) MemoryOption {
+	return func(m *memory) { m.items = n }
+}
+
+// MemoryShards makes the in-memory store split the snapshots into n shards by
+// their keys, each with its own lock and LRU list, so that concurrent requests
+// for different modules do not wait for each other. The size limit and the
+// maximum number of snapshots are divided evenly across the shards, so a
+// shard may evict snapshots while the others still have room.
+func MemoryShards(n int) MemoryOption {
+	return func(m *memory) { m.shards = n }
 }
 
 // Memory creates an in-memory LRU cache.
-func Memory(log logger, limit int64) Store { return &memory{log: log, limit: limit} }
+func Memory(log logger, limit int64, options ...MemoryOption) Store {
+	m := &memory{log: log, limit: limit, index: map[string]*lruItem{}}
+	for _, opt := range options {
+		opt(m)
+	}
+	if m.shards <= 1 {
+		return m
+	}
+	s := &shardedMemory{shards: make([]*memory, m.shards)}
+	for i := range s.shards {
+		shard := &memory{log: log, limit: limit, grace: m.grace, index: map[string]*lruItem{}}
+		if limit > 0 {
+			shard.limit = limit / int64(m.shards)
+		}
+		if m.items > 0 {
+			shard.items = (m.items + m.shards - 1) / m.shards
+		}
+		s.shards[i] = shard
+	}
+	return s
+}
+
+// shardedMemory is an in-memory store made of several independent LRU caches.
+type shardedMemory struct {
+	shards []*memory
+}
+
+// shard returns the LRU cache the module version belongs to. The snapshot key
+// is hashed without the bang encoding, which keeps it unique anyway.
+func (s *shardedMemory) shard(module string, version vcs.Version) *memory {
+	h := fnv.New32a()
+	h.Write([]byte(module + "@" + string(version)))
+	return s.shards[h.Sum32()%uint32(len(s.shards))]
+}
+
+func (s *shardedMemory) Put(ctx context.Context, snapshot Snapshot) error {
+	return s.shard(snapshot.Module, snapshot.Version).Put(ctx, snapshot)
+}
+
+func (s *shardedMemory) Get(ctx context.Context, module string, version vcs.Version) (Snapshot, error) {
+	return s.shard(module, version).Get(ctx, module, version)
+}
+
+func (s *shardedMemory) Del(ctx context.Context, module string, version vcs.Version) error {
+	return s.shard(module, version).Del(ctx, module, version)
+}
+
+// Restore brings back a snapshot deleted within the grace period.
+func (s *shardedMemory) Restore(ctx context.Context, module string, version vcs.Version) error {
+	return s.shard(module, version).Restore(ctx, module, version)
+}
+
+// Entries returns snapshots currently kept in memory, shard by shard, most
+// recently used first within each shard.
+func (s *shardedMemory) Entries(ctx context.Context) ([]Entry, error) {
+	entries := []Entry{}
+	for _, shard := range s.shards {
+		e, err := shard.Entries(ctx)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e...)
+	}
+	return entries, nil
+}
+
+// Reset removes all snapshots from memory.
+func (s *shardedMemory) Reset(ctx context.Context) error {
+	for _, shard := range s.shards {
+		if err := shard.Reset(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *shardedMemory) Close() error { return nil }
 
 func (m *memory) Put(ctx context.Context, snapshot Snapshot) error {
 	m.Lock()
@@ -36,7 +151,7 @@ func (m *memory) Put(ctx context.Context, snapshot Snapshot) error {
 	item := &lruItem{Snapshot: snapshot, next: m.head}
 	m.insert(item)
 
-	for m.limit >= 0 && m.size > m.limit {
+	for (m.limit >= 0 && m.size > m.limit) || (m.items > 0 && m.count > m.items) {
 		m.evict()
 	}
 	return nil
@@ -59,6 +174,45 @@ func (m *memory) Del(ctx context.Context, module string, version vcs.Version) er
 	if err != nil {
 		return err
 	}
+	if m.grace > 0 {
+		m.purge()
+		item.deleted = time.Now()
+		return nil
+	}
+	m.unlink(item)
+	return nil
+}
+
+// Restore brings back a snapshot deleted within the grace period.
+func (m *memory) Restore(ctx context.Context, module string, version vcs.Version) error {
+	m.Lock()
+	defer m.Unlock()
+	m.purge()
+	if _, err := m.lookup(module, version); err == nil {
+		return nil
+	}
+	item, ok := m.index[Snapshot{Module: module, Version: version}.Key()]
+	if !ok {
+		return errNotFound
+	}
+	item.deleted = time.Time{}
+	m.update(item)
+	return nil
+}
+
+// purge removes snapshots deleted earlier than the grace period ago.
+func (m *memory) purge() {
+	for item := m.head; item != nil; item = item.next {
+		if !item.deleted.IsZero() && time.Since(item.deleted) > m.grace {
+			m.unlink(item)
+		}
+	}
+}
+
+func (m *memory) unlink(item *lruItem) {
+	m.size = m.size - int64(len(item.Data))
+	m.count--
+	m.unindex(item)
 	if item.prev == nil {
 		m.head = item.next
 	} else {
@@ -69,17 +223,51 @@ func (m *memory) Del(ctx context.Context, module string, version vcs.Version) er
 	} else {
 		item.next.prev = item.prev
 	}
-	return nil
 }
 
-func (m *memory) lookup(module string, version vcs.Version) (*lruItem, error) {
+// Entries returns snapshots currently kept in memory, most recently used
+// first. Unlike Get it does not affect the eviction order.
+func (m *memory) Entries(ctx context.Context) ([]Entry, error) {
+	m.Lock()
+	defer m.Unlock()
+	entries := []Entry{}
 	for item := m.head; item != nil; item = item.next {
-		if item.Module == module && item.Version == version {
-			m.update(item)
-			return item, nil
+		if !item.deleted.IsZero() {
+			continue
 		}
+		entries = append(entries, Entry{Module: item.Module, Version: item.Version, Size: int64(len(item.Data))})
+	}
+	return entries, nil
+}
+
+// Reset removes all snapshots from memory.
+func (m *memory) Reset(ctx context.Context) error {
+	m.Lock()
+	defer m.Unlock()
+	m.head = nil
+	m.tail = nil
+	m.index = map[string]*lruItem{}
+	m.size = 0
+	m.count = 0
+	return nil
+}
+
+func (m *memory) lookup(module string, version vcs.Version) (*lruItem, error) {
+	item, ok := m.index[Snapshot{Module: module, Version: version}.Key()]
+	if !ok || !item.deleted.IsZero() {
+		return nil, errNotFound
+	}
+	m.update(item)
+	return item, nil
+}
+
+// unindex removes the item from the index, unless a snapshot put after the
+// item has been deleted has already replaced it there.
+func (m *memory) unindex(item *lruItem) {
+	key := item.Key()
+	if m.index[key] == item {
+		delete(m.index, key)
 	}
-	return nil, errors.New("not found")
 }
 
 func (m *memory) insert(item *lruItem) {
@@ -87,6 +275,8 @@ func (m *memory) insert(item *lruItem) {
 		"module", item.Module, "version", item.Version, "size", len(item.Data),
 		"cachesize", m.size, "cachelimit", m.limit)
 	m.size = m.size + int64(len(item.Data))
+	m.count++
+	m.index[item.Key()] = item
 	if m.head == nil {
 		m.head = item
 		m.tail = item
@@ -119,6 +309,8 @@ func (m *memory) evict() {
 	m.log("mem.evict", "module", m.tail.Module, "version", m.tail.Version, "size", len(m.tail.Data),
 		"cachesize", m.size, "cachelimit", m.limit)
 	m.size = m.size - int64(len(m.tail.Data))
+	m.count--
+	m.unindex(m.tail)
 	if m.tail.prev == nil {
 		m.head = nil
 		m.tail = nil
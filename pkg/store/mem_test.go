@@ -2,8 +2,13 @@ package store
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"math/rand"
+	"os"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func TestMemoryStore(t *testing.T) {
@@ -19,6 +24,28 @@ func TestMemoryStore(t *testing.T) {
 	}
 }
 
+func TestMemoryStoreDel(t *testing.T) {
+	ctx := context.Background()
+	m := Memory(t.Log, -1)
+	m.Put(ctx, Snapshot{Module: "foo", Version: "v1.0.0", Data: []byte("hello")})
+	m.Put(ctx, Snapshot{Module: "bar", Version: "v1.0.0", Data: []byte("world!")})
+	if err := m.Del(ctx, "foo", "v1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := m.Get(ctx, "foo", "v1.0.0"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal(res, err)
+	}
+	if _, err := m.Get(ctx, "bar", "v1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	if size := m.(*memory).size; size != 6 {
+		t.Fatal(size)
+	}
+	if err := m.Del(ctx, "foo", "v1.0.0"); err == nil {
+		t.Fatal("deleted twice")
+	}
+}
+
 func TestMemoryStoreOverflow(t *testing.T) {
 	ctx := context.Background()
 	m := Memory(t.Log, 10)
@@ -52,6 +79,36 @@ func TestMemoryStoreOverflow(t *testing.T) {
 	}
 }
 
+func TestMemoryStoreMaxItems(t *testing.T) {
+	ctx := context.Background()
+	m := Memory(t.Log, 1000, MemoryMaxItems(10))
+	for i := 0; i < 100; i++ {
+		m.Put(ctx, Snapshot{Module: fmt.Sprintf("mod%d", i), Version: "v1.0.0", Data: []byte{byte(i)}})
+	}
+	entries, err := m.(Inspector).Entries(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 10 || entries[0].Module != "mod99" || entries[9].Module != "mod90" {
+		t.Fatal(entries)
+	}
+
+	// "mod90" was used recently, so "mod91" is evicted instead
+	m.Get(ctx, "mod90", "v1.0.0")
+	m.Put(ctx, Snapshot{Module: "mod100", Version: "v1.0.0", Data: []byte{100}})
+	if _, err := m.Get(ctx, "mod90", "v1.0.0"); err != nil {
+		t.Fatal(err)
+	} else if _, err := m.Get(ctx, "mod91", "v1.0.0"); err == nil {
+		t.Fatal("mod91 is not evicted")
+	}
+
+	// the size limit still applies
+	m.Put(ctx, Snapshot{Module: "big", Version: "v1.0.0", Data: make([]byte, 995)})
+	if entries, _ := m.(Inspector).Entries(ctx); len(entries) != 6 {
+		t.Fatal(entries)
+	}
+}
+
 func TestMemoryStoreRandom(t *testing.T) {
 	snaphots := []Snapshot{
 		Snapshot{Module: "a", Version: "v1.0.0", Data: make([]byte, 1)},
@@ -72,3 +129,171 @@ func TestMemoryStoreRandom(t *testing.T) {
 		}
 	}
 }
+
+func TestMemoryStoreInspect(t *testing.T) {
+	ctx := context.Background()
+	m := Memory(t.Log, 10)
+	inspector, ok := m.(Inspector)
+	if !ok {
+		t.Fatal("memory store should implement Inspector")
+	}
+	m.Put(ctx, Snapshot{Module: "foo", Version: "v1.0.0", Data: make([]byte, 4)})
+	m.Put(ctx, Snapshot{Module: "bar", Version: "v1.0.0", Data: make([]byte, 3)})
+
+	entries, err := inspector.Entries(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(entries, []Entry{{"bar", "v1.0.0", 3}, {"foo", "v1.0.0", 4}}) {
+		t.Fatal(entries)
+	}
+
+	// Inspecting should not affect eviction order, "foo" is still the least
+	// recently used one
+	m.Put(ctx, Snapshot{Module: "baz", Version: "v1.0.0", Data: make([]byte, 5)})
+	if res, err := m.Get(ctx, "foo", "v1.0.0"); err == nil {
+		t.Fatal(res)
+	}
+
+	if err := inspector.Reset(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := inspector.Entries(ctx); len(entries) != 0 {
+		t.Fatal(entries)
+	}
+	// Full capacity should be available after reset
+	m.Put(ctx, Snapshot{Module: "qux", Version: "v1.0.0", Data: make([]byte, 10)})
+	if _, err := m.Get(ctx, "qux", "v1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryStoreSoftDelete(t *testing.T) {
+	ctx := context.Background()
+	grace := 100 * time.Millisecond
+	m := Memory(t.Log, -1, MemorySoftDelete(grace))
+	m.Put(ctx, Snapshot{Module: "foo", Version: "v1.0.0", Data: []byte("hello")})
+
+	// Deleted snapshot can be restored within the grace period
+	if err := m.Del(ctx, "foo", "v1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := m.Get(ctx, "foo", "v1.0.0"); err == nil {
+		t.Fatal(res)
+	}
+	if entries, _ := m.(Inspector).Entries(ctx); len(entries) != 0 {
+		t.Fatal(entries)
+	}
+	if err := m.(Restorer).Restore(ctx, "foo", "v1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := m.Get(ctx, "foo", "v1.0.0"); err != nil || string(res.Data) != "hello" {
+		t.Fatal(res, err)
+	}
+
+	// Once the grace period is over, the snapshot is gone
+	if err := m.Del(ctx, "foo", "v1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(grace)
+	if err := m.(Restorer).Restore(ctx, "foo", "v1.0.0"); err == nil {
+		t.Fatal("expired snapshot should not be restored")
+	}
+	if size := m.(*memory).size; size != 0 {
+		t.Fatal(size)
+	}
+}
+
+func TestMemoryStoreSoftDeleteReplaced(t *testing.T) {
+	ctx := context.Background()
+	m := Memory(t.Log, -1, MemorySoftDelete(time.Hour))
+	m.Put(ctx, Snapshot{Module: "foo", Version: "v1.0.0", Data: []byte("old")})
+	if err := m.Del(ctx, "foo", "v1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	// the snapshot put again replaces the deleted one, which stays unused
+	m.Put(ctx, Snapshot{Module: "foo", Version: "v1.0.0", Data: []byte("new")})
+	if err := m.(Restorer).Restore(ctx, "foo", "v1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := m.Get(ctx, "foo", "v1.0.0"); err != nil || string(res.Data) != "new" {
+		t.Fatal(res, err)
+	}
+	if entries, _ := m.(Inspector).Entries(ctx); len(entries) != 1 {
+		t.Fatal(entries)
+	}
+}
+
+func BenchmarkMemoryStoreGet(b *testing.B) {
+	ctx := context.Background()
+	for _, n := range []int{10, 1000, 100000} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			m := Memory(func(...interface{}) {}, -1)
+			for i := 0; i < n; i++ {
+				m.Put(ctx, Snapshot{Module: fmt.Sprintf("example.com/mod%d", i), Version: "v1.0.0", Data: []byte{1}})
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// the least recently used snapshot is the last one of the list
+				if _, err := m.Get(ctx, fmt.Sprintf("example.com/mod%d", i%n), "v1.0.0"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryStoreShards(t *testing.T) {
+	ctx := context.Background()
+	m := Memory(t.Log, 100, MemoryShards(4))
+	for i := 0; i < 200; i++ {
+		m.Put(ctx, Snapshot{Module: fmt.Sprintf("mod%d", i), Version: "v1.0.0", Data: []byte{byte(i)}})
+	}
+	// every shard keeps at most a quarter of the size limit
+	for i, shard := range m.(*shardedMemory).shards {
+		if shard.size > 25 || shard.size == 0 {
+			t.Fatal(i, shard.size)
+		}
+	}
+	if entries, _ := m.(Inspector).Entries(ctx); len(entries) < 50 || len(entries) > 100 {
+		t.Fatal(len(entries))
+	}
+	if res, err := m.Get(ctx, "mod199", "v1.0.0"); err != nil || res.Data[0] != 199 {
+		t.Fatal(res, err)
+	}
+	if err := m.Del(ctx, "mod199", "v1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Get(ctx, "mod199", "v1.0.0"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal(err)
+	}
+	if err := m.(Inspector).Reset(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := m.(Inspector).Entries(ctx); len(entries) != 0 {
+		t.Fatal(entries)
+	}
+}
+
+func BenchmarkMemoryStoreParallel(b *testing.B) {
+	ctx := context.Background()
+	modules := make([]string, 1000)
+	for i := range modules {
+		modules[i] = fmt.Sprintf("example.com/mod%d", i)
+	}
+	for _, shards := range []int{1, 16} {
+		b.Run(fmt.Sprint(shards), func(b *testing.B) {
+			m := Memory(func(...interface{}) {}, -1, MemoryShards(shards))
+			for _, module := range modules {
+				m.Put(ctx, Snapshot{Module: module, Version: "v1.0.0", Data: []byte{1}})
+			}
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				r := rand.New(rand.NewSource(rand.Int63()))
+				for pb.Next() {
+					m.Get(ctx, modules[r.Intn(len(modules))], "v1.0.0")
+				}
+			})
+		})
+	}
+}
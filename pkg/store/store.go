@@ -24,9 +24,34 @@ type Snapshot struct {
 	Version   vcs.Version
 	Timestamp time.Time
 	Data      []byte
+	// Hash of the commit the snapshot is made of, if known. Only the memory
+	// and disk stores keep it.
+	Hash string
 }
 
-// Key returns a snapshot key string that can be used in cache stores.
+// Key returns a snapshot key string that can be used in cache stores. Uppercase
+// letters are bang-encoded, so that modules differing only by case do not
+// collide on case-insensitive filesystems.
 func (s Snapshot) Key() string {
-	return s.Module + "@" + string(s.Version)
+	return vcs.EncodeBangs(s.Module) + "@" + vcs.EncodeBangs(string(s.Version))
+}
+
+// Entry describes a snapshot kept in a cache store without its contents.
+type Entry struct {
+	Module  string
+	Version vcs.Version
+	Size    int64
+}
+
+// Inspector is implemented by stores that can enumerate and drop their
+// contents, e.g. for administration or in tests.
+type Inspector interface {
+	Entries(ctx context.Context) ([]Entry, error)
+	Reset(ctx context.Context) error
+}
+
+// Restorer is implemented by stores that keep deleted snapshots for a grace
+// period and can bring them back.
+type Restorer interface {
+	Restore(ctx context.Context, module string, version vcs.Version) error
 }
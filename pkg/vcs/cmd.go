@@ -12,6 +12,7 @@ import (
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
 )
 
 type cmdVCS struct {
@@ -21,20 +22,42 @@ type cmdVCS struct {
 	cmd           string
 }
 
-func encodeBangs(s string) string {
-	buf := []byte{}
+// EncodeBangs replaces every uppercase letter in a module path or version with
+// an exclamation mark followed by the lowercase letter, e.g. "github.com/Foo"
+// becomes "github.com/!foo", like the go tool does in proxy URLs and in its
+// module cache. Encoded paths are safe to use on case-insensitive filesystems.
+func EncodeBangs(s string) string {
+	b := strings.Builder{}
 	for _, r := range s {
 		if 'A' <= r && r <= 'Z' {
-			buf = append(buf, '!', byte(r+'a'-'A'))
+			b.WriteByte('!')
+			b.WriteRune(r + 'a' - 'A')
 		} else {
-			buf = append(buf, byte(r))
+			b.WriteRune(r)
 		}
 	}
-	return string(buf)
+	return b.String()
+}
+
+// DecodeBangs reverses EncodeBangs.
+func DecodeBangs(s string) string {
+	b := strings.Builder{}
+	bang := false
+	for _, r := range s {
+		if bang {
+			bang = false
+			b.WriteRune(unicode.ToUpper(r))
+		} else if r == '!' {
+			bang = true
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
 }
 
 func NewCommand(l logger, cmd string, module string) VCS {
-	return &cmdVCS{log: l, cmd: cmd, module: module, moduleEncoded: encodeBangs(module)}
+	return &cmdVCS{log: l, cmd: cmd, module: module, moduleEncoded: EncodeBangs(module)}
 }
 
 func (c *cmdVCS) List(ctx context.Context) ([]Version, error) {
@@ -99,7 +122,14 @@ func (c *cmdVCS) Zip(ctx context.Context, version Version) (io.ReadCloser, error
 	return ioutil.NopCloser(bytes.NewReader(b)), nil
 }
 
+// Describe returns the kind of the VCS client only, since the command may
+// contain credentials.
+func (c *cmdVCS) Describe(ctx context.Context) (Remote, error) {
+	return Remote{VCS: "cmd", Auth: "none"}, nil
+}
+
 func (c *cmdVCS) exec(ctx context.Context, env ...string) ([]byte, error) {
+	setOrigin(ctx, "cmd", "")
 	cmd := exec.Command("sh", "-c", c.cmd)
 	cmd.Env = append(os.Environ(), env...)
 	cmd.Stderr = os.Stderr
@@ -0,0 +1,96 @@
+package vcs
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	githttp "gopkg.in/src-d/go-git.v4/plumbing/transport/http"
+)
+
+// ErrorKind is a client-facing category of VCS errors.
+type ErrorKind int
+
+const (
+	// Internal errors are unexpected failures, such as I/O errors or bugs.
+	Internal ErrorKind = iota
+	// NotFound errors mean that the repository, the version or the module
+	// does not exist.
+	NotFound
+	// Unauthorized errors mean that the credentials are missing or rejected.
+	Unauthorized
+	// Unavailable errors mean that the VCS host can not be reached.
+	Unavailable
+	// Forbidden errors mean that the proxy is not allowed to contact the host
+	// or to serve the module.
+	Forbidden
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case NotFound:
+		return "not_found"
+	case Unauthorized:
+		return "unauthorized"
+	case Unavailable:
+		return "unavailable"
+	case Forbidden:
+		return "forbidden"
+	default:
+		return "internal"
+	}
+}
+
+// Classify returns a category of the error returned by VCS clients. Errors
+// returned by custom VCS commands or by the go tool are treated as NotFound,
+// since those are mostly caused by the missing modules or versions.
+func Classify(err error) ErrorKind {
+	for err != nil {
+		switch e := err.(type) {
+		case *plumbing.PermanentError:
+			err = e.Err
+			continue
+		case *plumbing.UnexpectedError:
+			err = e.Err
+			continue
+		case *githttp.Err:
+			if e.StatusCode() >= http.StatusInternalServerError {
+				return Unavailable
+			}
+			return Internal
+		case *exec.ExitError:
+			return NotFound
+		case net.Error:
+			return Unavailable
+		}
+		switch err {
+		case transport.ErrRepositoryNotFound, transport.ErrEmptyRemoteRepository,
+			plumbing.ErrReferenceNotFound, plumbing.ErrObjectNotFound,
+			git.ErrRepositoryNotExists, git.ErrTagNotFound, git.ErrBranchNotFound,
+			errNoVersions, errAfterSnapshot, errNotInManifest, errMajorMismatch, errBadModule, errMetaNotFound, errBadMetaURL, errPrefixDoesNotMatch:
+			return NotFound
+		case transport.ErrAuthenticationRequired, transport.ErrAuthorizationFailed,
+			transport.ErrInvalidAuthMethod:
+			return Unauthorized
+		case context.DeadlineExceeded:
+			return Unavailable
+		case ErrHostNotAllowed, errFileTooLarge:
+			return Forbidden
+		}
+		if os.IsNotExist(err) {
+			return NotFound
+		}
+		if strings.HasPrefix(err.Error(), "ssh: handshake failed") {
+			return Unauthorized
+		}
+		err = errors.Unwrap(err)
+	}
+	return Internal
+}
@@ -0,0 +1,40 @@
+package vcs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+)
+
+func TestClassify(t *testing.T) {
+	for _, test := range []struct {
+		Err  error
+		Kind ErrorKind
+	}{
+		{Err: transport.ErrRepositoryNotFound, Kind: NotFound},
+		{Err: plumbing.NewPermanentError(transport.ErrRepositoryNotFound), Kind: NotFound},
+		{Err: plumbing.ErrObjectNotFound, Kind: NotFound},
+		{Err: plumbing.ErrReferenceNotFound, Kind: NotFound},
+		{Err: errNoVersions, Kind: NotFound},
+		{Err: errMetaNotFound, Kind: NotFound},
+		{Err: &os.PathError{Op: "open", Path: "/foo", Err: os.ErrNotExist}, Kind: NotFound},
+		{Err: transport.ErrAuthenticationRequired, Kind: Unauthorized},
+		{Err: transport.ErrAuthorizationFailed, Kind: Unauthorized},
+		{Err: errors.New("ssh: handshake failed: ssh: unable to authenticate"), Kind: Unauthorized},
+		{Err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, Kind: Unavailable},
+		{Err: &net.DNSError{Err: "no such host", Name: "example.com"}, Kind: Unavailable},
+		{Err: plumbing.NewUnexpectedError(&net.DNSError{Err: "no such host"}), Kind: Unavailable},
+		{Err: fmt.Errorf("fetch: %w", context.DeadlineExceeded), Kind: Unavailable},
+		{Err: errors.New("something went wrong"), Kind: Internal},
+	} {
+		if kind := Classify(test.Err); kind != test.Kind {
+			t.Fatal(test.Err, kind, test.Kind)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package vcs
+
+import (
+	"context"
+	"expvar"
+	"io"
+	"sync"
+	"time"
+)
+
+// Failovers to the next VCS client are counted by the kind of the error the
+// previous one has failed with, e.g. "unavailable".
+var failovers = expvar.NewMap("vcs_failovers_total")
+
+type failoverVCS struct {
+	log      logger
+	module   string
+	backends []VCS
+
+	sync.Mutex
+	// served remembers which backend has resolved the version timestamp, so
+	// that the archive is built from the same source.
+	served map[Version]int
+}
+
+// Failover returns a VCS client that asks the given clients in order and
+// returns the first successful answer, e.g. to fetch modules from a fast
+// internal mirror and fall back to the public host when the mirror fails or
+// does not have the module. The archive of a version is taken from the client
+// that has returned its timestamp, if possible, so that both come from the
+// same source.
+func Failover(l logger, module string, backends ...VCS) VCS {
+	return &failoverVCS{log: l, module: module, backends: backends, served: map[Version]int{}}
+}
+
+func (f *failoverVCS) List(ctx context.Context) (list []Version, err error) {
+	_, err = f.try(ctx, 0, func(v VCS) (err error) {
+		list, err = v.List(ctx)
+		return err
+	})
+	return list, err
+}
+
+func (f *failoverVCS) Timestamp(ctx context.Context, version Version) (t time.Time, err error) {
+	i, err := f.try(ctx, 0, func(v VCS) (err error) {
+		t, err = v.Timestamp(ctx, version)
+		return err
+	})
+	if err == nil {
+		f.Lock()
+		f.served[version] = i
+		f.Unlock()
+	}
+	return t, err
+}
+
+func (f *failoverVCS) Zip(ctx context.Context, version Version) (r io.ReadCloser, err error) {
+	f.Lock()
+	first := f.served[version]
+	f.Unlock()
+	_, err = f.try(ctx, first, func(v VCS) (err error) {
+		r, err = v.Zip(ctx, version)
+		return err
+	})
+	return r, err
+}
+
+// Resolve returns the version of the revision from the first client that can
+// resolve it. Clients that can not resolve revisions take them as versions.
+func (f *failoverVCS) Resolve(ctx context.Context, rev string) (version Version, err error) {
+	_, err = f.try(ctx, 0, func(v VCS) (err error) {
+		if r, ok := v.(Resolver); ok {
+			version, err = r.Resolve(ctx, rev)
+			return err
+		}
+		version = Version(rev)
+		return nil
+	})
+	return version, err
+}
+
+// Describe returns the repository of the first client that can tell it.
+func (f *failoverVCS) Describe(ctx context.Context) (Remote, error) {
+	for _, v := range f.backends {
+		if d, ok := v.(Describer); ok {
+			return d.Describe(ctx)
+		}
+	}
+	return Remote{}, nil
+}
+
+// try calls fn with every client, starting with the given one and then the
+// rest in order, until it succeeds, and returns the index of the last client
+// called. The error of the last client is returned if all of them fail.
+// Nothing is retried once the context is done.
+func (f *failoverVCS) try(ctx context.Context, first int, fn func(v VCS) error) (int, error) {
+	order := append([]int{first}, seq(0, first)...)
+	order = append(order, seq(first+1, len(f.backends))...)
+	var err error
+	for n, i := range order {
+		if err = fn(f.backends[i]); err == nil || ctx.Err() != nil || n == len(order)-1 {
+			return i, err
+		}
+		kind := Classify(err)
+		failovers.Add(kind.String(), 1)
+		f.log("failoverVCS", "module", f.module, "backend", i, "kind", kind, "error", err)
+	}
+	return 0, err
+}
+
+// seq returns the integers from a up to, but not including, b.
+func seq(a, b int) []int {
+	s := []int{}
+	for i := a; i < b; i++ {
+		s = append(s, i)
+	}
+	return s
+}
@@ -4,101 +4,494 @@ import (
 	"archive/zip"
 	"bytes"
 	"context"
+	"crypto/tls"
+	"encoding/binary"
 	"errors"
+	"expvar"
 	"fmt"
 	"io"
 	"io/ioutil"
+	nethttp "net/http"
 	"os"
 	"path"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"golang.org/x/mod/modfile"
 	"gopkg.in/src-d/go-git.v4"
 	"gopkg.in/src-d/go-git.v4/config"
 	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/packfile"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/pktline"
 	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
 	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/client"
 	"gopkg.in/src-d/go-git.v4/plumbing/transport/http"
 	"gopkg.in/src-d/go-git.v4/plumbing/transport/ssh"
+	"gopkg.in/src-d/go-git.v4/storage"
 	"gopkg.in/src-d/go-git.v4/storage/memory"
 )
 
 const remoteName = "origin"
 
+// gitProtocol is the version of the git wire protocol used to talk to the
+// remotes. go-git never asks servers for protocol v2, so every fetch uses the
+// original protocol, also known as v0.
+const gitProtocol = "v0"
+
+// Fetches from git remotes are counted and timed by protocol version, e.g.
+// "v0", so that the average fetch time can be compared once newer protocol
+// versions are in use.
+var (
+	gitFetches       = expvar.NewMap("git_fetches_total")
+	gitFetchDuration = expvar.NewMap("git_fetch_seconds_total")
+)
+
+// Objects and packfile bytes received by fetches are counted by the host of
+// the module, e.g. "github.com", to tell which remotes the traffic comes from.
+var (
+	gitFetchObjects = expvar.NewMap("git_fetch_objects_total")
+	gitFetchBytes   = expvar.NewMap("git_fetch_bytes_total")
+)
+
+// ignoreFile is a name of the file in the module root that lists glob patterns
+// of files to exclude from the module archive.
+const ignoreFile = ".goproxyignore"
+
+var (
+	errNoVersions    = errors.New("no tags and no default branch found")
+	errAfterSnapshot = errors.New("version was made after the snapshot time")
+	errFileTooLarge  = errors.New("file exceeds the maximum size")
+	errNotInManifest = errors.New("version is not in the manifest")
+	errMajorMismatch = errors.New("go.mod module path does not match the major version")
+)
+
+// reShortHash matches commit hashes abbreviated to at least 7 characters, like
+// git shortens them by default.
+var reShortHash = regexp.MustCompile(`^[0-9a-f]{7,40}$`)
+
 type gitVCS struct {
-	log    logger
-	dir    string
-	module string
-	prefix string
-	auth   Auth
+	log           logger
+	dir           string
+	module        string
+	prefix        string
+	major         string
+	auth          Auth
+	remote        string
+	legacy        bool
+	noPseudo      bool
+	foldCase      bool
+	tagPattern    *regexp.Regexp
+	anon          bool
+	insecure      bool
+	meta          *nethttp.Client
+	sshURL        string
+	pin           string
+	manifest      map[Version]string
+	ignore        []string
+	filter        bool
+	hosts         *HostPolicy
+	snapshot      time.Time
+	zipWorkers    int
+	maxFileSize   int64
+	skipLarge     bool
+	shallow       int
+	knownHosts    []string
+	acceptNew     bool
+	ignoreHostKey bool
+	majorDir      bool
+	mirrorPath    string
+	mirrorDir     string
+}
+
+// GitOption configures a go-git VCS client.
+type GitOption func(*gitVCS)
+
+// LegacyTags makes git client accept release tags without the "v" prefix, e.g.
+// "1.0.0", when no matching "v1.0.0" tag exists. Such tags are reported as
+// canonical "vX.Y.Z" versions.
+func LegacyTags() GitOption { return func(g *gitVCS) { g.legacy = true } }
+
+// CaseInsensitiveTags makes git client accept release tags that only become
+// valid versions when lowercased, e.g. "V1.0.0", when no exact-case tag
+// exists. Such tags are reported as lowercased versions.
+func CaseInsensitiveTags() GitOption { return func(g *gitVCS) { g.foldCase = true } }
+
+// TagPattern makes git client accept release tags that match the regular
+// expression as a whole, e.g. "release-1.2.3" or "mymodule-1.2.3" with
+// `^(?:release|mymodule)-(\d+\.\d+\.\d+)$`, for repositories with their own
+// tagging conventions. The first subexpression is the semantic version, which
+// is reported as a canonical "vX.Y.Z" version. Tags with the "v" prefix are
+// still accepted and win over the matching ones.
+func TagPattern(re *regexp.Regexp) GitOption { return func(g *gitVCS) { g.tagPattern = re } }
+
+// NoPseudoVersions makes git client list no versions for repositories without
+// release tags, instead of the pseudo-version of the default branch tip.
+// Pseudo-versions requested explicitly are still served.
+func NoPseudoVersions() GitOption { return func(g *gitVCS) { g.noPseudo = true } }
+
+// InsecureGitProtocol makes git client fetch repositories via anonymous git://
+// protocol. The protocol is neither authenticated nor encrypted, so it should
+// only be used for legacy servers in trusted networks that support nothing else.
+func InsecureGitProtocol() GitOption { return func(g *gitVCS) { g.anon = true } }
+
+// InsecureHTTP makes git client look the go-import meta tag up and fetch
+// repositories over plain HTTP instead of HTTPS, like GOINSECURE does for the
+// go tool, e.g. for internal hosts without TLS. Neither the meta tag nor the
+// repository content is protected in transit.
+func InsecureHTTP() GitOption { return func(g *gitVCS) { g.insecure = true } }
+
+// SSHURL makes git client fetch repositories over SSH from the URL built by
+// the template instead of "ssh://<repo root>.git", e.g. for Gerrit servers
+// with a non-standard port and path, as in
+// "ssh://git@gerrit.example.com:29418/{path}". In the template "{repo}" is
+// replaced with the repository root, "{host}" with its host and "{path}" with
+// the rest of it. The template is only used with key authentication.
+func SSHURL(template string) GitOption { return func(g *gitVCS) { g.sshURL = template } }
+
+// Pin makes git client serve the commit with the given full hash for every
+// requested version of the module. It is an emergency override: the content
+// served for a version no longer matches its tag, so checksums recorded in
+// go.sum files for that version will not match.
+func Pin(hash string) GitOption { return func(g *gitVCS) { g.pin = hash } }
+
+// Manifest makes git client serve only the given release versions, each from
+// the commit with the given full hash, instead of the repository tags. Versions
+// are listed without contacting the remote. Pseudo-versions are still resolved
+// as usual.
+func Manifest(versions map[Version]string) GitOption {
+	return func(g *gitVCS) { g.manifest = versions }
 }
 
+// Ignore makes git client exclude files matching the given glob patterns, as
+// well as patterns listed in the .goproxyignore file of the module root, from
+// the module archive. Patterns without a slash match file or directory names
+// at any depth, other patterns match paths relative to the module root. This
+// changes module checksums, so it must be coordinated with go.sum files of
+// the module consumers.
+func Ignore(patterns ...string) GitOption {
+	return func(g *gitVCS) {
+		g.filter = true
+		g.ignore = append(g.ignore, patterns...)
+	}
+}
+
+// Hosts makes git client check the module host and the repository host against
+// the given policy before making any requests to them.
+func Hosts(p *HostPolicy) GitOption { return func(g *gitVCS) { g.hosts = p } }
+
+// MetaClient makes git client look go-import meta tags up with the given HTTP
+// client, see NewMetaClient, instead of the default one.
+func MetaClient(c *nethttp.Client) GitOption { return func(g *gitVCS) { g.meta = c } }
+
+// Snapshot makes git client behave as if it was the given time: only the tags
+// pointing to commits made before that time are listed, branch tips resolve to
+// the last commit before that time, and newer commits are not served.
+func Snapshot(t time.Time) GitOption { return func(g *gitVCS) { g.snapshot = t } }
+
+// ZipWorkers makes git client read file contents using n parallel workers when
+// building module archives. The archives are identical to the ones built
+// sequentially, but all file contents are kept in memory at once.
+func ZipWorkers(n int) GitOption { return func(g *gitVCS) { g.zipWorkers = n } }
+
+// MaxFileSize makes git client refuse to build module archives with files
+// larger than n bytes, unless SkipLargeFiles option is given.
+func MaxFileSize(n int64) GitOption { return func(g *gitVCS) { g.maxFileSize = n } }
+
+// SkipLargeFiles makes git client leave the files larger than MaxFileSize out
+// of module archives instead of failing. This changes module checksums, so it
+// must be coordinated with go.sum files of the module consumers.
+func SkipLargeFiles() GitOption { return func(g *gitVCS) { g.skipLarge = true } }
+
+// ShallowPseudoVersions makes git client resolve pseudo-versions by fetching
+// only the last depth commits of every branch into memory first, instead of
+// the full history of a possibly huge repository. go-git can not fetch the
+// commits made since the pseudo-version timestamp (--shallow-since), so the
+// depth bounds the work instead. If the commit is not among them, the full
+// history is fetched as usual.
+func ShallowPseudoVersions(depth int) GitOption { return func(g *gitVCS) { g.shallow = depth } }
+
+// MajorSubdirectory makes git client serve a major version module, e.g.
+// "example.com/foo/v2", from the "v2" subdirectory of the repository even if
+// that directory has no go.mod file, when the go.mod file in the repository
+// root declares another module path. By default such requests fail, since the
+// archive would contain a go.mod of the wrong major version.
+func MajorSubdirectory() GitOption { return func(g *gitVCS) { g.majorDir = true } }
+
+// Mirror makes git client fetch modules with the given path prefix from the
+// bare repositories in the local directory instead of the remotes, e.g. with
+// the "git.example.com/" prefix module "git.example.com/team/repo/sub" is
+// fetched from "<dir>/team/repo.git" or "<dir>/team/repo", the longest module
+// path that is a bare repository. The mirrors are expected to be updated by
+// other means, such as "git remote update" run periodically.
+func Mirror(prefix, dir string) GitOption {
+	return func(g *gitVCS) { g.mirrorPath, g.mirrorDir = prefix, dir }
+}
+
+// KnownHosts makes git client verify SSH host keys against the given
+// known_hosts files instead of the ones in SSH_KNOWN_HOSTS, ~/.ssh/known_hosts
+// and /etc/ssh/ssh_known_hosts. Connections to hosts missing in the files are
+// refused.
+func KnownHosts(files ...string) GitOption {
+	return func(g *gitVCS) { g.knownHosts = append(g.knownHosts, files...) }
+}
+
+// AcceptNewHostKeys makes git client trust SSH hosts it connects to for the
+// first time and add their keys to the first known_hosts file, or to
+// ~/.ssh/known_hosts if none is given, like StrictHostKeyChecking=accept-new of
+// OpenSSH. Hosts whose key differs from the known one are still refused.
+func AcceptNewHostKeys() GitOption { return func(g *gitVCS) { g.acceptNew = true } }
+
+// InsecureIgnoreHostKey makes git client accept any SSH host key without
+// verifying it, e.g. for throwaway test environments. Connections can then be
+// intercepted, so it should never be used in production.
+func InsecureIgnoreHostKey() GitOption { return func(g *gitVCS) { g.ignoreHostKey = true } }
+
 // NewGit return a go-git VCS client implementation that provides information
 // about the specific module using the pgiven authentication mechanism.
-func NewGit(l logger, dir string, module string, auth Auth) VCS {
-	return &gitVCS{log: l, dir: dir, module: module, auth: auth}
+func NewGit(l logger, dir string, module string, auth Auth, options ...GitOption) VCS {
+	g := &gitVCS{log: l, dir: dir, module: module, auth: auth}
+	for _, opt := range options {
+		opt(g)
+	}
+	return g
 }
 
 func (g *gitVCS) List(ctx context.Context) ([]Version, error) {
-	g.log("gitVCS.List", "module", g.module)
-	repo, err := g.repo(ctx)
+	versions, wait, err := g.listStream(ctx)
 	if err != nil {
 		return nil, err
 	}
+	list := []Version{}
+	for version := range versions {
+		list = append(list, version)
+	}
+	if err := wait(); err != nil {
+		return nil, err
+	}
+	sortVersions(list)
+	g.log("gitVCS.List", "module", g.module, "list", list)
+	return list, nil
+}
+
+// ListStream sends module versions to the returned channel while the ref
+// advertisement of the remote is read, so the versions come in the order the
+// remote advertises the tags rather than sorted like List does. The channel is
+// closed when all versions are sent or the context is cancelled. Errors that
+// happen after the first version was sent are only logged.
+func (g *gitVCS) ListStream(ctx context.Context) (<-chan Version, error) {
+	versions, _, err := g.listStream(ctx)
+	return versions, err
+}
+
+// listStream starts sending module versions to the returned channel. It
+// returns once the first version is ready or the listing is over, and the
+// returned function waits for the listing to end and reports its error.
+func (g *gitVCS) listStream(ctx context.Context) (<-chan Version, func() error, error) {
+	g.log("gitVCS.ListStream", "module", g.module)
+	if g.manifest != nil {
+		list := []Version{}
+		for version := range g.manifest {
+			list = append(list, version)
+		}
+		sortVersions(list)
+		c := make(chan Version, len(list))
+		for _, version := range list {
+			c <- version
+		}
+		close(c)
+		return c, func() error { return nil }, nil
+	}
+	repo, done, err := g.repo(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	remote, err := repo.Remote(remoteName)
 	if err != nil {
-		return nil, err
+		done()
+		return nil, nil, err
 	}
 
 	auth, err := g.authMethod()
 	if err != nil {
-		return nil, err
+		done()
+		return nil, nil, err
 	}
 
-	refs, err := remote.List(&git.ListOptions{Auth: auth})
-	if err != nil {
-		return nil, err
+	if !g.snapshot.IsZero() {
+		// commit timestamps are needed to tell which tags existed back then
+		if err := g.fetch(ctx, repo); err != nil {
+			done()
+			return nil, nil, err
+		}
 	}
 
-	list := []Version{}
-	masterHash := ""
-	tagPrefix := ""
-	if g.prefix != "" {
-		tagPrefix = g.prefix + "/"
+	refs, refsErr, err := advertise(ctx, remote.Config().URLs[0], auth)
+	if err != nil {
+		done()
+		return nil, nil, err
 	}
-	for _, ref := range refs {
-		name := ref.Name()
-		if name == plumbing.Master {
-			masterHash = ref.Hash().String()
-		} else if name.IsTag() && strings.HasPrefix(name.String(), "refs/tags/"+tagPrefix+"v") {
-			list = append(list, Version(strings.TrimPrefix(name.String(), "refs/tags/"+tagPrefix)))
+
+	c := make(chan Version)
+	first := make(chan error, 1)
+	finished := make(chan struct{})
+	var listErr error
+	go func() {
+		defer done()
+		sent := false
+		err := g.sendVersions(ctx, repo, done, refs, refsErr, func(version Version) bool {
+			if !sent {
+				sent = true
+				first <- nil
+			}
+			select {
+			case c <- version:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+		if !sent {
+			first <- err
+		} else if err != nil && ctx.Err() == nil {
+			g.log("gitVCS.ListStream", "module", g.module, "error", err)
 		}
+		listErr = err
+		close(finished)
+		close(c)
+	}()
+	if err := <-first; err != nil {
+		return nil, nil, err
 	}
+	return c, func() error {
+		<-finished
+		if listErr != nil {
+			return listErr
+		}
+		return ctx.Err()
+	}, nil
+}
 
-	if len(list) == 0 {
-		if masterHash == "" {
-			return nil, errors.New("no tags and no master branch found")
+// sendVersions sends the versions of the tags from the ref advertisement as
+// they come. If there are no release tags, the pseudo-version of the default
+// branch is sent once the advertisement is over. The repository is released
+// with done before the timestamp of the pseudo-version is looked up, which
+// opens the repository again.
+func (g *gitVCS) sendVersions(ctx context.Context, repo *git.Repository, done func(), refs <-chan *plumbing.Reference, refsErr func() error, send func(Version) bool) error {
+	// The default branch is the one the remote HEAD points to. It is taken
+	// from the current ref advertisement, so that the changes of the default
+	// branch upstream are noticed even if the repository is already cached.
+	head := plumbing.Master
+	branches := map[plumbing.ReferenceName]string{}
+	seen := map[Version]bool{}
+	fetched := !g.snapshot.IsZero()
+	for ref := range refs {
+		if ref.Name() == plumbing.HEAD && ref.Type() == plumbing.SymbolicReference {
+			head = ref.Target()
+		} else if ref.Name().IsBranch() {
+			branches[ref.Name()] = ref.Hash().String()
+		} else if version, ok := g.tagVersion(ref); ok && !seen[version] {
+			if !g.snapshot.IsZero() && !g.beforeSnapshot(repo, ref) {
+				continue
+			}
+			if isIncompatible(version) {
+				// the tagged tree is needed to tell if it has a go.mod file
+				if !fetched {
+					if err := g.fetch(ctx, repo); err != nil {
+						return err
+					}
+					fetched = true
+				}
+				if g.hasGoMod(repo, ref) {
+					continue
+				}
+			}
+			seen[version] = true
+			if !send(version) {
+				return ctx.Err()
+			}
 		}
-		short := masterHash[:12]
-		t, err := g.Timestamp(ctx, Version("v0.0.0-20060102150405-"+short))
-		if err != nil {
-			return nil, err
+	}
+	if err := refsErr(); err != nil {
+		return err
+	}
+	if len(seen) > 0 {
+		return nil
+	}
+
+	tipHash := branches[head]
+	if tipHash == "" {
+		return errNoVersions
+	}
+	if g.noPseudo {
+		return nil
+	}
+	if !g.snapshot.IsZero() {
+		var err error
+		if tipHash, err = g.tipBefore(repo, tipHash); err != nil {
+			return err
 		}
-		list = []Version{Version(fmt.Sprintf("v0.0.0-%s-%s", t.Format("20060102150405"), short))}
 	}
+	short := tipHash[:12]
+	done()
+	t, err := g.Timestamp(ctx, Version("v0.0.0-20060102150405-"+short))
+	if err != nil {
+		return err
+	}
+	if !send(pseudoVersion(g.major, "", t, short)) {
+		return ctx.Err()
+	}
+	return nil
+}
 
-	g.log("gitVCS.List", "module", g.module, "list", list)
-	return list, nil
+// tagVersion returns a module version for the tag reference, if the tag is a
+// release tag of the module.
+func (g *gitVCS) tagVersion(ref *plumbing.Reference) (Version, bool) {
+	name := ref.Name()
+	tagPrefix := ""
+	if g.prefix != "" {
+		tagPrefix = g.prefix + "/"
+	}
+	if !name.IsTag() || !strings.HasPrefix(name.String(), "refs/tags/"+tagPrefix) {
+		return "", false
+	}
+	tag := strings.TrimPrefix(name.String(), "refs/tags/"+tagPrefix)
+	if v, ok := g.matchTag(tag); ok {
+		tag = string(v)
+	}
+	if strings.Contains(tag, "/") {
+		// a tag of a nested module, e.g. "v2compat/thing/v1.0.0"
+		return "", false
+	}
+	if g.foldCase && !Version(tag).IsSemVer() && Version(strings.ToLower(tag)).IsSemVer() {
+		tag = strings.ToLower(tag)
+	}
+	version := Version(tag)
+	if !strings.HasPrefix(tag, "v") {
+		if version = Version("v" + tag); !g.legacy || !version.IsSemVer() {
+			return "", false
+		}
+	}
+	if g.major != "" && !strings.HasPrefix(string(version), g.major+".") {
+		return "", false
+	}
+	return incompatible(g.prefix, g.major, version)
 }
 
 func (g *gitVCS) Timestamp(ctx context.Context, version Version) (time.Time, error) {
 	g.log("gitVCS.Timestamp", "module", g.module, "version", version)
-	ci, err := g.commit(ctx, version)
+	ci, done, err := g.commit(ctx, version)
 	if err != nil {
 		return time.Time{}, err
 	}
+	done()
 	g.log("gitVCS.Timestamp", "module", g.module, "version", version, "timestamp", ci.Committer.When)
 	return ci.Committer.When, nil
 }
@@ -117,31 +510,64 @@ func isVendoredPackage(name string) bool {
 
 func (g *gitVCS) Zip(ctx context.Context, version Version) (io.ReadCloser, error) {
 	g.log("gitVCS.Zip", "module", g.module, "version", version)
-	ci, err := g.commit(ctx, version)
+	ci, done, err := g.commit(ctx, version)
 	if err != nil {
 		return nil, err
 	}
+	defer done()
 	tree, err := ci.Tree()
 	if err != nil {
 		return nil, err
 	}
 
+	endWalk := Span(ctx, "walk")
 	b := &bytes.Buffer{}
 	zw := zip.NewWriter(b)
 	modules := map[string]bool{}
-	files := []*object.File{}
-	tree.Files().ForEach(func(f *object.File) error {
-		dir, file := path.Split(f.Name)
+	// Walk the tree without loading the blobs, they are read later only for the
+	// files that end up in the archive.
+	files := []object.TreeEntry{}
+	walker := object.NewTreeWalker(tree, true, nil)
+	defer walker.Close()
+	for {
+		name, entry, err := walker.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if entry.Mode == filemode.Dir || entry.Mode == filemode.Submodule {
+			continue
+		}
+		dir, file := path.Split(name)
 		if file == "go.mod" {
 			modules[dir] = true
 		}
-		files = append(files, f)
-		return nil
-	})
+		files = append(files, object.TreeEntry{Name: name, Mode: entry.Mode, Hash: entry.Hash})
+	}
 	prefix := g.prefix
+	if g.major != "" {
+		if prefix, err = g.majorPrefix(tree, version); err != nil {
+			return nil, err
+		}
+	}
 	if prefix != "" {
 		prefix = prefix + "/"
 	}
+	ignore := g.ignore
+	if g.filter {
+		if f, err := tree.File(prefix + ignoreFile); err == nil {
+			lines, err := f.Lines()
+			if err != nil {
+				return nil, err
+			}
+			for _, line := range lines {
+				if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+					ignore = append(ignore, line)
+				}
+			}
+		}
+	}
 	submodule := func(name string) bool {
 		for {
 			dir, _ := path.Split(name)
@@ -154,6 +580,8 @@ func (g *gitVCS) Zip(ctx context.Context, version Version) (io.ReadCloser, error
 			name = dir[:len(dir)-1]
 		}
 	}
+	included := []object.TreeEntry{}
+	names := []string{}
 	for _, f := range files {
 		// go mod strips vendored directories from the zip, and we do the same
 		// to match the checksums in the go.sum
@@ -176,7 +604,53 @@ func (g *gitVCS) Zip(ctx context.Context, version Version) (io.ReadCloser, error
 		} else {
 			continue
 		}
-		w, err := zw.Create(filepath.Join(g.module+"@"+string(version), name))
+		if ignored(name, ignore) {
+			continue
+		}
+		included = append(included, f)
+		names = append(names, name)
+	}
+	endWalk()
+	defer Span(ctx, "zip")()
+
+	if g.maxFileSize > 0 {
+		kept, keptNames := included[:0], names[:0]
+		for i := range included {
+			f, err := tree.TreeEntryFile(&included[i])
+			if err != nil {
+				return nil, err
+			}
+			if f.Size <= g.maxFileSize {
+				kept, keptNames = append(kept, included[i]), append(keptNames, names[i])
+			} else if g.skipLarge {
+				g.log("gitVCS.Zip", "module", g.module, "version", version, "skipped", names[i], "size", f.Size)
+			} else {
+				return nil, fmt.Errorf("%s: %d bytes: %w", names[i], f.Size, errFileTooLarge)
+			}
+		}
+		included, names = kept, keptNames
+	}
+
+	// Blobs may be read in parallel, but they are always written in the same
+	// order, so that the archive stays byte-identical.
+	var contents [][]byte
+	if g.zipWorkers > 1 {
+		if contents, err = readBlobs(tree, included, g.zipWorkers); err != nil {
+			return nil, err
+		}
+	}
+	for i := range included {
+		w, err := zw.Create(filepath.Join(g.module+"@"+string(version), names[i]))
+		if err != nil {
+			return nil, err
+		}
+		if contents != nil {
+			if _, err := w.Write(contents[i]); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		f, err := tree.TreeEntryFile(&included[i])
 		if err != nil {
 			return nil, err
 		}
@@ -184,100 +658,1052 @@ func (g *gitVCS) Zip(ctx context.Context, version Version) (io.ReadCloser, error
 		if err != nil {
 			return nil, err
 		}
-		defer r.Close()
-		io.Copy(w, r)
+		_, err = io.Copy(w, r)
+		r.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
 	}
-	zw.Close()
 	return ioutil.NopCloser(bytes.NewBuffer(b.Bytes())), nil
 }
 
-func (g *gitVCS) repo(ctx context.Context) (repo *git.Repository, err error) {
-	repoRoot, path, err := RepoRoot(ctx, g.module)
+// ignored returns true if the file name relative to the module root or any of
+// its parent directories matches one of the glob patterns.
+func ignored(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.Trim(pattern, "/")
+		for dir := name; dir != "." && dir != "/"; dir = path.Dir(dir) {
+			subject := dir
+			if !strings.Contains(pattern, "/") {
+				subject = path.Base(dir)
+			}
+			if ok, _ := path.Match(pattern, subject); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// readBlobs reads contents of the tree entries using n parallel workers.
+func readBlobs(tree *object.Tree, entries []object.TreeEntry, n int) ([][]byte, error) {
+	contents := make([][]byte, len(entries))
+	errs := make([]error, len(entries))
+	next := make(chan int)
+	wg := sync.WaitGroup{}
+	// go-git object storage is not safe for concurrent lookups, only reading
+	// and decompressing the blobs is done in parallel.
+	mu := sync.Mutex{}
+	for w := 0; w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				mu.Lock()
+				f, err := tree.TreeEntryFile(&entries[i])
+				mu.Unlock()
+				if err != nil {
+					errs[i] = err
+					continue
+				}
+				contents[i], errs[i] = readBlob(f)
+			}
+		}()
+	}
+	for i := range entries {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return contents, nil
+}
+
+func readBlob(f *object.File) ([]byte, error) {
+	r, err := f.Reader()
 	if err != nil {
 		return nil, err
 	}
-	g.prefix = path
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// repo opens the repository of the module, and returns a function to be called
+// when the repository is no longer used. Repositories in the git directory are
+// neither pruned nor replaced until then.
+func (g *gitVCS) repo(ctx context.Context) (repo *git.Repository, done func(), err error) {
+	defer Span(ctx, "open")()
+	repoRoot, path, url, err := g.resolve(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	setOrigin(ctx, "git", repoRoot)
+	g.prefix, g.major = splitMajor(path)
+	done = func() {}
 	if g.dir != "" {
 		dir := filepath.Join(g.dir, repoRoot)
-		if _, err := os.Stat(dir); os.IsNotExist(err) {
+		done = useGitDir(dir)
+		if _, statErr := os.Stat(dir); os.IsNotExist(statErr) {
 			os.MkdirAll(dir, 0755)
 			repo, err = git.PlainInit(dir, true)
 		} else {
-			return git.PlainOpen(dir)
+			// modification time tells PruneGitDir when the repo was last used
+			now := time.Now()
+			os.Chtimes(dir, now, now)
+			if repo, err = git.PlainOpen(dir); err != nil {
+				done()
+				return nil, nil, err
+			}
+			return repo, done, nil
 		}
 	} else {
 		repo, err = git.Init(memory.NewStorage(), nil)
 	}
 	if err != nil {
-		return nil, err
-	}
-	schema := "https://"
-	if g.auth.Key != "" {
-		schema = "ssh://"
+		done()
+		return nil, nil, err
 	}
-	g.log("repo", "url", schema+repoRoot+".git", "prefix", g.prefix)
+	g.log("repo", "url", url, "prefix", g.prefix, "major", g.major)
 	_, err = repo.CreateRemote(&config.RemoteConfig{
 		Name: remoteName,
-		URLs: []string{schema + repoRoot + ".git"},
+		URLs: []string{url},
 	})
-	return repo, err
+	if err != nil {
+		done()
+		return nil, nil, err
+	}
+	return repo, done, nil
 }
 
-func (g *gitVCS) commit(ctx context.Context, version Version) (*object.Commit, error) {
-	repo, err := g.repo(ctx)
+// resolve returns the repository root of the module, the module path within
+// the repository and the remote URL to fetch it from.
+func (g *gitVCS) resolve(ctx context.Context) (repoRoot, path, url string, err error) {
+	if g.mirrorDir != "" && g.remote == "" {
+		return g.resolveMirror()
+	}
+	if g.remote == "" {
+		if err := g.hosts.Check(strings.SplitN(g.module, "/", 2)[0]); err != nil {
+			return "", "", "", err
+		}
+	}
+	meta := g.meta
+	if meta == nil {
+		meta = defaultMetaClient
+	}
+	repoRoot, path, err = lookupRepoRoot(ctx, meta, g.module, g.insecure)
 	if err != nil {
-		return nil, err
+		return "", "", "", err
 	}
-	auth, err := g.authMethod()
+	if g.remote != "" {
+		return repoRoot, path, g.remote, nil
+	}
+	// go-import meta tag may point to a different host
+	if err := g.hosts.Check(strings.SplitN(repoRoot, "/", 2)[0]); err != nil {
+		return "", "", "", err
+	}
+	schema := "https://"
+	if g.anon {
+		schema = "git://"
+	} else if g.auth.Key != "" && g.sshURL != "" {
+		host, rest := repoRoot, ""
+		if i := strings.Index(repoRoot, "/"); i >= 0 {
+			host, rest = repoRoot[:i], repoRoot[i+1:]
+		}
+		return repoRoot, path, strings.NewReplacer("{repo}", repoRoot, "{host}", host, "{path}", rest).Replace(g.sshURL), nil
+	} else if g.auth.Key != "" {
+		schema = "ssh://"
+	} else if g.insecure {
+		schema = "http://"
+	}
+	return repoRoot, path, schema + repoRoot + ".git", nil
+}
+
+// resolveMirror returns the repository root of the module, the module path
+// within the repository and the URL of the bare repository in the local mirror
+// directory.
+func (g *gitVCS) resolveMirror() (repoRoot, path, url string, err error) {
+	rel := strings.Trim(strings.TrimPrefix(g.module, g.mirrorPath), "/")
+	if !strings.HasPrefix(g.module, g.mirrorPath) || rel == "" {
+		return "", "", "", fmt.Errorf("%s: not under the mirror prefix %s: %w", g.module, g.mirrorPath, os.ErrNotExist)
+	}
+	elems := strings.Split(rel, "/")
+	for n := len(elems); n > 0; n-- {
+		sub := filepath.Join(g.mirrorDir, filepath.FromSlash(strings.Join(elems[:n], "/")))
+		for _, dir := range []string{sub + ".git", sub} {
+			if isBareRepo(dir) {
+				path = strings.Join(elems[n:], "/")
+				repoRoot = strings.TrimSuffix(strings.TrimSuffix(g.module, path), "/")
+				return repoRoot, path, "file://" + filepath.ToSlash(dir), nil
+			}
+		}
+	}
+	return "", "", "", fmt.Errorf("%s: no mirror in %s: %w", g.module, g.mirrorDir, os.ErrNotExist)
+}
+
+// isBareRepo returns true if the directory looks like a bare git repository.
+func isBareRepo(dir string) bool {
+	head, err := os.Stat(filepath.Join(dir, "HEAD"))
+	if err != nil || !head.Mode().IsRegular() {
+		return false
+	}
+	objects, err := os.Stat(filepath.Join(dir, "objects"))
+	return err == nil && objects.IsDir()
+}
+
+// Describe returns the repository the module is fetched from.
+func (g *gitVCS) Describe(ctx context.Context) (Remote, error) {
+	repoRoot, _, url, err := g.resolve(ctx)
 	if err != nil {
-		return nil, err
+		return Remote{}, err
 	}
-	err = repo.FetchContext(ctx, &git.FetchOptions{
-		RemoteName: remoteName,
-		Auth:       auth,
-		Tags:       git.AllTags,
-	})
-	if err != nil && err != git.NoErrAlreadyUpToDate {
+	return Remote{VCS: "git", Repo: repoRoot, URL: url, Auth: g.auth.Kind()}, nil
+}
+
+// commit returns the commit the version refers to, and a function to be called
+// when the repository the commit is read from is no longer used.
+func (g *gitVCS) commit(ctx context.Context, version Version) (*object.Commit, func(), error) {
+	repo, done, err := g.repo(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	ci, err := g.openCommit(ctx, repo, version)
+	if err == plumbing.ErrObjectNotFound && isShallow(repo) {
+		// the repository can not be replaced while it is used
+		done()
+		if repo, done, err = g.unshallow(ctx); err != nil {
+			return nil, nil, err
+		}
+		ci, err = g.lookup(repo, version)
+	}
+	if err != nil {
+		done()
+		return nil, nil, err
+	}
+	RecordCommit(ctx, ci.Hash.String())
+	return ci, done, nil
+}
+
+// openCommit returns the commit the version refers to in the repository, which
+// is fetched unless the commit is found in the shallow history.
+func (g *gitVCS) openCommit(ctx context.Context, repo *git.Repository, version Version) (*object.Commit, error) {
+	if g.shallow > 0 && g.pin == "" && !version.IsSemVer() && version.Hash() != "" {
+		if ci, err := g.shallowCommit(ctx, repo, version.Hash()); err != nil {
+			return nil, err
+		} else if ci != nil {
+			if !g.snapshot.IsZero() && ci.Committer.When.After(g.snapshot) {
+				return nil, errAfterSnapshot
+			}
+			return ci, nil
+		}
+	}
+	if err := g.fetch(ctx, repo); err != nil {
 		return nil, err
 	}
+	defer Span(ctx, "resolve")()
+	return g.lookup(repo, version)
+}
+
+// lookup returns the commit the version refers to in the fetched repository.
+func (g *gitVCS) lookup(repo *git.Repository, version Version) (*object.Commit, error) {
+	if g.pin != "" {
+		g.log("gitVCS.commit", "module", g.module, "version", version, "pinned", g.pin)
+		return repo.CommitObject(plumbing.NewHash(g.pin))
+	}
+
+	if g.manifest != nil {
+		if hash, ok := g.manifest[version]; ok {
+			g.log("gitVCS.commit", "module", g.module, "version", version, "manifest", hash)
+			return repo.CommitObject(plumbing.NewHash(hash))
+		} else if version.Hash() == "" {
+			return nil, errNotInManifest
+		}
+	}
 
 	version = Version(strings.TrimSuffix(string(version), "+incompatible"))
 	hash := version.Hash()
-	if version.IsSemVer() {
-		tags, err := repo.Tags()
+	tagPrefix := ""
+	if g.prefix != "" {
+		tagPrefix = g.prefix + "/"
+	}
+	if hash == "" {
+		if h, ok := g.tag(repo, tagPrefix+string(version)); ok && tagPrefix != "" {
+			hash = h
+		} else if h, ok := g.tag(repo, string(version)); ok {
+			hash = h
+		} else if h, ok := g.tag(repo, strings.TrimPrefix(string(version), "v")); ok && g.legacy {
+			hash = h
+		} else if h, ok := g.tagFold(repo, tagPrefix, version); ok && g.foldCase {
+			hash = h
+		} else if h, ok := g.tagMatching(repo, tagPrefix, version); ok {
+			hash = h
+		}
+	} else {
+		commits, err := repo.CommitObjects()
 		if err != nil {
 			return nil, err
 		}
-		tags.ForEach(func(t *plumbing.Reference) error {
-			if t.Name().String() == "refs/tags/"+string(version) {
-				hash = t.Hash().String()
-				annotated, err := repo.TagObject(t.Hash())
-				if err == nil {
-					hash = annotated.Target.String()
-				}
+		commits.ForEach(func(ci *object.Commit) error {
+			if strings.HasPrefix(ci.Hash.String(), version.Hash()) {
+				hash = ci.Hash.String()
 			}
 			return nil
 		})
-	} else {
+	}
+
+	g.log("gitVCS.commit", "module", g.module, "version", version, "hash", hash)
+	ci, err := repo.CommitObject(plumbing.NewHash(hash))
+	if err != nil {
+		return nil, err
+	}
+	if !g.snapshot.IsZero() && ci.Committer.When.After(g.snapshot) {
+		return nil, errAfterSnapshot
+	}
+	return ci, nil
+}
+
+// isShallow tells if the repository lacks the history before some commits,
+// e.g. because it was cloned into the git directory with "git clone --depth".
+func isShallow(repo *git.Repository) bool {
+	commits, err := repo.Storer.Shallow()
+	return err == nil && len(commits) > 0
+}
+
+// unshallow replaces the shallow repository in the git directory with a full
+// clone. go-git can not deepen the repository in place, since it tells the
+// remote that it already has the history of all its commits. The clone is
+// fetched next to the repository and moved into its place once the repository
+// is no longer used.
+func (g *gitVCS) unshallow(ctx context.Context) (*git.Repository, func(), error) {
+	repoRoot, _, url, err := g.resolve(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	g.log("gitVCS.unshallow", "module", g.module)
+	dir := filepath.Join(g.dir, repoRoot)
+	tmp, err := ioutil.TempDir(filepath.Dir(dir), filepath.Base(dir)+".unshallow")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.RemoveAll(tmp)
+	// the clone must not be pruned before it is in place
+	done := useGitDir(tmp)
+	defer done()
+	repo, err := git.PlainInit(tmp, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := repo.CreateRemote(&config.RemoteConfig{Name: remoteName, URLs: []string{url}}); err != nil {
+		return nil, nil, err
+	}
+	if err := g.fetch(ctx, repo); err != nil {
+		return nil, nil, err
+	}
+	done()
+
+	unlock := lockGitDir(dir)
+	if err := os.RemoveAll(dir); err != nil {
+		unlock()
+		return nil, nil, err
+	}
+	err = os.Rename(tmp, dir)
+	unlock()
+	if err != nil {
+		return nil, nil, err
+	}
+	return g.repo(ctx)
+}
+
+// Resolve returns the version of the commit the branch, tag or commit hash
+// prefix refers to: the highest release tag of the module pointing to the
+// commit, or its pseudo-version based on the closest tagged ancestor.
+func (g *gitVCS) Resolve(ctx context.Context, rev string) (Version, error) {
+	if g.manifest != nil {
+		return "", errNotInManifest
+	}
+	repo, done, err := g.repo(ctx)
+	if err != nil {
+		return "", err
+	}
+	if err := g.fetch(ctx, repo); err != nil {
+		done()
+		return "", err
+	}
+	defer Span(ctx, "resolve")()
+	if g.pin != "" {
+		rev = g.pin
+	}
+	version, err := g.resolveRevision(repo, rev)
+	if err == plumbing.ErrObjectNotFound && isShallow(repo) {
+		// the repository can not be replaced while it is used
+		done()
+		if repo, done, err = g.unshallow(ctx); err != nil {
+			return "", err
+		}
+		version, err = g.resolveRevision(repo, rev)
+	}
+	done()
+	return version, err
+}
+
+// resolveRevision returns the version of the commit the revision refers to in
+// the fetched repository.
+func (g *gitVCS) resolveRevision(repo *git.Repository, rev string) (Version, error) {
+	ci, err := g.revision(repo, rev)
+	if err != nil {
+		return "", err
+	}
+	if !g.snapshot.IsZero() && ci.Committer.When.After(g.snapshot) {
+		return "", errAfterSnapshot
+	}
+	// +incompatible versions are only allowed for commits without go.mod
+	tree, err := ci.Tree()
+	if err != nil {
+		return "", err
+	}
+	_, err = tree.File(path.Join(g.prefix, "go.mod"))
+	hasGoMod := err == nil
+	tags, err := g.tagCommits(repo, !hasGoMod)
+	if err != nil {
+		return "", err
+	}
+	if version := highest(tags[ci.Hash]); version != "" {
+		return version, nil
+	}
+
+	// The base of the pseudo-version is the highest tag among the ancestors,
+	// like the go tool picks it.
+	base := Version("")
+	if len(tags) > 0 {
+		commits := object.NewCommitPreorderIter(ci, nil, nil)
+		defer commits.Close()
+		err := commits.ForEach(func(c *object.Commit) error {
+			if v := highest(tags[c.Hash]); v != "" && (base == "" || v.Compare(base) > 0) {
+				base = v
+			}
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	version := pseudoVersion(g.major, base, ci.Committer.When, ci.Hash.String()[:12])
+	g.log("gitVCS.Resolve", "module", g.module, "rev", rev, "version", version)
+	return version, nil
+}
+
+// revision returns the commit the branch, tag or commit hash prefix refers to.
+func (g *gitVCS) revision(repo *git.Repository, rev string) (*object.Commit, error) {
+	if ref, err := repo.Reference(plumbing.NewRemoteReferenceName(remoteName, rev), true); err == nil {
+		return repo.CommitObject(ref.Hash())
+	}
+	if hash, ok := g.tag(repo, rev); ok {
+		return repo.CommitObject(plumbing.NewHash(hash))
+	}
+	if reShortHash.MatchString(rev) {
 		commits, err := repo.CommitObjects()
 		if err != nil {
 			return nil, err
 		}
+		var found *object.Commit
 		commits.ForEach(func(ci *object.Commit) error {
-			if strings.HasPrefix(ci.Hash.String(), version.Hash()) {
-				hash = ci.Hash.String()
+			if strings.HasPrefix(ci.Hash.String(), rev) {
+				found = ci
+				return storer.ErrStop
 			}
 			return nil
 		})
+		if found != nil {
+			return found, nil
+		}
 	}
+	return nil, fmt.Errorf("%s@%s: unknown revision: %w", g.module, rev, os.ErrNotExist)
+}
 
-	g.log("gitVCS.commit", "module", g.module, "version", version, "hash", hash)
-	return repo.CommitObject(plumbing.NewHash(hash))
+// tagCommits returns the release versions of the module by the commits they
+// are tagged on. Tags of other major versions are left out, and so are the
+// +incompatible ones unless asked for.
+func (g *gitVCS) tagCommits(repo *git.Repository, withIncompatible bool) (map[plumbing.Hash][]Version, error) {
+	refs, err := repo.Tags()
+	if err != nil {
+		return nil, err
+	}
+	tags := map[plumbing.Hash][]Version{}
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		version, ok := g.tagVersion(ref)
+		if !ok || !version.IsValid() || (isIncompatible(version) && (!withIncompatible || g.hasGoMod(repo, ref))) {
+			return nil
+		}
+		if !g.snapshot.IsZero() && !g.beforeSnapshot(repo, ref) {
+			return nil
+		}
+		if hash, ok := g.tag(repo, strings.TrimPrefix(ref.Name().String(), "refs/tags/")); ok {
+			tags[plumbing.NewHash(hash)] = append(tags[plumbing.NewHash(hash)], version)
+		}
+		return nil
+	})
+	return tags, err
+}
+
+// highest returns the highest of the versions, or an empty string if there
+// are none.
+func highest(versions []Version) Version {
+	max := Version("")
+	for _, v := range versions {
+		if max == "" || v.Compare(max) > 0 {
+			max = v
+		}
+	}
+	return max
+}
+
+func (g *gitVCS) fetch(ctx context.Context, repo *git.Repository) error {
+	defer Span(ctx, "fetch")()
+	auth, err := g.authMethod()
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	pack := &packStorer{Storer: repo.Storer}
+	err = pack.repo(repo).FetchContext(ctx, &git.FetchOptions{
+		RemoteName: remoteName,
+		Auth:       auth,
+		Tags:       git.AllTags,
+	})
+	d := time.Since(start)
+	gitFetches.Add(gitProtocol, 1)
+	gitFetchDuration.AddFloat(gitProtocol, d.Seconds())
+	host := strings.SplitN(g.module, "/", 2)[0]
+	gitFetchObjects.Add(host, pack.objects)
+	gitFetchBytes.Add(host, pack.bytes)
+	g.log("gitVCS.fetch", "module", g.module, "protocol", gitProtocol, "time", d,
+		"objects", pack.objects, "bytes", pack.bytes)
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return err
+	}
+	return nil
+}
+
+// packStorer counts the objects and bytes of the packfiles written into the
+// wrapped repository storage.
+type packStorer struct {
+	storage.Storer
+	objects int64
+	bytes   int64
+	header  []byte
+}
+
+// repo returns a copy of the repository that stores objects through s.
+func (s *packStorer) repo(repo *git.Repository) *git.Repository {
+	r := *repo
+	r.Storer = s
+	return &r
+}
+
+// PackfileWriter returns a writer that counts the packfile and passes it on to
+// the wrapped storage. Storages that can not keep packfiles, such as the
+// in-memory one, get the objects parsed from it instead, as go-git does.
+func (s *packStorer) PackfileWriter() (io.WriteCloser, error) {
+	if pw, ok := s.Storer.(storer.PackfileWriter); ok {
+		w, err := pw.PackfileWriter()
+		if err != nil {
+			return nil, err
+		}
+		return &packWriter{WriteCloser: w, s: s}, nil
+	}
+	r, w := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		p, err := packfile.NewParserWithStorage(packfile.NewScanner(r), s.Storer)
+		if err == nil {
+			_, err = p.Parse()
+		}
+		r.CloseWithError(err)
+		done <- err
+	}()
+	return &packWriter{WriteCloser: &pipeWriter{PipeWriter: w, done: done}, s: s}, nil
+}
+
+// packWriter counts the bytes written and reads the number of objects from the
+// packfile header: "PACK", the version and the object count, 4 bytes each.
+type packWriter struct {
+	io.WriteCloser
+	s *packStorer
+}
+
+func (w *packWriter) Write(b []byte) (int, error) {
+	if n := 12 - len(w.s.header); n > 0 {
+		if n > len(b) {
+			n = len(b)
+		}
+		w.s.header = append(w.s.header, b[:n]...)
+		if len(w.s.header) == 12 && string(w.s.header[:4]) == "PACK" {
+			w.s.objects = int64(binary.BigEndian.Uint32(w.s.header[8:]))
+		}
+	}
+	n, err := w.WriteCloser.Write(b)
+	w.s.bytes = w.s.bytes + int64(n)
+	return n, err
+}
+
+// pipeWriter waits for the packfile to be parsed on close.
+type pipeWriter struct {
+	*io.PipeWriter
+	done chan error
+}
+
+func (w *pipeWriter) Close() error {
+	w.PipeWriter.Close()
+	return <-w.done
+}
+
+// shallowCommit fetches the last commits of every branch of the repository
+// remote into memory and returns the one with the given hash prefix, or nil if
+// it is not there.
+func (g *gitVCS) shallowCommit(ctx context.Context, repo *git.Repository, prefix string) (*object.Commit, error) {
+	defer Span(ctx, "fetch")()
+	remote, err := repo.Remote(remoteName)
+	if err != nil {
+		return nil, err
+	}
+	auth, err := g.authMethod()
+	if err != nil {
+		return nil, err
+	}
+	shallow, err := git.Init(memory.NewStorage(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := shallow.CreateRemote(&config.RemoteConfig{Name: remoteName, URLs: remote.Config().URLs}); err != nil {
+		return nil, err
+	}
+	err = shallow.FetchContext(ctx, &git.FetchOptions{
+		RemoteName: remoteName,
+		Auth:       auth,
+		Depth:      g.shallow,
+		Tags:       git.NoTags,
+	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return nil, err
+	}
+	commits, err := shallow.CommitObjects()
+	if err != nil {
+		return nil, err
+	}
+	var found *object.Commit
+	commits.ForEach(func(ci *object.Commit) error {
+		if strings.HasPrefix(ci.Hash.String(), prefix) {
+			found = ci
+			return storer.ErrStop
+		}
+		return nil
+	})
+	g.log("gitVCS.shallowCommit", "module", g.module, "depth", g.shallow, "hash", prefix, "found", found != nil)
+	return found, nil
+}
+
+// beforeSnapshot returns true if the tag points to a commit made before the
+// snapshot time.
+func (g *gitVCS) beforeSnapshot(repo *git.Repository, ref *plumbing.Reference) bool {
+	hash, ok := g.tag(repo, strings.TrimPrefix(ref.Name().String(), "refs/tags/"))
+	if !ok {
+		return false
+	}
+	ci, err := repo.CommitObject(plumbing.NewHash(hash))
+	return err == nil && !ci.Committer.When.After(g.snapshot)
+}
+
+// hasGoMod tells if the tree of the commit the tag reference points to has a
+// go.mod file in the module directory.
+func (g *gitVCS) hasGoMod(repo *git.Repository, ref *plumbing.Reference) bool {
+	hash, ok := g.tag(repo, strings.TrimPrefix(ref.Name().String(), "refs/tags/"))
+	if !ok {
+		return false
+	}
+	ci, err := repo.CommitObject(plumbing.NewHash(hash))
+	if err != nil {
+		return false
+	}
+	_, err = ci.File(path.Join(g.prefix, "go.mod"))
+	return err == nil
+}
+
+// tipBefore returns a hash of the latest commit in the history of the given
+// branch tip that was made before the snapshot time.
+func (g *gitVCS) tipBefore(repo *git.Repository, tip string) (string, error) {
+	commits, err := repo.Log(&git.LogOptions{From: plumbing.NewHash(tip)})
+	if err != nil {
+		return "", err
+	}
+	defer commits.Close()
+	hash := ""
+	err = commits.ForEach(func(ci *object.Commit) error {
+		if !ci.Committer.When.After(g.snapshot) {
+			hash = ci.Hash.String()
+			return storer.ErrStop
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	} else if hash == "" {
+		return "", errNoVersions
+	}
+	return hash, nil
+}
+
+// majorPrefix returns the directory of the major version module in the tree.
+// Major version may live either in the repo root tagged with vN.x.y tags or in
+// the "vN" subdirectory that has its own go.mod. Either way the go.mod file,
+// if there is one, must declare the requested module path.
+func (g *gitVCS) majorPrefix(tree *object.Tree, version Version) (string, error) {
+	sub := path.Join(g.prefix, g.major)
+	if _, err := tree.File(path.Join(sub, "go.mod")); err == nil {
+		return sub, g.checkModulePath(tree, sub, version)
+	}
+	err := g.checkModulePath(tree, g.prefix, version)
+	if err != nil && g.majorDir {
+		if _, dirErr := tree.Tree(sub); dirErr == nil {
+			g.log("gitVCS.Zip", "module", g.module, "version", version, "dir", sub, "error", err)
+			return sub, nil
+		}
+	}
+	return g.prefix, err
+}
+
+// checkModulePath returns an error if the go.mod file in the given directory
+// declares a module path other than the requested one.
+func (g *gitVCS) checkModulePath(tree *object.Tree, dir string, version Version) error {
+	f, err := tree.File(path.Join(dir, "go.mod"))
+	if err != nil {
+		return nil
+	}
+	content, err := f.Contents()
+	if err != nil {
+		return err
+	}
+	if mod := modfile.ModulePath([]byte(content)); mod != "" && mod != g.module {
+		return fmt.Errorf("%s@%s: %s declares module path %q, expected %q: %w",
+			g.module, version, path.Join(dir, "go.mod"), mod, g.module, errMajorMismatch)
+	}
+	return nil
+}
+
+// splitMajor splits a module path within the repo into the directory and the
+// major version suffix, e.g. "sub/v3" into "sub" and "v3". Only the last path
+// element is a suffix, and only if it is "v" followed by a major version
+// number, so that directories like "v2compat/thing" are plain subdirectories.
+// Paths without major version suffix, as well as "v0" and "v1", are returned
+// as is.
+func splitMajor(p string) (dir string, major string) {
+	dir, major = path.Split(p)
+	if len(major) < 2 || major[0] != 'v' || major == "v0" || major == "v1" {
+		return p, ""
+	}
+	if _, err := strconv.Atoi(major[1:]); err != nil || major[1] == '0' {
+		return p, ""
+	}
+	return strings.TrimSuffix(dir, "/"), major
+}
+
+// tag returns a hash of the commit the given tag points to. Annotated tags are
+// resolved to their target commits.
+func (g *gitVCS) tag(repo *git.Repository, name string) (string, bool) {
+	ref, err := repo.Reference(plumbing.ReferenceName("refs/tags/"+name), true)
+	if err != nil {
+		return "", false
+	}
+	if annotated, err := repo.TagObject(ref.Hash()); err == nil {
+		return annotated.Target.String(), true
+	}
+	return ref.Hash().String(), true
+}
+
+// tagFold looks up a release tag that matches the version when lowercased.
+func (g *gitVCS) tagFold(repo *git.Repository, tagPrefix string, version Version) (string, bool) {
+	if !g.foldCase {
+		return "", false
+	}
+	refs, err := repo.Tags()
+	if err != nil {
+		return "", false
+	}
+	defer refs.Close()
+	for {
+		ref, err := refs.Next()
+		if err != nil {
+			return "", false
+		}
+		// nested modules never fall back to the tags of the root module
+		name := strings.TrimPrefix(ref.Name().String(), "refs/tags/")
+		if strings.HasPrefix(name, tagPrefix) && strings.ToLower(name[len(tagPrefix):]) == string(version) {
+			return g.tag(repo, name)
+		}
+	}
+}
+
+// matchTag returns the version of the tag, if it matches the tag pattern.
+func (g *gitVCS) matchTag(tag string) (Version, bool) {
+	if g.tagPattern == nil {
+		return "", false
+	}
+	m := g.tagPattern.FindStringSubmatch(tag)
+	if len(m) < 2 || m[0] != tag {
+		return "", false
+	}
+	version := Version("v" + strings.TrimPrefix(m[1], "v"))
+	return version, version.IsValid()
+}
+
+// tagMatching looks up a release tag that matches the tag pattern and the
+// version.
+func (g *gitVCS) tagMatching(repo *git.Repository, tagPrefix string, version Version) (string, bool) {
+	if g.tagPattern == nil {
+		return "", false
+	}
+	refs, err := repo.Tags()
+	if err != nil {
+		return "", false
+	}
+	defer refs.Close()
+	for {
+		ref, err := refs.Next()
+		if err != nil {
+			return "", false
+		}
+		name := strings.TrimPrefix(ref.Name().String(), "refs/tags/")
+		for _, prefix := range []string{tagPrefix, ""} {
+			if v, ok := g.matchTag(strings.TrimPrefix(name, prefix)); ok && strings.HasPrefix(name, prefix) && v == version {
+				return g.tag(repo, name)
+			}
+		}
+	}
+}
+
+// listRemote returns the references advertised by the remote, like
+// git.Remote.List, which can not be cancelled. HTTP requests are bound to the
+// context and other sessions are closed once the context is done, so that a
+// slow or unreachable remote does not hold a worker for a request that is
+// already gone.
+func listRemote(ctx context.Context, url string, auth transport.AuthMethod) (refs []*plumbing.Reference, err error) {
+	ep, err := transport.NewEndpoint(url)
+	if err != nil {
+		return nil, err
+	}
+	var c transport.Transport
+	if ep.Protocol == "http" || ep.Protocol == "https" {
+		c = http.NewClient(&nethttp.Client{Transport: contextTransport{ctx}})
+	} else if c, err = client.NewClient(ep); err != nil {
+		return nil, err
+	}
+	s, err := c.NewUploadPackSession(ep, auth)
+	if err != nil {
+		return nil, err
+	}
+	once := sync.Once{}
+	closeSession := func() { once.Do(func() { s.Close() }) }
+	defer closeSession()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			closeSession()
+		case <-done:
+		}
+	}()
+
+	ar, err := s.AdvertisedReferences()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	} else if err != nil {
+		return nil, err
+	}
+	all, err := ar.AllReferences()
+	if err != nil {
+		return nil, err
+	}
+	iter, err := all.IterReferences()
+	if err != nil {
+		return nil, err
+	}
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		refs = append(refs, ref)
+		return nil
+	})
+	return refs, err
+}
+
+// advertise sends the references advertised by the remote to the returned
+// channel. Smart HTTP advertisements are parsed while they are received, so
+// that the tags of huge repos are available before the whole advertisement
+// is downloaded, other remotes are listed with listRemote. The returned
+// function reports the error that ended the advertisement once the channel is
+// closed.
+func advertise(ctx context.Context, url string, auth transport.AuthMethod) (<-chan *plumbing.Reference, func() error, error) {
+	ep, err := transport.NewEndpoint(url)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ep.Protocol != "http" && ep.Protocol != "https" {
+		refs, err := listRemote(ctx, url, auth)
+		if err != nil {
+			return nil, nil, err
+		}
+		c := make(chan *plumbing.Reference, len(refs))
+		for _, ref := range refs {
+			c <- ref
+		}
+		close(c)
+		return c, func() error { return nil }, nil
+	}
+
+	req, err := nethttp.NewRequest("GET", ep.String()+"/info/refs?service="+transport.UploadPackServiceName, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Add("User-Agent", "git/1.0")
+	if auth != nil {
+		a, ok := auth.(http.AuthMethod)
+		if !ok {
+			return nil, nil, transport.ErrInvalidAuthMethod
+		}
+		a.SetAuth(req)
+	}
+	res, err := (&nethttp.Client{Transport: contextTransport{ctx}}).Do(req)
+	if ctx.Err() != nil {
+		return nil, nil, ctx.Err()
+	} else if err != nil {
+		return nil, nil, err
+	}
+	if err := http.NewErr(res); err != nil {
+		res.Body.Close()
+		return nil, nil, err
+	}
+
+	c := make(chan *plumbing.Reference)
+	var advErr error
+	go func() {
+		defer close(c)
+		defer res.Body.Close()
+		advErr = readAdvRefs(ctx, res.Body, c)
+	}()
+	return c, func() error { return advErr }, nil
+}
+
+// readAdvRefs reads the pkt-lines of a smart HTTP ref advertisement and sends
+// the references to the channel. The symbolic HEAD reference is taken from the
+// symref capability and peeled tags are skipped, like go-git does.
+func readAdvRefs(ctx context.Context, r io.Reader, c chan<- *plumbing.Reference) error {
+	send := func(ref *plumbing.Reference) bool {
+		select {
+		case c <- ref:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	s := pktline.NewScanner(r)
+	first, service, empty := true, false, false
+	for s.Scan() {
+		line := bytes.TrimSuffix(s.Bytes(), []byte("\n"))
+		if len(line) == 0 {
+			// the service announcement ends with a flush-pkt of its own
+			if service {
+				service = false
+				continue
+			}
+			if empty {
+				return transport.ErrEmptyRemoteRepository
+			}
+			return nil
+		}
+		if first && bytes.HasPrefix(line, []byte("# service=")) {
+			service = true
+			continue
+		}
+		if first {
+			first = false
+			i := bytes.IndexByte(line, 0)
+			if i < 0 {
+				return fmt.Errorf("malformed ref advertisement: no capabilities: %q", line)
+			}
+			for _, capability := range strings.Fields(string(line[i+1:])) {
+				if target := strings.TrimPrefix(capability, "symref=HEAD:"); target != capability {
+					if !send(plumbing.NewSymbolicReference(plumbing.HEAD, plumbing.ReferenceName(target))) {
+						return ctx.Err()
+					}
+				}
+			}
+			line = line[:i]
+		}
+		fields := strings.SplitN(string(line), " ", 2)
+		if len(fields) != 2 || len(fields[0]) != 40 {
+			return fmt.Errorf("malformed ref advertisement: %q", line)
+		}
+		if fields[1] == "capabilities^{}" {
+			empty = true
+			continue
+		}
+		if strings.HasSuffix(fields[1], "^{}") {
+			continue
+		}
+		if !send(plumbing.NewReferenceFromStrings(fields[1], fields[0])) {
+			return ctx.Err()
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	} else if err := s.Err(); err != nil {
+		return err
+	}
+	return io.ErrUnexpectedEOF
+}
+
+// contextTransport binds the HTTP requests to the context.
+type contextTransport struct {
+	ctx context.Context
+}
+
+func (t contextTransport) RoundTrip(r *nethttp.Request) (*nethttp.Response, error) {
+	gitHTTPMu.RLock()
+	base := gitHTTP
+	gitHTTPMu.RUnlock()
+	return base.RoundTrip(r.WithContext(t.ctx))
+}
+
+var (
+	gitHTTPMu sync.RWMutex
+	gitHTTP   = nethttp.DefaultTransport
+)
+
+// configureGitTLS makes go-git use the TLS configuration for remotes fetched
+// over HTTPS.
+func configureGitTLS(c *tls.Config) {
+	t := nethttp.DefaultTransport.(*nethttp.Transport).Clone()
+	t.TLSClientConfig = c
+	gitHTTPMu.Lock()
+	defer gitHTTPMu.Unlock()
+	gitHTTP = t
+	client.InstallProtocol("https", http.NewClient(&nethttp.Client{Transport: t}))
 }
 
 func (g *gitVCS) authMethod() (transport.AuthMethod, error) {
 	if g.auth.Key != "" {
-		return ssh.NewPublicKeysFromFile("git", g.auth.Key, "")
+		keys, err := ssh.NewPublicKeysFromFile("git", g.auth.Key, g.auth.Passphrase)
+		if err != nil {
+			return nil, err
+		}
+		if keys.HostKeyCallback, err = g.hostKeyCallback(); err != nil {
+			return nil, err
+		}
+		return keys, nil
 	} else if g.auth.Username != "" {
 		return &http.BasicAuth{Username: g.auth.Username, Password: g.auth.Password}, nil
 	}
@@ -4,16 +4,135 @@ import (
 	"archive/zip"
 	"bytes"
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
 	"crypto/sha256"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"expvar"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
 	"sort"
 	"strings"
 	"testing"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/pktline"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
 )
 
+// testCommit describes a commit in a local test repository.
+type testCommit struct {
+	files map[string]string
+	tags  []string
+	when  time.Time
+}
+
+// testRepo creates a local git repository with the given commits on the
+// master branch and returns its path.
+func testRepo(t testing.TB, commits ...testCommit) string {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is required to serve local test repositories")
+	}
+	dir, err := ioutil.TempDir(os.TempDir(), "gomodproxy_git_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, c := range commits {
+		for name, content := range c.files {
+			path := filepath.Join(dir, name)
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := wt.Add(name); err != nil {
+				t.Fatal(err)
+			}
+		}
+		when := c.when
+		if when.IsZero() {
+			when = time.Date(2018, 9, 21, 10, 0, i, 0, time.UTC)
+		}
+		sig := &object.Signature{Name: "test", Email: "test@example.com", When: when}
+		hash, err := wt.Commit(fmt.Sprintf("commit %d", i), &git.CommitOptions{Author: sig})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tag := range c.tags {
+			if _, err := repo.CreateTag(tag, hash, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return dir
+}
+
+// testGit returns a git client for the module that fetches from a local test
+// repository instead of the remote derived from the module path.
+func testGit(t testing.TB, dir string, module string, options ...GitOption) *gitVCS {
+	g := NewGit(t.Log, "", module, NoAuth(), options...).(*gitVCS)
+	g.remote = "file://" + dir
+	return g
+}
+
+func hasVersion(list []Version, v Version) bool {
+	for _, version := range list {
+		if version == v {
+			return true
+		}
+	}
+	return false
+}
+
+func zipFiles(t *testing.T, r io.ReadCloser) map[string]string {
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	for _, zf := range zr.File {
+		f, err := zf.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := ioutil.ReadAll(f)
+		f.Close()
+		files[zf.Name] = string(content)
+	}
+	return files
+}
+
 func TestGit(t *testing.T) {
 	if testing.Short() {
 		t.Skip("testing with external VCS might be slow")
@@ -154,3 +273,1501 @@ func TestGit(t *testing.T) {
 		}
 	}
 }
+
+func TestGitListOrder(t *testing.T) {
+	dir := testRepo(t, testCommit{
+		files: map[string]string{"foo.go": "package foo\n"},
+		tags:  []string{"v1.9.0", "v1.10.0", "v1.0.0", "v1.0.0-rc1", "v1.2.0", "v1.0.0-rc2"},
+	})
+	defer os.RemoveAll(dir)
+	list, err := testGit(t, dir, "github.com/gomodproxytest/order").List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Version{"v1.0.0-rc1", "v1.0.0-rc2", "v1.0.0", "v1.2.0", "v1.9.0", "v1.10.0"}
+	if !reflect.DeepEqual(list, want) {
+		t.Fatal(list)
+	}
+}
+
+func TestGitResolve(t *testing.T) {
+	dir := testRepo(t,
+		testCommit{files: map[string]string{"foo.go": "package foo // 0\n"}},
+		testCommit{files: map[string]string{"foo.go": "package foo // 1\n"}, tags: []string{"v1.2.3", "v1.2.2"}},
+		testCommit{files: map[string]string{"foo.go": "package foo // 2\n"}, tags: []string{"v2.0.0"}},
+		testCommit{files: map[string]string{"foo.go": "package foo // 3\n"}, tags: []string{"v1.3.0-rc.1"}},
+		testCommit{files: map[string]string{"foo.go": "package foo // 4\n", "go.mod": "module github.com/gomodproxytest/resolve\n"}},
+	)
+	defer os.RemoveAll(dir)
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commits, err := repo.Log(&git.LogOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashes := []string{}
+	commits.ForEach(func(ci *object.Commit) error {
+		hashes = append([]string{ci.Hash.String()[:12]}, hashes...)
+		return nil
+	})
+
+	ctx := context.Background()
+	module := "github.com/gomodproxytest/resolve"
+	for _, test := range []struct {
+		Module string
+		Rev    string
+		Want   Version
+	}{
+		// no tagged ancestor
+		{module, hashes[0], Version("v0.0.0-20180921100000-" + hashes[0])},
+		{module + "/v2", hashes[0], Version("v2.0.0-20180921100000-" + hashes[0])},
+		// tagged commits resolve to the highest tag
+		{module, hashes[1][:7], "v1.2.3"},
+		{module, "v1.2.3", "v1.2.3"},
+		// v2 tags of commits without go.mod are +incompatible v1 versions
+		{module, hashes[2], "v2.0.0+incompatible"},
+		{module + "/v2", hashes[2], "v2.0.0"},
+		// release ancestor
+		{module + "/v2", hashes[3], Version("v2.0.1-0.20180921100003-" + hashes[3])},
+		// pre-release ancestor, +incompatible tags are not a base of commits with go.mod
+		{module, "master", Version("v1.3.0-rc.1.0.20180921100004-" + hashes[4])},
+	} {
+		g := testGit(t, dir, test.Module)
+		version, err := g.Resolve(ctx, test.Rev)
+		if err != nil || version != test.Want {
+			t.Fatal(test.Module, test.Rev, version, err)
+		}
+		if _, err := g.Zip(ctx, version); err != nil {
+			t.Fatal(test.Module, version, err)
+		}
+	}
+	if _, err := testGit(t, dir, module).Resolve(ctx, "nosuchbranch"); Classify(err) != NotFound {
+		t.Fatal(err)
+	}
+}
+
+func TestGitIncompatible(t *testing.T) {
+	dir := testRepo(t,
+		testCommit{files: map[string]string{"foo.go": "package foo // 1\n"}, tags: []string{"v1.0.0"}},
+		testCommit{files: map[string]string{"foo.go": "package foo // 2\n"}, tags: []string{"v2.0.0", "v2.1.0-rc.1"}},
+		testCommit{files: map[string]string{"foo.go": "package foo // 3\n"}},
+	)
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	module := "github.com/gomodproxytest/incompatible"
+	want := []Version{"v1.0.0", "v2.0.0+incompatible", "v2.1.0-rc.1+incompatible"}
+	for name, v := range map[string]VCS{"git": testGit(t, dir, module), "gitcli": testGitCLI(t, dir, module)} {
+		list, err := v.List(ctx)
+		if err != nil || !reflect.DeepEqual(list, want) {
+			t.Fatal(name, list, err)
+		}
+		if ts, err := v.Timestamp(ctx, "v2.0.0+incompatible"); err != nil || ts.Second() != 1 {
+			t.Fatal(name, ts, err)
+		}
+		r, err := v.Zip(ctx, "v2.0.0+incompatible")
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if files := zipFiles(t, r); files[module+"@v2.0.0+incompatible/foo.go"] != "package foo // 2\n" {
+			t.Fatal(name, files)
+		}
+	}
+
+	g := testGit(t, dir, module)
+	version, err := g.Resolve(ctx, "master")
+	if err != nil || !strings.HasPrefix(string(version), "v2.1.0-rc.1.0.20180921100002-") || !strings.HasSuffix(string(version), "+incompatible") {
+		t.Fatal(version, err)
+	}
+	if _, err := g.Zip(ctx, version); err != nil {
+		t.Fatal(version, err)
+	}
+	if list, err := testGit(t, dir, module+"/v2").List(ctx); err != nil || !reflect.DeepEqual(list, []Version{"v2.0.0", "v2.1.0-rc.1"}) {
+		t.Fatal(list, err)
+	}
+}
+
+func TestGitIncompatibleGoMod(t *testing.T) {
+	module := "github.com/gomodproxytest/incompatible"
+	dir := testRepo(t,
+		testCommit{files: map[string]string{"foo.go": "package foo // 1\n", "sub/sub.go": "package sub\n"}, tags: []string{"v1.0.0", "sub/v1.0.0"}},
+		testCommit{files: map[string]string{"go.mod": "module " + module + "/v2\n"}, tags: []string{"v2.0.0", "sub/v2.0.0"}},
+	)
+	defer os.RemoveAll(dir)
+
+	// tags of trees with go.mod and of nested modules are not +incompatible
+	ctx := context.Background()
+	for _, test := range []struct {
+		Module string
+		Want   []Version
+	}{
+		{module, []Version{"v1.0.0"}},
+		{module + "/v2", []Version{"v2.0.0"}},
+		{module + "/sub", []Version{"v1.0.0"}},
+	} {
+		for name, v := range map[string]VCS{"git": testGit(t, dir, test.Module), "gitcli": testGitCLI(t, dir, test.Module)} {
+			if list, err := v.List(ctx); err != nil || !reflect.DeepEqual(list, test.Want) {
+				t.Fatal(name, test.Module, list, err)
+			}
+		}
+	}
+}
+
+func TestGitLegacyTags(t *testing.T) {
+	dir := testRepo(t,
+		testCommit{files: map[string]string{"foo.go": "package foo // 1.0.0\n"}, tags: []string{"1.0.0"}},
+		testCommit{files: map[string]string{"foo.go": "package foo // 1.1.0\n"}, tags: []string{"v1.1.0"}},
+	)
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	module := "github.com/gomodproxytest/legacy"
+
+	// Without legacy mode tags without "v" prefix are ignored
+	git := testGit(t, dir, module)
+	if list, err := git.List(ctx); err != nil {
+		t.Fatal(err)
+	} else if hasVersion(list, "v1.0.0") || hasVersion(list, "1.0.0") || !hasVersion(list, "v1.1.0") {
+		t.Fatal(list)
+	}
+	if _, err := git.Zip(ctx, "v1.0.0"); err == nil {
+		t.Fatal("legacy tag should not be resolved")
+	}
+
+	// In legacy mode tags are reported with the canonical "v" prefix
+	git = testGit(t, dir, module, LegacyTags())
+	if list, err := git.List(ctx); err != nil {
+		t.Fatal(err)
+	} else if !hasVersion(list, "v1.0.0") || !hasVersion(list, "v1.1.0") {
+		t.Fatal(list)
+	}
+	r, err := git.Zip(ctx, "v1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files := zipFiles(t, r); files[module+"@v1.0.0/foo.go"] != "package foo // 1.0.0\n" {
+		t.Fatal(files)
+	}
+}
+
+func TestGitTagPattern(t *testing.T) {
+	dir := testRepo(t,
+		testCommit{files: map[string]string{"foo.go": "package foo // 1.0.0\n", "sub/foo.go": "package foo // 1.0.0\n"}, tags: []string{"release-1.0.0", "sub/release-1.0.0"}},
+		testCommit{files: map[string]string{"foo.go": "package foo // 1.1.0-rc.1\n"}, tags: []string{"release-1.1.0-rc.1", "release-1.1.0"}},
+		testCommit{files: map[string]string{"foo.go": "package foo // 1.1.0\n"}, tags: []string{"v1.1.0", "prerelease-1.2.0", "release-1.2"}},
+	)
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	module := "github.com/gomodproxytest/tagpattern"
+	re := regexp.MustCompile(`^release-(\d+\.\d+\.\d+(?:-[0-9A-Za-z.]+)?)$`)
+
+	// By default only the "v" tags are versions
+	if list, err := testGit(t, dir, module).List(ctx); err != nil || !reflect.DeepEqual(list, []Version{"v1.1.0"}) {
+		t.Fatal(list, err)
+	}
+	if _, err := testGit(t, dir, module).Zip(ctx, "v1.0.0"); err == nil {
+		t.Fatal("tag matching no pattern should not be resolved")
+	}
+
+	// Matching tags are canonical versions, "v" tags win over them
+	for _, test := range []struct {
+		Module  string
+		List    []Version
+		Version Version
+		Content string
+	}{
+		{module, []Version{"v1.0.0", "v1.1.0-rc.1", "v1.1.0"}, "v1.0.0", "1.0.0"},
+		{module, []Version{"v1.0.0", "v1.1.0-rc.1", "v1.1.0"}, "v1.1.0-rc.1", "1.1.0-rc.1"},
+		{module, []Version{"v1.0.0", "v1.1.0-rc.1", "v1.1.0"}, "v1.1.0", "1.1.0"},
+		{module + "/sub", []Version{"v1.0.0"}, "v1.0.0", "1.0.0"},
+	} {
+		g := testGit(t, dir, test.Module, TagPattern(re))
+		if list, err := g.List(ctx); err != nil || !reflect.DeepEqual(list, test.List) {
+			t.Fatal(test.Module, list, err)
+		}
+		r, err := g.Zip(ctx, test.Version)
+		if err != nil {
+			t.Fatal(test.Module, test.Version, err)
+		}
+		name := test.Module + "@" + string(test.Version) + "/foo.go"
+		if files := zipFiles(t, r); files[name] != "package foo // "+test.Content+"\n" {
+			t.Fatal(test.Module, test.Version, files)
+		}
+	}
+}
+
+func TestGitCaseInsensitiveTags(t *testing.T) {
+	dir := testRepo(t,
+		testCommit{files: map[string]string{"foo.go": "package foo // 1.0.0\n"}, tags: []string{"V1.0.0"}},
+		testCommit{files: map[string]string{"foo.go": "package foo // 1.1.0\n"}, tags: []string{"v1.1.0"}},
+	)
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	module := "github.com/gomodproxytest/uppercase"
+
+	// By default tags are matched exactly
+	git := testGit(t, dir, module)
+	if list, err := git.List(ctx); err != nil {
+		t.Fatal(err)
+	} else if hasVersion(list, "v1.0.0") || hasVersion(list, "V1.0.0") || !hasVersion(list, "v1.1.0") {
+		t.Fatal(list)
+	}
+	if _, err := git.Zip(ctx, "v1.0.0"); err == nil {
+		t.Fatal("uppercase tag should not be resolved")
+	}
+
+	// With case-insensitive matching tags are reported lowercased
+	git = testGit(t, dir, module, CaseInsensitiveTags())
+	if list, err := git.List(ctx); err != nil {
+		t.Fatal(err)
+	} else if !hasVersion(list, "v1.0.0") || !hasVersion(list, "v1.1.0") {
+		t.Fatal(list)
+	}
+	r, err := git.Zip(ctx, "v1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files := zipFiles(t, r); files[module+"@v1.0.0/foo.go"] != "package foo // 1.0.0\n" {
+		t.Fatal(files)
+	}
+
+	// Nested modules only match their own tags
+	dir = testRepo(t,
+		testCommit{files: map[string]string{
+			"foo.go":     "package foo\n",
+			"sub/go.mod": "module " + module + "/sub\n",
+			"sub/sub.go": "package sub\n",
+		}, tags: []string{"V1.2.0", "sub/V1.0.0"}},
+	)
+	defer os.RemoveAll(dir)
+	git = testGit(t, dir, module+"/sub", CaseInsensitiveTags())
+	if _, err := git.Zip(ctx, "v1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := git.Zip(ctx, "v1.2.0"); err == nil {
+		t.Fatal("tag of the root module should not be resolved")
+	}
+}
+
+func TestGitNoPseudoVersions(t *testing.T) {
+	dir := testRepo(t, testCommit{files: map[string]string{"foo.go": "package foo\n"}})
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	module := "github.com/gomodproxytest/tagless"
+
+	// By default the master tip is listed as a pseudo-version
+	git := testGit(t, dir, module)
+	list, err := git.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(list) != 1 || list[0].Hash() == "" {
+		t.Fatal(list)
+	}
+	pseudo := list[0]
+
+	// Otherwise nothing is listed, but the pseudo-version can still be fetched
+	git = testGit(t, dir, module, NoPseudoVersions())
+	if list, err := git.List(ctx); err != nil {
+		t.Fatal(err)
+	} else if len(list) != 0 {
+		t.Fatal(list)
+	}
+	if _, err := git.Timestamp(ctx, pseudo); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGitDefaultBranch(t *testing.T) {
+	dir := testRepo(t, testCommit{files: map[string]string{"foo.go": "package foo // master\n"}})
+	defer os.RemoveAll(dir)
+	gitdir, err := ioutil.TempDir(os.TempDir(), "gomodproxy_gitdir_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(gitdir)
+	ctx := context.Background()
+	module := "github.com/gomodproxytest/branch"
+
+	g := testGit(t, dir, module)
+	g.dir = gitdir
+	list, err := g.List(ctx)
+	if err != nil || len(list) != 1 {
+		t.Fatal(list, err)
+	}
+	if _, err := g.Zip(ctx, list[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	// Default branch is switched to a new "main" branch upstream, while the
+	// repository is already cached
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wt.Checkout(&git.CheckoutOptions{Branch: "refs/heads/main", Create: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "foo.go"), []byte("package foo // main\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wt.Add("foo.go"); err != nil {
+		t.Fatal(err)
+	}
+	sig := &object.Signature{Name: "test", Email: "test@example.com", When: time.Date(2018, 9, 22, 10, 0, 0, 0, time.UTC)}
+	hash, err := wt.Commit("main", &git.CommitOptions{Author: sig})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g = testGit(t, dir, module)
+	g.dir = gitdir
+	list, err = g.List(ctx)
+	if err != nil || len(list) != 1 || list[0].Hash() != hash.String()[:12] {
+		t.Fatal(list, err)
+	}
+	r, err := g.Zip(ctx, list[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files := zipFiles(t, r); files[module+"@"+string(list[0])+"/foo.go"] != "package foo // main\n" {
+		t.Fatal(files)
+	}
+}
+
+func TestGitMainBranchOnly(t *testing.T) {
+	dir := testRepo(t, testCommit{files: map[string]string{"foo.go": "package foo // main\n"}})
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	module := "github.com/gomodproxytest/main"
+
+	// The repository has no tags and its only branch is "main"
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	master, err := repo.Reference(plumbing.Master, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	main := plumbing.NewBranchReferenceName("main")
+	if err := repo.Storer.SetReference(plumbing.NewHashReference(main, master.Hash())); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, main)); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Storer.RemoveReference(plumbing.Master); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v := range []VCS{testGit(t, dir, module), testGitCLI(t, dir, module)} {
+		list, err := v.List(ctx)
+		if err != nil || len(list) != 1 || list[0].Hash() != master.Hash().String()[:12] {
+			t.Fatal(list, err)
+		}
+		r, err := v.Zip(ctx, list[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if files := zipFiles(t, r); files[module+"@"+string(list[0])+"/foo.go"] != "package foo // main\n" {
+			t.Fatal(files)
+		}
+	}
+}
+
+func TestGitShallowPseudoVersions(t *testing.T) {
+	commits := []testCommit{}
+	for i := 0; i < 50; i++ {
+		commits = append(commits, testCommit{files: map[string]string{"foo.go": fmt.Sprintf("package foo // %d\n", i)}})
+	}
+	dir := testRepo(t, commits...)
+	defer os.RemoveAll(dir)
+	gitdir, err := ioutil.TempDir(os.TempDir(), "gomodproxy_gitdir_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(gitdir)
+	ctx := context.Background()
+	module := "github.com/gomodproxytest/shallow"
+
+	upstream, err := git.PlainOpen(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log, err := upstream.Log(&git.LogOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashes := []string{}
+	log.ForEach(func(ci *object.Commit) error {
+		hashes = append([]string{ci.Hash.String()}, hashes...)
+		return nil
+	})
+	pseudo := func(i int) Version {
+		return Version(fmt.Sprintf("v0.0.0-201809211000%02d-%s", i, hashes[i][:12]))
+	}
+
+	g := testGit(t, dir, module, ShallowPseudoVersions(5))
+	g.dir = gitdir
+	fullHistory := func() bool {
+		repo, err := git.PlainOpen(filepath.Join(gitdir, module))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = repo.CommitObject(plumbing.NewHash(hashes[0]))
+		return err == nil
+	}
+
+	// A recent commit is resolved without fetching the full history
+	r, err := g.Zip(ctx, pseudo(47))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files := zipFiles(t, r); files[module+"@"+string(pseudo(47))+"/foo.go"] != "package foo // 47\n" {
+		t.Fatal(files)
+	}
+	if fullHistory() {
+		t.Fatal("full history should not be fetched")
+	}
+
+	// Older commits are found in the full history
+	if ts, err := g.Timestamp(ctx, pseudo(2)); err != nil || ts.Second() != 2 {
+		t.Fatal(ts, err)
+	}
+	if !fullHistory() {
+		t.Fatal("full history should be fetched")
+	}
+}
+
+func TestGitManifest(t *testing.T) {
+	dir := testRepo(t,
+		testCommit{files: map[string]string{"foo.go": "package foo // 1\n"}, tags: []string{"v1.0.0"}},
+		testCommit{files: map[string]string{"foo.go": "package foo // 2\n"}, tags: []string{"v1.1.0"}},
+	)
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	module := "github.com/gomodproxytest/manifest"
+	first := testGit(t, dir, module)
+	ci, done, err := first.commit(ctx, "v1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done()
+
+	// Only declared versions are listed and served, from the declared commits
+	git := testGit(t, dir, module, Manifest(map[Version]string{"v2.0.0": ci.Hash.String(), "v1.5.0": ci.Hash.String()}))
+	git.remote = "file:///nonexistent"
+	if list, err := git.List(ctx); err != nil {
+		t.Fatal(err)
+	} else if len(list) != 2 || list[0] != "v1.5.0" || list[1] != "v2.0.0" {
+		t.Fatal(list)
+	}
+	git.remote = "file://" + dir
+	r, err := git.Zip(ctx, "v1.5.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files := zipFiles(t, r); files[module+"@v1.5.0/foo.go"] != "package foo // 1\n" {
+		t.Fatal(files)
+	}
+	if _, err := git.Zip(ctx, "v1.1.0"); Classify(err) != NotFound {
+		t.Fatal("undeclared tag should not be served", err)
+	}
+}
+
+func TestGitTrace(t *testing.T) {
+	dir := testRepo(t, testCommit{files: map[string]string{"foo.go": "package foo\n"}, tags: []string{"v1.0.0"}})
+	defer os.RemoveAll(dir)
+
+	trace := &Trace{}
+	ctx := WithTrace(context.Background(), trace)
+	if _, err := testGit(t, dir, "github.com/gomodproxytest/trace").Zip(ctx, "v1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	phases := map[string]bool{}
+	for _, phase := range trace.Phases {
+		phases[phase.Name] = true
+	}
+	for _, name := range []string{"open", "fetch", "resolve", "walk", "zip"} {
+		if !phases[name] {
+			t.Fatal(name, trace.Phases)
+		}
+	}
+}
+
+func TestGitFetchProtocol(t *testing.T) {
+	dir := testRepo(t, testCommit{files: map[string]string{"foo.go": "package foo\n"}, tags: []string{"v1.0.0"}})
+	defer os.RemoveAll(dir)
+
+	fetches := func() int64 {
+		if v, ok := gitFetches.Get(gitProtocol).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	n := fetches()
+	logs := &bytes.Buffer{}
+	g := testGit(t, dir, "github.com/gomodproxytest/protocol")
+	g.log = func(v ...interface{}) { fmt.Fprintln(logs, v...) }
+	if _, err := g.Zip(context.Background(), "v1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(logs.String(), "gitVCS.fetch module github.com/gomodproxytest/protocol protocol v0 time") {
+		t.Fatal(logs.String())
+	}
+	if fetches() != n+1 {
+		t.Fatal(fetches(), n)
+	}
+}
+
+func TestGitFetchStats(t *testing.T) {
+	dir := testRepo(t,
+		testCommit{files: map[string]string{"foo.go": "package foo\n"}, tags: []string{"v1.0.0"}},
+		testCommit{files: map[string]string{"bar.go": "package bar\n"}, tags: []string{"v1.1.0"}},
+	)
+	defer os.RemoveAll(dir)
+	gitDir, err := ioutil.TempDir("", "gomodproxy_gitdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(gitDir)
+
+	value := func(m *expvar.Map) int64 {
+		if v, ok := m.Get("github.com").(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	for name, gitDir := range map[string]string{"memory": "", "gitdir": gitDir} {
+		objects, bytes := value(gitFetchObjects), value(gitFetchBytes)
+		logs := &strings.Builder{}
+		g := testGit(t, dir, "github.com/gomodproxytest/stats")
+		g.dir = gitDir
+		g.log = func(v ...interface{}) { fmt.Fprintln(logs, v...) }
+		if _, err := g.Zip(context.Background(), "v1.1.0"); err != nil {
+			t.Fatal(name, err)
+		}
+		// two commits, their trees and the blobs of both files
+		if n := value(gitFetchObjects) - objects; n != 6 {
+			t.Fatal(name, n, logs.String())
+		}
+		n := value(gitFetchBytes) - bytes
+		if n == 0 || !strings.Contains(logs.String(), fmt.Sprintf("objects 6 bytes %d\n", n)) {
+			t.Fatal(name, n, logs.String())
+		}
+	}
+}
+
+func TestGitUnshallow(t *testing.T) {
+	dir := testRepo(t,
+		testCommit{files: map[string]string{"foo.go": "package foo\n"}},
+		testCommit{files: map[string]string{"bar.go": "package bar\n"}, tags: []string{"v1.0.0"}},
+	)
+	defer os.RemoveAll(dir)
+	gitDir, err := ioutil.TempDir("", "gomodproxy_gitdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(gitDir)
+
+	// the cached repository only has the tip, e.g. cloned with "--depth 1"
+	repoDir := filepath.Join(gitDir, "github.com", "gomodproxytest", "shallow")
+	if err := os.MkdirAll(repoDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"init", "--quiet", "--bare"},
+		{"remote", "add", "origin", "file://" + dir},
+		{"fetch", "--quiet", "--depth", "1", "origin"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repoDir
+		if b, err := cmd.CombinedOutput(); err != nil {
+			t.Fatal(args, err, string(b))
+		}
+	}
+	cmd := exec.Command("git", "rev-list", "--max-parents=0", "HEAD")
+	cmd.Dir = dir
+	b, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	version := Version("v0.0.0-20180921100000-" + string(b[:12]))
+
+	// another client still reads the shallow repository
+	other := testGit(t, dir, "github.com/gomodproxytest/shallow")
+	other.dir = gitDir
+	repo, done, err := other.repo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logs := &strings.Builder{}
+	g := testGit(t, dir, "github.com/gomodproxytest/shallow")
+	g.dir = gitDir
+	g.log = func(v ...interface{}) { fmt.Fprintln(logs, v...) }
+	var r io.ReadCloser
+	zipped := make(chan error, 1)
+	go func() {
+		var err error
+		r, err = g.Zip(context.Background(), version)
+		zipped <- err
+	}()
+	select {
+	case err := <-zipped:
+		t.Fatal("repository replaced while in use", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if !isShallow(repo) {
+		t.Fatal("repository in use was modified")
+	}
+	done()
+	if err := <-zipped; err != nil {
+		t.Fatal(err, logs.String())
+	}
+	if files := zipFiles(t, r); len(files) != 1 || files["github.com/gomodproxytest/shallow@"+string(version)+"/foo.go"] == "" {
+		t.Fatal(files)
+	}
+	if !strings.Contains(logs.String(), "gitVCS.unshallow") {
+		t.Fatal(logs.String())
+	}
+	if _, err := os.Stat(filepath.Join(repoDir, "shallow")); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	if fis, err := ioutil.ReadDir(filepath.Dir(repoDir)); err != nil || len(fis) != 1 {
+		t.Fatal(fis, err)
+	}
+	if v, err := g.Resolve(context.Background(), string(b[:12])); err != nil || v != version {
+		t.Fatal(v, err)
+	}
+}
+
+func TestGitRemoteURL(t *testing.T) {
+	for _, test := range []struct {
+		Auth    Auth
+		Options []GitOption
+		URL     string
+	}{
+		{Auth: NoAuth(), URL: "https://github.com/gomodproxytest/repo.git"},
+		{Auth: Key("/path/to/id_rsa"), URL: "ssh://github.com/gomodproxytest/repo.git"},
+		{Auth: NoAuth(), Options: []GitOption{InsecureGitProtocol()}, URL: "git://github.com/gomodproxytest/repo.git"},
+		{Auth: Key("/path/to/id_rsa"), Options: []GitOption{SSHURL("ssh://git@{host}:29418/a/{path}")}, URL: "ssh://git@github.com:29418/a/gomodproxytest/repo"},
+		{Auth: Key("/path/to/id_rsa"), Options: []GitOption{SSHURL("ssh://gerrit.example.com/{repo}.git")}, URL: "ssh://gerrit.example.com/github.com/gomodproxytest/repo.git"},
+		{Auth: NoAuth(), Options: []GitOption{SSHURL("ssh://git@{host}:29418/{path}")}, URL: "https://github.com/gomodproxytest/repo.git"},
+	} {
+		g := NewGit(t.Log, "", "github.com/gomodproxytest/repo/sub", test.Auth, test.Options...).(*gitVCS)
+		repo, _, err := g.repo(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		remote, err := repo.Remote(remoteName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if url := remote.Config().URLs[0]; url != test.URL {
+			t.Fatal(url, test.URL)
+		}
+	}
+}
+
+func TestGitSSHPort(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "gomodproxy_key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "id_rsa")
+	block := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	if err := ioutil.WriteFile(file, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// the SSH server never answers, it only tells which port is dialed
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	dialed := make(chan struct{})
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			close(dialed)
+			conn.Close()
+		}
+	}()
+	url := fmt.Sprintf("ssh://git@%s/{path}", l.Addr())
+	g := NewGit(t.Log, "", "github.com/gomodproxytest/repo", Key(file), SSHURL(url), InsecureIgnoreHostKey())
+	if _, err := g.List(context.Background()); err == nil {
+		t.Fatal("listed without an SSH server")
+	}
+	select {
+	case <-dialed:
+	default:
+		t.Fatal("custom SSH port not dialed")
+	}
+}
+
+func TestGitListCancel(t *testing.T) {
+	// The remote never answers, so only the context can end the listing
+	aborted := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		close(aborted)
+	}))
+	defer srv.Close()
+
+	g := NewGit(t.Log, "", "github.com/gomodproxytest/slow", NoAuth()).(*gitVCS)
+	g.remote = srv.URL + "/slow.git"
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := g.List(ctx); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+	select {
+	case <-aborted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("remote request was not aborted")
+	}
+}
+
+func TestGitListStream(t *testing.T) {
+	// The remote advertises some tags and stalls before the rest
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/stream.git/info/refs" {
+			http.NotFound(w, r)
+			return
+		}
+		hash := strings.Repeat("1", 40)
+		e := pktline.NewEncoder(w)
+		e.EncodeString("# service=git-upload-pack\n")
+		e.Flush()
+		e.EncodeString(
+			hash+" HEAD\x00symref=HEAD:refs/heads/master side-band-64k\n",
+			hash+" refs/heads/master\n",
+			hash+" refs/tags/v1.1.0\n",
+			hash+" refs/tags/v1.1.0^{}\n",
+			hash+" refs/tags/v1.0.0\n",
+		)
+		w.(http.Flusher).Flush()
+		<-release
+		e.EncodeString(hash + " refs/tags/v1.2.0\n")
+		e.Flush()
+	}))
+	defer srv.Close()
+
+	g := NewGit(t.Log, "", "github.com/gomodproxytest/stream", NoAuth()).(*gitVCS)
+	g.remote = srv.URL + "/stream.git"
+	versions, err := g.ListStream(context.Background())
+	if err != nil {
+		close(release)
+		t.Fatal(err)
+	}
+	for _, want := range []Version{"v1.1.0", "v1.0.0"} {
+		select {
+		case version := <-versions:
+			if version != want {
+				close(release)
+				t.Fatal(version, want)
+			}
+		case <-time.After(5 * time.Second):
+			close(release)
+			t.Fatal("advertised versions were not streamed")
+		}
+	}
+	close(release)
+	rest := []Version{}
+	for version := range versions {
+		rest = append(rest, version)
+	}
+	if !reflect.DeepEqual(rest, []Version{"v1.2.0"}) {
+		t.Fatal(rest)
+	}
+
+	if list, err := g.List(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(list, []Version{"v1.0.0", "v1.1.0", "v1.2.0"}) {
+		t.Fatal(list)
+	}
+}
+
+func TestGitPin(t *testing.T) {
+	dir := testRepo(t,
+		testCommit{files: map[string]string{"foo.go": "package foo // 1.0.0\n"}, tags: []string{"v1.0.0"}},
+		testCommit{files: map[string]string{"foo.go": "package foo // 1.1.0\n"}, tags: []string{"v1.1.0"}},
+	)
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	module := "github.com/gomodproxytest/pin"
+
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := repo.Tag("v1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	git := testGit(t, dir, module, Pin(ref.Hash().String()))
+	r, err := git.Zip(ctx, "v1.1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files := zipFiles(t, r); files[module+"@v1.1.0/foo.go"] != "package foo // 1.0.0\n" {
+		t.Fatal(files)
+	}
+}
+
+func TestGitIgnore(t *testing.T) {
+	files := map[string]string{
+		"foo.go":               "package foo\n",
+		"testdata/model.bin":   strings.Repeat("\x00", 1<<20),
+		"testdata/small.txt":   "small\n",
+		"assets/logo.png":      "png",
+		"sub/dataset/data.csv": "a,b,c\n",
+		".goproxyignore":       "# large artifacts\n*.bin\n\n/assets/\n",
+	}
+	dir := testRepo(t, testCommit{files: files, tags: []string{"v1.0.0"}})
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	module := "github.com/gomodproxytest/ignore"
+	prefix := module + "@v1.0.0/"
+
+	// By default all files are included
+	r, err := testGit(t, dir, module).Zip(ctx, "v1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if zf := zipFiles(t, r); len(zf) != len(files) {
+		t.Fatal(zf)
+	}
+
+	// With ignore rules files from .goproxyignore and the configured patterns
+	// are excluded
+	r, err = testGit(t, dir, module, Ignore("dataset")).Zip(ctx, "v1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zf := zipFiles(t, r)
+	for _, name := range []string{"testdata/model.bin", "assets/logo.png", "sub/dataset/data.csv"} {
+		if _, ok := zf[prefix+name]; ok {
+			t.Fatal(name, "should be ignored")
+		}
+	}
+	for _, name := range []string{"foo.go", "testdata/small.txt", ".goproxyignore"} {
+		if zf[prefix+name] != files[name] {
+			t.Fatal(name, "should be included")
+		}
+	}
+}
+
+func TestGitGoModVerbatim(t *testing.T) {
+	gomod := "module github.com/gomodproxytest/gomod\n\ngo 1.21\n\ntoolchain go1.21.5\n\nrequire (\n\tgolang.org/x/net v0.17.0\n\tgithub.com/pkg/errors v0.9.1 // indirect\n)\n"
+	dir := testRepo(t, testCommit{files: map[string]string{"go.mod": gomod}, tags: []string{"v1.0.0"}})
+	defer os.RemoveAll(dir)
+	module := "github.com/gomodproxytest/gomod"
+
+	r, err := testGit(t, dir, module).Zip(context.Background(), "v1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if zf := zipFiles(t, r); zf[module+"@v1.0.0/go.mod"] != gomod {
+		t.Fatal(zf)
+	}
+}
+
+func TestGitMaxFileSize(t *testing.T) {
+	files := map[string]string{
+		"foo.go":             "package foo\n",
+		"testdata/model.bin": strings.Repeat("\x00", 1<<16),
+	}
+	dir := testRepo(t, testCommit{files: files, tags: []string{"v1.0.0"}})
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	module := "github.com/gomodproxytest/large"
+	prefix := module + "@v1.0.0/"
+
+	// Files above the limit are rejected by default
+	_, err := testGit(t, dir, module, MaxFileSize(1024)).Zip(ctx, "v1.0.0")
+	if !errors.Is(err, errFileTooLarge) || Classify(err) != Forbidden {
+		t.Fatal(err)
+	}
+
+	// Files within the limit are served
+	r, err := testGit(t, dir, module, MaxFileSize(1<<16)).Zip(ctx, "v1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if zf := zipFiles(t, r); len(zf) != len(files) {
+		t.Fatal(zf)
+	}
+
+	// Files above the limit are left out when skipping is enabled
+	r, err = testGit(t, dir, module, MaxFileSize(1024), SkipLargeFiles()).Zip(ctx, "v1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zf := zipFiles(t, r)
+	if len(zf) != 1 || zf[prefix+"foo.go"] != files["foo.go"] {
+		t.Fatal(zf)
+	}
+}
+
+func TestGitMajorVersion(t *testing.T) {
+	ctx := context.Background()
+	for _, test := range []struct {
+		Name    string
+		Options []GitOption
+		Files   map[string]string
+		Tags    []string
+		Want    map[string]string
+		Err     string
+	}{
+		{
+			// Major version in the repo root, tagged with v3 tags
+			Name: "root",
+			Files: map[string]string{
+				"go.mod": "module github.com/gomodproxytest/major/v3\n",
+				"foo.go": "package foo // v3\n",
+			},
+			Tags: []string{"v1.0.0", "v3.1.0"},
+			Want: map[string]string{
+				"go.mod": "module github.com/gomodproxytest/major/v3\n",
+				"foo.go": "package foo // v3\n",
+			},
+		},
+		{
+			// Major version in the v3 subdirectory next to the v1 module
+			Name: "subdir",
+			Files: map[string]string{
+				"go.mod":    "module github.com/gomodproxytest/major\n",
+				"foo.go":    "package foo // v1\n",
+				"v3/go.mod": "module github.com/gomodproxytest/major/v3\n",
+				"v3/foo.go": "package foo // v3\n",
+			},
+			Tags: []string{"v1.0.0", "v3.1.0"},
+			Want: map[string]string{
+				"go.mod": "module github.com/gomodproxytest/major/v3\n",
+				"foo.go": "package foo // v3\n",
+			},
+		},
+		{
+			// v3 tag on a v1 module
+			Name: "mismatch",
+			Files: map[string]string{
+				"go.mod": "module github.com/gomodproxytest/major\n",
+				"foo.go": "package foo // v1\n",
+			},
+			Tags: []string{"v1.0.0", "v3.1.0"},
+			Err:  `go.mod declares module path "github.com/gomodproxytest/major", expected "github.com/gomodproxytest/major/v3"`,
+		},
+		{
+			// v3 subdirectory without go.mod is part of the v1 module
+			Name: "subdir without go.mod",
+			Files: map[string]string{
+				"go.mod":    "module github.com/gomodproxytest/major\n",
+				"foo.go":    "package foo // v1\n",
+				"v3/foo.go": "package foo // v3\n",
+			},
+			Tags: []string{"v1.0.0", "v3.1.0"},
+			Err:  `go.mod declares module path "github.com/gomodproxytest/major", expected "github.com/gomodproxytest/major/v3"`,
+		},
+		{
+			Name:    "subdir without go.mod allowed",
+			Options: []GitOption{MajorSubdirectory()},
+			Files: map[string]string{
+				"go.mod":    "module github.com/gomodproxytest/major\n",
+				"foo.go":    "package foo // v1\n",
+				"v3/foo.go": "package foo // v3\n",
+			},
+			Tags: []string{"v1.0.0", "v3.1.0"},
+			Want: map[string]string{
+				"foo.go": "package foo // v3\n",
+			},
+		},
+		{
+			// the subdirectory is only used if the root go.mod does not match
+			Name:    "root preferred",
+			Options: []GitOption{MajorSubdirectory()},
+			Files: map[string]string{
+				"go.mod":    "module github.com/gomodproxytest/major/v3\n",
+				"foo.go":    "package foo // v3\n",
+				"v3/foo.go": "package v3\n",
+			},
+			Tags: []string{"v3.1.0"},
+			Want: map[string]string{
+				"go.mod":    "module github.com/gomodproxytest/major/v3\n",
+				"foo.go":    "package foo // v3\n",
+				"v3/foo.go": "package v3\n",
+			},
+		},
+	} {
+		dir := testRepo(t, testCommit{files: test.Files, tags: test.Tags})
+		defer os.RemoveAll(dir)
+		module := "github.com/gomodproxytest/major/v3"
+		git := testGit(t, dir, module, test.Options...)
+
+		list, err := git.List(ctx)
+		if err != nil {
+			t.Fatal(test.Name, err)
+		}
+		if !hasVersion(list, "v3.1.0") || hasVersion(list, "v1.0.0") {
+			t.Fatal(test.Name, list)
+		}
+
+		r, err := git.Zip(ctx, "v3.1.0")
+		if test.Err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.Err) || Classify(err) != NotFound {
+				t.Fatal(test.Name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(test.Name, err)
+		}
+		files := zipFiles(t, r)
+		if len(files) != len(test.Want) {
+			t.Fatal(test.Name, files)
+		}
+		for name, content := range test.Want {
+			if files[module+"@v3.1.0/"+name] != content {
+				t.Fatal(test.Name, name, files)
+			}
+		}
+	}
+}
+
+func TestGitMajorVersionSubmodule(t *testing.T) {
+	ctx := context.Background()
+	module := "github.com/gomodproxytest/major/sub/v2"
+	for _, test := range []struct {
+		Name  string
+		Files map[string]string
+		Want  map[string]string
+	}{
+		{
+			// v2 module in the submodule directory, tagged with sub/v2 tags
+			Name: "sub",
+			Files: map[string]string{
+				"go.mod":     "module github.com/gomodproxytest/major\n",
+				"sub/go.mod": "module github.com/gomodproxytest/major/sub/v2\n",
+				"sub/sub.go": "package sub // v2\n",
+			},
+			Want: map[string]string{
+				"go.mod": "module github.com/gomodproxytest/major/sub/v2\n",
+				"sub.go": "package sub // v2\n",
+			},
+		},
+		{
+			// v2 module in the v2 subdirectory of the v1 submodule
+			Name: "sub/v2",
+			Files: map[string]string{
+				"go.mod":        "module github.com/gomodproxytest/major\n",
+				"sub/go.mod":    "module github.com/gomodproxytest/major/sub\n",
+				"sub/sub.go":    "package sub // v1\n",
+				"sub/v2/go.mod": "module github.com/gomodproxytest/major/sub/v2\n",
+				"sub/v2/sub.go": "package sub // v2\n",
+			},
+			Want: map[string]string{
+				"go.mod": "module github.com/gomodproxytest/major/sub/v2\n",
+				"sub.go": "package sub // v2\n",
+			},
+		},
+	} {
+		dir := testRepo(t, testCommit{files: test.Files, tags: []string{"v1.0.0", "v2.0.0", "sub/v1.1.0", "sub/v2.1.0"}})
+		defer os.RemoveAll(dir)
+		for _, v := range []VCS{testGit(t, dir, module), testGitCLI(t, dir, module)} {
+			list, err := v.List(ctx)
+			if err != nil || !reflect.DeepEqual(list, []Version{"v2.1.0"}) {
+				t.Fatal(test.Name, list, err)
+			}
+			r, err := v.Zip(ctx, "v2.1.0")
+			if err != nil {
+				t.Fatal(test.Name, err)
+			}
+			files := zipFiles(t, r)
+			if len(files) != len(test.Want) {
+				t.Fatal(test.Name, files)
+			}
+			for name, content := range test.Want {
+				if files[module+"@v2.1.0/"+name] != content {
+					t.Fatal(test.Name, name, files)
+				}
+			}
+		}
+	}
+}
+
+func TestSplitMajor(t *testing.T) {
+	for path, want := range map[string][2]string{
+		"":       {"", ""},
+		"v3":     {"", "v3"},
+		"sub/v2": {"sub", "v2"},
+		"sub/v1": {"sub/v1", ""},
+		"v0":     {"v0", ""},
+		"v02":    {"v02", ""},
+		"vendor": {"vendor", ""},
+		"sub":    {"sub", ""},
+		// version-like directories that are not major version suffixes
+		"v2compat":       {"v2compat", ""},
+		"v2compat/thing": {"v2compat/thing", ""},
+		"v2/thing":       {"v2/thing", ""},
+		"sub/v2.1":       {"sub/v2.1", ""},
+		"v2compat/v3":    {"v2compat", "v3"},
+	} {
+		if dir, major := splitMajor(path); dir != want[0] || major != want[1] {
+			t.Fatal(path, dir, major)
+		}
+	}
+}
+
+func TestGitVersionLikeSubdir(t *testing.T) {
+	ctx := context.Background()
+	// Interior directories that look like versions are plain subdirectories
+	dir := testRepo(t, testCommit{
+		files: map[string]string{
+			"go.mod":                  "module github.com/gomodproxytest/compat\n",
+			"foo.go":                  "package foo\n",
+			"v2compat/thing/go.mod":   "module github.com/gomodproxytest/compat/v2compat/thing\n",
+			"v2compat/thing/thing.go": "package thing\n",
+			"v2/other/other.go":       "package other\n",
+		},
+		tags: []string{"v1.0.0", "v2compat/thing/v1.2.0"},
+	})
+	defer os.RemoveAll(dir)
+
+	for _, test := range []struct {
+		Module  string
+		Version Version
+		Want    map[string]string
+	}{
+		{
+			Module:  "github.com/gomodproxytest/compat/v2compat/thing",
+			Version: "v1.2.0",
+			Want: map[string]string{
+				"go.mod":   "module github.com/gomodproxytest/compat/v2compat/thing\n",
+				"thing.go": "package thing\n",
+			},
+		},
+		{
+			Module:  "github.com/gomodproxytest/compat",
+			Version: "v1.0.0",
+			Want: map[string]string{
+				"go.mod":            "module github.com/gomodproxytest/compat\n",
+				"foo.go":            "package foo\n",
+				"v2/other/other.go": "package other\n",
+			},
+		},
+	} {
+		for _, v := range []VCS{testGit(t, dir, test.Module), testGitCLI(t, dir, test.Module)} {
+			list, err := v.List(ctx)
+			if err != nil {
+				t.Fatal(test.Module, err)
+			}
+			if len(list) != 1 || list[0] != test.Version {
+				t.Fatal(test.Module, list)
+			}
+			r, err := v.Zip(ctx, test.Version)
+			if err != nil {
+				t.Fatal(test.Module, err)
+			}
+			files := zipFiles(t, r)
+			if len(files) != len(test.Want) {
+				t.Fatal(test.Module, files)
+			}
+			for name, content := range test.Want {
+				if files[test.Module+"@"+string(test.Version)+"/"+name] != content {
+					t.Fatal(test.Module, name, files)
+				}
+			}
+		}
+	}
+}
+
+func TestGitSnapshot(t *testing.T) {
+	ctx := context.Background()
+	cutoff := time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC)
+	jan := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	jun := time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	// Tags before and after the cutoff
+	dir := testRepo(t,
+		testCommit{files: map[string]string{"foo.go": "package foo // 1.0.0\n"}, tags: []string{"v1.0.0"}, when: jan},
+		testCommit{files: map[string]string{"foo.go": "package foo // 1.1.0\n"}, tags: []string{"v1.1.0"}, when: jun},
+	)
+	defer os.RemoveAll(dir)
+	module := "github.com/gomodproxytest/snapshot"
+	git := testGit(t, dir, module, Snapshot(cutoff))
+	if list, err := git.List(ctx); err != nil {
+		t.Fatal(err)
+	} else if len(list) != 1 || list[0] != "v1.0.0" {
+		t.Fatal(list)
+	}
+	if _, err := git.Zip(ctx, "v1.1.0"); Classify(err) != NotFound {
+		t.Fatal(err)
+	}
+	if _, err := git.Zip(ctx, "v1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Branch tip without tags resolves to the last commit before the cutoff
+	dir = testRepo(t,
+		testCommit{files: map[string]string{"foo.go": "package foo // jan\n"}, when: jan},
+		testCommit{files: map[string]string{"foo.go": "package foo // jun\n"}, when: jun},
+	)
+	defer os.RemoveAll(dir)
+	git = testGit(t, dir, module, Snapshot(cutoff))
+	list, err := git.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || !strings.HasPrefix(string(list[0]), "v0.0.0-20180101000000-") {
+		t.Fatal(list)
+	}
+	r, err := git.Zip(ctx, list[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files := zipFiles(t, r); files[module+"@"+string(list[0])+"/foo.go"] != "package foo // jan\n" {
+		t.Fatal(files)
+	}
+}
+
+// manyFiles returns a fixture with n small files in a few directories.
+func manyFiles(n int) map[string]string {
+	files := map[string]string{"go.mod": "module github.com/gomodproxytest/many\n"}
+	for i := 0; i < n; i++ {
+		files[fmt.Sprintf("pkg%d/file%d.go", i%10, i)] = fmt.Sprintf("package pkg%d // %d\n", i%10, i)
+	}
+	return files
+}
+
+func TestGitZipWorkers(t *testing.T) {
+	dir := testRepo(t, testCommit{files: manyFiles(200), tags: []string{"v1.0.0"}})
+	defer os.RemoveAll(dir)
+	gitdir, err := ioutil.TempDir(os.TempDir(), "gomodproxy_gitdir_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(gitdir)
+	ctx := context.Background()
+	module := "github.com/gomodproxytest/many"
+
+	// Archives should be byte-identical with both in-memory and on-disk repos
+	for _, storage := range []string{"", gitdir} {
+		zips := [][]byte{}
+		for _, workers := range []int{1, 8} {
+			git := testGit(t, dir, module, ZipWorkers(workers))
+			git.dir = storage
+			r, err := git.Zip(ctx, "v1.0.0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			zips = append(zips, b)
+		}
+		if !bytes.Equal(zips[0], zips[1]) {
+			t.Fatal(storage, "archives differ")
+		}
+	}
+}
+
+func BenchmarkGitZip(b *testing.B) {
+	dir := testRepo(b, testCommit{files: manyFiles(2000), tags: []string{"v1.0.0"}})
+	defer os.RemoveAll(dir)
+	gitdir, err := ioutil.TempDir(os.TempDir(), "gomodproxy_gitdir_test")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(gitdir)
+	ctx := context.Background()
+	module := "github.com/gomodproxytest/many"
+	nolog := func(...interface{}) {}
+
+	for _, workers := range []int{1, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			git := NewGit(nolog, gitdir, module, NoAuth(), ZipWorkers(workers)).(*gitVCS)
+			git.remote = "file://" + dir
+			for i := 0; i < b.N; i++ {
+				r, err := git.Zip(ctx, "v1.0.0")
+				if err != nil {
+					b.Fatal(err)
+				}
+				r.Close()
+			}
+		})
+	}
+}
+
+func TestGitKnownHosts(t *testing.T) {
+	newKey := func() gossh.PublicKey {
+		pub, _, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := gossh.NewPublicKey(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	known, other := newKey(), newKey()
+	dir, err := ioutil.TempDir("", "knownhosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize("git.example.com:22")}, known)
+	if err := ioutil.WriteFile(file, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	addr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 22}
+	check := func(options []GitOption, host string, key gossh.PublicKey) error {
+		g := NewGit(t.Log, "", "git.example.com/foo", NoAuth(), options...).(*gitVCS)
+		cb, err := g.hostKeyCallback()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cb(host, addr, key)
+	}
+
+	strict := []GitOption{KnownHosts(file)}
+	if err := check(strict, "git.example.com:22", known); err != nil {
+		t.Fatal(err)
+	}
+	if err := check(strict, "new.example.com:22", known); err == nil {
+		t.Fatal("unknown host accepted")
+	}
+	err = check(strict, "git.example.com:22", other)
+	if err == nil {
+		t.Fatal("changed host key accepted")
+	}
+	// the error names the host, both keys and the known_hosts line
+	for _, s := range []string{"git.example.com:22", gossh.FingerprintSHA256(other), gossh.FingerprintSHA256(known), file + ":1"} {
+		if !strings.Contains(err.Error(), s) {
+			t.Fatal(err, s)
+		}
+	}
+	if err := check([]GitOption{KnownHosts(file), InsecureIgnoreHostKey()}, "git.example.com:22", other); err != nil {
+		t.Fatal(err)
+	}
+
+	acceptNew := []GitOption{KnownHosts(file), AcceptNewHostKeys()}
+	if err := check(acceptNew, "git.example.com:22", other); err == nil {
+		t.Fatal("changed host key accepted")
+	}
+	if err := check(acceptNew, "new.example.com:22", other); err != nil {
+		t.Fatal(err)
+	}
+	// the new key has been remembered and is now verified without opt-in
+	if err := check(strict, "new.example.com:22", other); err != nil {
+		t.Fatal(err)
+	}
+	if err := check(strict, "new.example.com:22", known); err == nil {
+		t.Fatal("changed host key accepted")
+	}
+}
+
+func TestGitKeyPassphrase(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := x509.EncryptPEMBlock(rand.Reader, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key), []byte("secret"), x509.PEMCipherAES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "gomodproxy_key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "id_rsa")
+	if err := ioutil.WriteFile(file, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	knownHosts := filepath.Join(dir, "known_hosts")
+	if err := ioutil.WriteFile(knownHosts, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		Auth Auth
+		OK   bool
+	}{
+		{Auth: KeyWithPassphrase(file, "secret"), OK: true},
+		{Auth: KeyWithPassphrase(file, "wrong")},
+		{Auth: Key(file)},
+	} {
+		g := NewGit(t.Log, "", "git.example.com/foo", test.Auth, KnownHosts(knownHosts)).(*gitVCS)
+		if _, err := g.authMethod(); (err == nil) != test.OK {
+			t.Fatal(test.Auth.Passphrase, err)
+		}
+	}
+}
+
+func TestGitMirror(t *testing.T) {
+	ctx := context.Background()
+	src := testRepo(t, testCommit{
+		files: map[string]string{
+			"go.mod":     "module git.example.com/team/repo\n",
+			"foo.go":     "package foo\n",
+			"sub/go.mod": "module git.example.com/team/repo/sub\n",
+			"sub/sub.go": "package sub\n",
+		},
+		tags: []string{"v1.0.0", "sub/v1.1.0"},
+	})
+	defer os.RemoveAll(src)
+	mirrors, err := ioutil.TempDir("", "gomodproxy_mirrors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(mirrors)
+	if _, err := git.PlainClone(filepath.Join(mirrors, "team", "repo.git"), true, &git.CloneOptions{URL: src}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		Module  string
+		Version Version
+		File    string
+	}{
+		{"git.example.com/team/repo", "v1.0.0", "foo.go"},
+		{"git.example.com/team/repo/sub", "v1.1.0", "sub.go"},
+	} {
+		g := NewGit(t.Log, "", test.Module, NoAuth(), Mirror("git.example.com/", mirrors))
+		list, err := g.List(ctx)
+		if err != nil {
+			t.Fatal(test.Module, err)
+		}
+		if len(list) != 1 || list[0] != test.Version {
+			t.Fatal(test.Module, list)
+		}
+		r, err := g.Zip(ctx, test.Version)
+		if err != nil {
+			t.Fatal(test.Module, err)
+		}
+		if files := zipFiles(t, r); len(files) != 2 || files[test.Module+"@"+string(test.Version)+"/"+test.File] == "" {
+			t.Fatal(test.Module, files)
+		}
+	}
+
+	// modules missing in the mirror directory are never fetched from the remote
+	g := NewGit(t.Log, "", "git.example.com/team/other", NoAuth(), Mirror("git.example.com/", mirrors))
+	if _, err := g.List(ctx); Classify(err) != NotFound {
+		t.Fatal(err)
+	}
+}
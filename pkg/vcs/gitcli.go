@@ -0,0 +1,366 @@
+package vcs
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var reGitHash = regexp.MustCompile(`^[0-9a-f]{12,40}$`)
+
+type gitCLI struct {
+	log    logger
+	dir    string
+	module string
+	prefix string
+	major  string
+	auth   Auth
+	hosts  *HostPolicy
+	remote string
+}
+
+// NewGitCLI returns a VCS client that runs the system "git" command instead of
+// using go-git, e.g. for huge repositories go-git can not handle. It lists and
+// serves the same versions as the go-git client with no options, and builds
+// byte-identical module archives, ignoring the "export-ignore" and
+// "export-subst" attributes, like the go-git client does. Repositories are
+// kept as bare mirrors in the given directory, or in a temporary one if it is
+// empty. Only the hosts allowed by the policy are contacted.
+func NewGitCLI(l logger, dir string, module string, auth Auth, hosts *HostPolicy) VCS {
+	return &gitCLI{log: l, dir: dir, module: module, auth: auth, hosts: hosts}
+}
+
+func (g *gitCLI) List(ctx context.Context) ([]Version, error) {
+	g.log("gitCLI.List", "module", g.module)
+	_, _, url, err := g.resolve(ctx)
+	if err != nil {
+		return nil, err
+	}
+	refs, head, err := g.lsRemote(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	list := []Version{}
+	seen := map[Version]bool{}
+	dir, cleanup := "", func() {}
+	defer func() { cleanup() }()
+	for ref := range refs {
+		version, ok := g.tagVersion(ref)
+		if !ok || seen[version] {
+			continue
+		}
+		if isIncompatible(version) {
+			// the tagged tree is needed to tell if it has a go.mod file
+			if dir == "" {
+				if dir, cleanup, err = g.repo(ctx); err != nil {
+					return nil, err
+				}
+			}
+			if _, err := g.git(ctx, dir, "cat-file", "-e", ref+":go.mod"); err == nil {
+				continue
+			}
+		}
+		seen[version] = true
+		list = append(list, version)
+	}
+	if len(list) == 0 {
+		tip, ok := refs[head]
+		if !ok {
+			return nil, errNoVersions
+		}
+		t, err := g.Timestamp(ctx, Version("v0.0.0-20060102150405-"+tip[:12]))
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, pseudoVersion(g.major, "", t, tip[:12]))
+	}
+	sortVersions(list)
+	g.log("gitCLI.List", "module", g.module, "list", list)
+	return list, nil
+}
+
+// lsRemote returns the hashes of the remote refs and the name of the default
+// branch.
+func (g *gitCLI) lsRemote(ctx context.Context, url string) (map[string]string, string, error) {
+	b, err := g.git(ctx, "", "ls-remote", "--symref", url)
+	if err != nil {
+		return nil, "", err
+	}
+	refs, head := map[string]string{}, "refs/heads/master"
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 3 && fields[0] == "ref:" && fields[2] == "HEAD" {
+			head = fields[1]
+		} else if len(fields) == 2 && !strings.HasSuffix(fields[1], "^{}") {
+			refs[fields[1]] = fields[0]
+		}
+	}
+	return refs, head, nil
+}
+
+// tagVersion returns a module version for the ref, if it is a release tag of
+// the module.
+func (g *gitCLI) tagVersion(ref string) (Version, bool) {
+	tagPrefix := "refs/tags/"
+	if g.prefix != "" {
+		tagPrefix = tagPrefix + g.prefix + "/"
+	}
+	tag := strings.TrimPrefix(ref, tagPrefix)
+	if tag == ref || !strings.HasPrefix(tag, "v") || strings.Contains(tag, "/") {
+		return "", false
+	}
+	if g.major != "" && !strings.HasPrefix(tag, g.major+".") {
+		return "", false
+	}
+	return incompatible(g.prefix, g.major, Version(tag))
+}
+
+func (g *gitCLI) Timestamp(ctx context.Context, version Version) (time.Time, error) {
+	g.log("gitCLI.Timestamp", "module", g.module, "version", version)
+	dir, cleanup, err := g.repo(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer cleanup()
+	rev, err := g.commit(ctx, dir, version)
+	if err != nil {
+		return time.Time{}, err
+	}
+	b, err := g.git(ctx, dir, "log", "-1", "--format=%cI", rev)
+	if err != nil {
+		return time.Time{}, err
+	}
+	t, err := time.Parse(time.RFC3339, strings.TrimSpace(string(b)))
+	if err != nil {
+		return time.Time{}, err
+	}
+	g.log("gitCLI.Timestamp", "module", g.module, "version", version, "timestamp", t)
+	return t.UTC(), nil
+}
+
+func (g *gitCLI) Zip(ctx context.Context, version Version) (io.ReadCloser, error) {
+	g.log("gitCLI.Zip", "module", g.module, "version", version)
+	dir, cleanup, err := g.repo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	rev, err := g.commit(ctx, dir, version)
+	if err != nil {
+		return nil, err
+	}
+	endWalk := Span(ctx, "walk")
+	// The tree is listed and the blobs are read as they are stored, rather
+	// than with "git archive", which applies the export-ignore, export-subst
+	// and end-of-line attributes. Entries come in the tree order, the same the
+	// go-git client walks the tree in, so that the archives are byte-identical.
+	b, err := g.git(ctx, dir, "ls-tree", "-r", "-z", "--full-tree", rev)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{}
+	blobs := map[string]string{}
+	batch := &bytes.Buffer{}
+	for _, entry := range strings.Split(string(b), "\x00") {
+		// <mode> SP <type> SP <object> TAB <file>
+		i := strings.IndexByte(entry, '\t')
+		if i < 0 {
+			continue
+		}
+		fields := strings.Fields(entry[:i])
+		if len(fields) != 3 || fields[1] != "blob" || (fields[0] != "100644" && fields[0] != "100755") {
+			continue
+		}
+		name := entry[i+1:]
+		files = append(files, name)
+		blobs[name] = fields[2]
+		fmt.Fprintln(batch, fields[2])
+	}
+	out, err := g.gitInput(ctx, dir, batch, "cat-file", "--batch")
+	if err != nil {
+		return nil, err
+	}
+	contents, err := catFileBatch(out)
+	if err != nil {
+		return nil, err
+	}
+	endWalk()
+	read := func(name string) ([]byte, error) {
+		if content, ok := contents[blobs[name]]; ok {
+			return content, nil
+		}
+		return nil, os.ErrNotExist
+	}
+	return zipFileList(ctx, files, read, g.module, g.prefix, g.major, version)
+}
+
+// Describe returns the repository the module is fetched from.
+func (g *gitCLI) Describe(ctx context.Context) (Remote, error) {
+	repoRoot, _, url, err := g.resolve(ctx)
+	if err != nil {
+		return Remote{}, err
+	}
+	return Remote{VCS: "git", Repo: repoRoot, URL: url, Auth: g.auth.Kind()}, nil
+}
+
+// resolve returns the repository root of the module, the module path within
+// the repository and the remote URL to fetch it from.
+func (g *gitCLI) resolve(ctx context.Context) (repoRoot, path, url string, err error) {
+	if g.remote == "" {
+		if err := g.hosts.Check(strings.SplitN(g.module, "/", 2)[0]); err != nil {
+			return "", "", "", err
+		}
+	}
+	repoRoot, path, err = RepoRoot(ctx, g.module)
+	if err != nil {
+		return "", "", "", err
+	}
+	setOrigin(ctx, "git", repoRoot)
+	g.prefix, g.major = splitMajor(path)
+	if g.remote != "" {
+		return repoRoot, path, g.remote, nil
+	}
+	// go-import meta tag may point to a different host
+	if err := g.hosts.Check(strings.SplitN(repoRoot, "/", 2)[0]); err != nil {
+		return "", "", "", err
+	}
+	schema := "https://"
+	if g.auth.Key != "" {
+		schema = "ssh://"
+	}
+	return repoRoot, path, schema + repoRoot + ".git", nil
+}
+
+// repo returns the directory of the bare mirror of the module repository with
+// all the remote refs fetched, and a function to be called when the mirror is
+// no longer used.
+func (g *gitCLI) repo(ctx context.Context) (dir string, cleanup func(), err error) {
+	defer Span(ctx, "open")()
+	repoRoot, _, url, err := g.resolve(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	g.log("repo", "url", url, "prefix", g.prefix, "major", g.major)
+	cleanup = func() {}
+	if g.dir == "" {
+		tmp, err := ioutil.TempDir(os.TempDir(), "gomodproxy_gitcli")
+		if err != nil {
+			return "", nil, err
+		}
+		cleanup = func() { os.RemoveAll(tmp) }
+		dir = tmp
+	} else {
+		dir = filepath.Join(g.dir, repoRoot)
+		cleanup = useGitDir(dir)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			cleanup()
+			return "", nil, err
+		}
+		// modification time tells PruneGitDir when the repo was last used
+		now := time.Now()
+		os.Chtimes(dir, now, now)
+	}
+	if !isBareRepo(dir) {
+		if _, err := g.git(ctx, dir, "init", "--quiet", "--bare"); err != nil {
+			cleanup()
+			return "", nil, err
+		}
+	}
+	defer Span(ctx, "fetch")()
+	if _, err := g.git(ctx, dir, "fetch", "--quiet", "--force", "--prune", url, "+refs/heads/*:refs/heads/*", "+refs/tags/*:refs/tags/*"); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return dir, cleanup, nil
+}
+
+// commit returns the revision of the commit the version refers to, either by
+// a tag or by a hash of a pseudo-version.
+func (g *gitCLI) commit(ctx context.Context, dir string, version Version) (string, error) {
+	version = Version(strings.TrimSuffix(string(version), "+incompatible"))
+	names := []string{}
+	if !version.IsSemVer() && reGitHash.MatchString(version.Hash()) {
+		names = append(names, version.Hash())
+	} else if g.prefix != "" {
+		names = append(names, "refs/tags/"+g.prefix+"/"+string(version), "refs/tags/"+string(version))
+	} else {
+		names = append(names, "refs/tags/"+string(version))
+	}
+	for _, name := range names {
+		b, err := g.git(ctx, dir, "rev-parse", "--verify", "--quiet", name+"^{commit}")
+		if err == nil {
+			rev := strings.TrimSpace(string(b))
+			RecordCommit(ctx, rev)
+			return rev, nil
+		}
+	}
+	return "", fmt.Errorf("%s@%s: %w", g.module, version, os.ErrNotExist)
+}
+
+// catFileBatch returns the contents of the objects in the output of "git
+// cat-file --batch" by their hashes.
+func catFileBatch(b []byte) (map[string][]byte, error) {
+	contents := map[string][]byte{}
+	for len(b) > 0 {
+		// <object> SP <type> SP <size> LF <contents> LF
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			return nil, fmt.Errorf("git cat-file: truncated output")
+		}
+		fields := strings.Fields(string(b[:i]))
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("git cat-file: %s", b[:i])
+		}
+		size, err := strconv.Atoi(fields[2])
+		if err != nil || len(b) < i+1+size+1 {
+			return nil, fmt.Errorf("git cat-file: truncated output")
+		}
+		contents[fields[0]] = b[i+1 : i+1+size]
+		b = b[i+1+size+1:]
+	}
+	return contents, nil
+}
+
+// git runs the git command in the given directory and returns its output.
+// Credentials are passed in the environment rather than in the command line
+// or the URL, so they never show up in process lists or errors.
+func (g *gitCLI) git(ctx context.Context, dir string, args ...string) ([]byte, error) {
+	return g.gitInput(ctx, dir, nil, args...)
+}
+
+// gitInput is like git, but feeds the command with the given input.
+func (g *gitCLI) gitInput(ctx context.Context, dir string, stdin io.Reader, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	cmd.Stdin = stdin
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "LC_ALL=C")
+	if g.auth.Key != "" {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("GIT_SSH_COMMAND=ssh -i %q -o BatchMode=yes -o IdentitiesOnly=yes", g.auth.Key))
+	} else if g.auth.Username != "" {
+		creds := base64.StdEncoding.EncodeToString([]byte(g.auth.Username + ":" + g.auth.Password))
+		cmd.Env = append(cmd.Env, "GIT_CONFIG_COUNT=1", "GIT_CONFIG_KEY_0=http.extraHeader",
+			"GIT_CONFIG_VALUE_0=Authorization: Basic "+creds)
+	}
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		// the error names the git command, not the config options before it
+		name := args[0]
+		for i := 0; i+2 < len(args) && args[i] == "-c"; i = i + 2 {
+			name = args[i+2]
+		}
+		return nil, fmt.Errorf("git %s: %w: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
@@ -0,0 +1,145 @@
+package vcs
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// testGitCLI returns a git command client for the module that fetches from a
+// local test repository instead of the remote derived from the module path.
+func testGitCLI(t testing.TB, dir string, module string) *gitCLI {
+	g := NewGitCLI(t.Log, "", module, NoAuth(), nil).(*gitCLI)
+	g.remote = "file://" + dir
+	return g
+}
+
+func TestGitCLI(t *testing.T) {
+	files := map[string]string{
+		"go.mod":            "module github.com/gomodproxytest/cli\n",
+		"a.go":              "package cli\n",
+		"a/b.go":            "package a\n",
+		"a.b/c.go":          "package ab\n",
+		"a-b.go":            "package cli\n",
+		"vendor/foo/foo.go": "package foo\n",
+		"sub/go.mod":        "module github.com/gomodproxytest/cli/sub\n",
+		"sub/sub.go":        "package sub\n",
+		"v2/go.mod":         "module github.com/gomodproxytest/cli/v2\n",
+		"v2/v2.go":          "package cli\n",
+	}
+	dir := testRepo(t, testCommit{files: files, tags: []string{"v1.0.0", "sub/v1.1.0", "v2.0.0"}}, testCommit{files: map[string]string{"a.go": "package cli // tip\n"}})
+	defer os.RemoveAll(dir)
+	gitdir, err := ioutil.TempDir(os.TempDir(), "gomodproxy_gitdir_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(gitdir)
+	ctx := context.Background()
+
+	for _, test := range []struct {
+		Module  string
+		Version Version
+	}{
+		{"github.com/gomodproxytest/cli", "v1.0.0"},
+		{"github.com/gomodproxytest/cli/sub", "v1.1.0"},
+		{"github.com/gomodproxytest/cli/v2", "v2.0.0"},
+	} {
+		// both the temporary and the kept mirrors serve the same
+		for _, storage := range []string{"", gitdir, gitdir} {
+			g, cli := testGit(t, dir, test.Module), testGitCLI(t, dir, test.Module)
+			cli.dir = storage
+			want, err := g.List(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Slice(want, func(i, j int) bool { return want[i].Compare(want[j]) < 0 })
+			if list, err := cli.List(ctx); err != nil || !reflect.DeepEqual(list, want) {
+				t.Fatal(test.Module, list, want, err)
+			}
+			ts, err := g.Timestamp(ctx, test.Version)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, err := cli.Timestamp(ctx, test.Version); err != nil || !got.Equal(ts) {
+				t.Fatal(test.Module, got, ts, err)
+			}
+			r, err := g.Zip(ctx, test.Version)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantZip, _ := ioutil.ReadAll(r)
+			r, err = cli.Zip(ctx, test.Version)
+			if err != nil {
+				t.Fatal(test.Module, err)
+			}
+			if gotZip, _ := ioutil.ReadAll(r); !bytes.Equal(gotZip, wantZip) {
+				t.Fatal(test.Module, zipFiles(t, ioutil.NopCloser(bytes.NewReader(gotZip))), zipFiles(t, ioutil.NopCloser(bytes.NewReader(wantZip))))
+			}
+		}
+	}
+
+	if _, err := testGitCLI(t, dir, "github.com/gomodproxytest/cli").Zip(ctx, "v1.2.0"); Classify(err) != NotFound {
+		t.Fatal(err)
+	}
+}
+
+func TestGitCLIAttributes(t *testing.T) {
+	files := map[string]string{
+		".gitattributes": "ignored.go export-ignore\nsubst.go export-subst\n*.txt text eol=crlf\n",
+		"go.mod":         "module github.com/gomodproxytest/cli\n",
+		"ignored.go":     "package cli\n",
+		"subst.go":       "package cli // $Format:%H$\n",
+		"lf.txt":         "a\nb\n",
+	}
+	dir := testRepo(t, testCommit{files: files, tags: []string{"v1.0.0"}})
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+
+	g, cli := testGit(t, dir, "github.com/gomodproxytest/cli"), testGitCLI(t, dir, "github.com/gomodproxytest/cli")
+	r, err := g.Zip(ctx, "v1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := ioutil.ReadAll(r)
+	r, err = cli.Zip(ctx, "v1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := ioutil.ReadAll(r)
+	if !bytes.Equal(got, want) {
+		t.Fatal(zipFiles(t, ioutil.NopCloser(bytes.NewReader(got))), zipFiles(t, ioutil.NopCloser(bytes.NewReader(want))))
+	}
+	prefix := "github.com/gomodproxytest/cli@v1.0.0/"
+	// the files are archived as they are stored
+	archived := zipFiles(t, ioutil.NopCloser(bytes.NewReader(got)))
+	for _, name := range []string{"ignored.go", "subst.go", "lf.txt"} {
+		if archived[prefix+name] != files[name] {
+			t.Fatal(name, archived)
+		}
+	}
+}
+
+func TestGitCLIPseudoVersion(t *testing.T) {
+	dir := testRepo(t, testCommit{files: map[string]string{"go.mod": "module github.com/gomodproxytest/cli\n"}})
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+
+	g, cli := testGit(t, dir, "github.com/gomodproxytest/cli"), testGitCLI(t, dir, "github.com/gomodproxytest/cli")
+	want, err := g.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := cli.List(ctx)
+	if err != nil || !reflect.DeepEqual(list, want) {
+		t.Fatal(list, want, err)
+	}
+	if r, err := cli.Zip(ctx, list[0]); err != nil {
+		t.Fatal(err)
+	} else if files := zipFiles(t, r); len(files) != 1 {
+		t.Fatal(files)
+	}
+}
@@ -0,0 +1,138 @@
+package vcs
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The repositories in the git directory are counted by their users, so that
+// they are neither pruned nor replaced while a git client reads them. A count
+// of -1 means that the repository is locked to be removed or replaced.
+var (
+	gitDirMu    sync.Mutex
+	gitDirCond  = sync.NewCond(&gitDirMu)
+	gitDirUsers = map[string]int{}
+)
+
+// useGitDir marks the repository directory as used until the returned function
+// is called. It waits while the repository is locked.
+func useGitDir(dir string) func() {
+	dir = filepath.Clean(dir)
+	gitDirMu.Lock()
+	defer gitDirMu.Unlock()
+	for gitDirUsers[dir] < 0 {
+		gitDirCond.Wait()
+	}
+	gitDirUsers[dir]++
+	once := sync.Once{}
+	return func() {
+		once.Do(func() {
+			gitDirMu.Lock()
+			defer gitDirMu.Unlock()
+			if gitDirUsers[dir]--; gitDirUsers[dir] == 0 {
+				delete(gitDirUsers, dir)
+			}
+			gitDirCond.Broadcast()
+		})
+	}
+}
+
+// lockGitDir waits until the repository directory is no longer used and locks
+// it until the returned function is called.
+func lockGitDir(dir string) func() {
+	dir = filepath.Clean(dir)
+	gitDirMu.Lock()
+	defer gitDirMu.Unlock()
+	for gitDirUsers[dir] != 0 {
+		gitDirCond.Wait()
+	}
+	gitDirUsers[dir] = -1
+	return func() { unlockGitDir(dir) }
+}
+
+// tryLockGitDir locks the repository directory like lockGitDir, unless it is
+// used or locked already.
+func tryLockGitDir(dir string) (func(), bool) {
+	dir = filepath.Clean(dir)
+	gitDirMu.Lock()
+	defer gitDirMu.Unlock()
+	if gitDirUsers[dir] != 0 {
+		return nil, false
+	}
+	gitDirUsers[dir] = -1
+	return func() { unlockGitDir(dir) }, true
+}
+
+func unlockGitDir(dir string) {
+	gitDirMu.Lock()
+	defer gitDirMu.Unlock()
+	delete(gitDirUsers, dir)
+	gitDirCond.Broadcast()
+}
+
+type gitDirRepo struct {
+	dir  string
+	size int64
+	used time.Time
+}
+
+// PruneGitDir removes the least recently used bare git repositories from the
+// directory until their total size fits into the limit, and returns the
+// removed repository directories. Git clients touch repository directories on
+// every use, and re-create the removed repositories on demand. Repositories
+// that are in use are skipped.
+func PruneGitDir(dir string, limit int64) ([]string, error) {
+	repos := []gitDirRepo{}
+	total := int64(0)
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.IsDir() {
+			return err
+		}
+		if _, err := os.Stat(filepath.Join(path, "HEAD")); err != nil {
+			return nil
+		}
+		repo := gitDirRepo{dir: path, used: fi.ModTime()}
+		err = filepath.Walk(path, func(_ string, fi os.FileInfo, err error) error {
+			if err == nil && !fi.IsDir() {
+				repo.size = repo.size + fi.Size()
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		repos = append(repos, repo)
+		total = total + repo.size
+		return filepath.SkipDir
+	})
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(repos, func(i, j int) bool {
+		return repos[i].used.Before(repos[j].used)
+	})
+	removed := []string{}
+	for _, repo := range repos {
+		if total <= limit {
+			break
+		}
+		unlock, ok := tryLockGitDir(repo.dir)
+		if !ok {
+			continue
+		}
+		err := os.RemoveAll(repo.dir)
+		unlock()
+		if err != nil {
+			return removed, err
+		}
+		removed = append(removed, repo.dir)
+		total = total - repo.size
+	}
+	return removed, nil
+}
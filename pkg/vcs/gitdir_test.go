@@ -0,0 +1,121 @@
+package vcs
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4"
+)
+
+func TestPruneGitDir(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "gomodproxy_gitdir_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// three bare repos of ~64KB each, used one after another
+	repos := []string{"example.com/old", "example.com/mid", "example.com/new"}
+	for i, name := range repos {
+		path := filepath.Join(dir, name)
+		if _, err := git.PlainInit(path, true); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(path, "objects", "blob"), []byte(strings.Repeat("x", 1<<16)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		used := time.Now().Add(time.Duration(i-len(repos)) * time.Hour)
+		if err := os.Chtimes(path, used, used); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Within the limit nothing is removed
+	if removed, err := PruneGitDir(dir, 1<<20); err != nil || len(removed) != 0 {
+		t.Fatal(removed, err)
+	}
+
+	// Above the limit the least recently used repo is removed
+	removed, err := PruneGitDir(dir, 3<<16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0] != filepath.Join(dir, "example.com/old") {
+		t.Fatal(removed)
+	}
+	for _, name := range repos {
+		_, err := os.Stat(filepath.Join(dir, name))
+		if exists := err == nil; exists != (name != "example.com/old") {
+			t.Fatal(name, err)
+		}
+	}
+
+	// Missing directory is not an error
+	if removed, err := PruneGitDir(filepath.Join(dir, "missing"), 0); err != nil || len(removed) != 0 {
+		t.Fatal(removed, err)
+	}
+}
+
+func TestPruneGitDirInUse(t *testing.T) {
+	src := testRepo(t, testCommit{files: map[string]string{"foo.go": "package foo\n"}, tags: []string{"v1.0.0"}})
+	defer os.RemoveAll(src)
+	dir, err := ioutil.TempDir(os.TempDir(), "gomodproxy_gitdir_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	module := "github.com/gomodproxytest/prune"
+	newGit := func() *gitVCS {
+		g := NewGit(t.Log, dir, module, NoAuth()).(*gitVCS)
+		g.remote = "file://" + src
+		return g
+	}
+
+	// Repos in use are skipped
+	_, done, err := newGit().repo(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed, err := PruneGitDir(dir, 0); err != nil || len(removed) != 0 {
+		t.Fatal(removed, err)
+	}
+	done()
+	if removed, err := PruneGitDir(dir, 0); err != nil || len(removed) != 1 {
+		t.Fatal(removed, err)
+	}
+
+	// Concurrent fetches never see their repo removed
+	stop := make(chan struct{})
+	pruned := make(chan error)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				close(pruned)
+				return
+			default:
+			}
+			if _, err := PruneGitDir(dir, 0); err != nil {
+				pruned <- err
+			}
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		r, err := newGit().Zip(ctx, "v1.0.0")
+		if err != nil {
+			t.Error(err)
+			break
+		}
+		r.Close()
+	}
+	close(stop)
+	for err := range pruned {
+		t.Error(err)
+	}
+}
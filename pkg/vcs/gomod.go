@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
@@ -75,10 +76,22 @@ func (g *goVCS) Zip(ctx context.Context, version Version) (io.ReadCloser, error)
 }
 
 func (g *goVCS) download(ctx context.Context, version string) error {
+	setOrigin(ctx, "gomod", "")
 	cmd := exec.Command("go", "mod", "download", g.module+"@"+version)
 	cmd.Env = append(os.Environ(), "GOPATH="+g.dir)
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+	out := &bytes.Buffer{}
+	cmd.Stdout = out
+	cmd.Stderr = out
+	g.log("goVCS.download", "module", g.module, "version", version, "cmd", strings.Join(cmd.Args, " "))
+	err := cmd.Run()
+	if out.Len() > 0 {
+		g.log("goVCS.download", "module", g.module, "version", version, "output", out.String())
+	}
+	if err != nil {
+		g.log("goVCS.download", "module", g.module, "version", version, "error", err)
+		return fmt.Errorf("%s: %w: %s", strings.Join(cmd.Args, " "), err, strings.TrimSpace(out.String()))
+	}
+	return nil
 }
 
 func (g *goVCS) file(name string) ([]byte, error) {
@@ -0,0 +1,40 @@
+package vcs
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestGoModDownloadError(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go is required to test the gomod backend")
+	}
+	dir, err := ioutil.TempDir(os.TempDir(), "gomodproxy_gomod_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Forbid network access, so that the download fails right away
+	defer os.Setenv("GOPROXY", os.Getenv("GOPROXY"))
+	os.Setenv("GOPROXY", "off")
+
+	logs := []string{}
+	logger := func(v ...interface{}) { logs = append(logs, fmt.Sprint(v...)) }
+	g := NewGoMod(logger, "example.com/gomodproxytest/missing").(*goVCS)
+	g.dir = dir
+	if _, err := g.Zip(context.Background(), "v1.0.0"); err == nil {
+		t.Fatal("download should fail")
+	}
+	all := strings.Join(logs, "\n")
+	if !strings.Contains(all, "go mod download example.com/gomodproxytest/missing@v1.0.0") {
+		t.Fatal("command is not logged:", all)
+	}
+	if !strings.Contains(all, "GOPROXY=off") {
+		t.Fatal("output is not logged:", all)
+	}
+}
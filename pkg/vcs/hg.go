@@ -0,0 +1,337 @@
+package vcs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// hgDefaultBranch is the branch whose tip is served as a pseudo-version of
+// the repositories without release tags.
+const hgDefaultBranch = "default"
+
+var reHgHash = regexp.MustCompile(`^[0-9a-f]{12,40}$`)
+
+type hgVCS struct {
+	log    logger
+	dir    string
+	module string
+	prefix string
+	major  string
+	auth   Auth
+	hosts  *HostPolicy
+	remote string
+}
+
+// NewHg returns a Mercurial VCS client implementation that provides
+// information about the specific module using the given authentication
+// mechanism. It runs the "hg" command, which must be installed. Repositories
+// are cloned into the given directory and updated on every use, or into a
+// temporary directory if it is empty. Only the hosts allowed by the policy are
+// contacted.
+func NewHg(l logger, dir string, module string, auth Auth, hosts *HostPolicy) VCS {
+	return &hgVCS{log: l, dir: dir, module: module, auth: auth, hosts: hosts}
+}
+
+func (h *hgVCS) List(ctx context.Context) ([]Version, error) {
+	h.log("hgVCS.List", "module", h.module)
+	dir, cleanup, err := h.repo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	tags, err := h.tags(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	list := []Version{}
+	seen := map[Version]bool{}
+	for tag, node := range tags {
+		version, ok := h.tagVersion(tag)
+		if !ok || seen[version] {
+			continue
+		}
+		if isIncompatible(version) {
+			if _, err := h.hg(ctx, dir, "files", "-r", node, "path:go.mod"); err == nil {
+				continue
+			}
+		}
+		seen[version] = true
+		list = append(list, version)
+	}
+	if len(list) == 0 {
+		node, t, err := h.log1(ctx, dir, "max(branch("+hgDefaultBranch+"))")
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, pseudoVersion(h.major, "", t, node[:12]))
+	}
+	sortVersions(list)
+	h.log("hgVCS.List", "module", h.module, "list", list)
+	return list, nil
+}
+
+// tagVersion returns a module version for the tag, if the tag is a release
+// tag of the module.
+func (h *hgVCS) tagVersion(tag string) (Version, bool) {
+	if h.prefix != "" {
+		if !strings.HasPrefix(tag, h.prefix+"/") {
+			return "", false
+		}
+		tag = strings.TrimPrefix(tag, h.prefix+"/")
+	}
+	version := Version(tag)
+	if !version.IsValid() {
+		return "", false
+	}
+	if h.major != "" && !strings.HasPrefix(tag, h.major+".") {
+		return "", false
+	}
+	return incompatible(h.prefix, h.major, version)
+}
+
+func (h *hgVCS) Timestamp(ctx context.Context, version Version) (time.Time, error) {
+	h.log("hgVCS.Timestamp", "module", h.module, "version", version)
+	dir, cleanup, err := h.repo(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer cleanup()
+	_, t, err := h.changeset(ctx, dir, version)
+	if err != nil {
+		return time.Time{}, err
+	}
+	h.log("hgVCS.Timestamp", "module", h.module, "version", version, "timestamp", t)
+	return t, nil
+}
+
+// Zip builds the module archive from the changeset the same way the git
+// client does, so that the checksums match: vendored packages, nested modules
+// and non-regular files are left out, and every file is stored under the
+// "module@version/" directory.
+func (h *hgVCS) Zip(ctx context.Context, version Version) (io.ReadCloser, error) {
+	h.log("hgVCS.Zip", "module", h.module, "version", version)
+	dir, cleanup, err := h.repo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	node, _, err := h.changeset(ctx, dir, version)
+	if err != nil {
+		return nil, err
+	}
+
+	tmp, err := ioutil.TempDir(os.TempDir(), "gomodproxy_hg_archive")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	root := filepath.Join(tmp, "root")
+	// the archive metadata file is not a part of the repository
+	if _, err := h.hg(ctx, dir, "--config", "ui.archivemeta=false", "archive", "--no-decode", "-t", "files", "-r", node, root); err != nil {
+		return nil, err
+	}
+	return zipDir(ctx, root, h.module, h.prefix, h.major, version)
+}
+
+// Describe returns the repository the module is fetched from.
+func (h *hgVCS) Describe(ctx context.Context) (Remote, error) {
+	repoRoot, _, url, err := h.resolve(ctx)
+	if err != nil {
+		return Remote{}, err
+	}
+	return Remote{VCS: "hg", Repo: repoRoot, URL: url, Auth: h.auth.Kind()}, nil
+}
+
+// resolve returns the repository root of the module, the module path within
+// the repository and the remote URL to fetch it from.
+func (h *hgVCS) resolve(ctx context.Context) (repoRoot, path, url string, err error) {
+	if h.remote == "" {
+		if err := h.hosts.Check(strings.SplitN(h.module, "/", 2)[0]); err != nil {
+			return "", "", "", err
+		}
+	}
+	repoRoot, path, err = RepoRoot(ctx, h.module)
+	if err != nil {
+		return "", "", "", err
+	}
+	if h.remote != "" {
+		return repoRoot, path, h.remote, nil
+	}
+	// go-import meta tag may point to a different host
+	if err := h.hosts.Check(strings.SplitN(repoRoot, "/", 2)[0]); err != nil {
+		return "", "", "", err
+	}
+	schema := "https://"
+	if h.auth.Key != "" {
+		schema = "ssh://"
+	}
+	return repoRoot, path, schema + repoRoot, nil
+}
+
+// repo returns the directory of the up to date local clone of the module
+// repository, and a function to be called when the clone is no longer used.
+func (h *hgVCS) repo(ctx context.Context) (dir string, cleanup func(), err error) {
+	defer Span(ctx, "open")()
+	repoRoot, path, url, err := h.resolve(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	setOrigin(ctx, "hg", repoRoot)
+	h.prefix, h.major = splitMajor(path)
+	h.log("repo", "url", url, "prefix", h.prefix, "major", h.major)
+
+	cleanup = func() {}
+	if h.dir == "" {
+		tmp, err := ioutil.TempDir(os.TempDir(), "gomodproxy_hg")
+		if err != nil {
+			return "", nil, err
+		}
+		cleanup = func() { os.RemoveAll(tmp) }
+		dir = filepath.Join(tmp, "repo")
+	} else {
+		dir = filepath.Join(h.dir, repoRoot)
+	}
+
+	defer Span(ctx, "fetch")()
+	if _, err := os.Stat(filepath.Join(dir, ".hg")); err == nil {
+		now := time.Now()
+		os.Chtimes(dir, now, now)
+		_, err = h.hg(ctx, dir, "pull", "--quiet", url)
+		return dir, cleanup, err
+	}
+	// The repository is cloned next to its final location and moved there
+	// once complete, so that concurrent requests never see a partial clone.
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	tmp, err := ioutil.TempDir(filepath.Dir(dir), ".clone")
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	defer os.RemoveAll(tmp)
+	if _, err := h.hg(ctx, "", "clone", "--noupdate", "--quiet", url, filepath.Join(tmp, "repo")); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	if err := os.Rename(filepath.Join(tmp, "repo"), dir); err != nil {
+		if _, statErr := os.Stat(filepath.Join(dir, ".hg")); statErr != nil {
+			cleanup()
+			return "", nil, err
+		}
+		// cloned by a concurrent request in the meantime
+	}
+	return dir, cleanup, nil
+}
+
+// tags returns the tags of the repository and the changesets they point to.
+func (h *hgVCS) tags(ctx context.Context, dir string) (map[string]string, error) {
+	b, err := h.hg(ctx, dir, "tags", "--template", "{tag} {node}\n")
+	if err != nil {
+		return nil, err
+	}
+	tags := map[string]string{}
+	for _, line := range strings.Split(string(b), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 && fields[0] != "tip" {
+			tags[fields[0]] = fields[1]
+		}
+	}
+	return tags, nil
+}
+
+// changeset returns the full hash and the time of the changeset the version
+// refers to, either by a tag or by a hash of a pseudo-version.
+func (h *hgVCS) changeset(ctx context.Context, dir string, version Version) (string, time.Time, error) {
+	version = Version(strings.TrimSuffix(string(version), "+incompatible"))
+	if !version.IsSemVer() && reHgHash.MatchString(version.Hash()) {
+		return h.log1(ctx, dir, version.Hash())
+	}
+	tags, err := h.tags(ctx, dir)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	names := []string{string(version)}
+	if h.prefix != "" {
+		names = []string{h.prefix + "/" + string(version), string(version)}
+	}
+	for _, name := range names {
+		if node, ok := tags[name]; ok {
+			return h.log1(ctx, dir, node)
+		}
+	}
+	return "", time.Time{}, fmt.Errorf("%s@%s: no such tag: %w", h.module, version, os.ErrNotExist)
+}
+
+// log1 returns the full hash and the time of the single changeset.
+func (h *hgVCS) log1(ctx context.Context, dir string, rev string) (string, time.Time, error) {
+	b, err := h.hg(ctx, dir, "log", "--limit", "1", "-r", rev, "--template", "{node} {date|hgdate}")
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) != 3 {
+		return "", time.Time{}, fmt.Errorf("%s: revision %s: %w", h.module, rev, os.ErrNotExist)
+	}
+	sec, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return fields[0], time.Unix(sec, 0).UTC(), nil
+}
+
+// hg runs the hg command in the given directory and returns its output.
+// Credentials are passed in a temporary config file rather than in the
+// command line or the URL, so they never show up in process lists or errors.
+func (h *hgVCS) hg(ctx context.Context, dir string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "hg", append([]string{"--noninteractive"}, args...)...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "HGPLAIN=1", "HGENCODING=utf-8")
+	if rc, err := h.hgrc(); err != nil {
+		return nil, err
+	} else if rc != "" {
+		defer os.Remove(rc)
+		cmd.Env = append(cmd.Env, "HGRCPATH="+rc)
+	}
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("hg %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// hgrc writes the hg config file with the credentials and returns its name,
+// or an empty string if no authentication is used.
+func (h *hgVCS) hgrc() (string, error) {
+	rc := ""
+	if h.auth.Key != "" {
+		rc = fmt.Sprintf("[ui]\nssh = ssh -i %q -o BatchMode=yes -o IdentitiesOnly=yes\n", h.auth.Key)
+	} else if h.auth.Username != "" {
+		rc = fmt.Sprintf("[auth]\ngomodproxy.prefix = *\ngomodproxy.username = %s\ngomodproxy.password = %s\n",
+			h.auth.Username, h.auth.Password)
+	} else {
+		return "", nil
+	}
+	f, err := ioutil.TempFile(os.TempDir(), "gomodproxy_hgrc")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := f.WriteString(rc); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
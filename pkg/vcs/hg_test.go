@@ -0,0 +1,136 @@
+package vcs
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testHgRepo creates a local Mercurial repository with the given commits on
+// the default branch and returns its path.
+func testHgRepo(t testing.TB, commits ...testCommit) string {
+	if _, err := exec.LookPath("hg"); err != nil {
+		t.Skip("hg is required to serve local test repositories")
+	}
+	dir, err := ioutil.TempDir(os.TempDir(), "gomodproxy_hg_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hg := func(args ...string) {
+		cmd := exec.Command("hg", args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), "HGPLAIN=1", "HGRCPATH=")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatal(args, err, string(out))
+		}
+	}
+	hg("init")
+	for i, c := range commits {
+		for name, content := range c.files {
+			path := filepath.Join(dir, name)
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		date := fmt.Sprintf("%d 0", 1537524000+i)
+		if !c.when.IsZero() {
+			date = fmt.Sprintf("%d 0", c.when.Unix())
+		}
+		hg("commit", "--addremove", "-u", "test", "-d", date, "-m", fmt.Sprintf("commit %d", i))
+		if len(c.tags) > 0 {
+			hg(append([]string{"tag", "-u", "test", "-d", date, "-r", "."}, c.tags...)...)
+		}
+	}
+	return dir
+}
+
+// testHg returns a Mercurial client for the module that fetches from a local
+// test repository instead of the remote derived from the module path.
+func testHg(t testing.TB, dir string, module string) *hgVCS {
+	h := NewHg(t.Log, "", module, NoAuth(), nil).(*hgVCS)
+	h.remote = dir
+	return h
+}
+
+func TestHg(t *testing.T) {
+	files := map[string]string{
+		"go.mod":              "module github.com/gomodproxytest/hg\n",
+		"hg.go":               "package hg\n",
+		"vendor/foo/foo.go":   "package foo\n",
+		"sub/go.mod":          "module github.com/gomodproxytest/hg/sub\n",
+		"sub/sub.go":          "package sub\n",
+		"internal/x/x.go":     "package x\n",
+		"testdata/input.json": "{}\n",
+	}
+	dir := testHgRepo(t, testCommit{files: files}, testCommit{files: map[string]string{"hg.go": "package hg // v1\n"}, tags: []string{"v1.0.0", "sub/v1.1.0", "release"}})
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+
+	h := testHg(t, dir, "github.com/gomodproxytest/hg")
+	list, err := h.List(ctx)
+	if err != nil || !reflect.DeepEqual(list, []Version{"v1.0.0"}) {
+		t.Fatal(list, err)
+	}
+	ts, err := h.Timestamp(ctx, "v1.0.0")
+	if err != nil || ts.Unix() != 1537524001 {
+		t.Fatal(ts, err)
+	}
+	r, err := h.Zip(ctx, "v1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := zipFiles(t, r)
+	// the same files as the git client would archive, the tags file is only
+	// added by the tagging changeset
+	for _, name := range []string{"go.mod", "hg.go", "internal/x/x.go", "testdata/input.json"} {
+		if _, ok := got["github.com/gomodproxytest/hg@v1.0.0/"+name]; !ok {
+			t.Fatal(name, got)
+		}
+	}
+	if len(got) != 4 || got["github.com/gomodproxytest/hg@v1.0.0/hg.go"] != "package hg // v1\n" {
+		t.Fatal(got)
+	}
+
+	sub := testHg(t, dir, "github.com/gomodproxytest/hg/sub")
+	if list, err := sub.List(ctx); err != nil || !reflect.DeepEqual(list, []Version{"v1.1.0"}) {
+		t.Fatal(list, err)
+	}
+	if r, err := sub.Zip(ctx, "v1.1.0"); err != nil {
+		t.Fatal(err)
+	} else if got := zipFiles(t, r); len(got) != 2 || got["github.com/gomodproxytest/hg/sub@v1.1.0/sub.go"] != "package sub\n" {
+		t.Fatal(got)
+	}
+
+	if _, err := h.Zip(ctx, "v2.0.0"); Classify(err) != NotFound {
+		t.Fatal(err)
+	}
+}
+
+func TestHgPseudoVersion(t *testing.T) {
+	dir := testHgRepo(t, testCommit{files: map[string]string{"go.mod": "module github.com/gomodproxytest/hg\n"}})
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+
+	h := testHg(t, dir, "github.com/gomodproxytest/hg")
+	list, err := h.List(ctx)
+	if err != nil || len(list) != 1 || len(list[0].Hash()) != 12 || string(list[0][:21]) != "v0.0.0-20180921100000" {
+		t.Fatal(list, err)
+	}
+	ts, err := h.Timestamp(ctx, list[0])
+	if err != nil || ts.Unix() != 1537524000 {
+		t.Fatal(ts, err)
+	}
+	if r, err := h.Zip(ctx, list[0]); err != nil {
+		t.Fatal(err)
+	} else if got := zipFiles(t, r); len(got) != 1 {
+		t.Fatal(got)
+	}
+}
@@ -0,0 +1,78 @@
+package vcs
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+// ErrHostNotAllowed is returned when a module or its repository is located on
+// a host that VCS clients are not allowed to contact.
+var ErrHostNotAllowed = errors.New("host is not allowed")
+
+// HostPolicy decides which hosts VCS clients may contact. A nil policy allows
+// all hosts except for the internal ones.
+type HostPolicy struct {
+	allowed []string
+}
+
+// AllowHosts returns a policy that only allows the given hosts. A host may be
+// a domain name, an IP address, or a "*.example.com" pattern matching all
+// subdomains. Ports are ignored. If no hosts are given, all hosts except
+// internal ones are allowed.
+func AllowHosts(hosts ...string) *HostPolicy {
+	p := &HostPolicy{}
+	for _, host := range hosts {
+		p.allowed = append(p.allowed, normalizeHost(host))
+	}
+	return p
+}
+
+// Check returns ErrHostNotAllowed if the host, optionally with a port, is not
+// allowed by the policy. Loopback, link-local and unspecified addresses (e.g.
+// cloud metadata endpoints) are rejected unless they are allowed explicitly,
+// wildcard patterns never match them. Host names are not resolved, so the
+// check does not protect against names that resolve to internal addresses.
+func (p *HostPolicy) Check(host string) error {
+	host = normalizeHost(host)
+	if host == "" {
+		return ErrHostNotAllowed
+	}
+	if p != nil {
+		for _, allowed := range p.allowed {
+			if host == allowed {
+				return nil
+			}
+		}
+	}
+	if internalHost(host) {
+		return ErrHostNotAllowed
+	}
+	if p == nil || len(p.allowed) == 0 {
+		return nil
+	}
+	for _, allowed := range p.allowed {
+		if strings.HasPrefix(allowed, "*.") && strings.HasSuffix(host, allowed[1:]) {
+			return nil
+		}
+	}
+	return ErrHostNotAllowed
+}
+
+// normalizeHost strips the port from the host and converts it to lower case,
+// since ports are not taken into account by the policy.
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.Trim(host, "[]"))
+}
+
+func internalHost(host string) bool {
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && (ip.IsLoopback() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsUnspecified())
+}
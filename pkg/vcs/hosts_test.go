@@ -0,0 +1,57 @@
+package vcs
+
+import (
+	"context"
+	"testing"
+)
+
+func TestHostPolicy(t *testing.T) {
+	for _, test := range []struct {
+		Policy  *HostPolicy
+		Host    string
+		Allowed bool
+	}{
+		{Policy: nil, Host: "github.com", Allowed: true},
+		{Policy: nil, Host: "169.254.169.254", Allowed: false},
+		{Policy: nil, Host: "127.0.0.1:8080", Allowed: false},
+		{Policy: nil, Host: "[::1]", Allowed: false},
+		{Policy: nil, Host: "0.0.0.0", Allowed: false},
+		{Policy: nil, Host: "localhost", Allowed: false},
+		{Policy: nil, Host: "", Allowed: false},
+		{Policy: AllowHosts(), Host: "github.com", Allowed: true},
+		{Policy: AllowHosts("github.com"), Host: "GitHub.com", Allowed: true},
+		{Policy: AllowHosts("github.com"), Host: "bitbucket.org", Allowed: false},
+		{Policy: AllowHosts("*.example.com"), Host: "git.example.com", Allowed: true},
+		{Policy: AllowHosts("*.example.com"), Host: "example.com", Allowed: false},
+		{Policy: AllowHosts("*.example.com"), Host: "evilexample.com", Allowed: false},
+		{Policy: AllowHosts("*.localhost"), Host: "git.localhost", Allowed: false},
+		{Policy: AllowHosts("127.0.0.1"), Host: "127.0.0.1:8080", Allowed: true},
+	} {
+		if err := test.Policy.Check(test.Host); (err == nil) != test.Allowed {
+			t.Fatal(test.Policy, test.Host, err)
+		}
+	}
+}
+
+func TestGitHostPolicy(t *testing.T) {
+	g := NewGit(t.Log, "", "github.com/gomodproxytest/repo", NoAuth(), Hosts(AllowHosts("bitbucket.org")))
+	if _, err := g.List(context.Background()); err != ErrHostNotAllowed {
+		t.Fatal(err)
+	}
+	if kind := Classify(ErrHostNotAllowed); kind != Forbidden {
+		t.Fatal(kind)
+	}
+}
+
+func TestCLIHostPolicy(t *testing.T) {
+	module, hosts := "github.com/gomodproxytest/repo", AllowHosts("bitbucket.org")
+	for _, v := range []VCS{
+		NewGitCLI(t.Log, "", module, NoAuth(), hosts),
+		NewHg(t.Log, "", module, NoAuth(), hosts),
+		NewSVN(t.Log, module, NoAuth(), hosts),
+	} {
+		if _, err := v.List(context.Background()); err != ErrHostNotAllowed {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package vcs
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/ssh"
+)
+
+// knownHostsMu serializes the lookups and the appends of new host keys, so
+// that concurrent fetches from a new host add its key only once.
+var knownHostsMu sync.Mutex
+
+// hostKeyCallback returns the function verifying SSH host keys against the
+// known_hosts files.
+func (g *gitVCS) hostKeyCallback() (gossh.HostKeyCallback, error) {
+	if g.ignoreHostKey {
+		return func(hostname string, remote net.Addr, key gossh.PublicKey) error {
+			g.log("gitVCS.hostKey", "module", g.module, "host", hostname, "key", gossh.FingerprintSHA256(key), "verified", false)
+			return nil
+		}, nil
+	}
+	if !g.acceptNew {
+		known, err := ssh.NewKnownHostsCallback(g.knownHosts...)
+		if err != nil {
+			return nil, err
+		}
+		return func(hostname string, remote net.Addr, key gossh.PublicKey) error {
+			return hostKeyError(hostname, key, known(hostname, remote, key))
+		}, nil
+	}
+	files := g.knownHosts
+	if len(files) == 0 {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		files = []string{filepath.Join(home, ".ssh", "known_hosts")}
+	}
+	return func(hostname string, remote net.Addr, key gossh.PublicKey) error {
+		knownHostsMu.Lock()
+		defer knownHostsMu.Unlock()
+		if err := os.MkdirAll(filepath.Dir(files[0]), 0700); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(files[0], os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		existing := []string{}
+		for _, file := range files {
+			if _, err := os.Stat(file); err == nil {
+				existing = append(existing, file)
+			}
+		}
+		// The files are read on every connection to see the keys added since.
+		known, err := knownhosts.New(existing...)
+		if err != nil {
+			return err
+		}
+		err = known(hostname, remote, key)
+		keyErr := &knownhosts.KeyError{}
+		if !errors.As(err, &keyErr) || len(keyErr.Want) > 0 {
+			return hostKeyError(hostname, key, err)
+		}
+		g.log("gitVCS.hostKey", "module", g.module, "host", hostname, "key", gossh.FingerprintSHA256(key), "file", files[0])
+		_, err = fmt.Fprintln(f, knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key))
+		return err
+	}, nil
+}
+
+// hostKeyError explains why the host key has been refused. The errors of the
+// knownhosts package name neither the host nor the key.
+func hostKeyError(hostname string, key gossh.PublicKey, err error) error {
+	keyErr := &knownhosts.KeyError{}
+	if !errors.As(err, &keyErr) {
+		return err
+	} else if len(keyErr.Want) == 0 {
+		return fmt.Errorf("ssh: host %s with key %s is not in known_hosts: %w", hostname, gossh.FingerprintSHA256(key), err)
+	}
+	want := keyErr.Want[0]
+	return fmt.Errorf("ssh: host key of %s is %s, not %s as in %s:%d: %w",
+		hostname, gossh.FingerprintSHA256(key), gossh.FingerprintSHA256(want.Key), want.Filename, want.Line, err)
+}
@@ -2,33 +2,107 @@ package vcs
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/xml"
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strings"
+	"time"
 )
 
 var (
 	errPrefixDoesNotMatch = errors.New("prefix does not match the module")
 	errMetaNotFound       = errors.New("go-import meta tag not found")
+	errBadModule          = errors.New("bad module name")
+	errBadMetaURL         = errors.New("go-import meta tag has a malformed repo URL")
 )
 
+// MetaOption configures the HTTP client used for go-import meta tag lookups.
+type MetaOption func(*http.Client)
+
+// MetaMaxIdleConns sets the number of idle connections kept open to every
+// vanity import host.
+func MetaMaxIdleConns(n int) MetaOption {
+	return func(c *http.Client) { c.Transport.(*http.Transport).MaxIdleConnsPerHost = n }
+}
+
+// MetaIdleTimeout sets how long idle connections to vanity import hosts are
+// kept open.
+func MetaIdleTimeout(d time.Duration) MetaOption {
+	return func(c *http.Client) { c.Transport.(*http.Transport).IdleConnTimeout = d }
+}
+
+// MetaTimeout sets the time limit of a go-import meta tag lookup, including
+// reading the page, so that an unreachable vanity import host does not hold a
+// VCS worker for long. Zero means no limit.
+func MetaTimeout(d time.Duration) MetaOption { return func(c *http.Client) { c.Timeout = d } }
+
+// NewMetaClient returns an HTTP client for go-import meta tag lookups, which
+// uses the TLS configuration if it is not nil. The client keeps connections to
+// vanity import hosts alive, so that resolving many modules of the same host
+// does not pay for a TLS handshake every time. Lookups time out after 30
+// seconds, unless MetaTimeout says otherwise.
+func NewMetaClient(tc *tls.Config, options ...MetaOption) *http.Client {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = tc
+	t.MaxIdleConnsPerHost = 16
+	t.IdleConnTimeout = 90 * time.Second
+	c := &http.Client{Transport: t, Timeout: 30 * time.Second}
+	for _, opt := range options {
+		opt(c)
+	}
+	return c
+}
+
+// defaultMetaClient looks go-import meta tags up for the VCS clients that are
+// not given a client of their own.
+var defaultMetaClient = NewMetaClient(nil)
+
+// ConfigureTLS sets the TLS configuration of git remotes fetched over HTTPS,
+// e.g. to trust the private CA of an internal module host. It must be called
+// before any module is fetched, since go-git only has a process-wide HTTPS
+// client.
+func ConfigureTLS(c *tls.Config) {
+	configureGitTLS(c)
+}
+
+// RepoRoot returns the repository root of the module and the module directory
+// in the repository.
 func RepoRoot(ctx context.Context, module string) (root string, path string, err error) {
+	return lookupRepoRoot(ctx, defaultMetaClient, module, false)
+}
+
+// lookupRepoRoot is like RepoRoot, but looks the go-import meta tag up with the
+// given client, and over plain HTTP if insecure is set.
+func lookupRepoRoot(ctx context.Context, client *http.Client, module string, insecure bool) (root string, path string, err error) {
 	// For common VCS hosters we can figure out repo root by the URL
 	if strings.HasPrefix(module, "github.com/") || strings.HasPrefix(module, "bitbucket.org/") {
 		parts := strings.Split(module, "/")
 		if len(parts) < 3 {
-			return "", "", errors.New("bad module name")
+			return "", "", errBadModule
 		}
 		return strings.Join(parts[0:3], "/"), strings.Join(parts[3:], "/"), nil
 	}
 	// Otherwise we shall make a `?go-get=1` HTTP request
-	// TODO: use context
-	res, err := http.Get("https://" + module + "?go-get=1")
+	scheme := "https://"
+	if insecure {
+		scheme = "http://"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, scheme+module+"?go-get=1", nil)
+	if err != nil {
+		return "", "", err
+	}
+	res, err := client.Do(req)
 	if err != nil {
 		return "", "", err
 	}
 	defer res.Body.Close()
+	// the rest of the page is drained for the connection to be reused
+	defer io.Copy(ioutil.Discard, res.Body)
 	html := struct {
 		HTML string `xml:"html"`
 		Head struct {
@@ -45,17 +119,33 @@ func RepoRoot(ctx context.Context, module string) (root string, path string, err
 	if err := dec.Decode(&html); err != nil {
 		return "", "", err
 	}
+	found := false
 	for _, meta := range html.Head.Meta {
-		if meta.Name == "go-import" {
-			if f := strings.Fields(meta.Content); len(f) == 3 {
-				url := f[2]
-				if i := strings.Index(url, "://"); i >= 0 {
-					url = url[i+3:]
-				}
-				path = strings.TrimPrefix(strings.TrimPrefix(module, f[0]), "/")
-				return url, path, nil
-			}
+		f := strings.Fields(meta.Content)
+		if meta.Name != "go-import" || len(f) != 3 || f[1] == "mod" {
+			continue
+		}
+		found = true
+		// The repo root may have any number of path elements, e.g. projects
+		// in GitLab subgroups, but it must be the module or one of its
+		// parents. The rest of the module path is the directory in the repo.
+		if f[0] != module && !strings.HasPrefix(module, f[0]+"/") {
+			continue
+		}
+		// repo URL must be absolute, otherwise git fails obscurely later
+		u, err := url.Parse(f[2])
+		if err != nil || u.Scheme == "" || u.Host == "" || u.Opaque != "" {
+			return "", "", fmt.Errorf("%s: %q: %w", module, meta.Content, errBadMetaURL)
 		}
+		root = u.Host + strings.TrimRight(u.Path, "/")
+		if f[1] == "git" {
+			// git clients add the suffix, GitLab URLs already have it
+			root = strings.TrimSuffix(root, ".git")
+		}
+		return root, strings.TrimPrefix(strings.TrimPrefix(module, f[0]), "/"), nil
+	}
+	if found {
+		return "", "", fmt.Errorf("%s: %w", module, errPrefixDoesNotMatch)
 	}
 	return "", "", errMetaNotFound
 }
@@ -3,16 +3,32 @@ package vcs
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"reflect"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
 )
 
+// testMetaClient returns a meta lookup client that trusts the test servers.
+func testMetaClient(options ...MetaOption) *http.Client {
+	return NewMetaClient(&tls.Config{InsecureSkipVerify: true}, options...)
+}
+
 func TestRepoRoot(t *testing.T) {
 	var hostname string
-	http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	client := testMetaClient()
 	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Query().Get("go-get") != "1" {
 			fmt.Fprint(w, `<!doctype html><html><body>Hello</body></html>`)
@@ -31,7 +47,7 @@ func TestRepoRoot(t *testing.T) {
 	defer ts.Close()
 	hostname = strings.TrimPrefix(ts.URL, "https://")
 
-	if root, path, err := RepoRoot(context.Background(), hostname+"/foo/bar"); err != nil {
+	if root, path, err := lookupRepoRoot(context.Background(), client, hostname+"/foo/bar", false); err != nil {
 		t.Fatal(err)
 	} else if root != "example.com/foo/bar" {
 		t.Fatal(root)
@@ -40,6 +56,196 @@ func TestRepoRoot(t *testing.T) {
 	}
 }
 
+func TestRepoRootMalformed(t *testing.T) {
+	var hostname string
+	client := testMetaClient()
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		repo := "/" + strings.Split(r.URL.Path, "/")[1]
+		content := map[string]string{
+			"/relative":   "%s git /foo/bar",
+			"/nohost":     "%s git https:///foo/bar",
+			"/noscheme":   "%s git example.com/foo/bar",
+			"/whitespace": "  %s \t git   https://example.com/foo/bar/  ",
+		}[repo]
+		fmt.Fprintf(w, `<html><head><meta name="go-import" content="`+content+`"></head></html>`, hostname+repo)
+	}))
+	defer ts.Close()
+	hostname = strings.TrimPrefix(ts.URL, "https://")
+
+	for _, path := range []string{"/relative", "/nohost", "/noscheme"} {
+		root, _, err := lookupRepoRoot(context.Background(), client, hostname+path, false)
+		if root != "" || !errors.Is(err, errBadMetaURL) || Classify(err) != NotFound {
+			t.Fatal(path, root, err)
+		}
+		if !strings.Contains(err.Error(), "foo/bar") {
+			t.Fatal(path, "error should name the meta content:", err)
+		}
+	}
+
+	// Extra whitespace and trailing slashes are tolerated
+	if root, path, err := lookupRepoRoot(context.Background(), client, hostname+"/whitespace/sub", false); err != nil {
+		t.Fatal(err)
+	} else if root != "example.com/foo/bar" || path != "sub" {
+		t.Fatal(root, path)
+	}
+}
+
+func TestRepoRootSubgroup(t *testing.T) {
+	var hostname string
+	client := testMetaClient()
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// GitLab answers for any path in the project with its full path
+		fmt.Fprintf(w, `<html><head>
+		<meta name="go-import" content="%[1]s/group/subgroup/project mod https://goproxy.example.com">
+		<meta name="go-import" content="%[1]s/group/subgroup/project git https://gitlab.example.com/group/subgroup/project.git">
+		</head></html>`, hostname)
+	}))
+	defer ts.Close()
+	hostname = strings.TrimPrefix(ts.URL, "https://")
+
+	for _, test := range []struct {
+		Module string
+		Path   string
+	}{
+		{"/group/subgroup/project", ""},
+		{"/group/subgroup/project/pkg", "pkg"},
+		{"/group/subgroup/project/pkg/v2", "pkg/v2"},
+	} {
+		root, path, err := lookupRepoRoot(context.Background(), client, hostname+test.Module, false)
+		if err != nil || root != "gitlab.example.com/group/subgroup/project" || path != test.Path {
+			t.Fatal(test.Module, root, path, err)
+		}
+	}
+	for _, module := range []string{"/group/subgroup", "/group/subgroup/projectfoo"} {
+		if _, _, err := lookupRepoRoot(context.Background(), client, hostname+module, false); !errors.Is(err, errPrefixDoesNotMatch) || Classify(err) != NotFound {
+			t.Fatal(module, err)
+		}
+	}
+
+	// the directory in the repo is the prefix of the module tags
+	dir := testRepo(t, testCommit{files: map[string]string{"pkg/foo.go": "package foo\n"}, tags: []string{"v1.0.0", "pkg/v1.1.0"}})
+	defer os.RemoveAll(dir)
+	module := hostname + "/group/subgroup/project/pkg"
+	g := testGit(t, dir, module, MetaClient(client))
+	if list, err := g.List(context.Background()); err != nil || !reflect.DeepEqual(list, []Version{"v1.1.0"}) || g.prefix != "pkg" {
+		t.Fatal(list, g.prefix, err)
+	}
+	r, err := g.Zip(context.Background(), "v1.1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files := zipFiles(t, r); files[module+"@v1.1.0/foo.go"] != "package foo\n" {
+		t.Fatal(files)
+	}
+}
+
+func TestRepoRootTimeout(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+	module := strings.TrimPrefix(ts.URL, "https://") + "/foo"
+
+	// the lookup is cancelled together with the request
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, _, err := lookupRepoRoot(ctx, testMetaClient(MetaTimeout(0)), module, false); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal(err)
+	}
+
+	// and limited by the timeout
+	start := time.Now()
+	if _, _, err := lookupRepoRoot(context.Background(), testMetaClient(MetaTimeout(50*time.Millisecond)), module, false); err == nil || Classify(err) != Unavailable {
+		t.Fatal(err)
+	} else if d := time.Since(start); d > 5*time.Second {
+		t.Fatal(d)
+	}
+}
+
+func TestRepoRootInsecure(t *testing.T) {
+	var hostname string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `<html><head><meta name="go-import" content="%s/foo git http://%s/repos/foo"></head></html>`, hostname, hostname)
+	}))
+	defer ts.Close()
+	hostname = strings.TrimPrefix(ts.URL, "http://")
+
+	if _, _, err := RepoRoot(context.Background(), hostname+"/foo"); err == nil {
+		t.Fatal("meta tag should not be looked up over plain HTTP")
+	}
+	if root, path, err := lookupRepoRoot(context.Background(), defaultMetaClient, hostname+"/foo/bar", true); err != nil || root != hostname+"/repos/foo" || path != "bar" {
+		t.Fatal(root, path, err)
+	}
+	g := NewGit(t.Log, "", hostname+"/foo", NoAuth(), InsecureHTTP(), Hosts(AllowHosts("127.0.0.1"))).(*gitVCS)
+	if remote, err := g.Describe(context.Background()); err != nil || remote.URL != "http://"+hostname+"/repos/foo.git" {
+		t.Fatal(remote, err)
+	}
+}
+
+func TestConfigureTLS(t *testing.T) {
+	var hostname string
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("go-get") == "1" {
+			fmt.Fprintf(w, `<html><head><meta name="go-import" content="%s/foo git https://%s/foo"></head></html>`, hostname, hostname)
+			return
+		}
+		// git remotes are reached over the trusted connection
+		http.Error(w, "", http.StatusUnauthorized)
+	}))
+	ts.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	ts.StartTLS()
+	defer ts.Close()
+	hostname = strings.TrimPrefix(ts.URL, "https://")
+	defer ConfigureTLS(nil)
+
+	if _, _, err := RepoRoot(context.Background(), hostname+"/foo"); err == nil {
+		t.Fatal("certificate of an unknown CA should not be trusted")
+	}
+	if _, err := listRemote(context.Background(), ts.URL+"/foo.git", nil); err == nil || errors.Is(err, transport.ErrAuthenticationRequired) {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ts.Certificate())
+	ConfigureTLS(&tls.Config{RootCAs: pool})
+	client := NewMetaClient(&tls.Config{RootCAs: pool})
+	if root, _, err := lookupRepoRoot(context.Background(), client, hostname+"/foo", false); err != nil || root != hostname+"/foo" {
+		t.Fatal(root, err)
+	}
+	if _, err := listRemote(context.Background(), ts.URL+"/foo.git", nil); !errors.Is(err, transport.ErrAuthenticationRequired) {
+		t.Fatal(err)
+	}
+}
+
+func TestRepoRootKeepAlive(t *testing.T) {
+	var hostname string
+	conns := int32(0)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `<html><head><meta name="go-import" content="%s git https://example.com/repo"></head><body>%s</body></html>`,
+			hostname+"/repo", strings.Repeat("padding ", 1024))
+	}))
+	ts.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	ts.StartTLS()
+	defer ts.Close()
+	hostname = strings.TrimPrefix(ts.URL, "https://")
+	client := testMetaClient()
+
+	for i := 0; i < 10; i++ {
+		if root, _, err := lookupRepoRoot(context.Background(), client, fmt.Sprintf("%s/repo/pkg%d", hostname, i), false); err != nil {
+			t.Fatal(err)
+		} else if root != "example.com/repo" {
+			t.Fatal(root)
+		}
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Fatal("connections opened:", n)
+	}
+}
+
 func TestRepoRootExternal(t *testing.T) {
 	if testing.Short() {
 		t.Skip("testing with external VCS might be slow")
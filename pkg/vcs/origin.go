@@ -0,0 +1,40 @@
+package vcs
+
+import "context"
+
+// Origin describes where the module source code is fetched from: the kind of
+// the VCS client, the resolved repository root and the hash of the commit the
+// version refers to, if known.
+type Origin struct {
+	VCS  string
+	Repo string
+	Hash string
+
+	parent *Origin
+}
+
+type originKey struct{}
+
+// WithOrigin returns a context in which VCS clients record the origin of the
+// module they contact into the given struct, as well as into the structs of
+// the enclosing contexts.
+func WithOrigin(ctx context.Context, o *Origin) context.Context {
+	o.parent, _ = ctx.Value(originKey{}).(*Origin)
+	return context.WithValue(ctx, originKey{}, o)
+}
+
+func setOrigin(ctx context.Context, vcs string, repo string) {
+	o, _ := ctx.Value(originKey{}).(*Origin)
+	for ; o != nil; o = o.parent {
+		o.VCS, o.Repo = vcs, repo
+	}
+}
+
+// RecordCommit records the hash of the commit the module version refers to in
+// the origin of the context. VCS clients call it once the version is resolved.
+func RecordCommit(ctx context.Context, hash string) {
+	o, _ := ctx.Value(originKey{}).(*Origin)
+	for ; o != nil; o = o.parent {
+		o.Hash = hash
+	}
+}
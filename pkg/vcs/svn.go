@@ -0,0 +1,292 @@
+package vcs
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Subversion pseudo-versions use the revision number, padded with zeros to
+// twelve digits, in place of the commit hash, like the go tool does.
+var reSVNRevision = regexp.MustCompile(`^[0-9]{12}$`)
+
+type svnVCS struct {
+	log    logger
+	module string
+	prefix string
+	major  string
+	auth   Auth
+	hosts  *HostPolicy
+	remote string
+}
+
+// svnCommit is the last change of a path, as reported by "svn ls --xml" and
+// "svn info --xml".
+type svnCommit struct {
+	Revision int64     `xml:"revision,attr"`
+	Date     time.Time `xml:"date"`
+}
+
+// NewSVN returns a Subversion VCS client implementation that provides
+// information about the specific module using the given authentication
+// mechanism. It runs the "svn" command, which must be installed. Repositories
+// are expected in the standard layout: the default branch is "trunk" and every
+// directory in "tags" is a copy of the trunk made for a release, e.g.
+// "tags/v1.0.0", or "tags/sub/v1.0.0" for the module in the "sub" directory.
+// Only the hosts allowed by the policy are contacted.
+func NewSVN(l logger, module string, auth Auth, hosts *HostPolicy) VCS {
+	return &svnVCS{log: l, module: module, auth: auth, hosts: hosts}
+}
+
+func (s *svnVCS) List(ctx context.Context) ([]Version, error) {
+	s.log("svnVCS.List", "module", s.module)
+	url, err := s.repo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// a repository without releases may have no tags directory at all
+	tags, tagsErr := s.tags(ctx, url)
+	list := []Version{}
+	for tag := range tags {
+		version, ok := incompatible(s.prefix, s.major, tag)
+		if !ok {
+			continue
+		}
+		if isIncompatible(version) {
+			if _, err := s.info(ctx, url+"/tags/"+string(tag)+"/go.mod"); err == nil {
+				continue
+			}
+		}
+		list = append(list, version)
+	}
+	if len(list) == 0 {
+		ci, err := s.info(ctx, url+"/trunk")
+		if err != nil && tagsErr != nil {
+			return nil, tagsErr
+		} else if err != nil {
+			return nil, err
+		}
+		list = append(list, svnPseudoVersion(s.major, ci))
+	}
+	sortVersions(list)
+	s.log("svnVCS.List", "module", s.module, "list", list)
+	return list, nil
+}
+
+// svnPseudoVersion returns the pseudo-version of the change.
+func svnPseudoVersion(major string, ci svnCommit) Version {
+	return pseudoVersion(major, "", ci.Date, fmt.Sprintf("%012d", ci.Revision))
+}
+
+func (s *svnVCS) Timestamp(ctx context.Context, version Version) (time.Time, error) {
+	s.log("svnVCS.Timestamp", "module", s.module, "version", version)
+	url, err := s.repo(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+	_, ci, err := s.revision(ctx, url, version)
+	if err != nil {
+		return time.Time{}, err
+	}
+	s.log("svnVCS.Timestamp", "module", s.module, "version", version, "timestamp", ci.Date)
+	return ci.Date.UTC(), nil
+}
+
+func (s *svnVCS) Zip(ctx context.Context, version Version) (io.ReadCloser, error) {
+	s.log("svnVCS.Zip", "module", s.module, "version", version)
+	url, err := s.repo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	src, ci, err := s.revision(ctx, url, version)
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempDir(os.TempDir(), "gomodproxy_svn_export")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	root := filepath.Join(tmp, "root")
+	endFetch := Span(ctx, "fetch")
+	rev := strconv.FormatInt(ci.Revision, 10)
+	// keywords are not expanded, so that the files match the repository
+	_, err = s.svn(ctx, "export", "--quiet", "--ignore-keywords", "--ignore-externals", "-r", rev, src+"@"+rev, root)
+	endFetch()
+	if err != nil {
+		return nil, err
+	}
+	return zipDir(ctx, root, s.module, s.prefix, s.major, version)
+}
+
+// Describe returns the repository the module is fetched from.
+func (s *svnVCS) Describe(ctx context.Context) (Remote, error) {
+	repoRoot, _, url, err := s.resolve(ctx)
+	if err != nil {
+		return Remote{}, err
+	}
+	return Remote{VCS: "svn", Repo: repoRoot, URL: url, Auth: s.auth.Kind()}, nil
+}
+
+// resolve returns the repository root of the module, the module path within
+// the repository and the repository URL.
+func (s *svnVCS) resolve(ctx context.Context) (repoRoot, path, url string, err error) {
+	if s.remote == "" {
+		if err := s.hosts.Check(strings.SplitN(s.module, "/", 2)[0]); err != nil {
+			return "", "", "", err
+		}
+	}
+	repoRoot, path, err = RepoRoot(ctx, s.module)
+	if err != nil {
+		return "", "", "", err
+	}
+	if s.remote != "" {
+		return repoRoot, path, s.remote, nil
+	}
+	// go-import meta tag may point to a different host
+	if err := s.hosts.Check(strings.SplitN(repoRoot, "/", 2)[0]); err != nil {
+		return "", "", "", err
+	}
+	schema := "https://"
+	if s.auth.Key != "" {
+		schema = "svn+ssh://"
+	}
+	return repoRoot, path, schema + repoRoot, nil
+}
+
+// repo returns the repository URL of the module.
+func (s *svnVCS) repo(ctx context.Context) (string, error) {
+	repoRoot, path, url, err := s.resolve(ctx)
+	if err != nil {
+		return "", err
+	}
+	setOrigin(ctx, "svn", repoRoot)
+	s.prefix, s.major = splitMajor(path)
+	s.log("repo", "url", url, "prefix", s.prefix, "major", s.major)
+	return strings.TrimSuffix(url, "/"), nil
+}
+
+// tags returns the release versions of the module and the last changes of
+// their tag directories.
+func (s *svnVCS) tags(ctx context.Context, url string) (map[Version]svnCommit, error) {
+	dir := url + "/tags"
+	if s.prefix != "" {
+		dir = dir + "/" + s.prefix
+	}
+	b, err := s.svn(ctx, "ls", "--xml", dir)
+	if err != nil {
+		return nil, err
+	}
+	ls := struct {
+		Entries []struct {
+			Kind   string    `xml:"kind,attr"`
+			Name   string    `xml:"name"`
+			Commit svnCommit `xml:"commit"`
+		} `xml:"list>entry"`
+	}{}
+	if err := xml.Unmarshal(b, &ls); err != nil {
+		return nil, err
+	}
+	tags := map[Version]svnCommit{}
+	for _, e := range ls.Entries {
+		version := Version(e.Name)
+		if e.Kind != "dir" || !version.IsValid() {
+			continue
+		}
+		if s.major != "" && !strings.HasPrefix(e.Name, s.major+".") {
+			continue
+		}
+		tags[version] = e.Commit
+	}
+	return tags, nil
+}
+
+// revision returns the URL of the directory the version is exported from and
+// its last change, either by a tag or by a revision of a pseudo-version.
+func (s *svnVCS) revision(ctx context.Context, url string, version Version) (string, svnCommit, error) {
+	version = Version(strings.TrimSuffix(string(version), "+incompatible"))
+	if !version.IsSemVer() && reSVNRevision.MatchString(version.Hash()) {
+		rev, _ := strconv.ParseInt(version.Hash(), 10, 64)
+		ci, err := s.logEntry(ctx, url, rev)
+		return url + "/trunk", ci, err
+	}
+	tags, err := s.tags(ctx, url)
+	if err != nil {
+		return "", svnCommit{}, err
+	}
+	ci, ok := tags[version]
+	if !ok {
+		return "", svnCommit{}, fmt.Errorf("%s@%s: no such tag: %w", s.module, version, os.ErrNotExist)
+	}
+	dir := url + "/tags/" + string(version)
+	if s.prefix != "" {
+		dir = url + "/tags/" + s.prefix + "/" + string(version)
+	}
+	return dir, ci, nil
+}
+
+// info returns the last change of the given URL.
+func (s *svnVCS) info(ctx context.Context, url string) (svnCommit, error) {
+	b, err := s.svn(ctx, "info", "--xml", url)
+	if err != nil {
+		return svnCommit{}, err
+	}
+	info := struct {
+		Commit svnCommit `xml:"entry>commit"`
+	}{}
+	if err := xml.Unmarshal(b, &info); err != nil {
+		return svnCommit{}, err
+	}
+	return info.Commit, nil
+}
+
+// logEntry returns the given revision of the repository.
+func (s *svnVCS) logEntry(ctx context.Context, url string, rev int64) (svnCommit, error) {
+	b, err := s.svn(ctx, "log", "--xml", "-r", strconv.FormatInt(rev, 10), url)
+	if err != nil {
+		return svnCommit{}, err
+	}
+	log := struct {
+		Entries []svnCommit `xml:"logentry"`
+	}{}
+	if err := xml.Unmarshal(b, &log); err != nil {
+		return svnCommit{}, err
+	}
+	if len(log.Entries) != 1 {
+		return svnCommit{}, fmt.Errorf("%s: revision %d: %w", s.module, rev, os.ErrNotExist)
+	}
+	return log.Entries[0], nil
+}
+
+// svn runs the svn command and returns its output. The password is passed on
+// the standard input rather than in the command line, so it never shows up in
+// process lists or errors.
+func (s *svnVCS) svn(ctx context.Context, args ...string) ([]byte, error) {
+	flags := []string{"--non-interactive", "--no-auth-cache"}
+	cmd := exec.CommandContext(ctx, "svn")
+	cmd.Env = append(os.Environ(), "LC_ALL=C")
+	if s.auth.Key != "" {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("SVN_SSH=ssh -i %q -o BatchMode=yes -o IdentitiesOnly=yes", s.auth.Key))
+	} else if s.auth.Username != "" {
+		flags = append(flags, "--username", s.auth.Username, "--password-from-stdin")
+		cmd.Stdin = strings.NewReader(s.auth.Password + "\n")
+	}
+	cmd.Args = append(append(cmd.Args, args[0]), append(flags, args[1:]...)...)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("svn %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
@@ -0,0 +1,120 @@
+package vcs
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testSVNRepo creates a local Subversion repository with the given files in
+// the trunk, copies the trunk into the given tags and returns the repository
+// URL.
+func testSVNRepo(t testing.TB, files map[string]string, tags ...string) (string, string) {
+	for _, bin := range []string{"svn", "svnadmin"} {
+		if _, err := exec.LookPath(bin); err != nil {
+			t.Skip("svn is required to serve local test repositories")
+		}
+	}
+	dir, err := ioutil.TempDir(os.TempDir(), "gomodproxy_svn_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := func(name string, args ...string) {
+		if out, err := exec.Command(name, args...).CombinedOutput(); err != nil {
+			t.Fatal(args, err, string(out))
+		}
+	}
+	repo, trunk := filepath.Join(dir, "repo"), filepath.Join(dir, "trunk")
+	for name, content := range files {
+		path := filepath.Join(trunk, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	url := "file://" + filepath.ToSlash(repo)
+	run("svnadmin", "create", repo)
+	run("svn", "import", "--quiet", "-m", "trunk", trunk, url+"/trunk")
+	for _, tag := range tags {
+		run("svn", "copy", "--quiet", "--parents", "-m", tag, url+"/trunk", url+"/tags/"+tag)
+	}
+	return dir, url
+}
+
+// testSVN returns a Subversion client for the module that fetches from a
+// local test repository instead of the remote derived from the module path.
+func testSVN(t testing.TB, url string, module string) *svnVCS {
+	s := NewSVN(t.Log, module, NoAuth(), nil).(*svnVCS)
+	s.remote = url
+	return s
+}
+
+func TestSVN(t *testing.T) {
+	dir, url := testSVNRepo(t, map[string]string{
+		"go.mod":            "module github.com/gomodproxytest/svn\n",
+		"svn.go":            "package svn\n",
+		"vendor/foo/foo.go": "package foo\n",
+		"sub/go.mod":        "module github.com/gomodproxytest/svn/sub\n",
+		"sub/sub.go":        "package sub\n",
+	}, "v1.0.0", "release", "sub/v1.1.0")
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+
+	s := testSVN(t, url, "github.com/gomodproxytest/svn")
+	list, err := s.List(ctx)
+	if err != nil || !reflect.DeepEqual(list, []Version{"v1.0.0"}) {
+		t.Fatal(list, err)
+	}
+	if ts, err := s.Timestamp(ctx, "v1.0.0"); err != nil || ts.IsZero() {
+		t.Fatal(ts, err)
+	}
+	r, err := s.Zip(ctx, "v1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := zipFiles(t, r)
+	if len(got) != 2 || got["github.com/gomodproxytest/svn@v1.0.0/svn.go"] != "package svn\n" {
+		t.Fatal(got)
+	}
+
+	sub := testSVN(t, url, "github.com/gomodproxytest/svn/sub")
+	if list, err := sub.List(ctx); err != nil || !reflect.DeepEqual(list, []Version{"v1.1.0"}) {
+		t.Fatal(list, err)
+	}
+	if r, err := sub.Zip(ctx, "v1.1.0"); err != nil {
+		t.Fatal(err)
+	} else if got := zipFiles(t, r); len(got) != 2 || got["github.com/gomodproxytest/svn/sub@v1.1.0/sub.go"] != "package sub\n" {
+		t.Fatal(got)
+	}
+
+	if _, err := s.Zip(ctx, "v2.0.0"); Classify(err) != NotFound {
+		t.Fatal(err)
+	}
+}
+
+func TestSVNPseudoVersion(t *testing.T) {
+	dir, url := testSVNRepo(t, map[string]string{"go.mod": "module github.com/gomodproxytest/svn\n"})
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+
+	s := testSVN(t, url, "github.com/gomodproxytest/svn")
+	list, err := s.List(ctx)
+	if err != nil || len(list) != 1 || list[0].Hash() != "000000000001" {
+		t.Fatal(list, err)
+	}
+	ts, err := s.Timestamp(ctx, list[0])
+	if err != nil || svnPseudoVersion("", svnCommit{Revision: 1, Date: ts}) != list[0] {
+		t.Fatal(ts, err)
+	}
+	if r, err := s.Zip(ctx, list[0]); err != nil {
+		t.Fatal(err)
+	} else if got := zipFiles(t, r); len(got) != 1 {
+		t.Fatal(got)
+	}
+}
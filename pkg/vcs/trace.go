@@ -0,0 +1,52 @@
+package vcs
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Trace records the time VCS clients spend in the phases of a request, such
+// as "open", "fetch", "resolve", "walk" and "zip". Time of the phases that
+// are repeated is summed up.
+type Trace struct {
+	sync.Mutex
+	Phases []Phase
+}
+
+// Phase is a named part of the VCS request.
+type Phase struct {
+	Name     string
+	Duration time.Duration
+}
+
+type traceKey struct{}
+
+// WithTrace returns a context in which VCS clients record the timings of
+// the request phases into the given trace.
+func WithTrace(ctx context.Context, t *Trace) context.Context {
+	return context.WithValue(ctx, traceKey{}, t)
+}
+
+// Span starts a phase in the trace of the context, if any, and returns a
+// function that ends it.
+func Span(ctx context.Context, name string) func() {
+	t, ok := ctx.Value(traceKey{}).(*Trace)
+	if !ok {
+		return func() {}
+	}
+	start := time.Now()
+	return func() { t.add(name, time.Since(start)) }
+}
+
+func (t *Trace) add(name string, d time.Duration) {
+	t.Lock()
+	defer t.Unlock()
+	for i := range t.Phases {
+		if t.Phases[i].Name == name {
+			t.Phases[i].Duration = t.Phases[i].Duration + d
+			return
+		}
+	}
+	t.Phases = append(t.Phases, Phase{Name: name, Duration: d})
+}
@@ -2,10 +2,15 @@ package vcs
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
+
+	"golang.org/x/mod/semver"
 )
 
 type logger = func(v ...interface{})
@@ -18,13 +23,134 @@ var reSemVer = regexp.MustCompile(`^v\d+\.\d+\.\d+$`)
 // IsSemVer returns true if a version string is a semantic version e.g. vX.Y.Z.
 func (v Version) IsSemVer() bool { return reSemVer.MatchString(string(v)) }
 
-// Hash returns a commit hash if a version is of a form v0.0.0-timestamp-hash.
+// rePseudo matches all three forms of pseudo-versions, capturing the commit
+// hash: "vX.0.0-timestamp-hash", "vX.Y.Z-pre.0.timestamp-hash" and
+// "vX.Y.Z-0.timestamp-hash".
+var rePseudo = regexp.MustCompile(`^v[0-9]+\.(0\.0-|[0-9]+\.[0-9]+-([^+]*\.)?0\.)[0-9]{14}-([A-Za-z0-9]+)(\+[0-9A-Za-z.-]+)?$`)
+
+// Hash returns a commit hash if a version is a pseudo-version, e.g.
+// v0.0.0-timestamp-hash or v1.2.4-0.timestamp-hash.
 func (v Version) Hash() string {
-	fields := strings.Split(string(v), "-")
-	if len(fields) != 3 {
+	m := rePseudo.FindStringSubmatch(string(v))
+	if m == nil {
 		return ""
 	}
-	return fields[2]
+	return m[3]
+}
+
+// pseudoVersion returns the pseudo-version of the commit made at the given
+// time in the form the go tool expects for the closest release tag of the
+// module among the commit ancestors: "vX.0.0-yyyymmddhhmmss-hash" if there is
+// none, where vX is the major version of the module,
+// "vX.Y.(Z+1)-0.yyyymmddhhmmss-hash" after the release "vX.Y.Z" and
+// "vX.Y.Z-pre.0.yyyymmddhhmmss-hash" after the pre-release "vX.Y.Z-pre".
+// Build metadata of the tag, such as "+incompatible", is kept.
+func pseudoVersion(major string, base Version, t time.Time, hash string) Version {
+	ts := t.UTC().Format("20060102150405")
+	nums, pre, ok := base.parse()
+	if !ok {
+		if major == "" {
+			major = "v0"
+		}
+		return Version(fmt.Sprintf("%s.0.0-%s-%s", major, ts, hash))
+	}
+	build := ""
+	if i := strings.Index(string(base), "+"); i >= 0 {
+		build = string(base)[i:]
+	}
+	if pre != "" {
+		return Version(fmt.Sprintf("v%d.%d.%d-%s.0.%s-%s%s", nums[0], nums[1], nums[2], pre, ts, hash, build))
+	}
+	return Version(fmt.Sprintf("v%d.%d.%d-0.%s-%s%s", nums[0], nums[1], nums[2]+1, ts, hash, build))
+}
+
+// incompatible returns the version of a release tag of the module with the
+// given directory in the repository and major version suffix. Tags of major
+// versions 2 and above of modules without a suffix get the "+incompatible"
+// build metadata, like the go tool expects for repositories that were tagged
+// before they adopted modules. Such versions are only allowed for the module
+// in the repository root, so the tags of nested modules are left out. The
+// caller still has to leave out the tags of trees with a go.mod file.
+func incompatible(prefix, major string, version Version) (Version, bool) {
+	nums, _, ok := version.parse()
+	if major != "" || !ok || nums[0] < 2 || strings.Contains(string(version), "+") {
+		return version, true
+	}
+	if prefix != "" {
+		return "", false
+	}
+	return version + "+incompatible", true
+}
+
+// isIncompatible tells if the version has the "+incompatible" build metadata.
+func isIncompatible(version Version) bool {
+	return strings.HasSuffix(string(version), "+incompatible")
+}
+
+// IsValid returns true if a version is a semantic version with an optional
+// pre-release suffix, e.g. "v1.0.0", "v1.0.0-rc.1" or a pseudo-version.
+func (v Version) IsValid() bool {
+	_, _, ok := v.parse()
+	return ok
+}
+
+// IsRelease returns true if a version is a valid semantic version without a
+// pre-release suffix, e.g. "v1.0.0" or "v2.0.0+incompatible", but not
+// "v1.0.0-rc.1" or a pseudo-version.
+func (v Version) IsRelease() bool {
+	_, pre, ok := v.parse()
+	return ok && pre == ""
+}
+
+// Compare returns -1, 0 or 1 if a version is lower, equal or higher than the
+// other one. Versions are compared by the semantic versioning precedence
+// rules, e.g. a version with a pre-release suffix, such as a pseudo-version,
+// is lower than the release itself, and "v1.0.0-alpha.2" is lower than
+// "v1.0.0-alpha.10", which also orders pseudo-versions by their timestamps.
+// Malformed versions are lower than any valid ones.
+func (v Version) Compare(other Version) int {
+	if aok, bok := v.IsValid(), other.IsValid(); !aok || !bok {
+		return compareBool(aok, bok)
+	}
+	return semver.Compare(string(v), string(other))
+}
+
+// parse splits a version into major, minor and patch numbers and the
+// pre-release suffix. Build metadata, such as "+incompatible", is ignored.
+// Only complete semantic versions are valid, unlike the "v1" or "v1.2"
+// shorthands the semver package accepts.
+func (v Version) parse() (nums [3]int, pre string, ok bool) {
+	s := strings.SplitN(string(v), "+", 2)[0]
+	if !semver.IsValid(string(v)) || semver.Canonical(s) != s {
+		return nums, "", false
+	}
+	pre = semver.Prerelease(s)
+	parts := strings.Split(strings.TrimSuffix(s[1:], pre), ".")
+	for i, part := range parts {
+		nums[i], _ = strconv.Atoi(part)
+	}
+	return nums, strings.TrimPrefix(pre, "-"), true
+}
+
+// sortVersions sorts the versions in ascending order, as defined by Compare.
+// Versions that compare equal, e.g. malformed ones, are ordered as strings, so
+// that the order does not depend on the order the versions were found in.
+func sortVersions(list []Version) {
+	sort.Slice(list, func(i, j int) bool {
+		if cmp := list[i].Compare(list[j]); cmp != 0 {
+			return cmp < 0
+		}
+		return list[i] < list[j]
+	})
+}
+
+func compareBool(a, b bool) int {
+	if a == b {
+		return 0
+	} else if a {
+		return 1
+	}
+	return -1
 }
 
 // String returns a string representation of a version
@@ -46,12 +172,42 @@ type VCS interface {
 	Module
 }
 
+// Streamer is implemented by VCS clients that can report available versions
+// as they are discovered, which is useful for repos with huge tag sets. The
+// streamed versions are not sorted.
+type Streamer interface {
+	ListStream(ctx context.Context) (<-chan Version, error)
+}
+
+// Resolver is implemented by VCS clients that can tell the module version of
+// a branch, a tag or a commit hash, e.g. to answer queries like "@master" with
+// the version the go tool expects.
+type Resolver interface {
+	Resolve(ctx context.Context, rev string) (Version, error)
+}
+
+// Remote describes how a VCS client reaches the module repository. It never
+// contains any secrets.
+type Remote struct {
+	VCS  string
+	Repo string
+	URL  string
+	Auth string
+}
+
+// Describer is implemented by VCS clients that can tell where the module
+// repository is located without fetching it.
+type Describer interface {
+	Describe(ctx context.Context) (Remote, error)
+}
+
 // Auth defines a typical VCS authentication mechanism, such as SSH key or
 // username/password.
 type Auth struct {
-	Username string
-	Password string
-	Key      string
+	Username   string
+	Password   string
+	Key        string
+	Passphrase string
 }
 
 // NoAuth returns an Auth implementation that uses no authentication at all.
@@ -62,3 +218,18 @@ func Password(username, password string) Auth { return Auth{Username: username,
 
 // Key returns an Auth implementation that uses key file authentication mechanism.
 func Key(key string) Auth { return Auth{Key: key} }
+
+// KeyWithPassphrase returns an Auth implementation that uses a key file
+// encrypted with the given passphrase. Only the go-git client can decrypt it.
+func KeyWithPassphrase(key, passphrase string) Auth { return Auth{Key: key, Passphrase: passphrase} }
+
+// Kind returns the name of the authentication mechanism: "key", "password" or
+// "none".
+func (a Auth) Kind() string {
+	if a.Key != "" {
+		return "key"
+	} else if a.Username != "" {
+		return "password"
+	}
+	return "none"
+}
@@ -1,6 +1,10 @@
 package vcs
 
-import "testing"
+import (
+	"reflect"
+	"testing"
+	"time"
+)
 
 func TestVersion(t *testing.T) {
 	if !Version("v1.0.0").IsSemVer() {
@@ -16,3 +20,172 @@ func TestVersion(t *testing.T) {
 		t.Fatal()
 	}
 }
+
+func TestVersionCompare(t *testing.T) {
+	for _, test := range []struct {
+		A, B Version
+		Cmp  int
+	}{
+		{"v1.0.0", "v1.0.0", 0},
+		{"v1.0.0", "v1.0.1", -1},
+		{"v1.10.0", "v1.9.0", 1},
+		{"v2.0.0+incompatible", "v1.9.9", 1},
+		{"v1.0.0-rc.1", "v1.0.0", -1},
+		{"v0.0.0-20180910181607-0e37d006457b", "v0.0.0-20181010181607-1e37d006457b", -1},
+		{"v0.0.0-20180910181607-0e37d006457b", "v0.1.0", -1},
+		{"master", "v0.0.1", -1},
+		{"master", "latest", 0},
+	} {
+		if cmp := test.A.Compare(test.B); cmp != test.Cmp {
+			t.Fatal(test.A, test.B, cmp)
+		}
+		if cmp := test.B.Compare(test.A); cmp != -test.Cmp {
+			t.Fatal(test.B, test.A, cmp)
+		}
+	}
+}
+
+func TestVersionComparePrerelease(t *testing.T) {
+	// Pre-release precedence examples of the semantic versioning spec
+	spec := []Version{
+		"v1.0.0-alpha",
+		"v1.0.0-alpha.1",
+		"v1.0.0-alpha.beta",
+		"v1.0.0-beta",
+		"v1.0.0-beta.2",
+		"v1.0.0-beta.11",
+		"v1.0.0-rc.1",
+		"v1.0.0",
+	}
+	for i := range spec {
+		for j := range spec {
+			if cmp := spec[i].Compare(spec[j]); cmp != compareBool(i > j, i < j) {
+				t.Fatal(spec[i], spec[j], cmp)
+			}
+		}
+	}
+	for _, test := range []struct {
+		A, B Version
+		Cmp  int
+	}{
+		{"v1.0.0-alpha.1", "v1.0.0-alpha.2", -1},
+		{"v1.0.0-alpha.10", "v1.0.0-alpha.9", 1},
+		{"v1.0.0-1", "v1.0.0-a", -1},
+		{"v1.0.0-rc.1+build", "v1.0.0-rc.1", 0},
+		{"v1.2.4-0.20180910181607-0e37d006457b", "v1.2.4-0.20181010181607-1e37d006457b", -1},
+		{"v1.2.4-0.20180910181607-0e37d006457b", "v1.2.4-rc.1", -1},
+		{"v1.2.4-rc.1.0.20180910181607-0e37d006457b", "v1.2.4-rc.1", 1},
+	} {
+		if cmp := test.A.Compare(test.B); cmp != test.Cmp {
+			t.Fatal(test.A, test.B, cmp)
+		}
+		if cmp := test.B.Compare(test.A); cmp != -test.Cmp {
+			t.Fatal(test.B, test.A, cmp)
+		}
+	}
+}
+
+func TestVersionIsRelease(t *testing.T) {
+	for v, release := range map[Version]bool{
+		"v1.0.0":                             true,
+		"v2.0.0+incompatible":                true,
+		"v1.0.0-rc.1":                        false,
+		"v0.0.0-20180910181607-0e37d006457b": false,
+		"master":                             false,
+		"v1.0.0-":                            false,
+	} {
+		if v.IsRelease() != release {
+			t.Fatal(v)
+		}
+	}
+}
+
+func TestVersionIsValid(t *testing.T) {
+	for v, valid := range map[Version]bool{
+		"v1.0.0":                             true,
+		"v2.0.0+incompatible":                true,
+		"v1.0.0-rc.1":                        true,
+		"v0.0.0-20180910181607-0e37d006457b": true,
+		"v1.0":                               false,
+		"1.0.0":                              false,
+		"master":                             false,
+		"v01.0.0":                            false,
+		"v+1.0.0":                            false,
+		"v1.0.0-":                            false,
+		"v1.0.0-rc..1":                       false,
+		"v1.0.0-rc.01":                       false,
+	} {
+		if v.IsValid() != valid {
+			t.Fatal(v)
+		}
+	}
+}
+
+func TestSortVersions(t *testing.T) {
+	list := []Version{
+		"v1.10.0",
+		"v1.0.0",
+		"v2.0.0+incompatible",
+		"v1.9.0",
+		"vfoo",
+		"v1.0.0-rc1",
+		"v0.0.0-20180910181607-0e37d006457b",
+		"v1.0.0-beta",
+		"vbar",
+		"v1.9.1",
+	}
+	sortVersions(list)
+	want := []Version{
+		"vbar",
+		"vfoo",
+		"v0.0.0-20180910181607-0e37d006457b",
+		"v1.0.0-beta",
+		"v1.0.0-rc1",
+		"v1.0.0",
+		"v1.9.0",
+		"v1.9.1",
+		"v1.10.0",
+		"v2.0.0+incompatible",
+	}
+	if !reflect.DeepEqual(list, want) {
+		t.Fatal(list)
+	}
+}
+
+func TestPseudoVersion(t *testing.T) {
+	ts := time.Date(2018, 9, 21, 10, 0, 0, 0, time.FixedZone("CEST", 2*60*60))
+	for _, test := range []struct {
+		Major string
+		Base  Version
+		Want  Version
+	}{
+		{"", "", "v0.0.0-20180921080000-0123456789ab"},
+		{"v2", "", "v2.0.0-20180921080000-0123456789ab"},
+		{"", "v1.2.3", "v1.2.4-0.20180921080000-0123456789ab"},
+		{"", "v1.3.0-rc.1", "v1.3.0-rc.1.0.20180921080000-0123456789ab"},
+		{"", "v2.0.0+incompatible", "v2.0.1-0.20180921080000-0123456789ab+incompatible"},
+	} {
+		v := pseudoVersion(test.Major, test.Base, ts, "0123456789ab")
+		if v != test.Want || v.Hash() != "0123456789ab" {
+			t.Fatal(test.Base, v, v.Hash())
+		}
+	}
+}
+
+func TestVersionHash(t *testing.T) {
+	for v, hash := range map[Version]string{
+		"v0.0.0-20180921080000-0123456789ab":                "0123456789ab",
+		"v1.2.4-0.20180921080000-0123456789ab":              "0123456789ab",
+		"v1.3.0-rc.1.0.20180921080000-0123456789ab":         "0123456789ab",
+		"v2.0.1-0.20180921080000-0123456789ab+incompatible": "0123456789ab",
+		"v1.0.0":                             "",
+		"v1.0.0-rc.1":                        "",
+		"v1.0.0-beta-1":                      "",
+		"v1.2.4-20180921080000-0123456789ab": "",
+		"master":                             "",
+	} {
+		if v.Hash() != hash {
+			t.Fatal(v, v.Hash())
+		}
+	}
+}
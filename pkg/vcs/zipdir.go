@@ -0,0 +1,115 @@
+package vcs
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+)
+
+// zipDir builds the module archive from the files exported into the root
+// directory, see zipFileList.
+func zipDir(ctx context.Context, root, module, prefix, major string, version Version) (io.ReadCloser, error) {
+	endWalk := Span(ctx, "walk")
+	files := []string{}
+	err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() {
+			return err
+		}
+		name, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, filepath.ToSlash(name))
+		return nil
+	})
+	endWalk()
+	if err != nil {
+		return nil, err
+	}
+	read := func(name string) ([]byte, error) {
+		return ioutil.ReadFile(filepath.Join(root, filepath.FromSlash(name)))
+	}
+	return zipFileList(ctx, files, read, module, prefix, major, version)
+}
+
+// zipFileList builds the module archive from the regular files of the
+// repository the same way the git client does, so that the checksums match:
+// vendored packages and nested modules are left out, and every file of the
+// module directory is stored under "module@version/" in the given order.
+func zipFileList(ctx context.Context, files []string, read func(name string) ([]byte, error),
+	module, prefix, major string, version Version) (io.ReadCloser, error) {
+	modules := map[string]bool{}
+	for _, name := range files {
+		if dir, file := path.Split(name); file == "go.mod" {
+			modules[dir] = true
+		}
+	}
+	if major != "" {
+		if sub := path.Join(prefix, major); modules[sub+"/"] {
+			prefix = sub
+		}
+		if err := checkModuleDir(read, prefix, module, version); err != nil {
+			return nil, err
+		}
+	}
+	if prefix != "" {
+		prefix = prefix + "/"
+	}
+	submodule := func(name string) bool {
+		for {
+			dir, _ := path.Split(name)
+			if len(dir) <= len(prefix) {
+				return false
+			}
+			if modules[dir] {
+				return true
+			}
+			name = dir[:len(dir)-1]
+		}
+	}
+	defer Span(ctx, "zip")()
+	b := &bytes.Buffer{}
+	zw := zip.NewWriter(b)
+	for _, name := range files {
+		// go mod strips vendored directories from the zip, and we do the same
+		// to match the checksums in the go.sum
+		if isVendoredPackage(name) || submodule(name) || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		w, err := zw.Create(filepath.Join(module+"@"+string(version), strings.TrimPrefix(name, prefix)))
+		if err != nil {
+			return nil, err
+		}
+		content, err := read(name)
+		if err != nil {
+			return nil, err
+		}
+		w.Write(content)
+	}
+	zw.Close()
+	return ioutil.NopCloser(bytes.NewBuffer(b.Bytes())), nil
+}
+
+// checkModuleDir returns an error if the go.mod file in the given directory
+// declares a module path other than the requested one.
+func checkModuleDir(read func(name string) ([]byte, error), dir, module string, version Version) error {
+	name := path.Join(dir, "go.mod")
+	b, err := read(name)
+	if err != nil {
+		return nil
+	}
+	if mod := modfile.ModulePath(b); mod != "" && mod != module {
+		return fmt.Errorf("%s@%s: %s declares module path %q, expected %q: %w",
+			module, version, name, mod, module, errMajorMismatch)
+	}
+	return nil
+}